@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"sync/atomic"
+
+	"github.com/richardartoul/gobuildcache/pkg/ratelimit"
+)
+
+// admissionRejection is the reason an upload was not admitted to the backend.
+type admissionRejection int
+
+const (
+	admitted admissionRejection = iota
+	rejectedTooSmall
+	rejectedTooLarge
+	rejectedSampled
+	rejectedBudget
+	rejectedRate
+	numAdmissionRejections
+)
+
+// String returns a human-readable description of the rejection reason.
+func (r admissionRejection) String() string {
+	switch r {
+	case admitted:
+		return "admitted"
+	case rejectedTooSmall:
+		return "smaller than minimum size"
+	case rejectedTooLarge:
+		return "larger than maximum size"
+	case rejectedSampled:
+		return "not sampled"
+	case rejectedBudget:
+		return "upload budget exhausted"
+	case rejectedRate:
+		return "upload rate limit exceeded"
+	default:
+		return "unknown"
+	}
+}
+
+// admissionPolicyConfig configures an admissionPolicy. Zero values disable the
+// corresponding check.
+type admissionPolicyConfig struct {
+	// MinSize and MaxSize bound the (uncompressed) size of objects that are
+	// uploaded. Tiny objects cost more in request fees than they save, and very
+	// large objects can cost more to upload and download than to rebuild.
+	MinSize int64
+	MaxSize int64
+	// Budget is the total number of bytes this run may upload.
+	Budget int64
+	// RateLimit is the maximum number of bytes uploaded per second. Uploads that
+	// would exceed it are skipped rather than delayed.
+	RateLimit int64
+	// SampleRate is the fraction (0.0-1.0) of objects that are uploaded. Sampling
+	// is deterministic in the action ID so that concurrent runs agree on which
+	// objects to upload. Values <= 0 or >= 1 upload everything.
+	SampleRate float64
+}
+
+// admissionPolicy decides which PUTs are worth uploading to the backend. Objects
+// that aren't admitted are still written to the local cache.
+type admissionPolicy struct {
+	config admissionPolicyConfig
+	rate   *ratelimit.TokenBucket
+
+	uploadedBytes atomic.Int64
+	rejections    [numAdmissionRejections]atomic.Int64
+}
+
+// newAdmissionPolicy creates a new admission policy. It returns nil if the config
+// doesn't enable any checks.
+func newAdmissionPolicy(config admissionPolicyConfig) *admissionPolicy {
+	if config.SampleRate >= 1 {
+		config.SampleRate = 0
+	}
+	if config == (admissionPolicyConfig{}) {
+		return nil
+	}
+
+	p := &admissionPolicy{config: config}
+	if config.RateLimit > 0 {
+		p.rate = ratelimit.NewTokenBucket(config.RateLimit)
+	}
+	return p
+}
+
+// checkObject checks the properties of the object itself and should be called
+// before doing any work (such as compression) to prepare the upload.
+func (p *admissionPolicy) checkObject(actionID []byte, size int64) admissionRejection {
+	switch {
+	case p.config.MinSize > 0 && size < p.config.MinSize:
+		return p.reject(rejectedTooSmall)
+	case p.config.MaxSize > 0 && size > p.config.MaxSize:
+		return p.reject(rejectedTooLarge)
+	case p.config.SampleRate > 0 && !sampled(actionID, p.config.SampleRate):
+		return p.reject(rejectedSampled)
+	}
+	return admitted
+}
+
+// reserve accounts for uploadSize bytes (after compression) against the upload
+// budget and rate limit, and should be called right before the upload starts.
+func (p *admissionPolicy) reserve(uploadSize int64) admissionRejection {
+	if p.config.Budget > 0 {
+		if p.uploadedBytes.Add(uploadSize) > p.config.Budget {
+			p.uploadedBytes.Add(-uploadSize)
+			return p.reject(rejectedBudget)
+		}
+	} else {
+		p.uploadedBytes.Add(uploadSize)
+	}
+
+	if p.rate != nil && !p.rate.TryTake(uploadSize) {
+		p.uploadedBytes.Add(-uploadSize)
+		return p.reject(rejectedRate)
+	}
+	return admitted
+}
+
+// reject records a rejection and returns its reason.
+func (p *admissionPolicy) reject(reason admissionRejection) admissionRejection {
+	p.rejections[reason].Add(1)
+	return reason
+}
+
+// rejectionCounts returns the number of rejected uploads by reason.
+func (p *admissionPolicy) rejectionCounts() map[admissionRejection]int64 {
+	counts := make(map[admissionRejection]int64)
+	for reason := admissionRejection(1); reason < numAdmissionRejections; reason++ {
+		if n := p.rejections[reason].Load(); n > 0 {
+			counts[reason] = n
+		}
+	}
+	return counts
+}
+
+// sampled reports whether actionID falls within the sampled fraction of the
+// action ID space. Action IDs are hashes, so their leading bytes are uniformly
+// distributed.
+func sampled(actionID []byte, rate float64) bool {
+	var buf [8]byte
+	copy(buf[:], actionID)
+	return float64(binary.BigEndian.Uint64(buf[:])) < rate*math.MaxUint64
+}
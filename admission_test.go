@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"testing"
+
+	"github.com/richardartoul/gobuildcache/pkg/locking"
+)
+
+func TestNewAdmissionPolicy_DisabledByDefault(t *testing.T) {
+	if p := newAdmissionPolicy(admissionPolicyConfig{SampleRate: 1.0}); p != nil {
+		t.Errorf("Expected no admission policy when no checks are enabled")
+	}
+}
+
+func TestAdmissionPolicy_Sizes(t *testing.T) {
+	p := newAdmissionPolicy(admissionPolicyConfig{MinSize: 10, MaxSize: 100})
+
+	tests := []struct {
+		size     int64
+		expected admissionRejection
+	}{
+		{0, rejectedTooSmall},
+		{9, rejectedTooSmall},
+		{10, admitted},
+		{100, admitted},
+		{101, rejectedTooLarge},
+	}
+	for _, tt := range tests {
+		if got := p.checkObject([]byte{0}, tt.size); got != tt.expected {
+			t.Errorf("checkObject(size=%d) = %v, expected %v", tt.size, got, tt.expected)
+		}
+	}
+
+	counts := p.rejectionCounts()
+	if counts[rejectedTooSmall] != 2 || counts[rejectedTooLarge] != 1 {
+		t.Errorf("Unexpected rejection counts: %v", counts)
+	}
+}
+
+func TestAdmissionPolicy_Sampling(t *testing.T) {
+	p := newAdmissionPolicy(admissionPolicyConfig{SampleRate: 0.25})
+
+	const n = 10000
+	var admittedCount int
+	for i := 0; i < n; i++ {
+		actionID := sha256.Sum256([]byte(fmt.Sprintf("action-%d", i)))
+		first := p.checkObject(actionID[:], 1)
+		if first == admitted {
+			admittedCount++
+		}
+		// Sampling must be deterministic for a given action ID.
+		if again := p.checkObject(actionID[:], 1); again != first {
+			t.Fatalf("Expected sampling to be deterministic for action %d", i)
+		}
+	}
+
+	if rate := float64(admittedCount) / n; rate < 0.22 || rate > 0.28 {
+		t.Errorf("Expected roughly 25%% of objects to be sampled, got %.2f%%", rate*100)
+	}
+}
+
+func TestAdmissionPolicy_Budget(t *testing.T) {
+	p := newAdmissionPolicy(admissionPolicyConfig{Budget: 100})
+
+	if got := p.reserve(60); got != admitted {
+		t.Fatalf("Expected first upload to be admitted, got: %v", got)
+	}
+	if got := p.reserve(60); got != rejectedBudget {
+		t.Fatalf("Expected upload over budget to be rejected, got: %v", got)
+	}
+	// A smaller upload that still fits in the remaining budget is admitted.
+	if got := p.reserve(40); got != admitted {
+		t.Fatalf("Expected upload within the remaining budget to be admitted, got: %v", got)
+	}
+	if got := p.uploadedBytes.Load(); got != 100 {
+		t.Errorf("Expected 100 bytes admitted, got: %d", got)
+	}
+}
+
+func TestAdmissionPolicy_RateLimit(t *testing.T) {
+	p := newAdmissionPolicy(admissionPolicyConfig{RateLimit: 1000})
+
+	if got := p.reserve(1500); got != admitted {
+		t.Fatalf("Expected first upload to be admitted, got: %v", got)
+	}
+	if got := p.reserve(1); got != rejectedRate {
+		t.Fatalf("Expected upload over the rate limit to be rejected, got: %v", got)
+	}
+	if got := p.rejectionCounts()[rejectedRate]; got != 1 {
+		t.Errorf("Expected 1 rate rejection, got: %d", got)
+	}
+}
+
+func TestHandlePut_AdmissionPolicySkipsBackend(t *testing.T) {
+	backend := newRecordingBackend()
+	cp, err := NewCacheProg(backend, locking.NewNoOpGroup(), t.TempDir(), false, false, false, false)
+	if err != nil {
+		t.Fatalf("Failed to create CacheProg: %v", err)
+	}
+	cp.admission = newAdmissionPolicy(admissionPolicyConfig{MaxSize: 10})
+
+	for i, body := range [][]byte{[]byte("small"), bytes.Repeat([]byte("x"), 100)} {
+		actionID := []byte{byte(i)}
+		resp, err := cp.handlePut(&Request{
+			ID:       int64(i),
+			Command:  CmdPut,
+			ActionID: actionID,
+			OutputID: []byte("output"),
+			BodySize: int64(len(body)),
+			Body:     bytes.NewReader(body),
+		})
+		if err != nil {
+			t.Fatalf("handlePut returned error: %v", err)
+		}
+		if resp.DiskPath == "" {
+			t.Errorf("Expected PUT %d to be written to the local cache", i)
+		}
+	}
+
+	if _, ok := backend.get(cp.generateBackendKey([]byte{0})); !ok {
+		t.Errorf("Expected small object to be uploaded")
+	}
+	if _, ok := backend.get(cp.generateBackendKey([]byte{1})); ok {
+		t.Errorf("Expected large object not to be uploaded")
+	}
+	if got := cp.admission.rejectionCounts()[rejectedTooLarge]; got != 1 {
+		t.Errorf("Expected 1 too-large rejection, got: %d", got)
+	}
+}
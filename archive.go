@@ -0,0 +1,419 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/richardartoul/gobuildcache/pkg/backends"
+	"github.com/richardartoul/gobuildcache/pkg/locking"
+)
+
+// archiveManifestName is the name of the first file of an archive, which
+// describes the archive.
+const archiveManifestName = "gobuildcache-archive.json"
+
+// Archive compression formats.
+const (
+	archiveZstd = "zstd"
+	archiveGzip = "gzip"
+	archiveLZ4  = "lz4"
+	archiveNone = "none"
+)
+
+// archiveManifest describes an archive written by export.
+type archiveManifest struct {
+	// FileFormatVersion is the fileFormatVersion of the entries, which import
+	// requires to match its own.
+	FileFormatVersion string
+	Created           time.Time
+}
+
+// archiveFormatFor returns the compression format of an archive written to
+// name, based on its extension. Archives written to stdout ("-") are zstd
+// compressed, and other extensions are rejected rather than guessed.
+func archiveFormatFor(name string) (string, error) {
+	switch {
+	case name == "-", strings.HasSuffix(name, ".zst"), strings.HasSuffix(name, ".tzst"):
+		return archiveZstd, nil
+	case strings.HasSuffix(name, ".gz"), strings.HasSuffix(name, ".tgz"):
+		return archiveGzip, nil
+	case strings.HasSuffix(name, ".lz4"):
+		return archiveLZ4, nil
+	case strings.HasSuffix(name, ".tar"):
+		return archiveNone, nil
+	default:
+		return "", fmt.Errorf("can't tell the archive format of %s from its extension (.tar.zst, .tar.gz, .tar.lz4 or .tar), set -format", name)
+	}
+}
+
+// nopWriteCloser adds a no-op Close to an io.Writer.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// newArchiveWriter compresses w with format. Closing the returned writer flushes
+// it but doesn't close w.
+func newArchiveWriter(w io.Writer, format string) (io.WriteCloser, error) {
+	switch format {
+	case archiveZstd:
+		return zstd.NewWriter(w)
+	case archiveGzip:
+		return gzip.NewWriter(w), nil
+	case archiveLZ4:
+		return lz4.NewWriter(w), nil
+	case archiveNone:
+		return nopWriteCloser{w}, nil
+	default:
+		return nil, fmt.Errorf("unknown archive format %q (supported: %s, %s, %s, %s)", format, archiveZstd, archiveGzip, archiveLZ4, archiveNone)
+	}
+}
+
+// newArchiveReader decompresses r, detecting the format from its first bytes.
+// Closing the returned reader releases the decompressor but doesn't close r.
+func newArchiveReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(4)
+	switch {
+	case bytes.Equal(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		dec, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return dec.IOReadCloser(), nil
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return gzip.NewReader(br)
+	case bytes.Equal(magic, []byte{0x04, 0x22, 0x4d, 0x18}):
+		return io.NopCloser(lz4.NewReader(br)), nil
+	default:
+		return io.NopCloser(br), nil
+	}
+}
+
+// archiveEntryName returns the name of an entry's data file in an archive,
+// which is its path relative to the cache directory. The metadata file is the
+// same with a ".meta" suffix.
+func archiveEntryName(actionID []byte) string {
+	hexActionID := hex.EncodeToString(actionID)
+	return hexActionID[:2] + "/" + fileFormatVersion + hexActionID
+}
+
+// parseArchiveEntryName parses a name returned by archiveEntryName, with or
+// without the ".meta" suffix.
+func parseArchiveEntryName(name string) (actionID []byte, isMeta bool, ok bool) {
+	dir, file := path.Split(name)
+	file, isMeta = strings.CutSuffix(file, ".meta")
+	hexActionID, found := strings.CutPrefix(file, fileFormatVersion)
+	if !found || len(hexActionID) < 2 || dir != hexActionID[:2]+"/" {
+		return nil, false, false
+	}
+	actionID, err := hex.DecodeString(hexActionID)
+	if err != nil {
+		return nil, false, false
+	}
+	return actionID, isMeta, true
+}
+
+// exportOptions configures export.
+type exportOptions struct {
+	UsedWithin time.Duration // Only export entries used within this long, 0 disables
+	MaxBytes   int64         // Only export the most recently used entries up to this size, 0 disables
+	Format     string        // Compression format of the archive
+}
+
+// exportReport is the result of export.
+type exportReport struct {
+	Exported objectCount // Bytes are the sizes of the data files
+	Skipped  int64       // Entries left out by the filters
+	Corrupt  int64       // Entries left out because they are corrupt or vanished
+}
+
+// exportLocalCache writes the entries of the local cache to w as a compressed
+// tar archive, most recently used first. Every entry is read under its lock, so
+// a running server can keep using the cache.
+func exportLocalCache(lc *localCache, locker locking.Group, w io.Writer, opts exportOptions, now time.Time) (*exportReport, error) {
+	entries, _, err := lc.scan(defaultStaleTmpAge)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].lastAccess.After(entries[j].lastAccess) })
+
+	report := &exportReport{}
+	selected := entries[:0]
+	var total int64
+	for _, entry := range entries {
+		if (opts.UsedWithin > 0 && now.Sub(entry.lastAccess) > opts.UsedWithin) ||
+			(opts.MaxBytes > 0 && total+entry.size > opts.MaxBytes) {
+			report.Skipped++
+			continue
+		}
+		total += entry.size
+		selected = append(selected, entry)
+	}
+
+	cw, err := newArchiveWriter(w, opts.Format)
+	if err != nil {
+		return nil, err
+	}
+	tw := tar.NewWriter(cw)
+	manifest, err := json.Marshal(archiveManifest{FileFormatVersion: fileFormatVersion, Created: now})
+	if err != nil {
+		return nil, err
+	}
+	if err := writeArchiveFile(tw, archiveManifestName, now, bytes.NewReader(manifest), int64(len(manifest))); err != nil {
+		return nil, err
+	}
+
+	for _, entry := range selected {
+		v, err := locker.DoWithLock(hex.EncodeToString(entry.actionID), func() (interface{}, error) {
+			return exportEntry(lc, tw, entry)
+		})
+		if err != nil {
+			return report, err
+		}
+		if size, ok := v.(int64); ok {
+			report.Exported.add(size)
+		} else {
+			report.Corrupt++
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return report, fmt.Errorf("failed to write archive: %w", err)
+	}
+	if err := cw.Close(); err != nil {
+		return report, fmt.Errorf("failed to write archive: %w", err)
+	}
+	return report, nil
+}
+
+// exportEntry writes the metadata and data files of an entry to tw, and returns
+// the size of the data file, or nil if the entry is corrupt or was removed. The
+// metadata file keeps its modification time, which is the entry's last access.
+func exportEntry(lc *localCache, tw *tar.Writer, entry localCacheEntry) (interface{}, error) {
+	metaData, err := os.ReadFile(lc.metadataPath(entry.actionID))
+	if err != nil {
+		return nil, nil
+	}
+	meta, err := parseMetadata(metaData)
+	if err != nil || lc.verifyEntry(entry.actionID, meta, localVerifySize) != nil {
+		return nil, nil
+	}
+	f, err := os.Open(lc.actionIDToPath(entry.actionID))
+	if err != nil {
+		return nil, nil
+	}
+	defer f.Close()
+
+	name := archiveEntryName(entry.actionID)
+	if err := writeArchiveFile(tw, name+".meta", entry.lastAccess, bytes.NewReader(metaData), int64(len(metaData))); err != nil {
+		return nil, err
+	}
+	if err := writeArchiveFile(tw, name, meta.PutTime, f, meta.Size); err != nil {
+		return nil, err
+	}
+	return meta.Size, nil
+}
+
+func writeArchiveFile(tw *tar.Writer, name string, modTime time.Time, body io.Reader, size int64) error {
+	err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  modTime,
+		Format:   tar.FormatPAX,
+	})
+	if err == nil {
+		_, err = io.CopyN(tw, body, size)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+	return nil
+}
+
+// importReport is the result of import.
+type importReport struct {
+	Imported objectCount // Bytes are the sizes of the data files
+	Existing int64       // Entries that were already cached, and kept as they are
+	Corrupt  int64       // Entries whose data doesn't match their metadata
+	Ignored  int64       // Files that aren't part of a complete entry
+	// ActionIDs are the entries of the archive that are now in the local cache,
+	// imported or existing.
+	ActionIDs [][]byte `json:"-"`
+}
+
+// importLocalCache adds the entries of an archive written by exportLocalCache to
+// the local cache. Entries that are already cached are kept, and every entry is
+// written under its lock, so a running server can keep using the cache.
+func importLocalCache(lc *localCache, locker locking.Group, r io.Reader) (*importReport, error) {
+	ar, err := newArchiveReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive: %w", err)
+	}
+	defer ar.Close()
+	tr := tar.NewReader(ar)
+
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != archiveManifestName {
+		return nil, errors.New("not a gobuildcache archive: the manifest is missing")
+	}
+	var manifest archiveManifest
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("failed to read archive manifest: %w", err)
+	}
+	if manifest.FileFormatVersion != fileFormatVersion {
+		return nil, fmt.Errorf("the archive holds cache entries of format %q, this version of gobuildcache uses %q", manifest.FileFormatVersion, fileFormatVersion)
+	}
+
+	report := &importReport{}
+	var (
+		pendingID   []byte // Entry whose metadata file was just read
+		pendingMeta *localCacheMetadata
+		lastAccess  time.Time
+	)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return report, fmt.Errorf("failed to read archive: %w", err)
+		}
+
+		actionID, isMeta, ok := parseArchiveEntryName(hdr.Name)
+		switch {
+		case !ok || hdr.Typeflag != tar.TypeReg:
+			report.Ignored++
+			continue
+		case isMeta:
+			if pendingID != nil {
+				report.Ignored++
+			}
+			data, err := io.ReadAll(io.LimitReader(tr, 4096))
+			if err != nil {
+				return report, fmt.Errorf("failed to read archive: %w", err)
+			}
+			// Unparseable metadata leaves pendingMeta nil, which makes the entry
+			// corrupt once its data file is reached.
+			pendingID, lastAccess = actionID, hdr.ModTime
+			pendingMeta, _ = parseMetadata(data)
+			continue
+		case !bytes.Equal(actionID, pendingID):
+			report.Ignored++
+			continue
+		}
+
+		meta := pendingMeta
+		pendingID, pendingMeta = nil, nil
+		if meta == nil || hdr.Size != meta.Size {
+			report.Corrupt++
+			continue
+		}
+		_, err = locker.DoWithLock(hex.EncodeToString(actionID), func() (interface{}, error) {
+			return nil, importEntry(lc, actionID, tr, meta, lastAccess, report)
+		})
+		if err != nil {
+			return report, err
+		}
+	}
+	if pendingID != nil {
+		report.Ignored++
+	}
+	return report, nil
+}
+
+// importEntry writes an entry read from an archive to the local cache, unless it
+// is already cached, and restores its last access time.
+func importEntry(lc *localCache, actionID []byte, body io.Reader, meta *localCacheMetadata, lastAccess time.Time, report *importReport) error {
+	if existing, err := lc.readMetadata(actionID); err == nil && lc.verifyEntry(actionID, existing, localVerifySize) == nil {
+		report.Existing++
+		report.ActionIDs = append(report.ActionIDs, actionID)
+		return nil
+	}
+
+	if _, err := lc.writeWithMetadata(actionID, body, localCacheMetadata{
+		OutputID: meta.OutputID,
+		Size:     meta.Size,
+		PutTime:  meta.PutTime,
+	}); err != nil {
+		return fmt.Errorf("failed to write cache entry: %w", err)
+	}
+	written, err := lc.readMetadata(actionID)
+	if err != nil || (meta.Checksum != nil && !bytes.Equal(written.Checksum, meta.Checksum)) {
+		report.Corrupt++
+		return lc.remove(actionID)
+	}
+	if !lastAccess.IsZero() {
+		os.Chtimes(lc.metadataPath(actionID), lastAccess, lastAccess)
+	}
+	report.Imported.add(meta.Size)
+	report.ActionIDs = append(report.ActionIDs, actionID)
+	return nil
+}
+
+// pushEntries uploads the given local cache entries to backend in namespace,
+// concurrency at a time, the same way the server uploads them. It returns the
+// entries uploaded (with their uploaded sizes) and the errors of the others.
+func pushEntries(lc *localCache, backend backends.Backend, namespace string, compressed bool, actionIDs [][]byte, concurrency int) (objectCount, []error) {
+	var (
+		mu     sync.Mutex
+		pushed objectCount
+		errs   []error
+		wg     sync.WaitGroup
+		queue  = make(chan []byte)
+	)
+	for i := 0; i < max(concurrency, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for actionID := range queue {
+				size, err := pushEntry(lc, backend, namespace, compressed, actionID)
+				mu.Lock()
+				if err != nil {
+					errs = append(errs, fmt.Errorf("%x: %w", actionID, err))
+				} else {
+					pushed.add(size)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, actionID := range actionIDs {
+		queue <- actionID
+	}
+	close(queue)
+	wg.Wait()
+	return pushed, errs
+}
+
+func pushEntry(lc *localCache, backend backends.Backend, namespace string, compressed bool, actionID []byte) (int64, error) {
+	meta, err := lc.readMetadata(actionID)
+	if err != nil {
+		return 0, err
+	}
+	return uploadSpoolEntry(backend, spoolEntry{
+		BackendKey: hex.EncodeToString([]byte(namespace + fileFormatVersion + hex.EncodeToString(actionID))),
+		OutputID:   hex.EncodeToString(meta.OutputID),
+		Size:       meta.Size,
+		DiskPath:   lc.actionIDToPath(actionID),
+		Compressed: compressed,
+	})
+}
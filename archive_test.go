@@ -0,0 +1,178 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/hex"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/gobuildcache/pkg/locking"
+)
+
+func TestExportImport(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	src := newTestLocalCache(t)
+	recent := writeTestEntry(t, src, 1, 1000, now.Add(-time.Hour))
+	older := writeTestEntry(t, src, 2, 1000, now.Add(-48*time.Hour))
+	stale := writeTestEntry(t, src, 3, 1000, now.Add(-30*24*time.Hour))
+
+	for _, format := range []string{archiveZstd, archiveGzip, archiveLZ4, archiveNone} {
+		var archive bytes.Buffer
+		report, err := exportLocalCache(src, locking.NewMemLock(), &archive, exportOptions{UsedWithin: 7 * 24 * time.Hour, Format: format}, now)
+		if err != nil {
+			t.Fatalf("%s: export failed: %v", format, err)
+		}
+		if report.Exported != (objectCount{Objects: 2, Bytes: 2000}) || report.Skipped != 1 {
+			t.Errorf("%s: export report = %+v, want 2 entries and 1 skipped", format, report)
+		}
+
+		dst := newTestLocalCache(t)
+		imported, err := importLocalCache(dst, locking.NewMemLock(), &archive)
+		if err != nil {
+			t.Fatalf("%s: import failed: %v", format, err)
+		}
+		if imported.Imported.Objects != 2 || imported.Corrupt != 0 || imported.Ignored != 0 || len(imported.ActionIDs) != 2 {
+			t.Errorf("%s: import report = %+v", format, imported)
+		}
+		for _, actionID := range [][]byte{recent, older} {
+			meta := dst.check(actionID)
+			if meta == nil || meta.Size != 1000 || !bytes.Equal(meta.OutputID, actionID[:1]) {
+				t.Fatalf("%s: entry %x wasn't imported: %+v", format, actionID[:1], meta)
+			}
+			// The last access time is kept, so trimming the imported cache
+			// evicts the same entries first.
+			srcInfo, srcErr := os.Stat(src.metadataPath(actionID))
+			dstInfo, dstErr := os.Stat(dst.metadataPath(actionID))
+			if srcErr != nil || dstErr != nil || !dstInfo.ModTime().Equal(srcInfo.ModTime()) {
+				t.Errorf("%s: entry %x lost its last access time", format, actionID[:1])
+			}
+		}
+		if dst.check(stale) != nil {
+			t.Errorf("%s: filtered entry was imported", format)
+		}
+	}
+}
+
+func TestExport_MaxBytesKeepsMostRecentlyUsed(t *testing.T) {
+	now := time.Now()
+	lc := newTestLocalCache(t)
+	writeTestEntry(t, lc, 1, 1000, now.Add(-3*time.Hour))
+	newest := writeTestEntry(t, lc, 2, 1000, now.Add(-time.Hour))
+
+	var archive bytes.Buffer
+	report, err := exportLocalCache(lc, locking.NewMemLock(), &archive, exportOptions{MaxBytes: 1500, Format: archiveNone}, now)
+	if err != nil {
+		t.Fatalf("export failed: %v", err)
+	}
+	if report.Exported.Objects != 1 || report.Skipped != 1 {
+		t.Fatalf("export report = %+v, want 1 entry", report)
+	}
+	if !strings.Contains(archive.String(), archiveEntryName(newest)) {
+		t.Error("the most recently used entry wasn't exported")
+	}
+}
+
+func TestImport_SkipsExistingAndCorruptEntries(t *testing.T) {
+	now := time.Now()
+	actionID := bytes.Repeat([]byte{1}, 32)
+	meta := []byte("outputID:01\nsize:4\ntime:1\nsha256:" + strings.Repeat("00", 32) + "\n")
+
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	manifest := []byte(`{"FileFormatVersion":"` + fileFormatVersion + `"}`)
+	for _, f := range []struct {
+		name string
+		body []byte
+	}{
+		{archiveManifestName, manifest},
+		{archiveEntryName(actionID) + ".meta", meta},
+		{archiveEntryName(actionID), []byte("data")}, // Doesn't match the checksum
+		{"../../etc/passwd", []byte("evil")},
+	} {
+		if err := writeArchiveFile(tw, f.name, now, bytes.NewReader(f.body), int64(len(f.body))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tw.Close()
+
+	lc := newTestLocalCache(t)
+	report, err := importLocalCache(lc, locking.NewMemLock(), bytes.NewReader(archive.Bytes()))
+	if err != nil {
+		t.Fatalf("import failed: %v", err)
+	}
+	if report.Imported.Objects != 0 || report.Corrupt != 1 || report.Ignored != 1 {
+		t.Errorf("report = %+v, want 1 corrupt and 1 ignored", report)
+	}
+	if lc.check(actionID) != nil {
+		t.Error("corrupt entry was imported")
+	}
+
+	// Entries that are already cached are kept.
+	existing := writeTestEntry(t, lc, 2, 10, now)
+	var exported bytes.Buffer
+	if _, err := exportLocalCache(lc, locking.NewMemLock(), &exported, exportOptions{Format: archiveGzip}, now); err != nil {
+		t.Fatal(err)
+	}
+	report, err = importLocalCache(lc, locking.NewMemLock(), &exported)
+	if err != nil {
+		t.Fatalf("import failed: %v", err)
+	}
+	if report.Existing != 1 || report.Imported.Objects != 0 || !bytes.Equal(report.ActionIDs[0], existing) {
+		t.Errorf("report = %+v, want 1 existing entry", report)
+	}
+}
+
+func TestImport_RejectsOtherFormatVersions(t *testing.T) {
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	manifest := []byte(`{"FileFormatVersion":"v1"}`)
+	writeArchiveFile(tw, archiveManifestName, time.Now(), bytes.NewReader(manifest), int64(len(manifest)))
+	tw.Close()
+
+	_, err := importLocalCache(newTestLocalCache(t), locking.NewMemLock(), &archive)
+	if err == nil || !strings.Contains(err.Error(), "v1") {
+		t.Errorf("expected a format version error, got %v", err)
+	}
+	if _, err := importLocalCache(newTestLocalCache(t), locking.NewMemLock(), strings.NewReader("not an archive")); err == nil {
+		t.Error("expected an error for a file that isn't an archive")
+	}
+}
+
+func TestPushEntries(t *testing.T) {
+	lc := newTestLocalCache(t)
+	actionID := writeTestEntry(t, lc, 1, 1000, time.Now())
+	backend := newRecordingBackend()
+
+	pushed, errs := pushEntries(lc, backend, "main/", true, [][]byte{actionID}, 4)
+	if len(errs) != 0 || pushed.Objects != 1 {
+		t.Fatalf("pushed %+v, errors %v", pushed, errs)
+	}
+	data, ok := backend.get([]byte("main/" + fileFormatVersion + hex.EncodeToString(actionID)))
+	if !ok {
+		t.Fatal("entry wasn't pushed into the namespace")
+	}
+	if body, err := decompressData(data); err != nil || len(body) != 1000 {
+		t.Errorf("pushed body isn't the compressed entry: %d bytes, %v", len(body), err)
+	}
+}
+
+func TestArchiveFormatFor(t *testing.T) {
+	for name, want := range map[string]string{
+		"cache.tar.zst": archiveZstd,
+		"-":             archiveZstd,
+		"cache.tgz":     archiveGzip,
+		"cache.tar.gz":  archiveGzip,
+		"cache.tar.lz4": archiveLZ4,
+		"cache.tar":     archiveNone,
+	} {
+		if got, err := archiveFormatFor(name); got != want || err != nil {
+			t.Errorf("archiveFormatFor(%q) = %q, %v, want %q", name, got, err, want)
+		}
+	}
+	if _, err := archiveFormatFor("cache.tar.xz"); err == nil {
+		t.Error("expected an error for an unknown extension")
+	}
+}
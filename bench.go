@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	mathrand "math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/richardartoul/gobuildcache/pkg/backends"
+	"github.com/richardartoul/gobuildcache/pkg/locking"
+	"github.com/richardartoul/gobuildcache/pkg/metrics"
+)
+
+// defaultBenchSizes roughly follows the object sizes of a Go build cache: mostly
+// small objects, with a long tail of large archives and binaries.
+const defaultBenchSizes = "1KB:40,16KB:30,256KB:20,4MB:9,32MB:1"
+
+// sizeDistribution is a weighted set of object sizes.
+type sizeDistribution struct {
+	sizes       []int64
+	cumulative  []float64 // Cumulative weights, parallel to sizes
+	totalWeight float64
+}
+
+// parseSizeDistribution parses a comma-separated list of size:weight pairs, e.g.
+// "1KB:40,1MB:10". The weight defaults to 1.
+func parseSizeDistribution(spec string) (sizeDistribution, error) {
+	var d sizeDistribution
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		sizeStr, weightStr, hasWeight := strings.Cut(part, ":")
+		size, err := parseByteSize(sizeStr)
+		if err != nil || size <= 0 {
+			return sizeDistribution{}, fmt.Errorf("invalid size in distribution: %q", part)
+		}
+		weight := 1.0
+		if hasWeight {
+			weight, err = strconv.ParseFloat(strings.TrimSpace(weightStr), 64)
+			if err != nil || weight <= 0 {
+				return sizeDistribution{}, fmt.Errorf("invalid weight in distribution: %q", part)
+			}
+		}
+		d.totalWeight += weight
+		d.sizes = append(d.sizes, size)
+		d.cumulative = append(d.cumulative, d.totalWeight)
+	}
+	if len(d.sizes) == 0 {
+		return sizeDistribution{}, fmt.Errorf("empty size distribution")
+	}
+	return d, nil
+}
+
+// sample returns a random size from the distribution.
+func (d sizeDistribution) sample(r *mathrand.Rand) int64 {
+	x := r.Float64() * d.totalWeight
+	i := sort.SearchFloat64s(d.cumulative, x)
+	if i >= len(d.sizes) {
+		i = len(d.sizes) - 1
+	}
+	return d.sizes[i]
+}
+
+// max returns the largest size in the distribution.
+func (d sizeDistribution) max() int64 {
+	var m int64
+	for _, size := range d.sizes {
+		m = max(m, size)
+	}
+	return m
+}
+
+// benchOptions configures a benchmark.
+type benchOptions struct {
+	Concurrency  int           // Concurrent operations
+	Duration     time.Duration // How long to run for, unless Ops is set
+	Ops          int           // Total operations to run, 0 runs for Duration
+	GetRatio     float64       // Fraction (0.0-1.0) of operations that are GETs
+	SeedObjects  int           // Objects written before the run for GETs to read
+	Sizes        sizeDistribution
+	Compressible float64 // Fraction (0.0-1.0) of each body that is zeros
+	Compression  bool
+	WorkDir      string // Directory for the benchmark's temporary local caches
+	Namespace    string // Namespace all benchmark objects are written into
+	Keep         bool   // Don't delete the benchmark objects afterwards
+}
+
+// benchOpStats summarizes one type of benchmark operation.
+type benchOpStats struct {
+	Count       int64
+	Errors      int64
+	Misses      int64
+	Bytes       int64
+	OpsPerSec   float64
+	MBPerSec    float64
+	LatencyMs   metrics.Stats
+	FirstErrors []string `json:",omitempty"`
+}
+
+// benchReport is the result of a benchmark.
+type benchReport struct {
+	Backend     string
+	Compression bool
+	Concurrency int
+	GetRatio    float64
+	Elapsed     time.Duration
+	DrainTime   time.Duration // Time spent waiting for queued uploads after the run
+	Get         benchOpStats
+	Put         benchOpStats
+	Stages      []metrics.Stats // The cache server's internal latency breakdown
+}
+
+// benchOp records the outcomes of one type of operation.
+type benchOp struct {
+	count, errors, misses, bytes atomic.Int64
+
+	mu          sync.Mutex
+	firstErrors []string
+}
+
+func (o *benchOp) recordError(err error) {
+	o.errors.Add(1)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.firstErrors) < 5 {
+		o.firstErrors = append(o.firstErrors, err.Error())
+	}
+}
+
+func (o *benchOp) stats(name string, tracker *metrics.LatencyTracker, elapsed time.Duration) benchOpStats {
+	s := benchOpStats{
+		Count:       o.count.Load(),
+		Errors:      o.errors.Load(),
+		Misses:      o.misses.Load(),
+		Bytes:       o.bytes.Load(),
+		FirstErrors: o.firstErrors,
+	}
+	if secs := elapsed.Seconds(); secs > 0 {
+		s.OpsPerSec = float64(s.Count) / secs
+		s.MBPerSec = float64(s.Bytes) / secs / (1 << 20)
+	}
+	s.LatencyMs, _ = tracker.GetStats(name)
+	s.LatencyMs.Operation = name
+	return s
+}
+
+// benchBodies generates object bodies. Each body is unique, and the tail of it
+// is zeros so that the compression ratio can be controlled.
+type benchBodies struct {
+	random       []byte
+	compressible float64
+	counter      atomic.Int64
+}
+
+func newBenchBodies(maxSize int64, compressible float64) *benchBodies {
+	random := make([]byte, maxSize)
+	rand.Read(random)
+	return &benchBodies{random: random, compressible: compressible}
+}
+
+func (b *benchBodies) next(size int64) []byte {
+	body := make([]byte, size)
+	randomLen := size - int64(float64(size)*b.compressible)
+	copy(body, b.random[:randomLen])
+	// Make every body unique, so that no two objects share an output ID.
+	var unique [8]byte
+	binary.LittleEndian.PutUint64(unique[:], uint64(b.counter.Add(1)))
+	copy(body, unique[:min(len(unique), len(body))])
+	return body
+}
+
+// newScratchNamespace returns a unique namespace for the objects written by a
+// command such as bench, e.g. "gobuildcache-bench/<random>".
+func newScratchNamespace(command string) string {
+	suffix := make([]byte, 8)
+	rand.Read(suffix)
+	return "gobuildcache-" + command + "/" + hex.EncodeToString(suffix)
+}
+
+// newBenchProg creates a cache server with its own empty local cache, writing
+// into the benchmark namespace.
+func newBenchProg(backend backends.Backend, locker locking.Group, dir string, opts benchOptions) (*CacheProg, error) {
+	cp, err := NewCacheProg(backend, locker, dir, false, false, opts.Compression, false)
+	if err != nil {
+		return nil, err
+	}
+	cp.setNamespaces(opts.Namespace, nil)
+	return cp, nil
+}
+
+// newBenchActionID returns a random action ID.
+func newBenchActionID() []byte {
+	actionID := make([]byte, 32)
+	rand.Read(actionID)
+	return actionID
+}
+
+// benchPut PUTs a generated object of the given size through the cache server.
+func benchPut(cp *CacheProg, bodies *benchBodies, actionID []byte, size int64) error {
+	body := bodies.next(size)
+	outputID := sha256.Sum256(body)
+
+	resp, err := cp.handlePut(&Request{
+		Command:  CmdPut,
+		ActionID: actionID,
+		OutputID: outputID[:],
+		Body:     bytes.NewReader(body),
+		BodySize: size,
+	})
+	if err == nil && resp.Err != "" {
+		err = fmt.Errorf("%s", resp.Err)
+	}
+	return err
+}
+
+// runBench seeds the backend with objects, then runs a concurrent mix of GETs of
+// the seeded objects and PUTs of new ones through a full cache server (local
+// cache, locking group, compression and the backend stack returned by
+// newBackend). GETs always miss the local cache, so they measure the backend.
+func runBench(newBackend func() (backends.Backend, error), locker locking.Group, opts benchOptions, progress io.Writer) (*benchReport, error) {
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 1
+	}
+	if opts.SeedObjects <= 0 && opts.GetRatio > 0 {
+		opts.SeedObjects = 1
+	}
+	workDir, err := os.MkdirTemp(opts.WorkDir, "gobuildcache-bench-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create bench directory: %w", err)
+	}
+	defer os.RemoveAll(workDir)
+
+	bodies := newBenchBodies(opts.Sizes.max(), opts.Compressible)
+	var written [][]byte
+
+	// Seed the objects that GETs read, and close the backend so that they've all
+	// been uploaded before the run starts.
+	fmt.Fprintf(progress, "Seeding %d objects...\n", opts.SeedObjects)
+	seedBackend, err := newBackend()
+	if err != nil {
+		return nil, err
+	}
+	seedProg, err := newBenchProg(seedBackend, locker, workDir+"/seed", opts)
+	if err != nil {
+		seedBackend.Close()
+		return nil, err
+	}
+	seeds, err := benchSeed(seedProg, bodies, opts)
+	written = append(written, seeds...)
+	if closeErr := seedBackend.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to seed objects: %w", err)
+	}
+
+	backend, err := newBackend()
+	if err != nil {
+		return nil, err
+	}
+	cp, err := newBenchProg(backend, locker, workDir+"/run", opts)
+	if err != nil {
+		backend.Close()
+		return nil, err
+	}
+
+	if opts.Ops > 0 {
+		fmt.Fprintf(progress, "Running %d operations with concurrency %d...\n", opts.Ops, opts.Concurrency)
+	} else {
+		fmt.Fprintf(progress, "Running for %s with concurrency %d...\n", opts.Duration, opts.Concurrency)
+	}
+	var (
+		tracker  = metrics.NewLatencyTracker(0.01) // 1% relative accuracy
+		gets     benchOp
+		puts     benchOp
+		started  atomic.Int64
+		putIDsMu sync.Mutex
+		putIDs   [][]byte
+		wg       sync.WaitGroup
+		start    = time.Now()
+		deadline = start.Add(opts.Duration)
+	)
+	for w := 0; w < opts.Concurrency; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := mathrand.New(mathrand.NewSource(seed))
+			for {
+				n := started.Add(1)
+				if (opts.Ops > 0 && n > int64(opts.Ops)) || (opts.Ops <= 0 && time.Now().After(deadline)) {
+					return
+				}
+
+				if r.Float64() < opts.GetRatio {
+					actionID := seeds[r.Intn(len(seeds))]
+					// Evict the object from the local cache first, so the GET goes
+					// to the backend.
+					cp.locker.DoWithLock(hex.EncodeToString(actionID), func() (interface{}, error) {
+						return nil, cp.localCache.remove(actionID)
+					})
+					opStart := time.Now()
+					resp, err := cp.handleGet(&Request{Command: CmdGet, ActionID: actionID})
+					tracker.Record("GET", time.Since(opStart))
+					gets.count.Add(1)
+					switch {
+					case err != nil:
+						gets.recordError(err)
+					case resp.Miss:
+						gets.misses.Add(1)
+					default:
+						gets.bytes.Add(resp.Size)
+					}
+					continue
+				}
+
+				size := opts.Sizes.sample(r)
+				opStart := time.Now()
+				actionID := newBenchActionID()
+				err := benchPut(cp, bodies, actionID, size)
+				tracker.Record("PUT", time.Since(opStart))
+				puts.count.Add(1)
+				if err != nil {
+					puts.recordError(err)
+					continue
+				}
+				puts.bytes.Add(size)
+				putIDsMu.Lock()
+				putIDs = append(putIDs, actionID)
+				putIDsMu.Unlock()
+			}
+		}(int64(w))
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	drainStart := time.Now()
+	closeErr := backend.Close()
+	report := &benchReport{
+		Backend:     backendType,
+		Compression: opts.Compression,
+		Concurrency: opts.Concurrency,
+		GetRatio:    opts.GetRatio,
+		Elapsed:     elapsed,
+		DrainTime:   time.Since(drainStart),
+		Get:         gets.stats("GET", tracker, elapsed),
+		Put:         puts.stats("PUT", tracker, elapsed),
+		Stages:      cp.latencyTracker.GetAllStats(),
+	}
+	sort.Slice(report.Stages, func(i, j int) bool { return report.Stages[i].Operation < report.Stages[j].Operation })
+	if closeErr != nil {
+		fmt.Fprintf(progress, "Warning: failed to close backend: %v\n", closeErr)
+	}
+
+	if !opts.Keep {
+		written = append(written, putIDs...)
+		benchCleanup(newBackend, cp, written, progress)
+	}
+	return report, nil
+}
+
+// benchSeed concurrently PUTs the seed objects.
+func benchSeed(cp *CacheProg, bodies *benchBodies, opts benchOptions) ([][]byte, error) {
+	var (
+		mu       sync.Mutex
+		seeds    [][]byte
+		firstErr error
+		wg       sync.WaitGroup
+		next     atomic.Int64
+	)
+	for w := 0; w < opts.Concurrency; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := mathrand.New(mathrand.NewSource(seed))
+			for next.Add(1) <= int64(opts.SeedObjects) {
+				actionID := newBenchActionID()
+				err := benchPut(cp, bodies, actionID, opts.Sizes.sample(r))
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+				} else if err == nil {
+					seeds = append(seeds, actionID)
+				}
+				mu.Unlock()
+			}
+		}(-int64(w) - 1)
+	}
+	wg.Wait()
+	return seeds, firstErr
+}
+
+// benchCleanup deletes the benchmark's objects from the backend, if it supports
+// deleting.
+func benchCleanup(newBackend func() (backends.Backend, error), cp *CacheProg, actionIDs [][]byte, progress io.Writer) {
+	backend, err := newBackend()
+	if err != nil {
+		fmt.Fprintf(progress, "Warning: failed to clean up benchmark objects: %v\n", err)
+		return
+	}
+	defer backend.Close()
+
+	deleter, ok := backends.Find[backends.Deleter](backend)
+	if !ok {
+		return
+	}
+	keys := make([][]byte, 0, len(actionIDs))
+	for _, actionID := range actionIDs {
+		keys = append(keys, cp.generateBackendKey(actionID))
+	}
+	fmt.Fprintf(progress, "Deleting %d benchmark objects...\n", len(keys))
+	if err := deleter.Delete(keys); err != nil && !errors.Is(err, errors.ErrUnsupported) {
+		fmt.Fprintf(progress, "Warning: failed to delete some benchmark objects: %v\n", err)
+	}
+}
+
+// printBenchReport prints a human-readable benchmark report.
+func printBenchReport(w io.Writer, r *benchReport) {
+	compression := "off"
+	if r.Compression {
+		compression = "on"
+	}
+	fmt.Fprintf(w, "\nBackend: %s (compression: %s), concurrency: %d, GET ratio: %.2f\n",
+		r.Backend, compression, r.Concurrency, r.GetRatio)
+	fmt.Fprintf(w, "Elapsed: %s, upload drain: %s\n\n", r.Elapsed.Round(time.Millisecond), r.DrainTime.Round(time.Millisecond))
+
+	printBenchOps(w, r.Get, r.Put)
+
+	fmt.Fprintf(w, "\nLatency quantiles (ms):\n")
+	for _, stat := range r.Stages {
+		fmt.Fprintf(w, "%s\n", stat.String())
+	}
+}
+
+// printBenchOps prints a table of GET and PUT statistics.
+func printBenchOps(w io.Writer, get, put benchOpStats) {
+	fmt.Fprintf(w, "%-4s %8s %7s %7s %12s %9s %10s %9s %9s %9s %9s\n",
+		"Op", "Count", "Errors", "Misses", "Bytes", "Ops/s", "MB/s", "p50 ms", "p90 ms", "p99 ms", "max ms")
+	for _, op := range []struct {
+		name  string
+		stats benchOpStats
+	}{{"GET", get}, {"PUT", put}} {
+		s := op.stats
+		fmt.Fprintf(w, "%-4s %8d %7d %7d %12s %9.1f %10.2f %9.2f %9.2f %9.2f %9.2f\n",
+			op.name, s.Count, s.Errors, s.Misses, formatBytes(s.Bytes), s.OpsPerSec, s.MBPerSec,
+			s.LatencyMs.P50, s.LatencyMs.P90, s.LatencyMs.P99, s.LatencyMs.Max)
+		for _, e := range s.FirstErrors {
+			fmt.Fprintf(w, "  error: %s\n", e)
+		}
+	}
+}
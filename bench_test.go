@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	mathrand "math/rand"
+	"strings"
+	"testing"
+
+	"github.com/richardartoul/gobuildcache/pkg/backends"
+	"github.com/richardartoul/gobuildcache/pkg/locking"
+)
+
+func TestParseSizeDistribution(t *testing.T) {
+	d, err := parseSizeDistribution("1KB:3, 1MB")
+	if err != nil {
+		t.Fatalf("parseSizeDistribution failed: %v", err)
+	}
+	if d.max() != 1<<20 {
+		t.Errorf("max() = %d, want %d", d.max(), 1<<20)
+	}
+
+	counts := make(map[int64]int)
+	r := mathrand.New(mathrand.NewSource(1))
+	for i := 0; i < 4000; i++ {
+		counts[d.sample(r)]++
+	}
+	if len(counts) != 2 {
+		t.Fatalf("sampled sizes %v, want only 1KB and 1MB", counts)
+	}
+	// 1KB has three times the weight of 1MB.
+	if ratio := float64(counts[1024]) / float64(counts[1<<20]); ratio < 2.5 || ratio > 3.5 {
+		t.Errorf("1KB:1MB ratio = %.2f, want about 3", ratio)
+	}
+
+	for _, spec := range []string{"", "1KB:0", "1KB:x", "big:1", "0:1"} {
+		if _, err := parseSizeDistribution(spec); err == nil {
+			t.Errorf("parseSizeDistribution(%q) succeeded, want an error", spec)
+		}
+	}
+}
+
+func TestRunBench(t *testing.T) {
+	for _, keep := range []bool{false, true} {
+		backend := deletingBackend{newRecordingBackend()}
+		sizes, err := parseSizeDistribution("1KB:1,64KB:1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		report, err := runBench(func() (backends.Backend, error) { return backend, nil }, locking.NewMemLock(), benchOptions{
+			Concurrency:  4,
+			Ops:          200,
+			GetRatio:     0.5,
+			SeedObjects:  10,
+			Sizes:        sizes,
+			Compressible: 0.5,
+			Compression:  true,
+			WorkDir:      t.TempDir(),
+			Namespace:    "bench/",
+			Keep:         keep,
+		}, io.Discard)
+		if err != nil {
+			t.Fatalf("runBench failed: %v", err)
+		}
+
+		if got := report.Get.Count + report.Put.Count; got != 200 {
+			t.Errorf("ran %d operations, want 200", got)
+		}
+		if report.Get.Count == 0 || report.Put.Count == 0 {
+			t.Fatalf("got %d GETs and %d PUTs, want both", report.Get.Count, report.Put.Count)
+		}
+		if report.Get.Errors != 0 || report.Put.Errors != 0 || report.Get.Misses != 0 {
+			t.Errorf("got %d GET errors, %d PUT errors and %d GET misses, want none",
+				report.Get.Errors, report.Put.Errors, report.Get.Misses)
+		}
+		if report.Get.Bytes == 0 || report.Get.LatencyMs.Count != report.Get.Count {
+			t.Errorf("GET stats not recorded: %+v", report.Get)
+		}
+
+		backend.mu.Lock()
+		stored := len(backend.puts)
+		for key := range backend.puts {
+			if !strings.HasPrefix(key, "bench/") {
+				t.Errorf("object %q was written outside the benchmark namespace", key)
+			}
+		}
+		backend.mu.Unlock()
+		if want := 10 + int(report.Put.Count); keep && stored != want {
+			t.Errorf("keep: %d objects left in the backend, want %d", stored, want)
+		}
+		if !keep && stored != 0 {
+			t.Errorf("%d benchmark objects were left in the backend", stored)
+		}
+	}
+}
+
+func TestPrintBenchReport(t *testing.T) {
+	var buf bytes.Buffer
+	printBenchReport(&buf, &benchReport{
+		Backend: "s3",
+		Get:     benchOpStats{Count: 10, Bytes: 10 << 10, FirstErrors: []string{"boom"}},
+	})
+	for _, want := range []string{"Backend: s3", "GET ", "PUT ", "error: boom"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("report doesn't contain %q:\n%s", want, buf.String())
+		}
+	}
+}
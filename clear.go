@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/richardartoul/gobuildcache/pkg/backends"
+)
+
+// maxReportedErrors is the number of deletion errors kept for reports.
+const maxReportedErrors = 10
+
+// errClearAborted is returned by runClearRemote when the deletion isn't
+// confirmed.
+var errClearAborted = errors.New("aborted")
+
+// batchDeleter deletes backend objects in batches of deleteBatchSize on
+// concurrent workers, as they are added, printing progress as batches complete.
+type batchDeleter struct {
+	deleter  backends.Deleter
+	progress io.Writer
+	total    int64 // Number of objects expected, for progress
+	batches  chan deleteBatch
+	wg       sync.WaitGroup
+	pending  deleteBatch
+
+	mu      sync.Mutex
+	deleted objectCount
+	failed  objectCount // Objects of batches that failed, some may have been deleted
+	errors  []string    // The first maxReportedErrors errors
+}
+
+type deleteBatch struct {
+	keys  [][]byte
+	bytes int64
+}
+
+func newBatchDeleter(deleter backends.Deleter, concurrency int, total int64, progress io.Writer) *batchDeleter {
+	d := &batchDeleter{
+		deleter:  deleter,
+		progress: progress,
+		total:    total,
+		batches:  make(chan deleteBatch, concurrency),
+	}
+	for i := 0; i < max(concurrency, 1); i++ {
+		d.wg.Add(1)
+		go d.worker()
+	}
+	return d
+}
+
+// add queues the object stored under key for deletion.
+func (d *batchDeleter) add(key []byte, size int64) {
+	d.pending.keys = append(d.pending.keys, key)
+	d.pending.bytes += size
+	if len(d.pending.keys) == deleteBatchSize {
+		d.batches <- d.pending
+		d.pending = deleteBatch{}
+	}
+}
+
+// wait deletes the remaining objects and waits for every batch to complete. It
+// returns the objects deleted and the objects of the batches that failed.
+func (d *batchDeleter) wait() (deleted, failed objectCount, errs []string) {
+	if len(d.pending.keys) > 0 {
+		d.batches <- d.pending
+		d.pending = deleteBatch{}
+	}
+	close(d.batches)
+	d.wg.Wait()
+	return d.deleted, d.failed, d.errors
+}
+
+func (d *batchDeleter) worker() {
+	defer d.wg.Done()
+	for batch := range d.batches {
+		err := d.deleter.Delete(batch.keys)
+
+		d.mu.Lock()
+		if err != nil {
+			d.failed.Objects += int64(len(batch.keys))
+			d.failed.Bytes += batch.bytes
+			if len(d.errors) < maxReportedErrors {
+				d.errors = append(d.errors, err.Error())
+			}
+		} else {
+			d.deleted.Objects += int64(len(batch.keys))
+			d.deleted.Bytes += batch.bytes
+		}
+		fmt.Fprintf(d.progress, "Deleted %d/%d objects (%s), %d failed\n",
+			d.deleted.Objects, d.total, formatBytes(d.deleted.Bytes), d.failed.Objects)
+		d.mu.Unlock()
+	}
+}
+
+// clearFilter selects the backend objects clear-remote deletes.
+type clearFilter struct {
+	Prefix     string        // Only keys (namespace included) starting with this
+	OlderThan  time.Duration // Only objects written at least this long ago, 0 disables
+	LargerThan int64         // Only objects larger than this many bytes, 0 disables
+}
+
+func (f clearFilter) match(obj backends.ObjectInfo, now time.Time) bool {
+	return strings.HasPrefix(string(obj.ActionID), f.Prefix) &&
+		(f.OlderThan <= 0 || now.Sub(obj.PutTime) >= f.OlderThan) &&
+		(f.LargerThan <= 0 || obj.Size > f.LargerThan)
+}
+
+// clearOptions configures clear-remote.
+type clearOptions struct {
+	DryRun      bool
+	Concurrency int // Number of concurrent Delete calls
+	// Confirm is called with the matching objects before anything is deleted,
+	// and the deletion is aborted unless it returns true. Nil skips confirmation.
+	Confirm func(matched objectCount) bool
+}
+
+// clearReport is the result of clear-remote.
+type clearReport struct {
+	DryRun  bool
+	Matched objectCount // Objects matching the filter
+	Skipped int64       // Objects whose names gobuildcache didn't generate, never deleted
+	Deleted objectCount
+	Failed  objectCount // Objects that may not have been deleted
+	Errors  []string
+}
+
+// runClearRemote deletes the objects of lister that match filter. It lists them
+// twice, once to count them for confirmation and once to delete them as they are
+// listed, so it never holds the whole listing in memory.
+func runClearRemote(lister backends.Lister, deleter backends.Deleter, filter clearFilter, opts clearOptions, now time.Time, progress io.Writer) (*clearReport, error) {
+	report := &clearReport{DryRun: opts.DryRun}
+	err := backends.ListAll(lister, duListPageSize, func(obj backends.ObjectInfo) error {
+		switch {
+		case obj.ActionID == nil:
+			report.Skipped++
+		case filter.match(obj, now):
+			report.Matched.add(obj.Size)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backend: %w", err)
+	}
+	if opts.DryRun || report.Matched.Objects == 0 {
+		return report, nil
+	}
+	if opts.Confirm != nil && !opts.Confirm(report.Matched) {
+		return report, errClearAborted
+	}
+
+	d := newBatchDeleter(deleter, opts.Concurrency, report.Matched.Objects, progress)
+	listErr := backends.ListAll(lister, duListPageSize, func(obj backends.ObjectInfo) error {
+		if obj.ActionID != nil && filter.match(obj, now) {
+			d.add(obj.ActionID, obj.Size)
+		}
+		return nil
+	})
+	report.Deleted, report.Failed, report.Errors = d.wait()
+	if listErr != nil {
+		return report, fmt.Errorf("failed to list backend: %w", listErr)
+	}
+	return report, nil
+}
+
+// printClearReport prints a human-readable clear-remote report.
+func printClearReport(w io.Writer, r *clearReport) {
+	if r.DryRun {
+		fmt.Fprintf(w, "Would delete %d objects (%s)\n", r.Matched.Objects, formatBytes(r.Matched.Bytes))
+	} else {
+		fmt.Fprintf(w, "Deleted %d of %d objects (%s)\n", r.Deleted.Objects, r.Matched.Objects, formatBytes(r.Deleted.Bytes))
+	}
+	if r.Skipped > 0 {
+		fmt.Fprintf(w, "Skipped %d objects whose names gobuildcache didn't generate\n", r.Skipped)
+	}
+	if r.Failed.Objects > 0 {
+		fmt.Fprintf(w, "Failed: %d objects (%s) may not have been deleted\n", r.Failed.Objects, formatBytes(r.Failed.Bytes))
+		for _, err := range r.Errors {
+			fmt.Fprintf(w, "  %s\n", err)
+		}
+	}
+}
+
+// confirmClear asks on out whether to delete the matched objects from location
+// and reads the answer from in. Only "yes" confirms.
+func confirmClear(in io.Reader, out io.Writer, location string, matched objectCount) bool {
+	fmt.Fprintf(out, "Delete %d objects (%s) from %s? Type 'yes' to continue: ",
+		matched.Objects, formatBytes(matched.Bytes), location)
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	return strings.TrimSpace(answer) == "yes"
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/gobuildcache/pkg/backends"
+)
+
+// failingDeleter fails every Delete.
+type failingDeleter struct {
+	*listingBackend
+}
+
+func (failingDeleter) Delete(actionIDs [][]byte) error { return errors.New("access denied") }
+
+func newClearBackend(t *testing.T, now time.Time) *listingBackend {
+	backend := newListingBackend()
+	backend.foreign = []backends.ObjectInfo{{Name: "README", Size: 1}}
+	for _, e := range []struct {
+		key  string
+		size int
+		age  time.Duration
+	}{
+		{"main/old-small", 10, 10 * 24 * time.Hour},
+		{"main/old-large", 1000, 10 * 24 * time.Hour},
+		{"main/new-large", 1000, time.Hour},
+		{"branches/old-large", 1000, 10 * 24 * time.Hour},
+	} {
+		backend.putAt(t, e.key, e.size, now.Add(-e.age), time.Time{})
+	}
+	return backend
+}
+
+func TestClearFilter(t *testing.T) {
+	now := time.Now()
+	obj := backends.ObjectInfo{ActionID: []byte("main/abc"), Size: 100, PutTime: now.Add(-48 * time.Hour)}
+	tests := []struct {
+		filter clearFilter
+		want   bool
+	}{
+		{clearFilter{}, true},
+		{clearFilter{Prefix: "main/"}, true},
+		{clearFilter{Prefix: "branches/"}, false},
+		{clearFilter{OlderThan: 24 * time.Hour}, true},
+		{clearFilter{OlderThan: 72 * time.Hour}, false},
+		{clearFilter{LargerThan: 99}, true},
+		{clearFilter{LargerThan: 100}, false},
+		{clearFilter{Prefix: "main/", OlderThan: 24 * time.Hour, LargerThan: 100}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.filter.match(obj, now); got != tt.want {
+			t.Errorf("%+v: match = %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+}
+
+func TestRunClearRemote(t *testing.T) {
+	now := time.Now()
+	backend := newClearBackend(t, now)
+	filter := clearFilter{Prefix: "main/", OlderThan: 7 * 24 * time.Hour}
+
+	report, err := runClearRemote(backend, backend, filter, clearOptions{DryRun: true}, now, io.Discard)
+	if err != nil {
+		t.Fatalf("dry run failed: %v", err)
+	}
+	if report.Matched != (objectCount{Objects: 2, Bytes: 1010}) || report.Skipped != 1 || len(backend.puts) != 4 {
+		t.Errorf("dry run: report %+v, %d objects left, want 2 matched and nothing deleted", report, len(backend.puts))
+	}
+
+	var confirmed objectCount
+	decline := clearOptions{Confirm: func(matched objectCount) bool {
+		confirmed = matched
+		return false
+	}}
+	if _, err := runClearRemote(backend, backend, filter, decline, now, io.Discard); !errors.Is(err, errClearAborted) {
+		t.Fatalf("declined clear returned %v, want errClearAborted", err)
+	}
+	if confirmed.Objects != 2 || len(backend.puts) != 4 {
+		t.Errorf("confirmation saw %+v and %d objects were left, want 2 and nothing deleted", confirmed, len(backend.puts))
+	}
+
+	accept := clearOptions{Concurrency: 4, Confirm: func(objectCount) bool { return true }}
+	report, err = runClearRemote(backend, backend, filter, accept, now, io.Discard)
+	if err != nil {
+		t.Fatalf("clear failed: %v", err)
+	}
+	if report.Deleted != (objectCount{Objects: 2, Bytes: 1010}) || report.Failed.Objects != 0 {
+		t.Errorf("report = %+v", report)
+	}
+	for _, key := range []string{"main/new-large", "branches/old-large"} {
+		if _, ok := backend.get([]byte(key)); !ok {
+			t.Errorf("%s was deleted", key)
+		}
+	}
+	if len(backend.puts) != 2 {
+		t.Errorf("%d objects left, want 2", len(backend.puts))
+	}
+}
+
+func TestRunClearRemote_ReportsFailures(t *testing.T) {
+	now := time.Now()
+	backend := newClearBackend(t, now)
+
+	report, err := runClearRemote(backend, failingDeleter{backend}, clearFilter{LargerThan: 100}, clearOptions{}, now, io.Discard)
+	if err != nil {
+		t.Fatalf("runClearRemote failed: %v", err)
+	}
+	if report.Failed != (objectCount{Objects: 3, Bytes: 3000}) || report.Deleted.Objects != 0 {
+		t.Errorf("report = %+v, want 3 failed", report)
+	}
+
+	var out bytes.Buffer
+	printClearReport(&out, report)
+	if !strings.Contains(out.String(), "Failed: 3 objects") || !strings.Contains(out.String(), "access denied") {
+		t.Errorf("unexpected report:\n%s", out.String())
+	}
+}
+
+func TestConfirmClear(t *testing.T) {
+	matched := objectCount{Objects: 3, Bytes: 2048}
+	var out bytes.Buffer
+	if !confirmClear(strings.NewReader("yes\n"), &out, "s3://bucket/", matched) {
+		t.Error("'yes' didn't confirm")
+	}
+	if !strings.Contains(out.String(), "Delete 3 objects") {
+		t.Errorf("unexpected prompt: %q", out.String())
+	}
+	for _, answer := range []string{"y\n", "no\n", ""} {
+		if confirmClear(strings.NewReader(answer), io.Discard, "s3://bucket/", matched) {
+			t.Errorf("%q confirmed", answer)
+		}
+	}
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// configFileName is the name of the config file that is looked up from the
+// current directory up to the repository root when no file is given explicitly.
+const configFileName = ".gobuildcache.toml"
+
+const (
+	// configEnvVar and profileEnvVar select the config file and profile. Like the
+	// secret keys they must be prefixed, since unprefixed CONFIG and PROFILE are
+	// too likely to be set for something else.
+	configEnvVar  = "GOBUILDCACHE_CONFIG"
+	profileEnvVar = "GOBUILDCACHE_PROFILE"
+)
+
+// activeConfig is the config file loaded by loadConfig, or nil if there is none.
+var activeConfig *configFile
+
+// configFile is a parsed TOML config file. Top-level keys apply to every run,
+// and [profiles.<name>] tables override them when that profile is selected, e.g.
+//
+//	s3_bucket = "my-cache-bucket"
+//	compression = true
+//
+//	[profiles.ci]
+//	write_namespace = "main"
+//	async_queue_max_bytes = "1GB"
+//
+// Keys are the environment variable names without the GOBUILDCACHE_ prefix, in
+// any case and with either dashes or underscores, so s3_bucket, s3-bucket and
+// S3_BUCKET are all equivalent. Other tables and dotted keys are joined with
+// underscores, so s3.bucket is S3_BUCKET too.
+type configFile struct {
+	path     string
+	profile  string // Selected profile, empty for none
+	values   map[string]string
+	profiles map[string]map[string]string
+}
+
+// loadConfig finds, parses and activates the config file and profile selected by
+// the -config and -profile flags in args, the GOBUILDCACHE_CONFIG and
+// GOBUILDCACHE_PROFILE environment variables, or a .gobuildcache.toml file
+// between the current directory and the repository root. It must be called
+// before any flag defaults are resolved.
+func loadConfig(args []string) error {
+	path := flagArg(args, "config")
+	if path == "" {
+		path = os.Getenv(configEnvVar)
+	}
+	if path == "" {
+		path = findConfigFile()
+	}
+	if path == "" {
+		if profile := selectedProfile(args); profile != "" {
+			return fmt.Errorf("profile %q selected but no config file was found", profile)
+		}
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer f.Close()
+	cfg, err := parseConfig(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	cfg.path = path
+
+	profile := selectedProfile(args)
+	if profile == "" {
+		profile = cfg.profile
+	}
+	if profile != "" {
+		if _, ok := cfg.profiles[profile]; !ok {
+			return fmt.Errorf("%s: unknown profile %q (available: %s)", path, profile, strings.Join(cfg.profileNames(), ", "))
+		}
+	}
+	cfg.profile = profile
+	activeConfig = cfg
+	return nil
+}
+
+// selectedProfile returns the profile selected by the -profile flag or the
+// GOBUILDCACHE_PROFILE environment variable.
+func selectedProfile(args []string) string {
+	if profile := flagArg(args, "profile"); profile != "" {
+		return profile
+	}
+	return os.Getenv(profileEnvVar)
+}
+
+// flagArg returns the value of the named flag in args, which is needed before
+// the flags are parsed since their defaults depend on the config file.
+func flagArg(args []string, name string) string {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			break
+		}
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		arg = strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-")
+		if arg == name && i+1 < len(args) {
+			return args[i+1]
+		}
+		if value, ok := strings.CutPrefix(arg, name+"="); ok {
+			return value
+		}
+	}
+	return ""
+}
+
+// findConfigFile looks for a config file in the current directory and its
+// parents, stopping at the repository root (the first directory containing
+// .git).
+func findConfigFile() string {
+	dir, err := os.Getwd()
+	if err != nil {
+		return ""
+	}
+	for {
+		path := filepath.Join(dir, configFileName)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			return ""
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// registerConfigFlags registers the -config and -profile flags. They have
+// already been applied by loadConfig, but every subcommand accepts them.
+func registerConfigFlags(fs *flag.FlagSet) {
+	fs.String("config", "", fmt.Sprintf("Config file, defaults to %s in the current directory or any parent up to the repository root (env: %s)", configFileName, configEnvVar))
+	fs.String("profile", "", fmt.Sprintf("Config file profile to use (env: %s)", profileEnvVar))
+}
+
+// parseConfig parses a config file.
+func parseConfig(r io.Reader) (*configFile, error) {
+	var doc map[string]any
+	if _, err := toml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+	cfg := &configFile{
+		values:   make(map[string]string),
+		profiles: make(map[string]map[string]string),
+	}
+
+	// A top-level profile key selects the default profile.
+	if profile, ok := doc["profile"]; ok {
+		name, ok := profile.(string)
+		if !ok {
+			return nil, errors.New("profile must be a string")
+		}
+		cfg.profile = name
+		delete(doc, "profile")
+	}
+	profiles, hasProfiles := doc["profiles"]
+	delete(doc, "profiles")
+	if err := flattenConfig(cfg.values, "", doc); err != nil {
+		return nil, err
+	}
+	if !hasProfiles {
+		return cfg, nil
+	}
+
+	tables, ok := profiles.(map[string]any)
+	if !ok {
+		return nil, errors.New("profiles must be [profiles.<name>] tables")
+	}
+	for name, profile := range tables {
+		table, ok := profile.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("profiles.%s must be a table", name)
+		}
+		values := make(map[string]string)
+		if err := flattenConfig(values, "", table); err != nil {
+			return nil, fmt.Errorf("profiles.%s: %w", name, err)
+		}
+		cfg.profiles[name] = values
+	}
+	return cfg, nil
+}
+
+// flattenConfig adds the values of table to values, keyed by their setting.
+// The keys of nested tables (and dotted keys) are joined with underscores, so
+// [s3] bucket = "b" and s3.bucket = "b" are the same as s3_bucket = "b".
+func flattenConfig(values map[string]string, prefix string, table map[string]any) error {
+	for name, v := range table {
+		key := configKey(prefix + name)
+		if nested, ok := v.(map[string]any); ok {
+			if err := flattenConfig(values, key+"_", nested); err != nil {
+				return err
+			}
+			continue
+		}
+		value, err := configValue(v)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		if _, ok := values[key]; ok {
+			return fmt.Errorf("%s is set more than once", key)
+		}
+		values[key] = value
+	}
+	return nil
+}
+
+// configKey normalizes a config file key to its environment variable name.
+func configKey(key string) string {
+	return strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+}
+
+// configValue converts a TOML value into the string form an environment
+// variable would have. Arrays are joined with commas.
+func configValue(v any) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case time.Time:
+		return v.Format(time.RFC3339Nano), nil
+	case []any:
+		elems := make([]string, 0, len(v))
+		for _, elem := range v {
+			value, err := configValue(elem)
+			if err != nil {
+				return "", err
+			}
+			elems = append(elems, value)
+		}
+		return strings.Join(elems, ","), nil
+	default:
+		return "", fmt.Errorf("unsupported value %v, only strings, numbers, booleans, datetimes and arrays of them are supported", v)
+	}
+}
+
+// profileNames returns the names of all profiles, sorted.
+func (c *configFile) profileNames() []string {
+	names := make([]string, 0, len(c.profiles))
+	for name := range c.profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// settingCandidate is a value for a setting from one source.
+type settingCandidate struct {
+	value  string
+	source string
+}
+
+// settingCandidates returns the values set for a setting, highest precedence
+// first: the GOBUILDCACHE_ prefixed environment variable, the unprefixed
+// environment variable, the selected config file profile and the config file's
+// top-level values. Flags are applied on top of these when they are parsed.
+func settingCandidates(key string) []settingCandidate {
+	var candidates []settingCandidate
+	for _, envVar := range []string{"GOBUILDCACHE_" + key, key} {
+		if value := os.Getenv(envVar); value != "" {
+			candidates = append(candidates, settingCandidate{value, "env " + envVar})
+		}
+	}
+	if c := activeConfig; c != nil {
+		if value, ok := c.profiles[c.profile][key]; ok && c.profile != "" {
+			candidates = append(candidates, settingCandidate{value, fmt.Sprintf("config %s [profiles.%s]", c.path, c.profile)})
+		}
+		if value, ok := c.values[key]; ok {
+			candidates = append(candidates, settingCandidate{value, "config " + c.path})
+		}
+	}
+	return candidates
+}
+
+// resolveSetting returns the value of the highest precedence candidate that
+// parses, falling back to defaultValue, and records where it came from.
+func resolveSetting[T any](key string, defaultValue T, parse func(string) (T, bool)) T {
+	for _, candidate := range settingCandidates(key) {
+		if value, ok := parse(candidate.value); ok {
+			recordSetting(key, candidate.value, candidate.source)
+			return value
+		}
+	}
+	recordSetting(key, fmt.Sprint(defaultValue), "default")
+	return defaultValue
+}
+
+// resolvedSetting is the effective value of a setting and where it came from.
+type resolvedSetting struct {
+	Key    string
+	Value  string
+	Source string
+}
+
+var (
+	resolvedSettingsMu sync.Mutex
+	resolvedSettings   = make(map[string]resolvedSetting)
+)
+
+func recordSetting(key, value, source string) {
+	resolvedSettingsMu.Lock()
+	defer resolvedSettingsMu.Unlock()
+	resolvedSettings[key] = resolvedSetting{Key: key, Value: value, Source: source}
+}
+
+// effectiveSettings returns every setting resolved so far, sorted by key.
+func effectiveSettings() []resolvedSetting {
+	resolvedSettingsMu.Lock()
+	defer resolvedSettingsMu.Unlock()
+	settings := make([]resolvedSetting, 0, len(resolvedSettings))
+	for _, s := range resolvedSettings {
+		settings = append(settings, s)
+	}
+	sort.Slice(settings, func(i, j int) bool { return settings[i].Key < settings[j].Key })
+	return settings
+}
+
+// flagEnvKey extracts the setting a flag is bound to from the "(env: KEY)" that
+// every flag's usage ends with.
+var flagEnvKey = regexp.MustCompile(`\(env: ([A-Z0-9_]+)\)$`)
+
+// recordFlagSettings records the flags that were set on the command line as the
+// source of their settings, since they take precedence over everything else.
+func recordFlagSettings(fs *flag.FlagSet) {
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "config" || f.Name == "profile" {
+			return
+		}
+		if m := flagEnvKey.FindStringSubmatch(f.Usage); m != nil {
+			recordSetting(m[1], f.Value.String(), "flag -"+f.Name)
+		}
+	})
+}
+
+// unusedConfigKeys returns the keys in the config file that don't correspond
+// to any resolved setting, which are most likely typos.
+func unusedConfigKeys() []string {
+	c := activeConfig
+	if c == nil {
+		return nil
+	}
+	resolvedSettingsMu.Lock()
+	defer resolvedSettingsMu.Unlock()
+	seen := make(map[string]bool)
+	var unused []string
+	for _, section := range append([]map[string]string{c.values}, mapValues(c.profiles)...) {
+		for key := range section {
+			if _, ok := resolvedSettings[key]; !ok && !seen[key] {
+				seen[key] = true
+				unused = append(unused, key)
+			}
+		}
+	}
+	sort.Strings(unused)
+	return unused
+}
+
+func mapValues(m map[string]map[string]string) []map[string]string {
+	values := make([]map[string]string, 0, len(m))
+	for _, v := range m {
+		values = append(values, v)
+	}
+	return values
+}
+
+// isSecretSetting reports whether a setting's value must not be printed.
+func isSecretSetting(key string) bool {
+	switch key {
+	case "ENCRYPTION_KEY", "SIGNING_KEY", "TRUSTED_KEYS":
+		return true
+	}
+	return strings.Contains(key, "SECRET") || strings.Contains(key, "TOKEN") || strings.Contains(key, "PASSWORD")
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	cfg, err := parseConfig(strings.NewReader(`
+# Shared settings
+profile = "ci"
+backend_type = "s3"
+s3-bucket = 'my-bucket' # trailing comment
+S3_PREFIX = "team#1/"
+compression = false
+error_rate = 0.25
+read_namespaces = ["main", "release/1.0",]
+
+[profiles.ci]
+write_namespace = "main"
+async_queue_max_bytes = "1GB"
+
+[profiles."local"]
+backend_type = "disk"
+`))
+	if err != nil {
+		t.Fatalf("parseConfig failed: %v", err)
+	}
+
+	if cfg.profile != "ci" {
+		t.Errorf("default profile = %q, want ci", cfg.profile)
+	}
+	wantValues := map[string]string{
+		"BACKEND_TYPE":    "s3",
+		"S3_BUCKET":       "my-bucket",
+		"S3_PREFIX":       "team#1/",
+		"COMPRESSION":     "false",
+		"ERROR_RATE":      "0.25",
+		"READ_NAMESPACES": "main,release/1.0",
+	}
+	if len(cfg.values) != len(wantValues) {
+		t.Errorf("got %d top-level values, want %d: %v", len(cfg.values), len(wantValues), cfg.values)
+	}
+	for key, want := range wantValues {
+		if got := cfg.values[key]; got != want {
+			t.Errorf("%s = %q, want %q", key, got, want)
+		}
+	}
+	if got := cfg.profiles["ci"]["ASYNC_QUEUE_MAX_BYTES"]; got != "1GB" {
+		t.Errorf("ci ASYNC_QUEUE_MAX_BYTES = %q, want 1GB", got)
+	}
+	if got := cfg.profiles["local"]["BACKEND_TYPE"]; got != "disk" {
+		t.Errorf("local BACKEND_TYPE = %q, want disk", got)
+	}
+}
+
+func TestParseConfig_TOML(t *testing.T) {
+	cfg, err := parseConfig(strings.NewReader(`
+read_namespaces = [
+  "main",   # trailing comments and commas are fine
+  "release",
+]
+s3 = { bucket = "inline", prefix = "cache/" }
+circuit_breaker.failures = 3
+started = 2024-01-02T03:04:05Z
+
+[profiles.ci.async]
+queue_max_bytes = "1GB"
+`))
+	if err != nil {
+		t.Fatalf("parseConfig failed: %v", err)
+	}
+	for key, want := range map[string]string{
+		"READ_NAMESPACES":          "main,release",
+		"S3_BUCKET":                "inline",
+		"S3_PREFIX":                "cache/",
+		"CIRCUIT_BREAKER_FAILURES": "3",
+		"STARTED":                  "2024-01-02T03:04:05Z",
+	} {
+		if got := cfg.values[key]; got != want {
+			t.Errorf("%s = %q, want %q", key, got, want)
+		}
+	}
+	if got := cfg.profiles["ci"]["ASYNC_QUEUE_MAX_BYTES"]; got != "1GB" {
+		t.Errorf("ci ASYNC_QUEUE_MAX_BYTES = %q, want 1GB", got)
+	}
+}
+
+func TestParseConfig_Errors(t *testing.T) {
+	for name, input := range map[string]string{
+		"unquoted string":    `s3_bucket = my-bucket`,
+		"missing value":      `s3_bucket =`,
+		"missing equals":     `s3_bucket`,
+		"duplicate key":      "debug = true\ndebug = false",
+		"duplicate setting":  "s3_bucket = \"a\"\n[s3]\nbucket = \"b\"",
+		"duplicate profile":  "[profiles.ci]\n[profiles.ci]",
+		"unterminated":       `s3_bucket = "my-bucket`,
+		"profile not string": `profile = 1`,
+		"profiles not table": `profiles = "ci"`,
+		"array of tables":    "[[s3]]\nbucket = \"a\"",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := parseConfig(strings.NewReader(input)); err == nil {
+				t.Errorf("expected an error parsing %q", input)
+			}
+		})
+	}
+}
+
+func TestFlagArg(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-config", "a.toml"}, "a.toml"},
+		{[]string{"--config=b.toml", "-debug"}, "b.toml"},
+		{[]string{"-debug", "-config=c.toml"}, "c.toml"},
+		{[]string{"-configx=d.toml"}, ""},
+		{[]string{"--", "-config=e.toml"}, ""},
+		{[]string{"-config"}, ""},
+	}
+	for _, tt := range tests {
+		if got := flagArg(tt.args, "config"); got != tt.want {
+			t.Errorf("flagArg(%q) = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+// useConfig loads a config file with the given contents and profile for the
+// duration of a test.
+func useConfig(t *testing.T, contents, profile string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), configFileName)
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(configEnvVar, "")
+	t.Setenv(profileEnvVar, "")
+	t.Cleanup(func() { activeConfig = nil })
+
+	args := []string{"-config", path}
+	if profile != "" {
+		args = append(args, "-profile", profile)
+	}
+	if err := loadConfig(args); err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	useConfig(t, `
+test_string = "top"
+test_int = 1
+test_bytes = "1MB"
+test_bool = true
+
+[profiles.ci]
+test_string = "profile"
+test_int = "not-a-number"
+`, "ci")
+	for _, key := range []string{"TEST_STRING", "TEST_INT", "TEST_BYTES", "TEST_BOOL"} {
+		t.Setenv(key, "")
+		t.Setenv("GOBUILDCACHE_"+key, "")
+	}
+
+	if got := getEnvWithPrefix("TEST_STRING", "default"); got != "profile" {
+		t.Errorf("profile value: got %q, want profile", got)
+	}
+	// Invalid values fall through to the next source, like they do for env vars.
+	if got := getEnvIntWithPrefix("TEST_INT", 0); got != 1 {
+		t.Errorf("invalid profile value: got %d, want 1", got)
+	}
+	if got := getEnvBytesWithPrefix("TEST_BYTES", 0); got != 1<<20 {
+		t.Errorf("top-level value: got %d, want %d", got, 1<<20)
+	}
+	if got := getEnvWithPrefix("TEST_MISSING", "default"); got != "default" {
+		t.Errorf("missing value: got %q, want default", got)
+	}
+
+	t.Setenv("TEST_STRING", "unprefixed")
+	if got := getEnvWithPrefix("TEST_STRING", "default"); got != "unprefixed" {
+		t.Errorf("env should override the config file: got %q", got)
+	}
+	t.Setenv("GOBUILDCACHE_TEST_BOOL", "false")
+	if got := getEnvBoolWithPrefix("TEST_BOOL", true); got {
+		t.Errorf("prefixed env should override the config file")
+	}
+
+	sources := make(map[string]string)
+	for _, s := range effectiveSettings() {
+		sources[s.Key] = s.Source
+	}
+	for key, want := range map[string]string{
+		"TEST_STRING":  "env TEST_STRING",
+		"TEST_BOOL":    "env GOBUILDCACHE_TEST_BOOL",
+		"TEST_INT":     "config " + activeConfig.path,
+		"TEST_BYTES":   "config " + activeConfig.path,
+		"TEST_MISSING": "default",
+	} {
+		if sources[key] != want {
+			t.Errorf("source of %s = %q, want %q", key, sources[key], want)
+		}
+	}
+}
+
+func TestLoadConfig_UnknownProfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), configFileName)
+	if err := os.WriteFile(path, []byte("[profiles.ci]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { activeConfig = nil })
+	if err := loadConfig([]string{"-config=" + path, "-profile=release"}); err == nil {
+		t.Fatal("expected an error for an unknown profile")
+	}
+}
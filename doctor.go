@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/richardartoul/gobuildcache/pkg/backends"
+	"github.com/richardartoul/gobuildcache/pkg/metrics"
+)
+
+// minRecommendedFreeSpace is the free space below which doctor warns about the
+// local cache directory. Build caches of large repositories easily reach
+// several GB.
+const minRecommendedFreeSpace = 10 << 30
+
+// Latency thresholds above which doctor recommends changes.
+const (
+	highGetLatencyMs = 50
+	highPutLatencyMs = 200
+)
+
+// checkLocalDir checks that dir can be created and written to.
+func checkLocalDir(check, dir string) backends.Diagnostic {
+	d := backends.Diagnostic{Check: check, Status: backends.DiagnosticOK, Detail: dir}
+	err := os.MkdirAll(dir, 0755)
+	if err == nil {
+		var f *os.File
+		f, err = os.CreateTemp(dir, ".gobuildcache-doctor-*")
+		if err == nil {
+			f.Close()
+			err = os.Remove(f.Name())
+		}
+	}
+	if err != nil {
+		d.Status = backends.DiagnosticFailed
+		d.Detail = err.Error()
+		d.Recommendation = fmt.Sprintf("Make %s writable by the user running the build, or point the setting at a different directory", dir)
+	}
+	return d
+}
+
+// checkFreeSpace checks that the file system holding dir has room for the
+// local cache.
+func checkFreeSpace(dir string, maxSize int64) backends.Diagnostic {
+	const check = "cache dir free space"
+	free, err := freeDiskSpace(dir)
+	if err != nil {
+		return backends.Diagnostic{Check: check, Status: backends.DiagnosticSkipped, Detail: err.Error()}
+	}
+
+	d := backends.Diagnostic{Check: check, Status: backends.DiagnosticOK, Detail: formatBytes(free) + " free"}
+	switch {
+	case maxSize > 0 && free < maxSize:
+		d.Status = backends.DiagnosticWarning
+		d.Recommendation = fmt.Sprintf("The local cache may grow to %s (LOCAL_MAX_SIZE) but only %s is free, lower LOCAL_MAX_SIZE or use a larger disk",
+			formatBytes(maxSize), formatBytes(free))
+	case maxSize == 0 && free < minRecommendedFreeSpace:
+		d.Status = backends.DiagnosticWarning
+		d.Recommendation = fmt.Sprintf("Only %s is free, use a larger disk or set LOCAL_MAX_SIZE so the local cache doesn't fill it up", formatBytes(free))
+	}
+	return d
+}
+
+// measureLatency PUTs and then GETs samples random objects of each size through
+// backend, recording their latencies in tracker under "PUT <size>" and
+// "GET <size>". The objects are deleted afterwards if the backend supports it.
+func measureLatency(backend backends.Backend, sizes []int64, samples int, tracker *metrics.LatencyTracker) error {
+	var actionIDs [][]byte
+	defer func() {
+		if deleter, ok := backend.(backends.Deleter); ok && len(actionIDs) > 0 {
+			deleter.Delete(actionIDs)
+		}
+	}()
+
+	for _, size := range sizes {
+		body := make([]byte, size)
+		rand.Read(body)
+		label := formatBytes(size)
+
+		for i := 0; i < samples; i++ {
+			actionID := make([]byte, 32)
+			rand.Read(actionID)
+
+			start := time.Now()
+			if err := backend.Put(actionID, actionID, bytes.NewReader(body), size); err != nil {
+				return fmt.Errorf("PUT of %s object failed: %w", label, err)
+			}
+			tracker.Record("PUT "+label, time.Since(start))
+			actionIDs = append(actionIDs, actionID)
+
+			start = time.Now()
+			_, rc, _, _, miss, err := backend.Get(actionID)
+			if err != nil {
+				return fmt.Errorf("GET of %s object failed: %w", label, err)
+			}
+			if miss {
+				return fmt.Errorf("GET of %s object missed right after it was written", label)
+			}
+			n, err := io.Copy(io.Discard, rc)
+			rc.Close()
+			if err != nil {
+				return fmt.Errorf("GET of %s object failed: %w", label, err)
+			}
+			if n != size {
+				return fmt.Errorf("GET of %s object returned %d bytes", label, n)
+			}
+			tracker.Record("GET "+label, time.Since(start))
+		}
+	}
+	return nil
+}
+
+// latencyRecommendations suggests changes based on measured latencies.
+func latencyRecommendations(tracker *metrics.LatencyTracker, smallest string, async bool) []string {
+	var recommendations []string
+	if stats, err := tracker.GetStats("GET " + smallest); err == nil && stats.P50 > highGetLatencyMs {
+		recommendations = append(recommendations, fmt.Sprintf(
+			"Median GET latency for small objects is %.0fms, run builds in the same region/zone as the bucket, or use S3 Express One Zone or GCS Anywhere Cache",
+			stats.P50))
+	}
+	if stats, err := tracker.GetStats("PUT " + smallest); err == nil && stats.P50 > highPutLatencyMs && !async {
+		recommendations = append(recommendations, fmt.Sprintf(
+			"Median PUT latency for small objects is %.0fms, enable ASYNC_BACKEND so uploads don't block builds",
+			stats.P50))
+	}
+	return recommendations
+}
+
+// backendConnectionRecommendation suggests a fix when the backend can't be created.
+func backendConnectionRecommendation(err error) string {
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "is required"):
+		return "Set the bucket for the configured backend"
+	case strings.Contains(msg, "Invalid region"), strings.Contains(msg, "Missing Region"):
+		return "No AWS region is configured, set GOBUILDCACHE_AWS_REGION to the bucket's region"
+	case strings.Contains(msg, "StatusCode: 301"), strings.Contains(msg, "PermanentRedirect"):
+		return "The bucket is in a different region, set GOBUILDCACHE_AWS_REGION to the bucket's region"
+	case strings.Contains(msg, "StatusCode: 403"), strings.Contains(msg, "AccessDenied"), strings.Contains(msg, "Forbidden"):
+		return "The credentials can't access the bucket, check them and the bucket policy (see the README's Credentials Permissions)"
+	case strings.Contains(msg, "StatusCode: 404"), strings.Contains(msg, "NotFound"), strings.Contains(msg, "doesn't exist"):
+		return "Check that the bucket exists and, for S3, that GOBUILDCACHE_AWS_REGION is its region"
+	case strings.Contains(msg, "credentials"):
+		return "Configure credentials for the backend (see the README's Credentials Permissions)"
+	default:
+		return ""
+	}
+}
+
+// printDiagnostics prints a section of diagnostics and returns their
+// recommendations and whether any failed.
+func printDiagnostics(w io.Writer, title string, diagnostics []backends.Diagnostic) (recommendations []string, failed bool) {
+	fmt.Fprintf(w, "%s:\n", title)
+	for _, d := range diagnostics {
+		status := "[" + string(d.Status) + "]"
+		if d.Detail != "" {
+			fmt.Fprintf(w, "  %-10s %-26s %s\n", status, d.Check, d.Detail)
+		} else {
+			fmt.Fprintf(w, "  %-10s %s\n", status, d.Check)
+		}
+		if d.Recommendation != "" {
+			recommendations = append(recommendations, d.Recommendation)
+		}
+		failed = failed || d.Status == backends.DiagnosticFailed
+	}
+	fmt.Fprintln(w)
+	return recommendations, failed
+}
+
+// localDiagnostics runs the checks of the local cache and lock directories.
+func localDiagnostics(cacheDir, lockType, lockDir string, maxSize int64) []backends.Diagnostic {
+	diagnostics := []backends.Diagnostic{
+		checkLocalDir("cache dir writable", cacheDir),
+		checkFreeSpace(cacheDir, maxSize),
+	}
+	switch strings.ToLower(lockType) {
+	case "fslock", "fs":
+		diagnostics = append(diagnostics, checkLocalDir("lock dir writable", lockDir))
+	default:
+		diagnostics = append(diagnostics, backends.Diagnostic{
+			Check:  "lock dir writable",
+			Status: backends.DiagnosticSkipped,
+			Detail: "lock type is " + lockType,
+		})
+	}
+	return diagnostics
+}
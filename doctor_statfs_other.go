@@ -0,0 +1,10 @@
+//go:build !(linux || darwin)
+
+package main
+
+import "errors"
+
+// freeDiskSpace is not supported on this platform.
+func freeDiskSpace(path string) (int64, error) {
+	return 0, errors.New("checking free space is not supported on this platform")
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/richardartoul/gobuildcache/pkg/backends"
+	"github.com/richardartoul/gobuildcache/pkg/metrics"
+)
+
+// deletingBackend is a recordingBackend that supports deleting entries.
+type deletingBackend struct {
+	*recordingBackend
+}
+
+func (d deletingBackend) Delete(actionIDs [][]byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, actionID := range actionIDs {
+		delete(d.puts, string(actionID))
+	}
+	return nil
+}
+
+func TestMeasureLatency_RecordsAndCleansUp(t *testing.T) {
+	backend := deletingBackend{newRecordingBackend()}
+	tracker := metrics.NewLatencyTracker(0.01)
+
+	if err := measureLatency(backend, []int64{1024, 64 << 10}, 3, tracker); err != nil {
+		t.Fatalf("measureLatency failed: %v", err)
+	}
+	for _, op := range []string{"PUT 1.00 KB", "GET 1.00 KB", "PUT 64.00 KB", "GET 64.00 KB"} {
+		stats, err := tracker.GetStats(op)
+		if err != nil {
+			t.Fatalf("no latency recorded for %s: %v", op, err)
+		}
+		if stats.Count != 3 {
+			t.Errorf("%s: recorded %d samples, want 3", op, stats.Count)
+		}
+	}
+	if len(backend.puts) != 0 {
+		t.Errorf("%d probe objects were left in the backend", len(backend.puts))
+	}
+}
+
+func TestMeasureLatency_ReportsBackendErrors(t *testing.T) {
+	backend := newRecordingBackend()
+	backend.failing = true
+	if err := measureLatency(backend, []int64{1024}, 1, metrics.NewLatencyTracker(0.01)); err == nil {
+		t.Fatal("expected an error from a failing backend")
+	}
+}
+
+func TestLocalDiagnostics(t *testing.T) {
+	dir := t.TempDir()
+	// A directory can't be created under a regular file, even by root.
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	diagnostics := localDiagnostics(filepath.Join(dir, "cache"), "fslock", filepath.Join(file, "locks"), 0)
+	statuses := make(map[string]backends.DiagnosticStatus)
+	for _, d := range diagnostics {
+		statuses[d.Check] = d.Status
+	}
+	if statuses["cache dir writable"] != backends.DiagnosticOK {
+		t.Errorf("cache dir writable: got %s, want ok", statuses["cache dir writable"])
+	}
+	if statuses["lock dir writable"] != backends.DiagnosticFailed {
+		t.Errorf("lock dir writable: got %s, want failed", statuses["lock dir writable"])
+	}
+}
+
+func TestCheckFreeSpace_WarnsWhenMaxSizeExceedsFreeSpace(t *testing.T) {
+	d := checkFreeSpace(t.TempDir(), 1<<62)
+	if d.Status == backends.DiagnosticSkipped {
+		t.Skip(d.Detail)
+	}
+	if d.Status != backends.DiagnosticWarning || d.Recommendation == "" {
+		t.Errorf("got %s (%q), want a warning with a recommendation", d.Status, d.Recommendation)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io"
+	"time"
+
+	"github.com/richardartoul/gobuildcache/pkg/backends"
+	"github.com/richardartoul/gobuildcache/pkg/ratelimit"
+)
+
+// downloadMeter wraps the storage backend and throttles and times backend GETs
+// where bodies are actually downloaded.
+//
+// Encrypted and Signed read the whole body into memory before their Get
+// returns, so above them the download has already happened: limiting the body
+// handleGet gets back would only throttle an in-memory copy, and timing
+// handleGet's call to Get would count the entire download against the GET time
+// budget rather than just the wait for the backend to respond. The meter sits
+// directly above the storage backend so that neither depends on which wrappers
+// are configured.
+//
+// It passes everything through until the server attaches itself with
+// attachDownloadMeter.
+type downloadMeter struct {
+	backends.Backend
+
+	limiter *ratelimit.TokenBucket // nil if downloads aren't limited
+	onWait  func(time.Duration)    // called with every throttled wait
+	onGet   func(time.Duration)    // called with the duration of every Get
+}
+
+// Get retrieves an object from the wrapped backend, reporting how long the
+// backend took to respond and throttling its body.
+func (m *downloadMeter) Get(actionID []byte) ([]byte, io.ReadCloser, int64, *time.Time, bool, error) {
+	start := time.Now()
+	outputID, body, size, putTime, miss, err := m.Backend.Get(actionID)
+	if m.onGet != nil {
+		m.onGet(time.Since(start))
+	}
+	if err != nil || miss || m.limiter == nil {
+		return outputID, body, size, putTime, miss, err
+	}
+	limited := ratelimit.NewReader(body, m.limiter, m.onWait)
+	return outputID, readCloser{Reader: limited, Closer: body}, size, putTime, miss, nil
+}
+
+// Unwrap returns the wrapped backend.
+func (m *downloadMeter) Unwrap() backends.Backend {
+	return m.Backend
+}
+
+// readCloser combines a Reader with the Closer of the body it reads from.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// attachDownloadMeter makes the download meter in the backend stack, if there
+// is one, apply the download limiter and record backend GET time in place of
+// handleGet.
+func (cp *CacheProg) attachDownloadMeter() {
+	meter, ok := backends.Find[*downloadMeter](cp.backend)
+	if !ok {
+		return
+	}
+	meter.limiter = cp.downloadLimiter
+	meter.onWait = func(wait time.Duration) {
+		cp.downloadThrottledTime.Add(int64(wait))
+	}
+	meter.onGet = cp.recordBackendGetTime
+	cp.downloadMeter = meter
+}
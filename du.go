@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/richardartoul/gobuildcache/pkg/backends"
+)
+
+// duListPageSize is the number of objects requested per listing page.
+const duListPageSize = 1000
+
+// Histogram buckets of du reports. Sizes follow the default bench distribution.
+var (
+	duSizeBounds = []int64{1 << 10, 16 << 10, 256 << 10, 4 << 20, 64 << 20}
+	duSizeLabels = []string{"<1KB", "1KB-16KB", "16KB-256KB", "256KB-4MB", "4MB-64MB", ">=64MB"}
+	duAgeBounds  = []time.Duration{time.Hour, 24 * time.Hour, 7 * 24 * time.Hour, 30 * 24 * time.Hour}
+	duAgeLabels  = []string{"<1h", "1h-1d", "1d-7d", "7d-30d", ">=30d"}
+)
+
+// duBucket is one bucket of a histogram.
+type duBucket struct {
+	Label string
+	Count int64
+	Bytes int64
+}
+
+// duStats summarizes a set of cache entries. Ages are computed from put times.
+type duStats struct {
+	Objects int64
+	Bytes   int64
+	Oldest  time.Time `json:",omitzero"`
+	Newest  time.Time `json:",omitzero"`
+	Sizes   []duBucket
+	Ages    []duBucket
+}
+
+func newDuStats() *duStats {
+	s := &duStats{
+		Sizes: make([]duBucket, len(duSizeLabels)),
+		Ages:  make([]duBucket, len(duAgeLabels)+1),
+	}
+	for i, label := range duSizeLabels {
+		s.Sizes[i].Label = label
+	}
+	for i, label := range duAgeLabels {
+		s.Ages[i].Label = label
+	}
+	s.Ages[len(duAgeLabels)].Label = "unknown"
+	return s
+}
+
+// add records an entry of size bytes written at putTime, which may be zero if
+// unknown.
+func (s *duStats) add(size int64, putTime, now time.Time) {
+	s.Objects++
+	s.Bytes += size
+
+	i := sort.Search(len(duSizeBounds), func(i int) bool { return size < duSizeBounds[i] })
+	s.Sizes[i].Count++
+	s.Sizes[i].Bytes += size
+
+	if putTime.IsZero() {
+		i = len(duAgeLabels)
+	} else {
+		age := now.Sub(putTime)
+		i = sort.Search(len(duAgeBounds), func(i int) bool { return age < duAgeBounds[i] })
+		if s.Oldest.IsZero() || putTime.Before(s.Oldest) {
+			s.Oldest = putTime
+		}
+		if putTime.After(s.Newest) {
+			s.Newest = putTime
+		}
+	}
+	s.Ages[i].Count++
+	s.Ages[i].Bytes += size
+}
+
+// duGroup is the usage of one namespace.
+type duGroup struct {
+	Namespace string
+	*duStats
+}
+
+// duRemoteReport is the usage of the backend's prefix. Bytes are stored bytes,
+// i.e. compressed when compression is enabled.
+type duRemoteReport struct {
+	Backend      string
+	Prefix       string
+	Total        *duStats
+	Namespaces   []duGroup
+	Unrecognized *duStats // Objects whose names gobuildcache didn't generate
+}
+
+// duLocalReport is the usage of the local cache directory.
+type duLocalReport struct {
+	Dir        string
+	Total      *duStats // Bytes are the uncompressed sizes of the entries
+	DiskBytes  int64    // Including metadata files
+	StaleFiles int      // Temp files and data files without metadata
+	StaleBytes int64
+}
+
+// duCompression compares the local (uncompressed) and remote (stored) sizes of
+// the entries found in both places, in any namespace.
+type duCompression struct {
+	Entries           int64
+	UncompressedBytes int64
+	StoredBytes       int64
+	Ratio             float64
+}
+
+// duReport is the result of du.
+type duReport struct {
+	Remote      *duRemoteReport `json:",omitempty"`
+	Local       *duLocalReport  `json:",omitempty"`
+	Compression *duCompression  `json:",omitempty"`
+}
+
+// parseBackendKey splits a backend key generated by generateNamespacedBackendKey
+// into its namespace and action ID.
+func parseBackendKey(key []byte) (namespace string, actionID []byte, ok bool) {
+	const idLen = 64 // Hex encoded SHA-256
+	s := string(key)
+	n := len(s) - idLen - len(fileFormatVersion)
+	if n < 0 || s[n:n+len(fileFormatVersion)] != fileFormatVersion {
+		return "", nil, false
+	}
+	actionID, err := hex.DecodeString(s[n+len(fileFormatVersion):])
+	if err != nil {
+		return "", nil, false
+	}
+	return s[:n], actionID, true
+}
+
+// truncateNamespace returns the first depth segments of namespace, or all of
+// them if depth is zero.
+func truncateNamespace(namespace string, depth int) string {
+	if depth <= 0 {
+		return namespace
+	}
+	segments := strings.SplitAfter(namespace, "/")
+	if len(segments) <= depth {
+		return namespace
+	}
+	return strings.Join(segments[:depth], "")
+}
+
+// duLocal scans the local cache directory. It returns the uncompressed sizes of
+// the entries by hex action ID, for duRemote's compression ratio.
+func duLocal(lc *localCache, now time.Time) (*duLocalReport, map[string]int64, error) {
+	entries, stale, err := lc.scan(defaultStaleTmpAge)
+	if err != nil {
+		return nil, nil, err
+	}
+	report := &duLocalReport{Dir: lc.cacheDir, Total: newDuStats(), StaleFiles: len(stale)}
+	sizes := make(map[string]int64, len(entries))
+	for _, entry := range entries {
+		meta, err := lc.readMetadata(entry.actionID)
+		if err != nil {
+			// Removed concurrently, or unreadable and never served.
+			continue
+		}
+		report.Total.add(meta.Size, meta.PutTime, now)
+		report.DiskBytes += entry.size
+		sizes[hex.EncodeToString(entry.actionID)] = meta.Size
+	}
+	for _, path := range stale {
+		if info, err := os.Stat(path); err == nil {
+			report.StaleBytes += info.Size()
+		}
+	}
+	return report, sizes, nil
+}
+
+// duRemote lists the backend's objects, grouping them by namespace truncated to
+// depth segments. Entries also present in localSizes are compared for the
+// compression ratio.
+func duRemote(lister backends.Lister, localSizes map[string]int64, depth int, now time.Time, progress io.Writer) (*duRemoteReport, *duCompression, error) {
+	var (
+		report      = &duRemoteReport{Total: newDuStats(), Unrecognized: newDuStats()}
+		groups      = make(map[string]*duStats)
+		compression = &duCompression{}
+	)
+	err := backends.ListAll(lister, duListPageSize, func(obj backends.ObjectInfo) error {
+		report.Total.add(obj.Size, obj.PutTime, now)
+		if report.Total.Objects%100000 == 0 {
+			fmt.Fprintf(progress, "Listed %d objects...\n", report.Total.Objects)
+		}
+
+		namespace, actionID, ok := parseBackendKey(obj.ActionID)
+		if !ok {
+			report.Unrecognized.add(obj.Size, obj.PutTime, now)
+			return nil
+		}
+		namespace = truncateNamespace(namespace, depth)
+		group, ok := groups[namespace]
+		if !ok {
+			group = newDuStats()
+			groups[namespace] = group
+		}
+		group.add(obj.Size, obj.PutTime, now)
+
+		if size, ok := localSizes[hex.EncodeToString(actionID)]; ok {
+			compression.Entries++
+			compression.UncompressedBytes += size
+			compression.StoredBytes += obj.Size
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for namespace, stats := range groups {
+		report.Namespaces = append(report.Namespaces, duGroup{Namespace: namespace, duStats: stats})
+	}
+	sort.Slice(report.Namespaces, func(i, j int) bool {
+		return report.Namespaces[i].Namespace < report.Namespaces[j].Namespace
+	})
+	if compression.Entries == 0 {
+		return report, nil, nil
+	}
+	if compression.StoredBytes > 0 {
+		compression.Ratio = float64(compression.UncompressedBytes) / float64(compression.StoredBytes)
+	}
+	return report, compression, nil
+}
+
+// printDuReport prints a human-readable du report.
+func printDuReport(w io.Writer, r *duReport) {
+	if r.Remote != nil {
+		fmt.Fprintf(w, "Remote (%s, prefix %q):\n", r.Remote.Backend, r.Remote.Prefix)
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintf(tw, "  NAMESPACE\tOBJECTS\tBYTES\tOLDEST\tNEWEST\t\n")
+		for _, g := range r.Remote.Namespaces {
+			name := g.Namespace
+			if name == "" {
+				name = "(default)"
+			}
+			printDuRow(tw, name, g.duStats)
+		}
+		if r.Remote.Unrecognized.Objects > 0 {
+			printDuRow(tw, "(unrecognized)", r.Remote.Unrecognized)
+		}
+		printDuRow(tw, "total", r.Remote.Total)
+		tw.Flush()
+		printDuHistograms(w, r.Remote.Total)
+		fmt.Fprintln(w)
+	}
+
+	if r.Local != nil {
+		fmt.Fprintf(w, "Local (%s):\n", r.Local.Dir)
+		fmt.Fprintf(w, "  %d entries, %s of data, %s on disk\n",
+			r.Local.Total.Objects, formatBytes(r.Local.Total.Bytes), formatBytes(r.Local.DiskBytes))
+		if r.Local.StaleFiles > 0 {
+			fmt.Fprintf(w, "  %d stale files, %s (removed by trim)\n", r.Local.StaleFiles, formatBytes(r.Local.StaleBytes))
+		}
+		printDuHistograms(w, r.Local.Total)
+		fmt.Fprintln(w)
+	}
+
+	if c := r.Compression; c != nil {
+		fmt.Fprintf(w, "Compression: %d entries found both locally and remotely, %s uncompressed, %s stored (%.2fx)\n",
+			c.Entries, formatBytes(c.UncompressedBytes), formatBytes(c.StoredBytes), c.Ratio)
+	}
+}
+
+func printDuRow(w io.Writer, name string, s *duStats) {
+	fmt.Fprintf(w, "  %s\t%d\t%s\t%s\t%s\t\n", name, s.Objects, formatBytes(s.Bytes), formatDuTime(s.Oldest), formatDuTime(s.Newest))
+}
+
+func printDuHistograms(w io.Writer, s *duStats) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "  SIZE\tOBJECTS\tBYTES\t\tAGE\tOBJECTS\tBYTES\t\n")
+	for i := 0; i < max(len(s.Sizes), len(s.Ages)); i++ {
+		var size, age string
+		if i < len(s.Sizes) {
+			b := s.Sizes[i]
+			size = fmt.Sprintf("  %s\t%d\t%s\t", b.Label, b.Count, formatBytes(b.Bytes))
+		} else {
+			size = "  \t\t\t"
+		}
+		if i < len(s.Ages) {
+			b := s.Ages[i]
+			age = fmt.Sprintf("\t%s\t%d\t%s\t", b.Label, b.Count, formatBytes(b.Bytes))
+		}
+		fmt.Fprintf(tw, "%s%s\n", size, age)
+	}
+	tw.Flush()
+}
+
+func formatDuTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04")
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/gobuildcache/pkg/backends"
+)
+
+// listingBackend is a deletingBackend that lists its objects in one page, sorted
+// by name, with the put and access times recorded by putAt. Foreign objects,
+// whose names gobuildcache didn't generate, are listed without an action ID.
+type listingBackend struct {
+	deletingBackend
+	putTimes    map[string]time.Time
+	accessTimes map[string]time.Time
+	foreign     []backends.ObjectInfo
+}
+
+func newListingBackend() *listingBackend {
+	return &listingBackend{
+		deletingBackend: deletingBackend{newRecordingBackend()},
+		putTimes:        make(map[string]time.Time),
+		accessTimes:     make(map[string]time.Time),
+	}
+}
+
+// putAt stores an object of size bytes under key that was written at putTime and
+// last used at accessTime.
+func (l *listingBackend) putAt(t *testing.T, key string, size int, putTime, accessTime time.Time) {
+	t.Helper()
+	if err := l.Put([]byte(key), []byte("output"), bytes.NewReader(make([]byte, size)), int64(size)); err != nil {
+		t.Fatal(err)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.putTimes[key] = putTime
+	l.accessTimes[key] = accessTime
+}
+
+func (l *listingBackend) List(pageToken string, pageSize int) ([]backends.ObjectInfo, string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	objects := append([]backends.ObjectInfo(nil), l.foreign...)
+	for key, body := range l.puts {
+		objects = append(objects, backends.ObjectInfo{
+			ActionID:   []byte(key),
+			Name:       hex.EncodeToString([]byte(key)),
+			Size:       int64(len(body)),
+			PutTime:    l.putTimes[key],
+			AccessTime: l.accessTimes[key],
+		})
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Name < objects[j].Name })
+	return objects, "", nil
+}
+
+func TestParseBackendKey(t *testing.T) {
+	actionID := bytes.Repeat([]byte{0xab}, 32)
+	for _, namespace := range []string{"", "main/", "quarantine/branches/x/"} {
+		key := []byte(namespace + fileFormatVersion + hex.EncodeToString(actionID))
+		gotNamespace, gotID, ok := parseBackendKey(key)
+		if !ok || gotNamespace != namespace || !bytes.Equal(gotID, actionID) {
+			t.Errorf("parseBackendKey(%q) = %q, %x, %v", key, gotNamespace, gotID, ok)
+		}
+	}
+	for _, key := range []string{"", "v2abcd", "main/v1" + strings.Repeat("ab", 32), "main/v2" + strings.Repeat("zz", 32)} {
+		if _, _, ok := parseBackendKey([]byte(key)); ok {
+			t.Errorf("parseBackendKey(%q) succeeded, want failure", key)
+		}
+	}
+}
+
+func TestTruncateNamespace(t *testing.T) {
+	tests := []struct {
+		namespace string
+		depth     int
+		want      string
+	}{
+		{"branches/feature/", 0, "branches/feature/"},
+		{"branches/feature/", 1, "branches/"},
+		{"branches/feature/", 2, "branches/feature/"},
+		{"branches/feature/", 5, "branches/feature/"},
+		{"", 1, ""},
+	}
+	for _, tt := range tests {
+		if got := truncateNamespace(tt.namespace, tt.depth); got != tt.want {
+			t.Errorf("truncateNamespace(%q, %d) = %q, want %q", tt.namespace, tt.depth, got, tt.want)
+		}
+	}
+}
+
+func TestDuStats_Histograms(t *testing.T) {
+	now := time.Now()
+	s := newDuStats()
+	s.add(100, now.Add(-time.Minute), now)
+	s.add(2<<10, now.Add(-2*time.Hour), now)
+	s.add(100<<20, now.Add(-60*24*time.Hour), now)
+	s.add(1<<10, time.Time{}, now)
+
+	if s.Objects != 4 || s.Bytes != 100+2<<10+100<<20+1<<10 {
+		t.Errorf("got %d objects and %d bytes", s.Objects, s.Bytes)
+	}
+	wantSizes := map[string]int64{"<1KB": 1, "1KB-16KB": 2, ">=64MB": 1}
+	for _, b := range s.Sizes {
+		if b.Count != wantSizes[b.Label] {
+			t.Errorf("size bucket %s has %d objects, want %d", b.Label, b.Count, wantSizes[b.Label])
+		}
+	}
+	wantAges := map[string]int64{"<1h": 1, "1h-1d": 1, ">=30d": 1, "unknown": 1}
+	for _, b := range s.Ages {
+		if b.Count != wantAges[b.Label] {
+			t.Errorf("age bucket %s has %d objects, want %d", b.Label, b.Count, wantAges[b.Label])
+		}
+	}
+	if !s.Oldest.Equal(now.Add(-60*24*time.Hour)) || !s.Newest.Equal(now.Add(-time.Minute)) {
+		t.Errorf("oldest %s and newest %s are wrong", s.Oldest, s.Newest)
+	}
+}
+
+func TestDu_LocalAndRemote(t *testing.T) {
+	now := time.Now()
+	lc, err := newLocalCache(t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := newListingBackend()
+
+	shared := bytes.Repeat([]byte{1}, 32)
+	if _, err := lc.writeWithMetadata(shared, bytes.NewReader(make([]byte, 4000)), localCacheMetadata{OutputID: []byte("output"), Size: 4000, PutTime: now}); err != nil {
+		t.Fatal(err)
+	}
+	put := func(key string, size int) {
+		backend.putAt(t, key, size, now.Add(-2*24*time.Hour), time.Time{})
+	}
+	put("branches/a/"+fileFormatVersion+hex.EncodeToString(shared), 1000)
+	put("branches/b/"+fileFormatVersion+strings.Repeat("02", 32), 500)
+	put(fileFormatVersion+strings.Repeat("03", 32), 10)
+	put("junk", 1)
+
+	local, localSizes, err := duLocal(lc, now)
+	if err != nil {
+		t.Fatalf("duLocal failed: %v", err)
+	}
+	if local.Total.Objects != 1 || local.Total.Bytes != 4000 || local.DiskBytes <= 4000 {
+		t.Errorf("local report = %+v, %+v", local, local.Total)
+	}
+
+	remote, compression, err := duRemote(backend, localSizes, 1, now, io.Discard)
+	if err != nil {
+		t.Fatalf("duRemote failed: %v", err)
+	}
+	if remote.Total.Objects != 4 || remote.Total.Bytes != 1511 || remote.Unrecognized.Objects != 1 {
+		t.Errorf("remote totals = %+v, unrecognized %+v", remote.Total, remote.Unrecognized)
+	}
+	var namespaces []string
+	for _, g := range remote.Namespaces {
+		namespaces = append(namespaces, g.Namespace)
+	}
+	if strings.Join(namespaces, ",") != ",branches/" || remote.Namespaces[1].Objects != 2 {
+		t.Errorf("namespaces = %q, want the default namespace and branches/ with 2 objects", namespaces)
+	}
+	if compression == nil || compression.Entries != 1 || compression.Ratio != 4 {
+		t.Errorf("compression = %+v, want 1 entry with a ratio of 4", compression)
+	}
+
+	var out bytes.Buffer
+	printDuReport(&out, &duReport{Remote: remote, Local: local, Compression: compression})
+	for _, want := range []string{"(default)", "branches/", "(unrecognized)", "4.00x"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("report doesn't contain %q:\n%s", want, out.String())
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/richardartoul/gobuildcache/pkg/backends"
+)
+
+const (
+	// encryptionKeyEnvVar holds encryption keys directly. Unlike other settings it
+	// is only read in its prefixed form, so that an unrelated ENCRYPTION_KEY in
+	// the environment can't silently turn on encryption.
+	encryptionKeyEnvVar = "GOBUILDCACHE_ENCRYPTION_KEY"
+
+	// defaultEncryptionKeyID is the ID of keys specified without one.
+	defaultEncryptionKeyID = "default"
+)
+
+// loadEncryptionKeyring builds the keyring used to encrypt backend objects from
+// the keys in encryptionKeyEnvVar and keyFile. Both contain one key per line (or
+// comma-separated in the environment variable) in the form <key ID>:<base64 key>,
+// or just <base64 key> for a key with ID "default". Lines starting with # are
+// ignored. New objects are encrypted with activeID, or the first key if it's
+// empty. It returns nil if no keys are configured.
+func loadEncryptionKeyring(keyFile, activeID string) (*backends.Keyring, error) {
+	var specs []string
+	if env := os.Getenv(encryptionKeyEnvVar); env != "" {
+		specs = append(specs, strings.FieldsFunc(env, func(r rune) bool {
+			return r == ',' || r == '\n'
+		})...)
+	}
+	if keyFile != "" {
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read encryption key file: %w", err)
+		}
+		specs = append(specs, strings.Split(string(data), "\n")...)
+	}
+
+	keys := make(map[string][]byte)
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" || strings.HasPrefix(spec, "#") {
+			continue
+		}
+		id, encoded, ok := strings.Cut(spec, ":")
+		if !ok {
+			id, encoded = defaultEncryptionKeyID, spec
+		}
+		id, encoded = strings.TrimSpace(id), strings.TrimSpace(encoded)
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key %q: not valid base64", id)
+		}
+		if _, ok := keys[id]; ok {
+			return nil, fmt.Errorf("duplicate encryption key ID %q", id)
+		}
+		keys[id] = key
+		if activeID == "" {
+			activeID = id
+		}
+	}
+
+	if len(keys) == 0 {
+		if activeID != "" {
+			return nil, fmt.Errorf("encryption key ID %q is set but no encryption keys are configured", activeID)
+		}
+		return nil, nil
+	}
+	return backends.NewKeyring(keys, activeID)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadEncryptionKeyring(t *testing.T) {
+	key1 := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("1", 32)))
+	key2 := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("2", 32)))
+
+	t.Setenv(encryptionKeyEnvVar, "")
+	keyring, err := loadEncryptionKeyring("", "")
+	if err != nil || keyring != nil {
+		t.Fatalf("Expected no keyring without keys, got: %v, %v", keyring, err)
+	}
+
+	// A bare key gets the default ID.
+	t.Setenv(encryptionKeyEnvVar, key1)
+	keyring, err = loadEncryptionKeyring("", "")
+	if err != nil {
+		t.Fatalf("loadEncryptionKeyring returned error: %v", err)
+	}
+	if keyring.ActiveKeyID() != defaultEncryptionKeyID {
+		t.Errorf("Expected active key ID %q, got %q", defaultEncryptionKeyID, keyring.ActiveKeyID())
+	}
+
+	// Keys from the environment and a key file are merged, and the first one is
+	// active unless another one is selected.
+	keyFile := filepath.Join(t.TempDir(), "keys")
+	os.WriteFile(keyFile, []byte("# rotated 2026-10\nold:"+key1+"\n"), 0600)
+	t.Setenv(encryptionKeyEnvVar, "new:"+key2)
+	keyring, err = loadEncryptionKeyring(keyFile, "")
+	if err != nil {
+		t.Fatalf("loadEncryptionKeyring returned error: %v", err)
+	}
+	if got := strings.Join(keyring.KeyIDs(), ","); got != "new,old" || keyring.ActiveKeyID() != "new" {
+		t.Errorf("Unexpected keyring: keys %s, active %s", got, keyring.ActiveKeyID())
+	}
+	if keyring, err = loadEncryptionKeyring(keyFile, "old"); err != nil || keyring.ActiveKeyID() != "old" {
+		t.Errorf("Expected selected key to be active, got: %v", err)
+	}
+
+	t.Setenv(encryptionKeyEnvVar, "bad:not-base64!")
+	if _, err := loadEncryptionKeyring("", ""); err == nil {
+		t.Errorf("Expected error for an invalid key")
+	}
+}
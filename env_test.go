@@ -3,6 +3,7 @@ package main
 import (
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestGetEnvWithPrefix(t *testing.T) {
@@ -39,7 +40,7 @@ func TestGetEnvWithPrefix(t *testing.T) {
 			key:          "TEST_KEY",
 			defaultValue: "default",
 			envVars: map[string]string{
-				"TEST_KEY":             "unprefixed_value",
+				"TEST_KEY":              "unprefixed_value",
 				"GOBUILDCACHE_TEST_KEY": "prefixed_value",
 			},
 			expected: "prefixed_value",
@@ -129,7 +130,7 @@ func TestGetEnvBoolWithPrefix(t *testing.T) {
 			key:          "TEST_BOOL",
 			defaultValue: false,
 			envVars: map[string]string{
-				"TEST_BOOL":             "false",
+				"TEST_BOOL":              "false",
 				"GOBUILDCACHE_TEST_BOOL": "true",
 			},
 			expected: true,
@@ -139,7 +140,7 @@ func TestGetEnvBoolWithPrefix(t *testing.T) {
 			key:          "TEST_BOOL",
 			defaultValue: true,
 			envVars: map[string]string{
-				"TEST_BOOL":             "true",
+				"TEST_BOOL":              "true",
 				"GOBUILDCACHE_TEST_BOOL": "false",
 			},
 			expected: false,
@@ -239,7 +240,7 @@ func TestGetEnvFloatWithPrefix(t *testing.T) {
 			key:          "TEST_FLOAT",
 			defaultValue: 0.0,
 			envVars: map[string]string{
-				"TEST_FLOAT":             "0.5",
+				"TEST_FLOAT":              "0.5",
 				"GOBUILDCACHE_TEST_FLOAT": "0.9",
 			},
 			expected: 0.9,
@@ -284,6 +285,127 @@ func TestGetEnvFloatWithPrefix(t *testing.T) {
 	}
 }
 
+func TestGetEnvIntWithPrefix(t *testing.T) {
+	tests := []struct {
+		name         string
+		key          string
+		defaultValue int
+		envVars      map[string]string
+		expected     int
+	}{
+		{
+			name:         "returns default when neither env var is set",
+			key:          "TEST_INT",
+			defaultValue: 5,
+			envVars:      map[string]string{},
+			expected:     5,
+		},
+		{
+			name:         "returns unprefixed value when only unprefixed is set",
+			key:          "TEST_INT",
+			defaultValue: 0,
+			envVars:      map[string]string{"TEST_INT": "10"},
+			expected:     10,
+		},
+		{
+			name:         "prefixed value takes precedence over unprefixed",
+			key:          "TEST_INT",
+			defaultValue: 0,
+			envVars: map[string]string{
+				"TEST_INT":              "10",
+				"GOBUILDCACHE_TEST_INT": "20",
+			},
+			expected: 20,
+		},
+		{
+			name:         "invalid prefixed value falls back to unprefixed",
+			key:          "TEST_INT",
+			defaultValue: 0,
+			envVars: map[string]string{
+				"TEST_INT":              "10",
+				"GOBUILDCACHE_TEST_INT": "not-a-number",
+			},
+			expected: 10,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Clear environment variables (t.Setenv auto-restores on test completion)
+			t.Setenv(tt.key, "")
+			t.Setenv("GOBUILDCACHE_"+tt.key, "")
+			// Set test-specific environment variables
+			for k, v := range tt.envVars {
+				t.Setenv(k, v)
+			}
+
+			result := getEnvIntWithPrefix(tt.key, tt.defaultValue)
+			if result != tt.expected {
+				t.Errorf("getEnvIntWithPrefix(%q, %v) = %v, want %v", tt.key, tt.defaultValue, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestGetEnvDurationWithPrefix(t *testing.T) {
+	tests := []struct {
+		name         string
+		key          string
+		defaultValue time.Duration
+		envVars      map[string]string
+		expected     time.Duration
+	}{
+		{
+			name:         "returns default when neither env var is set",
+			key:          "TEST_DURATION",
+			defaultValue: 30 * time.Second,
+			envVars:      map[string]string{},
+			expected:     30 * time.Second,
+		},
+		{
+			name:         "returns unprefixed value when only unprefixed is set",
+			key:          "TEST_DURATION",
+			defaultValue: 0,
+			envVars:      map[string]string{"TEST_DURATION": "5m"},
+			expected:     5 * time.Minute,
+		},
+		{
+			name:         "prefixed value takes precedence over unprefixed",
+			key:          "TEST_DURATION",
+			defaultValue: 0,
+			envVars: map[string]string{
+				"TEST_DURATION":              "5m",
+				"GOBUILDCACHE_TEST_DURATION": "10s",
+			},
+			expected: 10 * time.Second,
+		},
+		{
+			name:         "invalid value returns default",
+			key:          "TEST_DURATION",
+			defaultValue: time.Second,
+			envVars:      map[string]string{"GOBUILDCACHE_TEST_DURATION": "10"},
+			expected:     time.Second,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Clear environment variables (t.Setenv auto-restores on test completion)
+			t.Setenv(tt.key, "")
+			t.Setenv("GOBUILDCACHE_"+tt.key, "")
+			// Set test-specific environment variables
+			for k, v := range tt.envVars {
+				t.Setenv(k, v)
+			}
+
+			result := getEnvDurationWithPrefix(tt.key, tt.defaultValue)
+			if result != tt.expected {
+				t.Errorf("getEnvDurationWithPrefix(%q, %v) = %v, want %v", tt.key, tt.defaultValue, result, tt.expected)
+			}
+		})
+	}
+}
+
 func TestResolveS3Config(t *testing.T) {
 	// Helper to clear all AWS env vars for a test.
 	clearAWSEnv := func(t *testing.T) {
@@ -396,3 +518,60 @@ func TestResolveS3Config(t *testing.T) {
 		}
 	})
 }
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+		wantErr  bool
+	}{
+		{"0", 0, false},
+		{"1024", 1024, false},
+		{"64KB", 64 * 1024, false},
+		{"512mb", 512 * 1024 * 1024, false},
+		{"1.5GiB", 1536 * 1024 * 1024, false},
+		{"2G", 2 * 1024 * 1024 * 1024, false},
+		{"100 B", 100, false},
+		{"lots", 0, true},
+		{"-1MB", 0, true},
+	}
+
+	for _, tt := range tests {
+		result, err := parseByteSize(tt.input)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseByteSize(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			continue
+		}
+		if result != tt.expected {
+			t.Errorf("parseByteSize(%q) = %d, expected %d", tt.input, result, tt.expected)
+		}
+	}
+}
+
+func TestParseAge(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected time.Duration
+		wantErr  bool
+	}{
+		{"7d", 7 * 24 * time.Hour, false},
+		{"1.5d", 36 * time.Hour, false},
+		{"36h", 36 * time.Hour, false},
+		{"90m", 90 * time.Minute, false},
+		{"0", 0, false},
+		{"d", 0, true},
+		{"-1d", 0, true},
+		{"week", 0, true},
+	}
+
+	for _, tt := range tests {
+		result, err := parseAge(tt.input)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseAge(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			continue
+		}
+		if result != tt.expected {
+			t.Errorf("parseAge(%q) = %s, expected %s", tt.input, result, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/richardartoul/gobuildcache/pkg/backends"
+)
+
+// deleteBatchSize is the number of objects deleted per Delete call, the most S3
+// deletes per request.
+const deleteBatchSize = 1000
+
+// gcOptions configures gc-remote.
+type gcOptions struct {
+	UnusedFor time.Duration // Delete entries unused for at least this long, 0 disables
+	MaxBytes  int64         // Delete the least recently used entries until the rest fit, 0 disables
+	DryRun    bool          // Report what would be deleted without deleting anything
+}
+
+// gcEntry is a cache entry considered by gc-remote.
+type gcEntry struct {
+	key      []byte // Backend key, including the namespace
+	size     int64
+	lastUsed time.Time // Zero if unknown, which sorts first
+}
+
+// objectCount is a number of objects and their stored size.
+type objectCount struct {
+	Objects int64
+	Bytes   int64
+}
+
+func (c *objectCount) add(size int64) {
+	c.Objects++
+	c.Bytes += size
+}
+
+// gcReport is the result of gc-remote.
+type gcReport struct {
+	Backend      string
+	Prefix       string
+	DryRun       bool
+	Entries      objectCount // Cache entries found, before deletion
+	Unrecognized objectCount // Objects whose names gobuildcache didn't generate, never deleted
+	Unused       objectCount // Entries deleted for being unused
+	OverBudget   objectCount // Entries deleted to fit the byte budget
+	Remaining    objectCount // Entries left afterwards
+	Failed       int64       // Entries that may not have been deleted
+	Errors       []string
+	// OldestKept is when the least recently used entry that was kept was last
+	// used.
+	OldestKept time.Time `json:",omitzero"`
+}
+
+// gcLastUsed returns when obj was last used: its access time if the backend
+// tracks it, or else when it was written.
+func gcLastUsed(obj backends.ObjectInfo) time.Time {
+	if !obj.AccessTime.IsZero() {
+		return obj.AccessTime
+	}
+	return obj.PutTime
+}
+
+// planGC returns the entries to delete, least recently used first: every entry
+// unused for opts.UnusedFor, then the least recently used of the others until
+// the rest fit in opts.MaxBytes. It fills in the counts of report.
+func planGC(entries []gcEntry, opts gcOptions, now time.Time, report *gcReport) []gcEntry {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].lastUsed.Before(entries[j].lastUsed) })
+
+	remaining := report.Entries.Bytes
+	i := 0
+	for ; i < len(entries); i++ {
+		e := entries[i]
+		switch {
+		case opts.UnusedFor > 0 && now.Sub(e.lastUsed) >= opts.UnusedFor:
+			report.Unused.add(e.size)
+		case opts.MaxBytes > 0 && remaining > opts.MaxBytes:
+			report.OverBudget.add(e.size)
+		default:
+			report.Remaining = objectCount{Objects: int64(len(entries) - i), Bytes: remaining}
+			report.OldestKept = e.lastUsed
+			return entries[:i]
+		}
+		remaining -= e.size
+	}
+	return entries
+}
+
+// runGC lists the cache entries of lister and deletes the ones planGC selects,
+// in batches of deleteBatchSize.
+func runGC(lister backends.Lister, deleter backends.Deleter, opts gcOptions, now time.Time, progress io.Writer) (*gcReport, error) {
+	if opts.UnusedFor <= 0 && opts.MaxBytes <= 0 {
+		return nil, fmt.Errorf("nothing to do: set an age and/or a byte budget")
+	}
+
+	report := &gcReport{DryRun: opts.DryRun}
+	var entries []gcEntry
+	err := backends.ListAll(lister, duListPageSize, func(obj backends.ObjectInfo) error {
+		if _, _, ok := parseBackendKey(obj.ActionID); !ok {
+			report.Unrecognized.add(obj.Size)
+			return nil
+		}
+		entries = append(entries, gcEntry{key: obj.ActionID, size: obj.Size, lastUsed: gcLastUsed(obj)})
+		report.Entries.add(obj.Size)
+		if report.Entries.Objects%100000 == 0 {
+			fmt.Fprintf(progress, "Listed %d entries...\n", report.Entries.Objects)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backend: %w", err)
+	}
+
+	deletions := planGC(entries, opts, now, report)
+	if opts.DryRun || len(deletions) == 0 {
+		return report, nil
+	}
+
+	fmt.Fprintf(progress, "Deleting %d entries...\n", len(deletions))
+	for start := 0; start < len(deletions); start += deleteBatchSize {
+		batch := deletions[start:min(start+deleteBatchSize, len(deletions))]
+		keys := make([][]byte, len(batch))
+		for i, e := range batch {
+			keys[i] = e.key
+		}
+		if err := deleter.Delete(keys); err != nil {
+			report.Failed += int64(len(batch))
+			report.Errors = append(report.Errors, err.Error())
+			if errors.Is(err, errors.ErrUnsupported) {
+				break
+			}
+		}
+		if done := start + len(batch); done%(10*deleteBatchSize) == 0 {
+			fmt.Fprintf(progress, "Deleted %d/%d entries...\n", done, len(deletions))
+		}
+	}
+	return report, nil
+}
+
+// printGCReport prints a human-readable gc-remote report.
+func printGCReport(w io.Writer, r *gcReport) {
+	verb := "Deleted"
+	if r.DryRun {
+		verb = "Would delete"
+	}
+	fmt.Fprintf(w, "Backend: %s, prefix %q\n", r.Backend, r.Prefix)
+	fmt.Fprintf(w, "Entries: %d (%s)\n", r.Entries.Objects, formatBytes(r.Entries.Bytes))
+	if r.Unrecognized.Objects > 0 {
+		fmt.Fprintf(w, "Unrecognized objects (kept): %d (%s)\n", r.Unrecognized.Objects, formatBytes(r.Unrecognized.Bytes))
+	}
+	fmt.Fprintf(w, "%s unused entries: %d (%s)\n", verb, r.Unused.Objects, formatBytes(r.Unused.Bytes))
+	fmt.Fprintf(w, "%s entries over the budget: %d (%s)\n", verb, r.OverBudget.Objects, formatBytes(r.OverBudget.Bytes))
+	fmt.Fprintf(w, "Remaining: %d entries (%s)", r.Remaining.Objects, formatBytes(r.Remaining.Bytes))
+	if !r.OldestKept.IsZero() {
+		fmt.Fprintf(w, ", least recently used %s", formatDuTime(r.OldestKept))
+	}
+	fmt.Fprintln(w)
+	if r.Failed > 0 {
+		fmt.Fprintf(w, "Failed: %d entries may not have been deleted\n", r.Failed)
+		for _, err := range r.Errors {
+			fmt.Fprintf(w, "  %s\n", err)
+		}
+	}
+}
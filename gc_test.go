@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPlanGC(t *testing.T) {
+	now := time.Now()
+	days := func(n int) time.Time { return now.Add(-time.Duration(n) * 24 * time.Hour) }
+	newEntries := func() []gcEntry {
+		return []gcEntry{
+			{key: []byte("fresh"), size: 100, lastUsed: days(0)},
+			{key: []byte("week"), size: 100, lastUsed: days(8)},
+			{key: []byte("unknown"), size: 100},
+			{key: []byte("month"), size: 100, lastUsed: days(31)},
+			{key: []byte("days"), size: 100, lastUsed: days(3)},
+		}
+	}
+
+	tests := []struct {
+		name       string
+		opts       gcOptions
+		want       string
+		unused     int64
+		overBudget int64
+	}{
+		{"unused", gcOptions{UnusedFor: 7 * 24 * time.Hour}, "unknown,month,week", 3, 0},
+		{"budget", gcOptions{MaxBytes: 250}, "unknown,month,week", 0, 3},
+		{"both", gcOptions{UnusedFor: 30 * 24 * time.Hour, MaxBytes: 150}, "unknown,month,week,days", 2, 2},
+		{"everything", gcOptions{MaxBytes: 1}, "unknown,month,week,days,fresh", 0, 5},
+	}
+	for _, tt := range tests {
+		report := &gcReport{Entries: objectCount{Objects: 5, Bytes: 500}}
+		var got []string
+		for _, e := range planGC(newEntries(), tt.opts, now, report) {
+			got = append(got, string(e.key))
+		}
+		if strings.Join(got, ",") != tt.want {
+			t.Errorf("%s: deleted %v, want %s", tt.name, got, tt.want)
+		}
+		if report.Unused.Objects != tt.unused || report.OverBudget.Objects != tt.overBudget {
+			t.Errorf("%s: %d unused and %d over budget, want %d and %d", tt.name, report.Unused.Objects, report.OverBudget.Objects, tt.unused, tt.overBudget)
+		}
+		if kept := int64(5 - len(got)); report.Remaining.Objects != kept || report.Remaining.Bytes != kept*100 {
+			t.Errorf("%s: remaining = %+v, want %d entries", tt.name, report.Remaining, kept)
+		}
+	}
+}
+
+func TestRunGC(t *testing.T) {
+	now := time.Now()
+	backend := newListingBackend()
+	put := func(key string, size int, lastUsed time.Time) {
+		backend.putAt(t, key, size, time.Time{}, lastUsed)
+	}
+	hot := "main/" + fileFormatVersion + strings.Repeat("01", 32)
+	cold := "main/" + fileFormatVersion + strings.Repeat("02", 32)
+	put(hot, 10, now.Add(-time.Hour))
+	put(cold, 20, now.Add(-10*24*time.Hour))
+	put("junk", 30, now.Add(-100*24*time.Hour))
+
+	opts := gcOptions{UnusedFor: 7 * 24 * time.Hour, DryRun: true}
+	report, err := runGC(backend, backend, opts, now, io.Discard)
+	if err != nil {
+		t.Fatalf("runGC failed: %v", err)
+	}
+	if report.Unused.Objects != 1 || report.Unrecognized.Objects != 1 || len(backend.puts) != 3 {
+		t.Errorf("dry run: report %+v, %d objects left, want 1 unused and nothing deleted", report, len(backend.puts))
+	}
+
+	opts.DryRun = false
+	report, err = runGC(backend, backend, opts, now, io.Discard)
+	if err != nil {
+		t.Fatalf("runGC failed: %v", err)
+	}
+	if report.Unused.Bytes != 20 || report.Remaining.Objects != 1 || report.Failed != 0 {
+		t.Errorf("report = %+v", report)
+	}
+	if _, ok := backend.get([]byte(cold)); ok {
+		t.Error("unused entry wasn't deleted")
+	}
+	for _, key := range []string{hot, "junk"} {
+		if _, ok := backend.get([]byte(key)); !ok {
+			t.Errorf("%s was deleted", key)
+		}
+	}
+
+	var out bytes.Buffer
+	printGCReport(&out, report)
+	if !strings.Contains(out.String(), "Deleted unused entries: 1") {
+		t.Errorf("unexpected report:\n%s", out.String())
+	}
+
+	if _, err := runGC(backend, backend, gcOptions{}, now, io.Discard); err == nil {
+		t.Error("expected an error without an age or budget")
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/richardartoul/gobuildcache/pkg/backends"
+	"github.com/richardartoul/gobuildcache/pkg/locking"
+)
+
+// inspectLayer is a layer of the backend stack that inspect fetches an entry
+// through. The first layer is the storage backend, and every other layer wraps
+// the one before it.
+type inspectLayer struct {
+	name    string
+	backend backends.Backend
+}
+
+// inspectOptions configures inspect.
+type inspectOptions struct {
+	Compressed   bool   // Whether remote entries are LZ4 compressed
+	DumpPath     string // Write the entry's body to this file, "" disables
+	DeleteLocal  bool   // Delete the local entry after inspecting it
+	DeleteRemote bool   // Delete the remote entry after inspecting it
+}
+
+// inspectReport is the result of inspect.
+type inspectReport struct {
+	ActionID   string
+	BackendKey string
+	Local      *inspectLocal
+	Remote     *inspectRemote `json:",omitempty"` // nil without a remote backend
+	DumpedFrom string         `json:",omitempty"` // "local" or "remote"
+	Deleted    []string       `json:",omitempty"` // "local" and/or "remote"
+}
+
+// inspectLocal describes a local cache entry, from its .meta file.
+type inspectLocal struct {
+	Found    bool
+	Path     string
+	OutputID string    `json:",omitempty"`
+	Size     int64     `json:",omitempty"`
+	PutTime  time.Time `json:",omitzero"`
+	LastUsed time.Time `json:",omitzero"` // Modification time of the .meta file
+	Checksum string    `json:",omitempty"`
+	Error    string    `json:",omitempty"` // Why the entry is corrupt
+}
+
+// inspectRemote describes a remote cache entry.
+type inspectRemote struct {
+	Found      bool
+	Name       string    `json:",omitempty"` // Name of the object in the storage system
+	Namespace  string    `json:",omitempty"`
+	StoredSize int64     `json:",omitempty"` // Including envelopes and compression
+	PutTime    time.Time `json:",omitzero"`
+	AccessTime time.Time `json:",omitzero"`
+	// Envelopes are the headers that encryption and signing stored in front of
+	// the body, outermost first.
+	Envelopes        []inspectEnvelope `json:",omitempty"`
+	OutputID         string            `json:",omitempty"`
+	CompressedSize   int64             `json:",omitempty"` // Zero when compression is disabled
+	UncompressedSize int64             `json:",omitempty"`
+	Checksum         string            `json:",omitempty"` // SHA-256 of the uncompressed body
+	// MatchesLocal reports whether the output ID and checksum match the local
+	// entry's, and is nil when there is no valid local entry to compare against.
+	MatchesLocal *bool  `json:",omitempty"`
+	Error        string `json:",omitempty"` // Why the body couldn't be decoded
+}
+
+// inspectEnvelope is an envelope header of a remote entry.
+type inspectEnvelope struct {
+	backends.EnvelopeHeader
+	// Opened reports whether the envelope was decrypted or its signature
+	// verified, which requires the corresponding keys.
+	Opened bool
+}
+
+// inspectEntry describes the local and remote copies of the entry for actionID,
+// then dumps and deletes them as configured. layers is nil without a remote
+// backend.
+func inspectEntry(lc *localCache, locker locking.Group, layers []inspectLayer, namespace string, actionID []byte, opts inspectOptions) (*inspectReport, error) {
+	key := []byte(namespace + fileFormatVersion + hex.EncodeToString(actionID))
+	report := &inspectReport{
+		ActionID:   hex.EncodeToString(actionID),
+		BackendKey: string(key),
+		Local:      inspectLocalEntry(lc, actionID),
+	}
+
+	var remoteBody []byte
+	if len(layers) > 0 {
+		report.Remote, remoteBody = inspectRemoteEntry(layers, key, opts.Compressed)
+		report.Remote.Namespace = namespace
+		if report.Local.Found && report.Local.Error == "" && report.Remote.Checksum != "" {
+			matches := report.Local.OutputID == report.Remote.OutputID && report.Local.Checksum == report.Remote.Checksum
+			report.Remote.MatchesLocal = &matches
+		}
+	}
+
+	if opts.DumpPath != "" {
+		from, err := dumpEntry(lc, actionID, report, remoteBody, opts.DumpPath)
+		if err != nil {
+			return report, err
+		}
+		report.DumpedFrom = from
+	}
+
+	if opts.DeleteLocal && report.Local.Found {
+		_, err := locker.DoWithLock(hex.EncodeToString(actionID), func() (interface{}, error) {
+			return nil, lc.remove(actionID)
+		})
+		if err != nil {
+			return report, fmt.Errorf("failed to delete local entry: %w", err)
+		}
+		report.Deleted = append(report.Deleted, "local")
+	}
+	if opts.DeleteRemote && report.Remote != nil && report.Remote.Found {
+		deleter, ok := backends.Find[backends.Deleter](layers[0].backend)
+		if !ok {
+			return report, errors.New("the backend doesn't support deleting objects")
+		}
+		if err := deleter.Delete([][]byte{key}); err != nil {
+			return report, fmt.Errorf("failed to delete remote entry: %w", err)
+		}
+		report.Deleted = append(report.Deleted, "remote")
+	}
+	return report, nil
+}
+
+// inspectLocalEntry reads the metadata of a local entry and verifies its data
+// file against it.
+func inspectLocalEntry(lc *localCache, actionID []byte) *inspectLocal {
+	local := &inspectLocal{Path: lc.actionIDToPath(actionID)}
+	meta, err := lc.readMetadata(actionID)
+	if errors.Is(err, os.ErrNotExist) {
+		if _, statErr := os.Stat(local.Path); statErr == nil {
+			local.Found = true
+			local.Error = "data file exists but its metadata is missing"
+		}
+		return local
+	}
+	local.Found = true
+	if err != nil {
+		local.Error = err.Error()
+		return local
+	}
+
+	local.OutputID = hex.EncodeToString(meta.OutputID)
+	local.Size = meta.Size
+	local.PutTime = meta.PutTime
+	local.Checksum = hex.EncodeToString(meta.Checksum)
+	if info, err := os.Stat(lc.metadataPath(actionID)); err == nil {
+		local.LastUsed = info.ModTime()
+	}
+	if err := lc.verifyEntry(actionID, meta, localVerifyChecksum); err != nil {
+		local.Error = err.Error()
+	}
+	return local
+}
+
+// inspectRemoteEntry fetches the remote entry stored under key through every
+// layer, recording the envelope each layer sees, and returns its description
+// along with the uncompressed body, which is nil if it couldn't be decoded.
+// Every layer downloads the object again, which is fine for a single entry.
+func inspectRemoteEntry(layers []inspectLayer, key []byte, compressed bool) (*inspectRemote, []byte) {
+	remote := &inspectRemote{}
+	if stater, ok := backends.Find[backends.Stater](layers[0].backend); ok {
+		info, miss, err := stater.Stat(key)
+		switch {
+		case err != nil && !errors.Is(err, errors.ErrUnsupported):
+			remote.Error = fmt.Sprintf("failed to stat object: %v", err)
+			return remote, nil
+		case err == nil && !miss:
+			remote.Found = true
+			remote.Name = info.Name
+			remote.StoredSize = info.Size
+			remote.PutTime = info.PutTime
+			remote.AccessTime = info.AccessTime
+		}
+	}
+
+	var outputID, data []byte
+	for i, layer := range layers {
+		id, body, _, putTime, miss, err := layer.backend.Get(key)
+		if err != nil {
+			remote.Error = fmt.Sprintf("%s: failed to get object: %v", layer.name, err)
+			return remote, nil
+		}
+		if miss {
+			if i > 0 {
+				remote.Error = fmt.Sprintf("%s: the object was rejected, see the warning above", layer.name)
+			}
+			return remote, nil
+		}
+		outputID = id
+		data, err = io.ReadAll(body)
+		body.Close()
+		if err != nil {
+			remote.Error = fmt.Sprintf("%s: failed to read object: %v", layer.name, err)
+			return remote, nil
+		}
+
+		if i == 0 {
+			remote.Found = true
+			if remote.StoredSize == 0 {
+				remote.StoredSize = int64(len(data))
+			}
+			if remote.PutTime.IsZero() && putTime != nil {
+				remote.PutTime = *putTime
+			}
+		} else if n := len(remote.Envelopes); n > 0 && !remote.Envelopes[n-1].Opened {
+			// This layer removed the envelope the layer below saw.
+			remote.Envelopes[n-1].Opened = true
+		}
+		if header, ok := backends.ParseEnvelopeHeader(data); ok {
+			remote.Envelopes = append(remote.Envelopes, inspectEnvelope{EnvelopeHeader: header})
+		}
+	}
+
+	// An envelope the configured layers couldn't open is still in front of the
+	// body. A signature can be skipped without its key, ciphertext can't.
+	if n := len(remote.Envelopes); n > 0 && !remote.Envelopes[n-1].Opened {
+		header := remote.Envelopes[n-1].EnvelopeHeader
+		if header.Type == backends.EnvelopeEncrypted {
+			remote.Error = fmt.Sprintf("the object is encrypted with key %q, configure the encryption keys to decode it", header.KeyID)
+			return remote, nil
+		}
+		data = data[header.Size:]
+	}
+
+	remote.OutputID = hex.EncodeToString(outputID)
+	if compressed && len(data) > 0 {
+		remote.CompressedSize = int64(len(data))
+		decompressed, err := decompressData(data)
+		if err != nil {
+			remote.Error = fmt.Sprintf("failed to decompress body: %v", err)
+			return remote, nil
+		}
+		data = decompressed
+	}
+	checksum := sha256.Sum256(data)
+	remote.UncompressedSize = int64(len(data))
+	remote.Checksum = hex.EncodeToString(checksum[:])
+	return remote, data
+}
+
+// dumpEntry writes the body of the entry to path: the remote body if it could be
+// decoded, or else the local one if it's valid. It returns where the body came
+// from.
+func dumpEntry(lc *localCache, actionID []byte, report *inspectReport, remoteBody []byte, path string) (string, error) {
+	if report.Remote != nil && report.Remote.Checksum != "" {
+		if err := os.WriteFile(path, remoteBody, 0644); err != nil {
+			return "", fmt.Errorf("failed to dump body: %w", err)
+		}
+		return "remote", nil
+	}
+	if !report.Local.Found || report.Local.Error != "" {
+		return "", errors.New("no valid copy of the entry to dump")
+	}
+	data, err := os.ReadFile(lc.actionIDToPath(actionID))
+	if err != nil {
+		return "", fmt.Errorf("failed to read local entry: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return "", fmt.Errorf("failed to dump body: %w", err)
+	}
+	return "local", nil
+}
+
+// parseInspectTarget parses the argument of inspect, which is either a hex
+// action ID, or a backend key (e.g. main/v2<action ID>) whose namespace then
+// overrides namespace.
+func parseInspectTarget(arg, namespace string) (actionID []byte, _ string, err error) {
+	arg = strings.TrimSpace(arg)
+	if keyNamespace, id, ok := parseBackendKey([]byte(arg)); ok {
+		return id, keyNamespace, nil
+	}
+	actionID, err = hex.DecodeString(arg)
+	if err != nil || len(actionID) == 0 {
+		return nil, "", fmt.Errorf("invalid action ID: %q", arg)
+	}
+	return actionID, namespace, nil
+}
+
+// printInspectReport prints a human-readable inspect report.
+func printInspectReport(w io.Writer, r *inspectReport) {
+	fmt.Fprintf(w, "Action ID:   %s\n", r.ActionID)
+	fmt.Fprintf(w, "Backend key: %s\n", r.BackendKey)
+
+	l := r.Local
+	fmt.Fprintf(w, "\nLocal entry: %s\n", l.Path)
+	switch {
+	case !l.Found:
+		fmt.Fprintf(w, "  Not found\n")
+	case l.OutputID == "":
+		fmt.Fprintf(w, "  Corrupt: %s\n", l.Error)
+	default:
+		fmt.Fprintf(w, "  Output ID: %s\n", l.OutputID)
+		fmt.Fprintf(w, "  Size:      %s (%d bytes)\n", formatBytes(l.Size), l.Size)
+		fmt.Fprintf(w, "  Written:   %s\n", formatDuTime(l.PutTime))
+		fmt.Fprintf(w, "  Last used: %s\n", formatDuTime(l.LastUsed))
+		if l.Checksum != "" {
+			fmt.Fprintf(w, "  SHA-256:   %s\n", l.Checksum)
+		}
+		if l.Error != "" {
+			fmt.Fprintf(w, "  Corrupt:   %s\n", l.Error)
+		} else {
+			fmt.Fprintf(w, "  Status:    OK\n")
+		}
+	}
+
+	if rm := r.Remote; rm != nil {
+		fmt.Fprintf(w, "\nRemote entry: %s\n", cmp.Or(rm.Name, r.BackendKey))
+		if !rm.Found {
+			if rm.Error != "" {
+				fmt.Fprintf(w, "  Error: %s\n", rm.Error)
+			} else {
+				fmt.Fprintf(w, "  Not found\n")
+			}
+		} else {
+			namespace := rm.Namespace
+			if namespace == "" {
+				namespace = "(none)"
+			}
+			fmt.Fprintf(w, "  Namespace:         %s\n", namespace)
+			fmt.Fprintf(w, "  Stored size:       %s (%d bytes)\n", formatBytes(rm.StoredSize), rm.StoredSize)
+			fmt.Fprintf(w, "  Written:           %s\n", formatDuTime(rm.PutTime))
+			if !rm.AccessTime.IsZero() && !rm.AccessTime.Equal(rm.PutTime) {
+				fmt.Fprintf(w, "  Last touched:      %s\n", formatDuTime(rm.AccessTime))
+			}
+			if len(rm.Envelopes) == 0 {
+				fmt.Fprintf(w, "  Envelope:          none (not encrypted or signed)\n")
+			}
+			for _, env := range rm.Envelopes {
+				state := "not opened, no key configured"
+				if env.Opened {
+					state = "decrypted"
+					if env.Type == backends.EnvelopeSigned {
+						state = "signature verified"
+					}
+				}
+				fmt.Fprintf(w, "  Envelope:          %s with key %q (version %d, %d byte header, %s)\n",
+					env.Type, env.KeyID, env.Version, env.Size, state)
+			}
+			if rm.Error != "" {
+				fmt.Fprintf(w, "  Error:             %s\n", rm.Error)
+			} else {
+				fmt.Fprintf(w, "  Output ID:         %s\n", rm.OutputID)
+				if rm.CompressedSize > 0 {
+					fmt.Fprintf(w, "  Compressed size:   %s (%d bytes)\n", formatBytes(rm.CompressedSize), rm.CompressedSize)
+				}
+				fmt.Fprintf(w, "  Uncompressed size: %s (%d bytes)\n", formatBytes(rm.UncompressedSize), rm.UncompressedSize)
+				fmt.Fprintf(w, "  SHA-256:           %s\n", rm.Checksum)
+			}
+			if rm.MatchesLocal != nil {
+				if *rm.MatchesLocal {
+					fmt.Fprintf(w, "  Local copy:        matches\n")
+				} else {
+					fmt.Fprintf(w, "  Local copy:        DIFFERS\n")
+				}
+			}
+		}
+	}
+
+	if r.DumpedFrom != "" {
+		fmt.Fprintf(w, "\nDumped the %s body\n", r.DumpedFrom)
+	}
+	for _, where := range r.Deleted {
+		fmt.Fprintf(w, "Deleted the %s entry\n", where)
+	}
+}
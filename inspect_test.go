@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/gobuildcache/pkg/backends"
+	"github.com/richardartoul/gobuildcache/pkg/locking"
+)
+
+func TestInspectEntry(t *testing.T) {
+	lc := newTestLocalCache(t)
+	actionID := bytes.Repeat([]byte{1}, 32)
+	body := bytes.Repeat([]byte("compiled output "), 100)
+	if _, err := lc.writeWithMetadata(actionID, bytes.NewReader(body), localCacheMetadata{
+		OutputID: []byte("output"),
+		Size:     int64(len(body)),
+		PutTime:  time.Now(),
+	}); err != nil {
+		t.Fatalf("Failed to write entry: %v", err)
+	}
+
+	// Store the entry the way a server with encryption and signing would.
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	storage := deletingBackend{newRecordingBackend()}
+	keyring, err := backends.NewKeyring(map[string][]byte{"k1": bytes.Repeat([]byte{1}, backends.EncryptionKeySize)}, "k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingKey := backends.SigningKey{ID: "ci", Algorithm: backends.SigningHMAC, Secret: bytes.Repeat([]byte{2}, 32)}
+	signingKeyring, err := backends.NewSigningKeyring(&signingKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted := backends.NewEncrypted(storage, keyring, logger)
+	signed := backends.NewSigned(encrypted, signingKeyring, logger)
+	compressed, err := compressData(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := []byte("main/" + fileFormatVersion + hex.EncodeToString(actionID))
+	if err := signed.Put(key, []byte("output"), bytes.NewReader(compressed), int64(len(compressed))); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	// Without keys, only the encryption envelope can be seen.
+	report, err := inspectEntry(lc, locking.NewMemLock(), []inspectLayer{{"storage", storage}}, "main/", actionID, inspectOptions{Compressed: true})
+	if err != nil {
+		t.Fatalf("inspectEntry failed: %v", err)
+	}
+	remote := report.Remote
+	if !remote.Found || len(remote.Envelopes) != 1 || remote.Envelopes[0].Opened || !strings.Contains(remote.Error, "encrypted") {
+		t.Errorf("Unexpected remote entry without keys: %+v", remote)
+	}
+	if !report.Local.Found || report.Local.Error != "" || report.Local.Size != int64(len(body)) {
+		t.Errorf("Unexpected local entry: %+v", report.Local)
+	}
+
+	// With them, both envelopes are opened and the body is compared to the
+	// local copy, then dumped and deleted.
+	dump := filepath.Join(t.TempDir(), "body")
+	layers := []inspectLayer{{"storage", storage}, {"encryption", encrypted}, {"signing", signed}}
+	report, err = inspectEntry(lc, locking.NewMemLock(), layers, "main/", actionID, inspectOptions{
+		Compressed:   true,
+		DumpPath:     dump,
+		DeleteLocal:  true,
+		DeleteRemote: true,
+	})
+	if err != nil {
+		t.Fatalf("inspectEntry failed: %v", err)
+	}
+	remote = report.Remote
+	if remote.Error != "" || len(remote.Envelopes) != 2 || !remote.Envelopes[0].Opened || !remote.Envelopes[1].Opened {
+		t.Fatalf("Unexpected remote entry: %+v", remote)
+	}
+	if remote.Envelopes[0].Type != backends.EnvelopeEncrypted || remote.Envelopes[1].KeyID != "ci" {
+		t.Errorf("Unexpected envelopes: %+v", remote.Envelopes)
+	}
+	if remote.CompressedSize != int64(len(compressed)) || remote.UncompressedSize != int64(len(body)) {
+		t.Errorf("Sizes = %d compressed, %d uncompressed, want %d and %d", remote.CompressedSize, remote.UncompressedSize, len(compressed), len(body))
+	}
+	if remote.MatchesLocal == nil || !*remote.MatchesLocal {
+		t.Errorf("Expected the remote entry to match the local one")
+	}
+	if got, err := os.ReadFile(dump); err != nil || !bytes.Equal(got, body) || report.DumpedFrom != "remote" {
+		t.Errorf("Dumped %d bytes from %q (err=%v), want the remote body", len(got), report.DumpedFrom, err)
+	}
+	if lc.check(actionID) != nil {
+		t.Error("Local entry wasn't deleted")
+	}
+	if _, ok := storage.get(key); ok {
+		t.Error("Remote entry wasn't deleted")
+	}
+
+	var out bytes.Buffer
+	printInspectReport(&out, report)
+	for _, want := range []string{"signed with key \"ci\"", "Local copy:        matches", "Deleted the remote entry"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Report is missing %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestParseInspectTarget(t *testing.T) {
+	hexID := strings.Repeat("ab", 32)
+	actionID, namespace, err := parseInspectTarget(hexID, "main/")
+	if err != nil || hex.EncodeToString(actionID) != hexID || namespace != "main/" {
+		t.Errorf("action ID: got %x, %q, %v", actionID, namespace, err)
+	}
+	actionID, namespace, err = parseInspectTarget("branches/feature/"+fileFormatVersion+hexID, "main/")
+	if err != nil || hex.EncodeToString(actionID) != hexID || namespace != "branches/feature/" {
+		t.Errorf("backend key: got %x, %q, %v", actionID, namespace, err)
+	}
+	if _, _, err := parseInspectTarget("not-hex", ""); err == nil {
+		t.Error("Expected an error for an invalid action ID")
+	}
+}
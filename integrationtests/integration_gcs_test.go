@@ -69,6 +69,7 @@ func TestCacheIntegrationGCS(t *testing.T) {
 	t.Log("Step 2: Clearing the GCS cache...")
 	clearCmd := exec.Command(binaryPath, "clear",
 		"-debug",
+		"-yes",
 		"-backend=gcs",
 		"-gcs-bucket="+gcsBucket,
 		"-gcs-prefix="+bucketPrefix+"/")
@@ -144,6 +145,7 @@ func TestCacheIntegrationGCS(t *testing.T) {
 	t.Log("Step 5: Cleaning up GCS test data...")
 	finalClearCmd := exec.Command(binaryPath, "clear",
 		"-debug",
+		"-yes",
 		"-backend=gcs",
 		"-gcs-bucket="+gcsBucket,
 		"-gcs-prefix="+bucketPrefix+"/")
@@ -67,6 +67,7 @@ func TestCacheIntegrationS3(t *testing.T) {
 	t.Log("Step 2: Clearing the S3 cache...")
 	clearCmd := exec.Command(binaryPath, "clear",
 		"-debug",
+		"-yes",
 		"-backend=s3",
 		"-s3-bucket="+s3Bucket,
 		"-s3-prefix="+bucketPrefix+"/")
@@ -142,6 +143,7 @@ func TestCacheIntegrationS3(t *testing.T) {
 	t.Log("Step 5: Cleaning up S3 test data...")
 	finalClearCmd := exec.Command(binaryPath, "clear",
 		"-debug",
+		"-yes",
 		"-backend=s3",
 		"-s3-bucket="+s3Bucket,
 		"-s3-prefix="+bucketPrefix+"/")
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -10,6 +11,7 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,6 +20,17 @@ import (
 type localCache struct {
 	cacheDir string // Absolute path to cache directory
 	logger   *slog.Logger
+
+	// verify controls how entries are verified before they're returned as hits.
+	// Corrupt entries are quarantined and treated as misses.
+	verify             localVerifyMode
+	quarantinedEntries atomic.Int64
+
+	// hits records when this process last hit each entry. Access times on disk
+	// are only updated once per accessTimeResolution, so trims in this process
+	// use these to avoid evicting entries they served minutes ago.
+	hitsMu sync.Mutex
+	hits   map[string]time.Time
 }
 
 // localCacheMetadata holds metadata for a cached entry.
@@ -25,6 +38,7 @@ type localCacheMetadata struct {
 	OutputID []byte
 	Size     int64
 	PutTime  time.Time
+	Checksum []byte // SHA-256 of the data file, nil for entries written before checksums existed
 }
 
 // newLocalCache creates a new local cache instance.
@@ -73,6 +87,8 @@ func newLocalCache(cacheDir string, logger *slog.Logger) (*localCache, error) {
 	return &localCache{
 		cacheDir: absCacheDir,
 		logger:   logger,
+		verify:   localVerifySize,
+		hits:     make(map[string]time.Time),
 	}, nil
 }
 
@@ -80,11 +96,14 @@ func newLocalCache(cacheDir string, logger *slog.Logger) (*localCache, error) {
 func (lc *localCache) writeMetadata(actionID []byte, meta localCacheMetadata) error {
 	metaPath := lc.metadataPath(actionID)
 
-	// Format: outputID:hex\nsize:num\ntime:unix\n
+	// Format: outputID:hex\nsize:num\ntime:unix\nsha256:hex\n
 	content := fmt.Sprintf("outputID:%s\nsize:%d\ntime:%d\n",
 		hex.EncodeToString(meta.OutputID),
 		meta.Size,
 		meta.PutTime.Unix())
+	if meta.Checksum != nil {
+		content += fmt.Sprintf("sha256:%s\n", hex.EncodeToString(meta.Checksum))
+	}
 
 	// Write to temp file first for atomic operation.
 	tmpPath := metaPath + ".tmp"
@@ -112,10 +131,15 @@ func (lc *localCache) readMetadata(actionID []byte) (*localCacheMetadata, error)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read metadata: %w", err)
 	}
+	return parseMetadata(data)
+}
 
+// parseMetadata parses the contents of a metadata file written by writeMetadata.
+func parseMetadata(data []byte) (*localCacheMetadata, error) {
 	var outputIDHex string
 	var size int64
 	var putTimeUnix int64
+	var checksumHex string
 
 	// Parse each line
 	for _, line := range strings.Split(string(data), "\n") {
@@ -126,6 +150,8 @@ func (lc *localCache) readMetadata(actionID []byte) (*localCacheMetadata, error)
 			fmt.Sscanf(line, "size:%d", &size)
 		} else if strings.HasPrefix(line, "time:") {
 			fmt.Sscanf(line, "time:%d", &putTimeUnix)
+		} else if strings.HasPrefix(line, "sha256:") {
+			fmt.Sscanf(line, "sha256:%s", &checksumHex)
 		}
 	}
 
@@ -138,34 +164,44 @@ func (lc *localCache) readMetadata(actionID []byte) (*localCacheMetadata, error)
 		return nil, fmt.Errorf("failed to decode outputID: %w", err)
 	}
 
+	var checksum []byte
+	if checksumHex != "" {
+		checksum, err = hex.DecodeString(checksumHex)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode checksum: %w", err)
+		}
+	}
+
 	return &localCacheMetadata{
 		OutputID: outputID,
 		Size:     size,
 		PutTime:  time.Unix(putTimeUnix, 0),
+		Checksum: checksum,
 	}, nil
 }
 
 // Write atomically writes data from a reader to the local cache.
-// Returns the absolute path to the cached file.
-func (lc *localCache) write(actionID []byte, body io.Reader) (string, error) {
+// Returns the absolute path to the cached file and the SHA-256 checksum of its contents.
+func (lc *localCache) write(actionID []byte, body io.Reader) (string, []byte, error) {
 	diskPath := lc.actionIDToPath(actionID)
 
 	// Write to temp file first for atomic operation.
 	tmpPath := diskPath + ".tmp"
 	tmpFile, err := os.Create(tmpPath)
 	if err != nil {
-		return "", fmt.Errorf("failed to create temp file: %w", err)
+		return "", nil, fmt.Errorf("failed to create temp file: %w", err)
 	}
 	defer os.Remove(tmpPath) // Clean up if something goes wrong
 
-	// Copy data to temp file.
-	_, err = io.Copy(tmpFile, body)
+	// Copy data to temp file, computing its checksum along the way.
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmpFile, hash), body)
 	closeErr := tmpFile.Close()
 	if err != nil {
-		return "", fmt.Errorf("failed to write to temp file: %w", err)
+		return "", nil, fmt.Errorf("failed to write to temp file: %w", err)
 	}
 	if closeErr != nil {
-		return "", fmt.Errorf("failed to close temp file: %w", closeErr)
+		return "", nil, fmt.Errorf("failed to close temp file: %w", closeErr)
 	}
 
 	// Then atomically rename the temp file to the final destination.
@@ -179,21 +215,22 @@ func (lc *localCache) write(actionID []byte, body io.Reader) (string, error) {
 	// as implemented in server.go. That said, I'm leaving this in for now
 	// because I think it's safer and probably doesn't hurt performance much.
 	if err := os.Rename(tmpPath, diskPath); err != nil {
-		return "", fmt.Errorf("failed to rename cache file: %w", err)
+		return "", nil, fmt.Errorf("failed to rename cache file: %w", err)
 	}
 
 	// diskPath is already absolute (cacheDir is absolute)
-	return diskPath, nil
+	return diskPath, hash.Sum(nil), nil
 }
 
 // WriteWithMetadata writes data and metadata to the local cache.
 // Returns the absolute path to the cached file.
 func (lc *localCache) writeWithMetadata(actionID []byte, body io.Reader, meta localCacheMetadata) (string, error) {
 	// Write data
-	diskPath, err := lc.write(actionID, body)
+	diskPath, checksum, err := lc.write(actionID, body)
 	if err != nil {
 		return "", err
 	}
+	meta.Checksum = checksum
 
 	// Write metadata
 	if err := lc.writeMetadata(actionID, meta); err != nil {
@@ -208,6 +245,8 @@ func (lc *localCache) writeWithMetadata(actionID []byte, body io.Reader, meta lo
 
 // Check checks if a file exists in the local cache and returns its metadata.
 // Returns nil if not found, and logs a warning if metadata is missing/corrupted.
+// Entries whose data file fails verification are quarantined and reported as
+// not found.
 func (lc *localCache) check(actionID []byte) *localCacheMetadata {
 	// Try to read metadata directly (avoids extra Stat syscall)
 	// If the data file doesn't exist, the metadata file likely won't either
@@ -238,6 +277,18 @@ func (lc *localCache) check(actionID []byte) *localCacheMetadata {
 		return nil
 	}
 
+	if err := lc.verifyEntry(actionID, meta, lc.verify); err != nil {
+		lc.logger.Error("local cache entry is corrupt, quarantining it and treating it as a miss",
+			"actionID", hex.EncodeToString(actionID),
+			"error", err)
+		if qErr := lc.quarantine(actionID); qErr != nil {
+			lc.logger.Warn("failed to quarantine corrupt local cache entry",
+				"actionID", hex.EncodeToString(actionID),
+				"error", qErr)
+		}
+		return nil
+	}
+
 	return meta
 }
 
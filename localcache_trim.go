@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/richardartoul/gobuildcache/pkg/locking"
+)
+
+const (
+	// accessTimeResolution is how stale an entry's recorded access time can get
+	// before a hit updates it. Updating it on every hit would double the number
+	// of syscalls on the hot path for no benefit to LRU ordering. Within the
+	// process that served them, hits are tracked exactly, see localCache.hits.
+	accessTimeResolution = time.Hour
+
+	// trimLowWatermark is the fraction of the max size that trimming evicts down
+	// to, so that a cache sitting right at its limit isn't trimmed on every pass.
+	trimLowWatermark = 0.9
+
+	// defaultStaleTmpAge is how old a .tmp file must be before it's considered
+	// left behind by a crashed process. Temp files are renamed into place as soon
+	// as they're written, so anything this old is garbage.
+	defaultStaleTmpAge = time.Hour
+)
+
+// trimOptions configures a local cache trim. Zero values disable the
+// corresponding limit.
+type trimOptions struct {
+	// MaxSize is the maximum total size of the local cache in bytes. When it's
+	// exceeded, the least recently used entries are evicted.
+	MaxSize int64
+	// MaxAge evicts entries that haven't been accessed for longer than this.
+	MaxAge time.Duration
+	// StaleTmpAge is how old .tmp files (and data files without metadata) must be
+	// before they are removed. Defaults to defaultStaleTmpAge.
+	StaleTmpAge time.Duration
+	// DryRun reports what would be removed without removing anything.
+	DryRun bool
+}
+
+// trimResult summarizes a local cache trim.
+type trimResult struct {
+	Entries        int   // Entries in the cache before trimming
+	Bytes          int64 // Bytes in the cache before trimming
+	EvictedEntries int
+	EvictedBytes   int64
+	StaleFiles     int // Stale .tmp files and orphaned data files removed
+	StaleBytes     int64
+	// Quarantined files removed, because they were older than
+	// quarantineRetention or to make room. Bytes includes all of them.
+	QuarantinedFiles int
+	QuarantinedBytes int64
+}
+
+// localCacheEntry is an entry found while scanning the local cache.
+type localCacheEntry struct {
+	actionID   []byte
+	size       int64     // Size of the data and metadata files
+	lastAccess time.Time // Modification time of the metadata file, or the last hit in this process if later
+}
+
+// touch records that an entry was accessed by updating the modification time of
+// its metadata file, which trimming uses as the entry's last access time. Access
+// times are only updated once per accessTimeResolution to keep hits cheap, but
+// every hit is recorded in memory for trims in this process.
+func (lc *localCache) touch(actionID []byte) {
+	now := time.Now()
+	lc.hitsMu.Lock()
+	lc.hits[string(actionID)] = now
+	lc.hitsMu.Unlock()
+
+	metaPath := lc.metadataPath(actionID)
+	info, err := os.Stat(metaPath)
+	if err != nil || now.Sub(info.ModTime()) < accessTimeResolution {
+		return
+	}
+	if err := os.Chtimes(metaPath, now, now); err != nil {
+		lc.logger.Debug("failed to update local cache access time",
+			"actionID", hex.EncodeToString(actionID),
+			"error", err)
+	}
+}
+
+// lastAccess returns when an entry was last accessed, given the modification time
+// of its metadata file.
+func (lc *localCache) lastAccess(actionID []byte, modTime time.Time) time.Time {
+	lc.hitsMu.Lock()
+	defer lc.hitsMu.Unlock()
+	if hit := lc.hits[string(actionID)]; hit.After(modTime) {
+		return hit
+	}
+	return modTime
+}
+
+// remove removes an entry from the local cache. The metadata file is removed
+// first so that the entry stops being a hit before its data disappears. Callers
+// must hold the lock for the action ID.
+func (lc *localCache) remove(actionID []byte) error {
+	lc.hitsMu.Lock()
+	delete(lc.hits, string(actionID))
+	lc.hitsMu.Unlock()
+
+	metaErr := os.Remove(lc.metadataPath(actionID))
+	dataErr := os.Remove(lc.actionIDToPath(actionID))
+	if errors.Is(metaErr, os.ErrNotExist) {
+		metaErr = nil
+	}
+	if errors.Is(dataErr, os.ErrNotExist) {
+		dataErr = nil
+	}
+	return errors.Join(metaErr, dataErr)
+}
+
+// scan walks the local cache and returns all entries with metadata, along with
+// files that aren't part of a valid entry (temp files and data files without
+// metadata) that are older than staleAge.
+func (lc *localCache) scan(staleAge time.Duration) (entries []localCacheEntry, stale []string, err error) {
+	now := time.Now()
+	for i := range 256 {
+		subdirPath := filepath.Join(lc.cacheDir, fmt.Sprintf("%02x", i))
+		files, err := os.ReadDir(subdirPath)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, nil, fmt.Errorf("failed to read cache directory: %w", err)
+		}
+
+		// Index data file sizes so that entries can account for them without an
+		// extra stat per entry.
+		dataSizes := make(map[string]int64)
+		for _, file := range files {
+			name := file.Name()
+			if !strings.HasPrefix(name, fileFormatVersion) || strings.Contains(name, ".") {
+				continue
+			}
+			if info, err := file.Info(); err == nil {
+				dataSizes[name] = info.Size()
+			}
+		}
+
+		for _, file := range files {
+			name := file.Name()
+			info, err := file.Info()
+			if err != nil {
+				// Removed concurrently.
+				continue
+			}
+
+			switch {
+			case strings.HasSuffix(name, ".tmp"):
+				if now.Sub(info.ModTime()) > staleAge {
+					stale = append(stale, filepath.Join(subdirPath, name))
+				}
+
+			case strings.HasPrefix(name, fileFormatVersion) && strings.HasSuffix(name, ".meta"):
+				dataName := strings.TrimSuffix(name, ".meta")
+				actionID, err := hex.DecodeString(strings.TrimPrefix(dataName, fileFormatVersion))
+				if err != nil {
+					continue
+				}
+				entries = append(entries, localCacheEntry{
+					actionID:   actionID,
+					size:       dataSizes[dataName] + info.Size(),
+					lastAccess: lc.lastAccess(actionID, info.ModTime()),
+				})
+				delete(dataSizes, dataName)
+			}
+		}
+
+		// Whatever is left are data files without metadata, which are never
+		// served and can only be left behind by a crash between the two writes.
+		for dataName := range dataSizes {
+			dataPath := filepath.Join(subdirPath, dataName)
+			if info, err := os.Stat(dataPath); err == nil && now.Sub(info.ModTime()) > staleAge {
+				stale = append(stale, dataPath)
+			}
+		}
+	}
+	return entries, stale, nil
+}
+
+// trim evicts entries from the local cache according to opts. Quarantined files
+// count towards MaxSize and are removed first, then entries that haven't been
+// accessed for longer than MaxAge are evicted, then the least recently used
+// entries are evicted until the cache is below MaxSize. Every
+// eviction happens under the entry's lock, so it can't race with a GET or PUT
+// for the same action ID, and entries accessed since the scan are skipped.
+func (lc *localCache) trim(opts trimOptions, locker locking.Group) (trimResult, error) {
+	var result trimResult
+	if opts.StaleTmpAge <= 0 {
+		opts.StaleTmpAge = defaultStaleTmpAge
+	}
+
+	entries, stale, err := lc.scan(opts.StaleTmpAge)
+	if err != nil {
+		return result, err
+	}
+
+	for _, path := range stale {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if !opts.DryRun {
+			if err := os.Remove(path); err != nil {
+				continue
+			}
+		}
+		result.StaleFiles++
+		result.StaleBytes += info.Size()
+	}
+
+	quarantined, err := lc.scanQuarantine()
+	if err != nil {
+		return result, err
+	}
+
+	result.Entries = len(entries)
+	for _, entry := range entries {
+		result.Bytes += entry.size
+	}
+	for _, file := range quarantined {
+		result.Bytes += file.size
+	}
+
+	// Least recently used first.
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].lastAccess.Before(entries[j].lastAccess)
+	})
+
+	// Only start evicting for size once the max size is exceeded, but then keep
+	// going until the low watermark is reached.
+	var (
+		remaining       = result.Bytes
+		target          = int64(float64(opts.MaxSize) * trimLowWatermark)
+		evictingForSize = opts.MaxSize > 0 && result.Bytes > opts.MaxSize
+		now             = time.Now()
+	)
+
+	// Quarantined files are never served, so they go before any entry. They're
+	// sorted oldest first.
+	for _, file := range quarantined {
+		tooOld := now.Sub(file.modTime) > quarantineRetention
+		tooBig := evictingForSize && remaining > target
+		if !tooOld && !tooBig {
+			break
+		}
+		if !opts.DryRun {
+			if err := os.Remove(file.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				lc.logger.Warn("failed to remove quarantined file",
+					"path", file.path,
+					"error", err)
+				continue
+			}
+		}
+		result.QuarantinedFiles++
+		result.QuarantinedBytes += file.size
+		remaining -= file.size
+	}
+
+	for _, entry := range entries {
+		tooOld := opts.MaxAge > 0 && now.Sub(entry.lastAccess) > opts.MaxAge
+		tooBig := evictingForSize && remaining > target
+		if !tooOld && !tooBig {
+			// Entries are sorted by access time, so no later entry needs to be
+			// evicted either.
+			break
+		}
+
+		evicted, err := lc.evict(entry, opts.DryRun, locker)
+		if err != nil {
+			lc.logger.Warn("failed to evict local cache entry",
+				"actionID", hex.EncodeToString(entry.actionID),
+				"error", err)
+			continue
+		}
+		if evicted {
+			result.EvictedEntries++
+			result.EvictedBytes += entry.size
+			remaining -= entry.size
+		}
+	}
+
+	return result, nil
+}
+
+// evict removes a single entry under its lock, unless it was accessed after it
+// was scanned. It reports whether the entry was evicted.
+func (lc *localCache) evict(entry localCacheEntry, dryRun bool, locker locking.Group) (bool, error) {
+	v, err := locker.DoWithLock(hex.EncodeToString(entry.actionID), func() (interface{}, error) {
+		info, err := os.Stat(lc.metadataPath(entry.actionID))
+		if err != nil {
+			// Already removed.
+			return false, nil
+		}
+		if lc.lastAccess(entry.actionID, info.ModTime()).After(entry.lastAccess) {
+			// Accessed or rewritten since the scan.
+			return false, nil
+		}
+		if dryRun {
+			return true, nil
+		}
+		if err := lc.remove(entry.actionID); err != nil {
+			return false, err
+		}
+		return true, nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return v.(bool), nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/gobuildcache/pkg/locking"
+)
+
+// writeTestEntry writes a local cache entry of the given size and sets its last
+// access time.
+func writeTestEntry(t *testing.T, lc *localCache, id byte, size int, lastAccess time.Time) []byte {
+	t.Helper()
+	actionID := bytes.Repeat([]byte{id}, 32)
+	_, err := lc.writeWithMetadata(actionID, bytes.NewReader(make([]byte, size)), localCacheMetadata{
+		OutputID: []byte{id},
+		Size:     int64(size),
+		PutTime:  lastAccess,
+	})
+	if err != nil {
+		t.Fatalf("Failed to write entry: %v", err)
+	}
+	if err := os.Chtimes(lc.metadataPath(actionID), lastAccess, lastAccess); err != nil {
+		t.Fatalf("Failed to set access time: %v", err)
+	}
+	return actionID
+}
+
+func newTestLocalCache(t *testing.T) *localCache {
+	t.Helper()
+	lc, err := newLocalCache(t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("Failed to create local cache: %v", err)
+	}
+	return lc
+}
+
+func TestLocalCacheTrim_EvictsLeastRecentlyUsed(t *testing.T) {
+	lc := newTestLocalCache(t)
+	now := time.Now()
+
+	oldest := writeTestEntry(t, lc, 1, 1000, now.Add(-3*time.Hour))
+	middle := writeTestEntry(t, lc, 2, 1000, now.Add(-2*time.Hour))
+	newest := writeTestEntry(t, lc, 3, 1000, now.Add(-1*time.Hour))
+
+	result, err := lc.trim(trimOptions{MaxSize: 2500}, locking.NewNoOpGroup())
+	if err != nil {
+		t.Fatalf("trim returned error: %v", err)
+	}
+
+	// 3 entries of ~1000 bytes exceed 2500, and the low watermark (2250) requires
+	// evicting only the oldest one.
+	if result.Entries != 3 || result.EvictedEntries != 1 {
+		t.Errorf("Unexpected trim result: %+v", result)
+	}
+	if lc.check(oldest) != nil {
+		t.Errorf("Expected least recently used entry to be evicted")
+	}
+	if lc.check(middle) == nil || lc.check(newest) == nil {
+		t.Errorf("Expected recently used entries to be kept")
+	}
+}
+
+func TestLocalCacheTrim_EvictsByAge(t *testing.T) {
+	lc := newTestLocalCache(t)
+	now := time.Now()
+
+	old := writeTestEntry(t, lc, 1, 10, now.Add(-48*time.Hour))
+	recent := writeTestEntry(t, lc, 2, 10, now.Add(-2*time.Hour))
+
+	// A dry run doesn't remove anything.
+	result, err := lc.trim(trimOptions{MaxAge: 24 * time.Hour, DryRun: true}, locking.NewNoOpGroup())
+	if err != nil {
+		t.Fatalf("trim returned error: %v", err)
+	}
+	if result.EvictedEntries != 1 || lc.check(old) == nil {
+		t.Fatalf("Expected dry run to report 1 eviction without removing anything: %+v", result)
+	}
+
+	result, err = lc.trim(trimOptions{MaxAge: 24 * time.Hour}, locking.NewNoOpGroup())
+	if err != nil {
+		t.Fatalf("trim returned error: %v", err)
+	}
+	if result.EvictedEntries != 1 {
+		t.Errorf("Expected 1 eviction, got: %+v", result)
+	}
+	if lc.check(old) != nil {
+		t.Errorf("Expected old entry to be evicted")
+	}
+	if lc.check(recent) == nil {
+		t.Errorf("Expected recent entry to be kept")
+	}
+}
+
+func TestLocalCacheTrim_RemovesStaleFiles(t *testing.T) {
+	lc := newTestLocalCache(t)
+	old := time.Now().Add(-2 * time.Hour)
+
+	staleTmp := lc.actionIDToPath(bytes.Repeat([]byte{1}, 32)) + ".tmp"
+	freshTmp := lc.actionIDToPath(bytes.Repeat([]byte{2}, 32)) + ".tmp"
+	orphanData := lc.actionIDToPath(bytes.Repeat([]byte{3}, 32))
+	for _, path := range []string{staleTmp, freshTmp, orphanData} {
+		if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+	os.Chtimes(staleTmp, old, old)
+	os.Chtimes(orphanData, old, old)
+
+	result, err := lc.trim(trimOptions{}, locking.NewNoOpGroup())
+	if err != nil {
+		t.Fatalf("trim returned error: %v", err)
+	}
+	if result.StaleFiles != 2 {
+		t.Errorf("Expected 2 stale files to be removed, got: %+v", result)
+	}
+	if _, err := os.Stat(staleTmp); !os.IsNotExist(err) {
+		t.Errorf("Expected stale temp file to be removed")
+	}
+	if _, err := os.Stat(orphanData); !os.IsNotExist(err) {
+		t.Errorf("Expected orphaned data file to be removed")
+	}
+	if _, err := os.Stat(freshTmp); err != nil {
+		t.Errorf("Expected fresh temp file to be kept")
+	}
+}
+
+func TestLocalCacheTouch_UpdatesAccessTime(t *testing.T) {
+	lc := newTestLocalCache(t)
+	old := time.Now().Add(-2 * accessTimeResolution)
+	actionID := writeTestEntry(t, lc, 1, 10, old)
+
+	lc.touch(actionID)
+
+	info, err := os.Stat(lc.metadataPath(actionID))
+	if err != nil {
+		t.Fatalf("Failed to stat metadata: %v", err)
+	}
+	if !info.ModTime().After(old.Add(accessTimeResolution)) {
+		t.Errorf("Expected access time to be updated, got: %v", info.ModTime())
+	}
+}
+
+func TestLocalCacheTrim_KeepsEntriesHitInThisProcess(t *testing.T) {
+	lc := newTestLocalCache(t)
+	now := time.Now()
+
+	// Touched 50 minutes ago, so hitting it now doesn't update its access time on
+	// disk, but it's still the most recently used entry.
+	hit := writeTestEntry(t, lc, 1, 1000, now.Add(-50*time.Minute))
+	idle := writeTestEntry(t, lc, 2, 1000, now.Add(-10*time.Minute))
+	lc.touch(hit)
+
+	info, err := os.Stat(lc.metadataPath(hit))
+	if err != nil {
+		t.Fatalf("Failed to stat metadata: %v", err)
+	}
+	if now.Sub(info.ModTime()) < 40*time.Minute {
+		t.Fatalf("Expected the access time on disk to be left alone, got: %v", info.ModTime())
+	}
+
+	result, err := lc.trim(trimOptions{MaxSize: 1500, MaxAge: 30 * time.Minute}, locking.NewNoOpGroup())
+	if err != nil {
+		t.Fatalf("trim returned error: %v", err)
+	}
+	if result.EvictedEntries != 1 {
+		t.Errorf("Unexpected trim result: %+v", result)
+	}
+	if lc.check(hit) == nil {
+		t.Errorf("Expected the entry hit in this process to be kept")
+	}
+	if lc.check(idle) != nil {
+		t.Errorf("Expected the idle entry to be evicted")
+	}
+}
+
+func TestLocalCacheTrim_CountsAndAgesOutQuarantine(t *testing.T) {
+	lc := newTestLocalCache(t)
+	now := time.Now()
+
+	entry := writeTestEntry(t, lc, 1, 1000, now.Add(-time.Hour))
+	expired := writeTestEntry(t, lc, 2, 1000, now)
+	recent := writeTestEntry(t, lc, 3, 1000, now)
+	for _, actionID := range [][]byte{expired, recent} {
+		if err := lc.quarantine(actionID); err != nil {
+			t.Fatalf("Failed to quarantine entry: %v", err)
+		}
+	}
+	// Age the first quarantined entry's files past the retention period.
+	dir := filepath.Join(lc.cacheDir, quarantineDir)
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Failed to read quarantine directory: %v", err)
+	}
+	old := now.Add(-2 * quarantineRetention)
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), filepath.Base(lc.actionIDToPath(expired))) {
+			os.Chtimes(filepath.Join(dir, file.Name()), old, old)
+		}
+	}
+
+	// Without a size limit, only the expired files are removed.
+	result, err := lc.trim(trimOptions{}, locking.NewNoOpGroup())
+	if err != nil {
+		t.Fatalf("trim returned error: %v", err)
+	}
+	if result.QuarantinedFiles != 2 || result.EvictedEntries != 0 || result.Bytes <= 3000 {
+		t.Errorf("Unexpected trim result: %+v", result)
+	}
+
+	// Quarantined files count towards the max size, and are removed before any
+	// entry is evicted.
+	result, err = lc.trim(trimOptions{MaxSize: 1500}, locking.NewNoOpGroup())
+	if err != nil {
+		t.Fatalf("trim returned error: %v", err)
+	}
+	if result.QuarantinedFiles == 0 || result.EvictedEntries != 0 || result.Bytes-result.QuarantinedBytes > 1500 {
+		t.Errorf("Unexpected trim result: %+v", result)
+	}
+	if lc.check(entry) == nil {
+		t.Errorf("Expected the entry to be kept")
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/richardartoul/gobuildcache/pkg/backends"
+	"github.com/richardartoul/gobuildcache/pkg/locking"
+)
+
+// quarantineDir is the subdirectory of the local cache that corrupt entries are
+// moved to, so they can be inspected later instead of being silently deleted.
+const quarantineDir = "quarantine"
+
+// quarantineRetention is how long quarantined files are kept for inspection
+// before trimming removes them. Trimming removes them sooner if the cache is
+// over its max size.
+const quarantineRetention = 7 * 24 * time.Hour
+
+// errChecksumMismatch is returned when an entry's contents don't match the
+// checksum recorded in its metadata.
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// localVerifyMode controls how local cache entries are verified on read.
+type localVerifyMode string
+
+const (
+	// localVerifyOff trusts the metadata file without checking the data file.
+	localVerifyOff localVerifyMode = "off"
+	// localVerifySize checks that the data file has the size recorded in its
+	// metadata. This costs a single stat and catches truncated files.
+	localVerifySize localVerifyMode = "size"
+	// localVerifyChecksum additionally hashes the data file and compares it to
+	// the checksum recorded in its metadata.
+	localVerifyChecksum localVerifyMode = "checksum"
+)
+
+// parseLocalVerifyMode parses a local verification mode.
+func parseLocalVerifyMode(s string) (localVerifyMode, error) {
+	switch mode := localVerifyMode(s); mode {
+	case localVerifyOff, localVerifySize, localVerifyChecksum:
+		return mode, nil
+	case "":
+		return localVerifySize, nil
+	default:
+		return "", fmt.Errorf("unknown local verification mode: %s (supported: off, size, checksum)", s)
+	}
+}
+
+// verifyEntry verifies that the data file for an entry matches its metadata.
+// Entries written before checksums were recorded are only checked for size.
+func (lc *localCache) verifyEntry(actionID []byte, meta *localCacheMetadata, mode localVerifyMode) error {
+	if mode == localVerifyOff || mode == "" {
+		return nil
+	}
+
+	diskPath := lc.actionIDToPath(actionID)
+	info, err := os.Stat(diskPath)
+	if err != nil {
+		return fmt.Errorf("failed to stat data file: %w", err)
+	}
+	if info.Size() != meta.Size {
+		return fmt.Errorf("size mismatch: metadata says %d bytes, data file has %d", meta.Size, info.Size())
+	}
+
+	if mode != localVerifyChecksum || meta.Checksum == nil {
+		return nil
+	}
+	checksum, err := fileChecksum(diskPath)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(checksum, meta.Checksum) {
+		return fmt.Errorf("%w: metadata says %x, data file has %x", errChecksumMismatch, meta.Checksum, checksum)
+	}
+	return nil
+}
+
+// quarantine moves an entry's data and metadata files out of the cache into the
+// quarantine directory. Callers must hold the lock for the action ID.
+func (lc *localCache) quarantine(actionID []byte) error {
+	dir := filepath.Join(lc.cacheDir, quarantineDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create quarantine directory: %w", err)
+	}
+
+	var (
+		now      = time.Now()
+		suffix   = fmt.Sprintf(".%d", now.UnixNano())
+		diskPath = lc.actionIDToPath(actionID)
+		metaPath = lc.metadataPath(actionID)
+	)
+	// Move the metadata first so the entry immediately stops being a hit. The
+	// files' modification times are set to now, which trimming ages them out by.
+	var errs []error
+	for _, path := range []string{metaPath, diskPath} {
+		dst := filepath.Join(dir, filepath.Base(path)+suffix)
+		err := os.Rename(path, dst)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+		if err == nil {
+			os.Chtimes(dst, now, now)
+		}
+	}
+	lc.quarantinedEntries.Add(1)
+	return errors.Join(errs...)
+}
+
+// quarantinedFile is a file found in the quarantine directory.
+type quarantinedFile struct {
+	path    string
+	size    int64
+	modTime time.Time // When the file was quarantined
+}
+
+// scanQuarantine returns the files in the quarantine directory, oldest first.
+func (lc *localCache) scanQuarantine() ([]quarantinedFile, error) {
+	dir := filepath.Join(lc.cacheDir, quarantineDir)
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read quarantine directory: %w", err)
+	}
+
+	var quarantined []quarantinedFile
+	for _, file := range files {
+		info, err := file.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		quarantined = append(quarantined, quarantinedFile{
+			path:    filepath.Join(dir, file.Name()),
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		})
+	}
+	sort.Slice(quarantined, func(i, j int) bool {
+		return quarantined[i].modTime.Before(quarantined[j].modTime)
+	})
+	return quarantined, nil
+}
+
+// fileChecksum returns the SHA-256 checksum of a file's contents.
+func fileChecksum(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open data file: %w", err)
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return nil, fmt.Errorf("failed to read data file: %w", err)
+	}
+	return hash.Sum(nil), nil
+}
+
+// verifyResult summarizes a verification scan.
+type verifyResult struct {
+	Checked  int // Entries checked
+	Corrupt  int // Entries that failed verification
+	Repaired int // Corrupt entries that were quarantined (local) or re-uploaded (remote)
+	Missing  int // Remote only: entries not present in the backend
+	Errors   int // Entries that couldn't be checked
+}
+
+// verifyLocalCache verifies the size and checksum of every entry in the local
+// cache. If repair is set, corrupt entries are quarantined under their lock.
+func verifyLocalCache(lc *localCache, locker locking.Group, repair bool) (verifyResult, error) {
+	var result verifyResult
+
+	entries, _, err := lc.scan(defaultStaleTmpAge)
+	if err != nil {
+		return result, err
+	}
+
+	for _, entry := range entries {
+		_, err := locker.DoWithLock(hex.EncodeToString(entry.actionID), func() (interface{}, error) {
+			meta, err := lc.readMetadata(entry.actionID)
+			if err != nil {
+				if errors.Is(err, os.ErrNotExist) {
+					// Removed concurrently.
+					return nil, nil
+				}
+				return nil, err
+			}
+
+			result.Checked++
+			if err := lc.verifyEntry(entry.actionID, meta, localVerifyChecksum); err != nil {
+				result.Corrupt++
+				lc.logger.Warn("corrupt local cache entry",
+					"actionID", hex.EncodeToString(entry.actionID),
+					"error", err)
+				if repair {
+					if err := lc.quarantine(entry.actionID); err != nil {
+						return nil, err
+					}
+					result.Repaired++
+				}
+			}
+			return nil, nil
+		})
+		if err != nil {
+			result.Errors++
+			lc.logger.Warn("failed to verify local cache entry",
+				"actionID", hex.EncodeToString(entry.actionID),
+				"error", err)
+		}
+	}
+	return result, nil
+}
+
+// verifyRemoteCache verifies the remote copies (in the given namespace) of the
+// entries in the local cache by downloading them and comparing them to the local
+// checksum. Remote entries are only checked against a local checksum, so
+// entries that aren't present locally are skipped rather than listed from the
+// backend. If repair is set, corrupt remote entries are overwritten with the
+// (verified) local copy.
+func verifyRemoteCache(lc *localCache, backend backends.Backend, namespace string, compressed bool, repair bool) (verifyResult, error) {
+	var result verifyResult
+
+	entries, _, err := lc.scan(defaultStaleTmpAge)
+	if err != nil {
+		return result, err
+	}
+
+	for _, entry := range entries {
+		meta, err := lc.readMetadata(entry.actionID)
+		if err != nil || meta.Checksum == nil {
+			// Without a local checksum there's nothing to compare against.
+			continue
+		}
+		if err := lc.verifyEntry(entry.actionID, meta, localVerifyChecksum); err != nil {
+			// Don't compare against (or repair from) a corrupt local copy.
+			continue
+		}
+
+		backendKey := []byte(namespace + fileFormatVersion + hex.EncodeToString(entry.actionID))
+		result.Checked++
+		remoteErr := verifyRemoteEntry(backend, backendKey, meta, compressed)
+		switch {
+		case remoteErr == nil:
+			continue
+		case errors.Is(remoteErr, errRemoteMissing):
+			result.Missing++
+			continue
+		case errors.Is(remoteErr, errChecksumMismatch) || errors.Is(remoteErr, errRemoteCorrupt):
+			result.Corrupt++
+			lc.logger.Warn("corrupt remote cache entry",
+				"actionID", hex.EncodeToString(entry.actionID),
+				"error", remoteErr)
+		default:
+			result.Errors++
+			lc.logger.Warn("failed to verify remote cache entry",
+				"actionID", hex.EncodeToString(entry.actionID),
+				"error", remoteErr)
+			continue
+		}
+
+		if !repair {
+			continue
+		}
+		_, err = uploadSpoolEntry(backend, spoolEntry{
+			BackendKey: hex.EncodeToString(backendKey),
+			OutputID:   hex.EncodeToString(meta.OutputID),
+			Size:       meta.Size,
+			DiskPath:   lc.actionIDToPath(entry.actionID),
+			Compressed: compressed,
+		})
+		if err != nil {
+			result.Errors++
+			lc.logger.Warn("failed to repair remote cache entry",
+				"actionID", hex.EncodeToString(entry.actionID),
+				"error", err)
+			continue
+		}
+		result.Repaired++
+	}
+	return result, nil
+}
+
+var (
+	// errRemoteMissing is returned when an entry doesn't exist in the backend.
+	errRemoteMissing = errors.New("entry not found in backend")
+	// errRemoteCorrupt is returned when a remote entry can't be decoded.
+	errRemoteCorrupt = errors.New("remote entry is corrupt")
+)
+
+// verifyRemoteEntry downloads a single remote entry and compares it against the
+// local metadata.
+func verifyRemoteEntry(backend backends.Backend, backendKey []byte, meta *localCacheMetadata, compressed bool) error {
+	outputID, body, _, _, miss, err := backend.Get(backendKey)
+	if err != nil {
+		return err
+	}
+	if miss {
+		return errRemoteMissing
+	}
+	defer body.Close()
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return fmt.Errorf("failed to read remote entry: %w", err)
+	}
+	if compressed && len(data) > 0 {
+		data, err = decompressData(data)
+		if err != nil {
+			return fmt.Errorf("%w: %v", errRemoteCorrupt, err)
+		}
+	}
+
+	if !bytes.Equal(outputID, meta.OutputID) {
+		return fmt.Errorf("%w: output ID %x does not match local output ID %x", errRemoteCorrupt, outputID, meta.OutputID)
+	}
+	checksum := sha256.Sum256(data)
+	if !bytes.Equal(checksum[:], meta.Checksum) {
+		return fmt.Errorf("%w: remote has %x, local has %x", errChecksumMismatch, checksum, meta.Checksum)
+	}
+	return nil
+}
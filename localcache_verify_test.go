@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/gobuildcache/pkg/locking"
+)
+
+func TestLocalCacheCheck_QuarantinesTruncatedEntry(t *testing.T) {
+	lc := newTestLocalCache(t)
+	actionID := writeTestEntry(t, lc, 1, 100, time.Now())
+
+	if err := os.Truncate(lc.actionIDToPath(actionID), 50); err != nil {
+		t.Fatalf("Failed to truncate data file: %v", err)
+	}
+
+	if lc.check(actionID) != nil {
+		t.Fatalf("Expected truncated entry to be a miss")
+	}
+	if got := lc.quarantinedEntries.Load(); got != 1 {
+		t.Errorf("Expected 1 quarantined entry, got %d", got)
+	}
+	if _, err := os.Stat(lc.metadataPath(actionID)); !os.IsNotExist(err) {
+		t.Errorf("Expected metadata to be moved out of the cache")
+	}
+	quarantined, err := os.ReadDir(filepath.Join(lc.cacheDir, quarantineDir))
+	if err != nil || len(quarantined) != 2 {
+		t.Errorf("Expected data and metadata files in the quarantine directory, got %d (err: %v)", len(quarantined), err)
+	}
+}
+
+func TestLocalCacheCheck_ChecksumMode(t *testing.T) {
+	lc := newTestLocalCache(t)
+	actionID := writeTestEntry(t, lc, 1, 100, time.Now())
+
+	// Same size, different contents.
+	if err := os.WriteFile(lc.actionIDToPath(actionID), bytes.Repeat([]byte{1}, 100), 0644); err != nil {
+		t.Fatalf("Failed to corrupt data file: %v", err)
+	}
+
+	if lc.check(actionID) == nil {
+		t.Fatalf("Expected size verification to miss same-size corruption")
+	}
+
+	lc.verify = localVerifyChecksum
+	if lc.check(actionID) != nil {
+		t.Errorf("Expected checksum verification to detect corruption")
+	}
+}
+
+func TestVerifyLocalCache_Repair(t *testing.T) {
+	lc := newTestLocalCache(t)
+	good := writeTestEntry(t, lc, 1, 100, time.Now())
+	bad := writeTestEntry(t, lc, 2, 100, time.Now())
+	os.WriteFile(lc.actionIDToPath(bad), bytes.Repeat([]byte{1}, 100), 0644)
+
+	result, err := verifyLocalCache(lc, locking.NewNoOpGroup(), false)
+	if err != nil {
+		t.Fatalf("verifyLocalCache returned error: %v", err)
+	}
+	if result.Checked != 2 || result.Corrupt != 1 || result.Repaired != 0 {
+		t.Fatalf("Unexpected verify result: %+v", result)
+	}
+
+	result, err = verifyLocalCache(lc, locking.NewNoOpGroup(), true)
+	if err != nil {
+		t.Fatalf("verifyLocalCache returned error: %v", err)
+	}
+	if result.Corrupt != 1 || result.Repaired != 1 {
+		t.Fatalf("Unexpected verify result: %+v", result)
+	}
+	if _, err := os.Stat(lc.metadataPath(bad)); !os.IsNotExist(err) {
+		t.Errorf("Expected corrupt entry to be quarantined")
+	}
+	if lc.check(good) == nil {
+		t.Errorf("Expected intact entry to be kept")
+	}
+}
+
+func TestVerifyRemoteCache_RepairsCorruptEntries(t *testing.T) {
+	lc := newTestLocalCache(t)
+	actionID := bytes.Repeat([]byte{1}, 32)
+	body := []byte("hello world")
+	_, err := lc.writeWithMetadata(actionID, bytes.NewReader(body), localCacheMetadata{
+		OutputID: []byte("output"),
+		Size:     int64(len(body)),
+		PutTime:  time.Now(),
+	})
+	if err != nil {
+		t.Fatalf("Failed to write entry: %v", err)
+	}
+	missingID := writeTestEntry(t, lc, 2, 10, time.Now())
+
+	backend := newRecordingBackend()
+	backendKey := []byte("ns/" + fileFormatVersion + hex.EncodeToString(actionID))
+	backend.puts[string(backendKey)] = []byte("hello w0rld")
+
+	result, err := verifyRemoteCache(lc, backend, "ns/", false, true)
+	if err != nil {
+		t.Fatalf("verifyRemoteCache returned error: %v", err)
+	}
+	if result.Checked != 2 || result.Corrupt != 1 || result.Repaired != 1 || result.Missing != 1 {
+		t.Fatalf("Unexpected verify result: %+v", result)
+	}
+	if data, _ := backend.get(backendKey); !bytes.Equal(data, body) {
+		t.Errorf("Expected corrupt remote entry to be overwritten with the local copy, got %q", data)
+	}
+	if _, ok := backend.get([]byte("ns/" + fileFormatVersion + hex.EncodeToString(missingID))); ok {
+		t.Errorf("Expected missing remote entries not to be uploaded")
+	}
+}
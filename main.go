@@ -1,17 +1,30 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/richardartoul/gobuildcache/pkg/backends"
 	"github.com/richardartoul/gobuildcache/pkg/locking"
+	"github.com/richardartoul/gobuildcache/pkg/metrics"
+	"github.com/richardartoul/gobuildcache/pkg/ratelimit"
 )
 
+// defaultBucketPrefix is the default S3 key prefix and GCS object prefix. Every
+// subcommand must use the same default, otherwise e.g. clear-remote would clear
+// a different prefix than the server writes to.
+const defaultBucketPrefix = "gobuildcache/"
+
 // Global flags
 var (
 	debug        bool
@@ -28,9 +41,67 @@ var (
 	compression  bool
 	asyncBackend bool
 	readOnly     bool
+
+	writeNamespace      string
+	readNamespaces      string
+	trust               string
+	quarantineNamespace string
+	quarantineRunID     string
+	uploadManifestPath  string
+	traceFile           string
+	remoteTouchInterval time.Duration
+
+	localVerify     string
+	verifyOutputIDs bool
+
+	localMaxSize      byteSize
+	localMaxAge       time.Duration
+	localTrimInterval time.Duration
+
+	circuitBreaker          bool
+	circuitBreakerFailures  int
+	circuitBreakerErrorRate float64
+	circuitBreakerCoolDown  time.Duration
+	circuitBreakerFallback  string
+
+	backendGetBudget time.Duration
+
+	downloadRateLimit byteSize
+	egressBudget      byteSize
+
+	adaptiveConcurrency        bool
+	adaptiveConcurrencyInitial int
+	adaptiveConcurrencyMax     int
+
+	asyncQueueMaxItems int
+	asyncQueueMaxBytes byteSize
+	asyncWorkers       int
+	asyncOverflow      string
+	asyncSpillDir      string
+
+	uploadMinSize    byteSize
+	uploadMaxSize    byteSize
+	uploadBudget     byteSize
+	uploadRateLimit  byteSize
+	uploadSampleRate float64
+
+	spoolDir          string
+	spoolDrainOnStart bool
+	closeTimeout      time.Duration
+
+	encryptionKeyFile string
+	encryptionKeyID   string
+	signingKeyFile    string
+	trustedKeysFile   string
 )
 
 func main() {
+	// Load the config file before any flag defaults are resolved from it.
+	if err := loadConfig(os.Args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+		os.Exit(1)
+	}
+
 	// Check if we have a subcommand
 	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
 		subcommand := os.Args[1]
@@ -45,6 +116,45 @@ func main() {
 		case "clear-remote":
 			runClearRemoteCommand()
 			return
+		case "flush":
+			runFlushCommand()
+			return
+		case "trim":
+			runTrimCommand()
+			return
+		case "verify":
+			runVerifyCommand()
+			return
+		case "export":
+			runExportCommand()
+			return
+		case "import":
+			runImportCommand()
+			return
+		case "promote":
+			runPromoteCommand()
+			return
+		case "config":
+			runConfigCommand()
+			return
+		case "doctor":
+			runDoctorCommand()
+			return
+		case "bench":
+			runBenchCommand()
+			return
+		case "replay":
+			runReplayCommand()
+			return
+		case "du":
+			runDuCommand()
+			return
+		case "gc-remote":
+			runGCRemoteCommand()
+			return
+		case "inspect":
+			runInspectCommand()
+			return
 		case "help", "-h", "--help":
 			printHelp()
 			return
@@ -60,39 +170,8 @@ func main() {
 }
 
 func runServerCommand() {
-	// Get defaults from environment variables.
-	// All variables support both GOBUILDCACHE_<KEY> and <KEY> forms, with prefixed taking precedence.
-	var (
-		serverFlags         = flag.NewFlagSet("server", flag.ExitOnError)
-		debugDefault        = getEnvBoolWithPrefix("DEBUG", false)
-		printStatsDefault   = getEnvBoolWithPrefix("PRINT_STATS", true)
-		backendDefault      = getEnvWithPrefix("BACKEND_TYPE", getEnv("BACKEND", "disk"))
-		lockTypeDefault     = getEnvWithPrefix("LOCK_TYPE", "fslock")
-		lockDirDefault      = getEnvWithPrefix("LOCK_DIR", filepath.Join(os.TempDir(), "gobuildcache", "locks"))
-		cacheDirDefault     = getEnvWithPrefix("CACHE_DIR", filepath.Join(os.TempDir(), "gobuildcache", "cache"))
-		s3BucketDefault     = getEnvWithPrefix("S3_BUCKET", "")
-		s3PrefixDefault     = getEnvWithPrefix("S3_PREFIX", "gobuildcache/")
-		gcsBucketDefault    = getEnvWithPrefix("GCS_BUCKET", "")
-		gcsPrefixDefault    = getEnvWithPrefix("GCS_PREFIX", "gobuildcache/")
-		errorRateDefault    = getEnvFloatWithPrefix("ERROR_RATE", 0.0)
-		compressionDefault  = getEnvBoolWithPrefix("COMPRESSION", true)
-		asyncBackendDefault = getEnvBoolWithPrefix("ASYNC_BACKEND", true)
-		readOnlyDefault     = getEnvBoolWithPrefix("READ_ONLY", false)
-	)
-	serverFlags.BoolVar(&debug, "debug", debugDefault, "Enable debug logging to stderr (env: DEBUG)")
-	serverFlags.BoolVar(&printStats, "stats", printStatsDefault, "Print cache statistics on exit (env: PRINT_STATS)")
-	serverFlags.StringVar(&backendType, "backend", backendDefault, "Backend type: disk (local only), s3, gcs (env: BACKEND_TYPE)")
-	serverFlags.StringVar(&lockingType, "lock-type", lockTypeDefault, "Locking type: memory (in-memory), fslock (filesystem) (env: LOCK_TYPE)")
-	serverFlags.StringVar(&lockDir, "lock-dir", lockDirDefault, "Lock directory for fslock (env: LOCK_DIR)")
-	serverFlags.StringVar(&cacheDir, "cache-dir", cacheDirDefault, "Local cache directory (env: CACHE_DIR)")
-	serverFlags.StringVar(&s3Bucket, "s3-bucket", s3BucketDefault, "S3 bucket name (required for s3 backend) (env: S3_BUCKET)")
-	serverFlags.StringVar(&s3Prefix, "s3-prefix", s3PrefixDefault, "S3 key prefix (optional) (env: S3_PREFIX)")
-	serverFlags.StringVar(&gcsBucket, "gcs-bucket", gcsBucketDefault, "GCS bucket name (required for gcs backend) (env: GCS_BUCKET)")
-	serverFlags.StringVar(&gcsPrefix, "gcs-prefix", gcsPrefixDefault, "GCS object prefix (optional) (env: GCS_PREFIX)")
-	serverFlags.Float64Var(&errorRate, "error-rate", errorRateDefault, "Error injection rate (0.0-1.0) for testing error handling (env: ERROR_RATE)")
-	serverFlags.BoolVar(&compression, "compression", compressionDefault, "Enable LZ4 compression for backend storage (env: COMPRESSION)")
-	serverFlags.BoolVar(&asyncBackend, "async-backend", asyncBackendDefault, "Enable async backend writer for non-blocking PUT operations (env: ASYNC_BACKEND)")
-	serverFlags.BoolVar(&readOnly, "read-only", readOnlyDefault, "Read-only mode: allow cache reads but skip writes (env: READ_ONLY)")
+	serverFlags := flag.NewFlagSet("server", flag.ExitOnError)
+	registerServerFlags(serverFlags)
 
 	serverFlags.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s [flags]\n\n", os.Args[0])
@@ -115,7 +194,53 @@ func runServerCommand() {
 		fmt.Fprintf(os.Stderr, "  COMPRESSION      Enable LZ4 compression (true/false)\n")
 		fmt.Fprintf(os.Stderr, "  ASYNC_BACKEND    Enable async backend writer (true/false)\n")
 		fmt.Fprintf(os.Stderr, "  READ_ONLY        Read-only mode: allow reads, skip writes (true/false)\n")
-		fmt.Fprintf(os.Stderr, "\nNote: Command-line flags take precedence over environment variables.\n")
+		fmt.Fprintf(os.Stderr, "  LOCAL_VERIFY     How local cache hits are verified (off, size, checksum)\n")
+		fmt.Fprintf(os.Stderr, "  VERIFY_OUTPUT_ID Verify that bodies hash to their output ID (true/false)\n")
+		fmt.Fprintf(os.Stderr, "  LOCAL_MAX_SIZE   Maximum size of the local cache (e.g. 20GB)\n")
+		fmt.Fprintf(os.Stderr, "  LOCAL_MAX_AGE    Evict local cache entries unused for this long (e.g. 168h)\n")
+		fmt.Fprintf(os.Stderr, "  LOCAL_TRIM_INTERVAL  How often the local cache is trimmed in the background\n")
+		fmt.Fprintf(os.Stderr, "  WRITE_NAMESPACE  Namespace that PUTs are written to\n")
+		fmt.Fprintf(os.Stderr, "  READ_NAMESPACES  Comma-separated, ordered list of namespaces GETs are read from\n")
+		fmt.Fprintf(os.Stderr, "  TRUST_LEVEL      Trust level (trusted, untrusted, auto)\n")
+		fmt.Fprintf(os.Stderr, "  QUARANTINE_NAMESPACE  Namespace that untrusted runs write into\n")
+		fmt.Fprintf(os.Stderr, "  QUARANTINE_RUN_ID     ID of an untrusted run, the sub-namespace of the quarantine namespace it writes into\n")
+		fmt.Fprintf(os.Stderr, "  UPLOAD_MANIFEST  File that the action IDs of uploaded entries are appended to\n")
+		fmt.Fprintf(os.Stderr, "  TRACE_FILE       File that every GET and PUT is appended to as JSON, for replay\n")
+		fmt.Fprintf(os.Stderr, "  REMOTE_TOUCH_INTERVAL  Refresh the access time of backend hits older than this (e.g. 24h)\n")
+		fmt.Fprintf(os.Stderr, "  ASYNC_QUEUE_MAX_ITEMS  Maximum number of queued async uploads\n")
+		fmt.Fprintf(os.Stderr, "  ASYNC_QUEUE_MAX_BYTES  Maximum bytes of queued async uploads (e.g. 512MB)\n")
+		fmt.Fprintf(os.Stderr, "  ASYNC_WORKERS          Maximum number of concurrent async uploads\n")
+		fmt.Fprintf(os.Stderr, "  ASYNC_OVERFLOW         Async queue overflow policy (block, drop-oldest, spill)\n")
+		fmt.Fprintf(os.Stderr, "  ASYNC_SPILL_DIR        Directory for spilled async uploads\n")
+		fmt.Fprintf(os.Stderr, "  UPLOAD_MIN_SIZE        Minimum size of objects uploaded to the backend (e.g. 1KB)\n")
+		fmt.Fprintf(os.Stderr, "  UPLOAD_MAX_SIZE        Maximum size of objects uploaded to the backend (e.g. 100MB)\n")
+		fmt.Fprintf(os.Stderr, "  UPLOAD_BUDGET          Total bytes a run may upload to the backend (e.g. 5GB)\n")
+		fmt.Fprintf(os.Stderr, "  UPLOAD_RATE_LIMIT      Maximum bytes per second uploaded to the backend (e.g. 50MB)\n")
+		fmt.Fprintf(os.Stderr, "  UPLOAD_SAMPLE_RATE     Fraction (0.0-1.0) of objects uploaded to the backend\n")
+		fmt.Fprintf(os.Stderr, "  SPOOL_DIR              Directory for the durable journal of pending uploads\n")
+		fmt.Fprintf(os.Stderr, "  SPOOL_DRAIN_ON_START   Upload entries left in the spool by previous processes (true/false)\n")
+		fmt.Fprintf(os.Stderr, "  CLOSE_TIMEOUT          Maximum time to wait for pending uploads on exit (e.g. 30s)\n")
+		fmt.Fprintf(os.Stderr, "  ENCRYPTION_KEY         Encryption keys (<key ID>:<base64 key>, comma-separated; GOBUILDCACHE_ prefix required)\n")
+		fmt.Fprintf(os.Stderr, "  ENCRYPTION_KEY_FILE    File of encryption keys, one <key ID>:<base64 key> per line\n")
+		fmt.Fprintf(os.Stderr, "  ENCRYPTION_KEY_ID      ID of the key new backend objects are encrypted with\n")
+		fmt.Fprintf(os.Stderr, "  SIGNING_KEY            Key entries are signed with (<key ID>:<algorithm>:<base64 key>; GOBUILDCACHE_ prefix required)\n")
+		fmt.Fprintf(os.Stderr, "  SIGNING_KEY_FILE       File with the key entries are signed with\n")
+		fmt.Fprintf(os.Stderr, "  TRUSTED_KEYS           Keys whose signatures are trusted (comma-separated; GOBUILDCACHE_ prefix required)\n")
+		fmt.Fprintf(os.Stderr, "  TRUSTED_KEYS_FILE      File of keys whose signatures are trusted, one per line\n")
+		fmt.Fprintf(os.Stderr, "  CIRCUIT_BREAKER  Degrade to local-only caching when the backend is unhealthy (true/false)\n")
+		fmt.Fprintf(os.Stderr, "  CIRCUIT_BREAKER_FAILURES    Consecutive failures that open the circuit\n")
+		fmt.Fprintf(os.Stderr, "  CIRCUIT_BREAKER_ERROR_RATE  Error rate (0.0-1.0) that opens the circuit\n")
+		fmt.Fprintf(os.Stderr, "  CIRCUIT_BREAKER_COOLDOWN    Cool-down before probing the backend again (e.g. 30s)\n")
+		fmt.Fprintf(os.Stderr, "  CIRCUIT_BREAKER_FALLBACK    Fallback backend type while the circuit is open (s3, gcs)\n")
+		fmt.Fprintf(os.Stderr, "  BACKEND_GET_BUDGET          Total time budget for backend GETs per run (e.g. 60s)\n")
+		fmt.Fprintf(os.Stderr, "  DOWNLOAD_RATE_LIMIT         Maximum bytes per second downloaded from the backend (e.g. 100MB)\n")
+		fmt.Fprintf(os.Stderr, "  EGRESS_BUDGET               Total bytes downloaded from the backend per run (e.g. 10GB)\n")
+		fmt.Fprintf(os.Stderr, "  ADAPTIVE_CONCURRENCY        Adapt backend concurrency to throttling (true/false)\n")
+		fmt.Fprintf(os.Stderr, "  ADAPTIVE_CONCURRENCY_INITIAL  Initial backend concurrency limit\n")
+		fmt.Fprintf(os.Stderr, "  ADAPTIVE_CONCURRENCY_MAX    Maximum backend concurrency limit\n")
+		fmt.Fprintf(os.Stderr, "  CONFIG                      Config file (GOBUILDCACHE_ prefix required)\n")
+		fmt.Fprintf(os.Stderr, "  PROFILE                     Config file profile (GOBUILDCACHE_ prefix required)\n")
+		fmt.Fprintf(os.Stderr, "\nNote: Command-line flags take precedence over environment variables, which take precedence over the config file.\n")
 		fmt.Fprintf(os.Stderr, "\nExamples:\n")
 		fmt.Fprintf(os.Stderr, "  # Run with disk backend using flags:\n")
 		fmt.Fprintf(os.Stderr, "  %s -cache-dir=/var/cache/go\n\n", os.Args[0])
@@ -132,49 +257,207 @@ func runServerCommand() {
 		fmt.Fprintf(os.Stderr, "  GOBUILDCACHE_BACKEND_TYPE=s3 %s -s3-bucket=my-cache-bucket -debug\n", os.Args[0])
 	}
 
+	registerConfigFlags(serverFlags)
 	serverFlags.Parse(os.Args[1:])
 	runServer()
 }
 
+// registerServerFlags registers the server's flags, which cover nearly every
+// setting, on fs.
+func registerServerFlags(serverFlags *flag.FlagSet) {
+	// Get defaults from environment variables and the config file.
+	// All variables support both GOBUILDCACHE_<KEY> and <KEY> forms, with prefixed taking precedence.
+	var (
+		debugDefault        = getEnvBoolWithPrefix("DEBUG", false)
+		printStatsDefault   = getEnvBoolWithPrefix("PRINT_STATS", true)
+		errorRateDefault    = getEnvFloatWithPrefix("ERROR_RATE", 0.0)
+		asyncBackendDefault = getEnvBoolWithPrefix("ASYNC_BACKEND", true)
+		readOnlyDefault     = getEnvBoolWithPrefix("READ_ONLY", false)
+
+		localVerifyDefault     = getEnvWithPrefix("LOCAL_VERIFY", string(localVerifySize))
+		verifyOutputIDsDefault = getEnvBoolWithPrefix("VERIFY_OUTPUT_ID", false)
+
+		localMaxSizeDefault      = getEnvBytesWithPrefix("LOCAL_MAX_SIZE", 0)
+		localMaxAgeDefault       = getEnvDurationWithPrefix("LOCAL_MAX_AGE", 0)
+		localTrimIntervalDefault = getEnvDurationWithPrefix("LOCAL_TRIM_INTERVAL", 5*time.Minute)
+
+		writeNamespaceDefault = getEnvWithPrefix("WRITE_NAMESPACE", "")
+		readNamespacesDefault = getEnvWithPrefix("READ_NAMESPACES", "")
+		trustDefault          = getEnvWithPrefix("TRUST_LEVEL", string(trustTrusted))
+		quarantineDefault     = getEnvWithPrefix("QUARANTINE_NAMESPACE", defaultQuarantineNamespace)
+		runIDDefault          = getEnvWithPrefix("QUARANTINE_RUN_ID", "")
+		uploadManifestDefault = getEnvWithPrefix("UPLOAD_MANIFEST", "")
+		traceFileDefault      = getEnvWithPrefix("TRACE_FILE", "")
+		remoteTouchDefault    = getEnvDurationWithPrefix("REMOTE_TOUCH_INTERVAL", 0)
+
+		circuitBreakerDefault          = getEnvBoolWithPrefix("CIRCUIT_BREAKER", false)
+		circuitBreakerFailuresDefault  = getEnvIntWithPrefix("CIRCUIT_BREAKER_FAILURES", 5)
+		circuitBreakerErrorRateDefault = getEnvFloatWithPrefix("CIRCUIT_BREAKER_ERROR_RATE", 0.5)
+		circuitBreakerCoolDownDefault  = getEnvDurationWithPrefix("CIRCUIT_BREAKER_COOLDOWN", 30*time.Second)
+		circuitBreakerFallbackDefault  = getEnvWithPrefix("CIRCUIT_BREAKER_FALLBACK", "")
+		backendGetBudgetDefault        = getEnvDurationWithPrefix("BACKEND_GET_BUDGET", 0)
+		downloadRateLimitDefault       = getEnvBytesWithPrefix("DOWNLOAD_RATE_LIMIT", 0)
+		egressBudgetDefault            = getEnvBytesWithPrefix("EGRESS_BUDGET", 0)
+
+		adaptiveConcurrencyDefault        = getEnvBoolWithPrefix("ADAPTIVE_CONCURRENCY", false)
+		adaptiveConcurrencyInitialDefault = getEnvIntWithPrefix("ADAPTIVE_CONCURRENCY_INITIAL", 64)
+		adaptiveConcurrencyMaxDefault     = getEnvIntWithPrefix("ADAPTIVE_CONCURRENCY_MAX", 1024)
+
+		asyncQueueMaxItemsDefault = getEnvIntWithPrefix("ASYNC_QUEUE_MAX_ITEMS", 0)
+		asyncQueueMaxBytesDefault = getEnvBytesWithPrefix("ASYNC_QUEUE_MAX_BYTES", 0)
+		asyncWorkersDefault       = getEnvIntWithPrefix("ASYNC_WORKERS", 0)
+		asyncOverflowDefault      = getEnvWithPrefix("ASYNC_OVERFLOW", string(backends.OverflowBlock))
+		asyncSpillDirDefault      = getEnvWithPrefix("ASYNC_SPILL_DIR", filepath.Join(os.TempDir(), "gobuildcache", "spill"))
+
+		uploadMinSizeDefault    = getEnvBytesWithPrefix("UPLOAD_MIN_SIZE", 0)
+		uploadMaxSizeDefault    = getEnvBytesWithPrefix("UPLOAD_MAX_SIZE", 0)
+		uploadBudgetDefault     = getEnvBytesWithPrefix("UPLOAD_BUDGET", 0)
+		uploadRateLimitDefault  = getEnvBytesWithPrefix("UPLOAD_RATE_LIMIT", 0)
+		uploadSampleRateDefault = getEnvFloatWithPrefix("UPLOAD_SAMPLE_RATE", 1.0)
+
+		spoolDirDefault          = getEnvWithPrefix("SPOOL_DIR", "")
+		spoolDrainOnStartDefault = getEnvBoolWithPrefix("SPOOL_DRAIN_ON_START", true)
+		closeTimeoutDefault      = getEnvDurationWithPrefix("CLOSE_TIMEOUT", 0)
+	)
+	serverFlags.BoolVar(&debug, "debug", debugDefault, "Enable debug logging to stderr (env: DEBUG)")
+	registerLocalCacheFlags(serverFlags)
+	registerLockFlags(serverFlags)
+	registerBackendFlags(serverFlags)
+	serverFlags.BoolVar(&printStats, "stats", printStatsDefault, "Print cache statistics on exit (env: PRINT_STATS)")
+	serverFlags.Float64Var(&errorRate, "error-rate", errorRateDefault, "Error injection rate (0.0-1.0) for testing error handling (env: ERROR_RATE)")
+	serverFlags.BoolVar(&asyncBackend, "async-backend", asyncBackendDefault, "Enable async backend writer for non-blocking PUT operations (env: ASYNC_BACKEND)")
+	serverFlags.BoolVar(&readOnly, "read-only", readOnlyDefault, "Read-only mode: allow cache reads but skip writes (env: READ_ONLY)")
+	serverFlags.StringVar(&localVerify, "local-verify", localVerifyDefault, "How local cache hits are verified before use: off, size, checksum (env: LOCAL_VERIFY)")
+	serverFlags.BoolVar(&verifyOutputIDs, "verify-output-id", verifyOutputIDsDefault, "Verify that bodies hash to their output ID before uploading and after downloading (env: VERIFY_OUTPUT_ID)")
+	localMaxSize = localMaxSizeDefault
+	serverFlags.Var(&localMaxSize, "local-max-size", "Maximum size of the local cache (e.g. 20GB), least recently used entries are evicted in the background, 0 disables (env: LOCAL_MAX_SIZE)")
+	serverFlags.DurationVar(&localMaxAge, "local-max-age", localMaxAgeDefault, "Evict local cache entries that haven't been used for this long (e.g. 168h), 0 disables (env: LOCAL_MAX_AGE)")
+	serverFlags.DurationVar(&localTrimInterval, "local-trim-interval", localTrimIntervalDefault, "How often the local cache is trimmed in the background when a limit is set (env: LOCAL_TRIM_INTERVAL)")
+	serverFlags.StringVar(&writeNamespace, "write-namespace", writeNamespaceDefault, "Namespace (key prefix within the bucket prefix) that PUTs are written to, e.g. branches/my-feature (env: WRITE_NAMESPACE)")
+	serverFlags.StringVar(&readNamespaces, "read-namespaces", readNamespacesDefault, "Comma-separated, ordered list of namespaces GETs are read from, defaults to the write namespace (env: READ_NAMESPACES)")
+	serverFlags.StringVar(&trust, "trust-level", trustDefault, "Trust level: trusted, untrusted (PUTs go to the quarantine namespace), auto (untrusted without a signing key) (env: TRUST_LEVEL)")
+	serverFlags.StringVar(&quarantineNamespace, "quarantine-namespace", quarantineDefault, "Namespace that untrusted runs write into and read from first (env: QUARANTINE_NAMESPACE)")
+	serverFlags.StringVar(&quarantineRunID, "quarantine-run-id", runIDDefault, "ID of this run, e.g. the CI run ID, required for untrusted runs, which write into their own sub-namespace of the quarantine namespace (env: QUARANTINE_RUN_ID)")
+	serverFlags.StringVar(&uploadManifestPath, "upload-manifest", uploadManifestDefault, "File that the action IDs of uploaded entries are appended to, e.g. for promote (env: UPLOAD_MANIFEST)")
+	serverFlags.StringVar(&traceFile, "trace-file", traceFileDefault, "File that every GET and PUT is appended to as a JSON line, for replay (env: TRACE_FILE)")
+	serverFlags.DurationVar(&remoteTouchInterval, "remote-touch-interval", remoteTouchDefault, "Refresh the access time of backend hits last written or touched longer ago than this (e.g. 24h), for gc-remote and lifecycle rules, 0 disables (env: REMOTE_TOUCH_INTERVAL)")
+	serverFlags.IntVar(&asyncQueueMaxItems, "async-queue-max-items", asyncQueueMaxItemsDefault, "Maximum number of uploads queued in memory by the async backend writer, 0 uses 128*GOMAXPROCS (env: ASYNC_QUEUE_MAX_ITEMS)")
+	asyncQueueMaxBytes = asyncQueueMaxBytesDefault
+	serverFlags.Var(&asyncQueueMaxBytes, "async-queue-max-bytes", "Maximum bytes queued in memory by the async backend writer (e.g. 512MB), 0 uses 512MB (env: ASYNC_QUEUE_MAX_BYTES)")
+	serverFlags.IntVar(&asyncWorkers, "async-workers", asyncWorkersDefault, "Maximum number of concurrent async uploads, 0 uses 16*GOMAXPROCS (env: ASYNC_WORKERS)")
+	serverFlags.StringVar(&asyncOverflow, "async-overflow", asyncOverflowDefault, "What to do when the async upload queue is full: block, drop-oldest, spill (env: ASYNC_OVERFLOW)")
+	serverFlags.StringVar(&asyncSpillDir, "async-spill-dir", asyncSpillDirDefault, "Directory for uploads spilled to disk by -async-overflow=spill (env: ASYNC_SPILL_DIR)")
+	uploadMinSize = uploadMinSizeDefault
+	serverFlags.Var(&uploadMinSize, "upload-min-size", "Objects smaller than this are not uploaded to the backend (e.g. 1KB), 0 disables (env: UPLOAD_MIN_SIZE)")
+	uploadMaxSize = uploadMaxSizeDefault
+	serverFlags.Var(&uploadMaxSize, "upload-max-size", "Objects larger than this are not uploaded to the backend (e.g. 100MB), 0 disables (env: UPLOAD_MAX_SIZE)")
+	uploadBudget = uploadBudgetDefault
+	serverFlags.Var(&uploadBudget, "upload-budget", "Total bytes a run may upload to the backend (e.g. 5GB), 0 disables (env: UPLOAD_BUDGET)")
+	uploadRateLimit = uploadRateLimitDefault
+	serverFlags.Var(&uploadRateLimit, "upload-rate-limit", "Maximum bytes per second uploaded to the backend, uploads above it are skipped (e.g. 50MB), 0 disables (env: UPLOAD_RATE_LIMIT)")
+	serverFlags.Float64Var(&uploadSampleRate, "upload-sample-rate", uploadSampleRateDefault, "Fraction (0.0-1.0) of objects uploaded to the backend (env: UPLOAD_SAMPLE_RATE)")
+	serverFlags.StringVar(&spoolDir, "spool-dir", spoolDirDefault, "Directory for a durable journal of pending uploads that survives process exit, empty disables (env: SPOOL_DIR)")
+	serverFlags.BoolVar(&spoolDrainOnStart, "spool-drain-on-start", spoolDrainOnStartDefault, "Upload entries left in the spool by previous processes on startup (env: SPOOL_DRAIN_ON_START)")
+	serverFlags.DurationVar(&closeTimeout, "close-timeout", closeTimeoutDefault, "Maximum time to wait for pending uploads on exit, 0 waits forever (env: CLOSE_TIMEOUT)")
+	serverFlags.BoolVar(&circuitBreaker, "circuit-breaker", circuitBreakerDefault, "Stop calling the backend for a cool-down period when it is unhealthy (env: CIRCUIT_BREAKER)")
+	serverFlags.IntVar(&circuitBreakerFailures, "circuit-breaker-failures", circuitBreakerFailuresDefault, "Consecutive backend failures that open the circuit, 0 disables (env: CIRCUIT_BREAKER_FAILURES)")
+	serverFlags.Float64Var(&circuitBreakerErrorRate, "circuit-breaker-error-rate", circuitBreakerErrorRateDefault, "Backend error rate (0.0-1.0) over recent operations that opens the circuit, 0 disables (env: CIRCUIT_BREAKER_ERROR_RATE)")
+	serverFlags.DurationVar(&circuitBreakerCoolDown, "circuit-breaker-cooldown", circuitBreakerCoolDownDefault, "How long the circuit stays open before probing the backend again (env: CIRCUIT_BREAKER_COOLDOWN)")
+	serverFlags.StringVar(&circuitBreakerFallback, "circuit-breaker-fallback", circuitBreakerFallbackDefault, "Optional fallback backend type (s3, gcs) used while the circuit is open (env: CIRCUIT_BREAKER_FALLBACK)")
+	serverFlags.BoolVar(&adaptiveConcurrency, "adaptive-concurrency", adaptiveConcurrencyDefault, "Adapt backend GET/PUT concurrency to throttling and timeouts (env: ADAPTIVE_CONCURRENCY)")
+	serverFlags.IntVar(&adaptiveConcurrencyInitial, "adaptive-concurrency-initial", adaptiveConcurrencyInitialDefault, "Initial concurrency limit for backend GETs and PUTs (env: ADAPTIVE_CONCURRENCY_INITIAL)")
+	serverFlags.IntVar(&adaptiveConcurrencyMax, "adaptive-concurrency-max", adaptiveConcurrencyMaxDefault, "Maximum concurrency limit for backend GETs and PUTs (env: ADAPTIVE_CONCURRENCY_MAX)")
+	serverFlags.DurationVar(&backendGetBudget, "backend-get-budget", backendGetBudgetDefault, "Total time a run may spend blocked on backend GETs before the backend is skipped, 0 disables (env: BACKEND_GET_BUDGET)")
+	downloadRateLimit = downloadRateLimitDefault
+	serverFlags.Var(&downloadRateLimit, "download-rate-limit", "Maximum combined bytes per second downloaded from the backend (e.g. 100MB), 0 disables (env: DOWNLOAD_RATE_LIMIT)")
+	egressBudget = egressBudgetDefault
+	serverFlags.Var(&egressBudget, "egress-budget", "Total bytes a run may download from the backend before the backend is skipped (e.g. 10GB), 0 disables (env: EGRESS_BUDGET)")
+}
+
+// registerBackendFlags registers the flags that select the backend and how
+// entries are stored in it: the backend type, the S3 and GCS buckets and
+// prefixes, compression, and the encryption and signing keys. The server and
+// every subcommand that talks to the backend share them, so they resolve the
+// same way everywhere.
+func registerBackendFlags(fs *flag.FlagSet) {
+	var (
+		backendDefault           = getEnvWithPrefix("BACKEND_TYPE", getEnv("BACKEND", "disk"))
+		s3BucketDefault          = getEnvWithPrefix("S3_BUCKET", "")
+		s3PrefixDefault          = getEnvWithPrefix("S3_PREFIX", defaultBucketPrefix)
+		gcsBucketDefault         = getEnvWithPrefix("GCS_BUCKET", "")
+		gcsPrefixDefault         = getEnvWithPrefix("GCS_PREFIX", defaultBucketPrefix)
+		compressionDefault       = getEnvBoolWithPrefix("COMPRESSION", true)
+		encryptionKeyFileDefault = getEnvWithPrefix("ENCRYPTION_KEY_FILE", "")
+		encryptionKeyIDDefault   = getEnvWithPrefix("ENCRYPTION_KEY_ID", "")
+		signingKeyFileDefault    = getEnvWithPrefix("SIGNING_KEY_FILE", "")
+		trustedKeysFileDefault   = getEnvWithPrefix("TRUSTED_KEYS_FILE", "")
+	)
+	fs.StringVar(&backendType, "backend", backendDefault, "Backend type: disk (local only), s3, gcs (env: BACKEND_TYPE)")
+	fs.StringVar(&s3Bucket, "s3-bucket", s3BucketDefault, "S3 bucket name (required for s3 backend) (env: S3_BUCKET)")
+	fs.StringVar(&s3Prefix, "s3-prefix", s3PrefixDefault, "S3 key prefix (optional, supports templates like {goversion}) (env: S3_PREFIX)")
+	fs.StringVar(&gcsBucket, "gcs-bucket", gcsBucketDefault, "GCS bucket name (required for gcs backend) (env: GCS_BUCKET)")
+	fs.StringVar(&gcsPrefix, "gcs-prefix", gcsPrefixDefault, "GCS object prefix (optional, supports templates like {goversion}) (env: GCS_PREFIX)")
+	fs.BoolVar(&compression, "compression", compressionDefault, "Enable LZ4 compression for backend storage (env: COMPRESSION)")
+	fs.StringVar(&encryptionKeyFile, "encryption-key-file", encryptionKeyFileDefault, "File of <key ID>:<base64 key> lines used to encrypt backend objects (env: ENCRYPTION_KEY_FILE)")
+	fs.StringVar(&encryptionKeyID, "encryption-key-id", encryptionKeyIDDefault, "ID of the key new backend objects are encrypted with, defaults to the first key (env: ENCRYPTION_KEY_ID)")
+	fs.StringVar(&signingKeyFile, "signing-key-file", signingKeyFileDefault, "File with the <key ID>:<algorithm>:<base64 key> key uploaded entries are signed with (env: SIGNING_KEY_FILE)")
+	fs.StringVar(&trustedKeysFile, "trusted-keys-file", trustedKeysFileDefault, "File of <key ID>:<algorithm>:<base64 key> lines whose signatures are trusted (env: TRUSTED_KEYS_FILE)")
+}
+
+// registerLocalCacheFlags registers the flag of the local cache directory.
+func registerLocalCacheFlags(fs *flag.FlagSet) {
+	cacheDirDefault := getEnvWithPrefix("CACHE_DIR", filepath.Join(os.TempDir(), "gobuildcache", "cache"))
+	fs.StringVar(&cacheDir, "cache-dir", cacheDirDefault, "Local cache directory (env: CACHE_DIR)")
+}
+
+// registerLockFlags registers the flags of the locks that fence local cache
+// entries, which every process using the same cache directory must share.
+func registerLockFlags(fs *flag.FlagSet) {
+	var (
+		lockTypeDefault = getEnvWithPrefix("LOCK_TYPE", "fslock")
+		lockDirDefault  = getEnvWithPrefix("LOCK_DIR", filepath.Join(os.TempDir(), "gobuildcache", "locks"))
+	)
+	fs.StringVar(&lockingType, "lock-type", lockTypeDefault, "Locking type: memory (in-memory), fslock (filesystem) (env: LOCK_TYPE)")
+	fs.StringVar(&lockDir, "lock-dir", lockDirDefault, "Lock directory for fslock (env: LOCK_DIR)")
+}
+
+// printFlagDefaults prints the flags of a subcommand, and how they can be set
+// other than on the command line.
+func printFlagDefaults(fs *flag.FlagSet) {
+	fmt.Fprintf(os.Stderr, "Flags (can also be set via environment variables or the config file):\n")
+	fs.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "\nEnvironment Variables:\n")
+	fmt.Fprintf(os.Stderr, "  Every flag can also be set with the variable shown as (env: <KEY>), in both\n")
+	fmt.Fprintf(os.Stderr, "  GOBUILDCACHE_<KEY> and <KEY> forms. The prefixed version takes precedence.\n")
+	if fs.Lookup("encryption-key-file") != nil {
+		fmt.Fprintf(os.Stderr, "  Keys can also be passed directly in %s, %s\n", encryptionKeyEnvVar, signingKeyEnvVar)
+		fmt.Fprintf(os.Stderr, "  and %s (prefix required).\n", trustedKeysEnvVar)
+	}
+	fmt.Fprintf(os.Stderr, "\nNote: Command-line flags take precedence over environment variables, which take precedence over the config file.\n")
+}
+
 func runClearCommand() {
-	// Get defaults from environment variables.
+	// Get defaults from environment variables and the config file.
 	// All variables support both GOBUILDCACHE_<KEY> and <KEY> forms, with prefixed taking precedence.
 	var (
-		clearFlags      = flag.NewFlagSet("clear", flag.ExitOnError)
-		debugDefault    = getEnvBoolWithPrefix("DEBUG", false)
-		backendDefault  = getEnvWithPrefix("BACKEND_TYPE", getEnv("BACKEND", "disk"))
-		cacheDirDefault = getEnvWithPrefix("CACHE_DIR", filepath.Join(os.TempDir(), "gobuildcache", "cache"))
-		s3BucketDefault = getEnvWithPrefix("S3_BUCKET", "")
-		s3PrefixDefault = getEnvWithPrefix("S3_PREFIX", "")
-		gcsBucketDefault = getEnvWithPrefix("GCS_BUCKET", "")
-		gcsPrefixDefault = getEnvWithPrefix("GCS_PREFIX", "")
+		clearFlags   = flag.NewFlagSet("clear", flag.ExitOnError)
+		debugDefault = getEnvBoolWithPrefix("DEBUG", false)
+		dryRun       bool
+		yes          bool
+		concurrency  int
 	)
 	clearFlags.BoolVar(&debug, "debug", debugDefault, "Enable debug logging to stderr (env: DEBUG)")
-	clearFlags.StringVar(&backendType, "backend", backendDefault, "Backend type: disk (local only), s3, gcs (env: BACKEND_TYPE)")
-	clearFlags.StringVar(&cacheDir, "cache-dir", cacheDirDefault, "Local cache directory (env: CACHE_DIR)")
-	clearFlags.StringVar(&s3Bucket, "s3-bucket", s3BucketDefault, "S3 bucket name (required for s3 backend) (env: S3_BUCKET)")
-	clearFlags.StringVar(&s3Prefix, "s3-prefix", s3PrefixDefault, "S3 key prefix (optional) (env: S3_PREFIX)")
-	clearFlags.StringVar(&gcsBucket, "gcs-bucket", gcsBucketDefault, "GCS bucket name (required for gcs backend) (env: GCS_BUCKET)")
-	clearFlags.StringVar(&gcsPrefix, "gcs-prefix", gcsPrefixDefault, "GCS object prefix (optional) (env: GCS_PREFIX)")
+	registerLocalCacheFlags(clearFlags)
+	registerBackendFlags(clearFlags)
+	clearFlags.BoolVar(&dryRun, "dry-run", false, "Report the number of remote objects that would be deleted without deleting anything")
+	clearFlags.BoolVar(&yes, "yes", false, "Delete remote objects without asking for confirmation")
+	clearFlags.IntVar(&concurrency, "concurrency", 16, "Number of concurrent delete requests")
 
 	clearFlags.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s clear [flags]\n\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "Clear all entries from the cache.\n\n")
-		fmt.Fprintf(os.Stderr, "Flags (can also be set via environment variables):\n")
-		clearFlags.PrintDefaults()
-		fmt.Fprintf(os.Stderr, "\nEnvironment Variables:\n")
-		fmt.Fprintf(os.Stderr, "  All variables support both GOBUILDCACHE_<KEY> and <KEY> forms.\n")
-		fmt.Fprintf(os.Stderr, "  The prefixed version takes precedence if both are set.\n\n")
-		fmt.Fprintf(os.Stderr, "  DEBUG          Enable debug logging (true/false)\n")
-		fmt.Fprintf(os.Stderr, "  PRINT_STATS    Print cache statistics on exit (true/false)\n")
-		fmt.Fprintf(os.Stderr, "  BACKEND_TYPE   Backend type (disk, s3, gcs)\n")
-		fmt.Fprintf(os.Stderr, "  CACHE_DIR      Local cache directory\n")
-		fmt.Fprintf(os.Stderr, "  S3_BUCKET      S3 bucket name\n")
-		fmt.Fprintf(os.Stderr, "  S3_PREFIX      S3 key prefix\n")
-		fmt.Fprintf(os.Stderr, "  GCS_BUCKET     GCS bucket name\n")
-		fmt.Fprintf(os.Stderr, "  GCS_PREFIX     GCS object prefix\n")
-		fmt.Fprintf(os.Stderr, "  S3_TMP_DIR     Local temp directory for S3 backend\n")
-		fmt.Fprintf(os.Stderr, "\nNote: Command-line flags take precedence over environment variables.\n")
+		fmt.Fprintf(os.Stderr, "Clear all entries from the cache. The remote objects are deleted as with\n")
+		fmt.Fprintf(os.Stderr, "clear-remote, after confirmation, and then the local cache is cleared.\n\n")
+		printFlagDefaults(clearFlags)
 		fmt.Fprintf(os.Stderr, "\nExamples:\n")
 		fmt.Fprintf(os.Stderr, "  # Clear disk cache using flags:\n")
 		fmt.Fprintf(os.Stderr, "  %s clear -cache-dir=/var/cache/go\n\n", os.Args[0])
@@ -182,36 +465,29 @@ func runClearCommand() {
 		fmt.Fprintf(os.Stderr, "  %s clear -backend=s3 -s3-bucket=my-cache-bucket\n\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  # Clear GCS cache using flags:\n")
 		fmt.Fprintf(os.Stderr, "  %s clear -backend=gcs -gcs-bucket=my-cache-bucket\n\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "  # Clear using environment variables:\n")
-		fmt.Fprintf(os.Stderr, "  GOBUILDCACHE_BACKEND_TYPE=s3 GOBUILDCACHE_S3_BUCKET=my-cache-bucket %s clear\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  # Clear using environment variables, without confirmation (e.g. in CI):\n")
+		fmt.Fprintf(os.Stderr, "  GOBUILDCACHE_BACKEND_TYPE=s3 GOBUILDCACHE_S3_BUCKET=my-cache-bucket %s clear -yes\n", os.Args[0])
 	}
 
+	registerConfigFlags(clearFlags)
 	clearFlags.Parse(os.Args[2:])
-	runClear()
+	runClear(clearOptions{DryRun: dryRun, Concurrency: concurrency}, yes)
 }
 
 func runClearLocalCommand() {
-	// Get defaults from environment variables.
+	// Get defaults from environment variables and the config file.
 	// All variables support both GOBUILDCACHE_<KEY> and <KEY> forms, with prefixed taking precedence.
 	var (
 		clearLocalFlags = flag.NewFlagSet("clear-local", flag.ExitOnError)
 		debugDefault    = getEnvBoolWithPrefix("DEBUG", false)
-		cacheDirDefault = getEnvWithPrefix("CACHE_DIR", filepath.Join(os.TempDir(), "gobuildcache", "cache"))
 	)
 	clearLocalFlags.BoolVar(&debug, "debug", debugDefault, "Enable debug logging to stderr (env: DEBUG)")
-	clearLocalFlags.StringVar(&cacheDir, "cache-dir", cacheDirDefault, "Local cache directory (env: CACHE_DIR)")
+	registerLocalCacheFlags(clearLocalFlags)
 
 	clearLocalFlags.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s clear-local [flags]\n\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "Clear only the local filesystem cache directory.\n\n")
-		fmt.Fprintf(os.Stderr, "Flags (can also be set via environment variables):\n")
-		clearLocalFlags.PrintDefaults()
-		fmt.Fprintf(os.Stderr, "\nEnvironment Variables:\n")
-		fmt.Fprintf(os.Stderr, "  All variables support both GOBUILDCACHE_<KEY> and <KEY> forms.\n")
-		fmt.Fprintf(os.Stderr, "  The prefixed version takes precedence if both are set.\n\n")
-		fmt.Fprintf(os.Stderr, "  DEBUG          Enable debug logging (true/false)\n")
-		fmt.Fprintf(os.Stderr, "  CACHE_DIR      Local cache directory\n")
-		fmt.Fprintf(os.Stderr, "\nNote: Command-line flags take precedence over environment variables.\n")
+		printFlagDefaults(clearLocalFlags)
 		fmt.Fprintf(os.Stderr, "\nExamples:\n")
 		fmt.Fprintf(os.Stderr, "  # Clear local cache using default directory:\n")
 		fmt.Fprintf(os.Stderr, "  %s clear-local\n\n", os.Args[0])
@@ -221,6 +497,7 @@ func runClearLocalCommand() {
 		fmt.Fprintf(os.Stderr, "  GOBUILDCACHE_CACHE_DIR=/var/cache/go %s clear-local\n", os.Args[0])
 	}
 
+	registerConfigFlags(clearLocalFlags)
 	clearLocalFlags.Parse(os.Args[2:])
 
 	// Clear the local cache directory
@@ -233,39 +510,33 @@ func runClearLocalCommand() {
 }
 
 func runClearRemoteCommand() {
-	// Get defaults from environment variables.
+	// Get defaults from environment variables and the config file.
 	// All variables support both GOBUILDCACHE_<KEY> and <KEY> forms, with prefixed taking precedence.
 	var (
 		clearRemoteFlags = flag.NewFlagSet("clear-remote", flag.ExitOnError)
 		debugDefault     = getEnvBoolWithPrefix("DEBUG", false)
-		backendDefault   = getEnvWithPrefix("BACKEND_TYPE", getEnv("BACKEND", "disk"))
-		s3BucketDefault  = getEnvWithPrefix("S3_BUCKET", "")
-		s3PrefixDefault  = getEnvWithPrefix("S3_PREFIX", "")
-		gcsBucketDefault = getEnvWithPrefix("GCS_BUCKET", "")
-		gcsPrefixDefault = getEnvWithPrefix("GCS_PREFIX", "")
+		dryRun           bool
+		yes              bool
+		filter           clearFilter
+		olderThan        age
+		largerThan       byteSize
+		concurrency      int
 	)
 	clearRemoteFlags.BoolVar(&debug, "debug", debugDefault, "Enable debug logging to stderr (env: DEBUG)")
-	clearRemoteFlags.StringVar(&backendType, "backend", backendDefault, "Backend type: disk, s3, gcs (env: BACKEND_TYPE)")
-	clearRemoteFlags.StringVar(&s3Bucket, "s3-bucket", s3BucketDefault, "S3 bucket name (required for s3 backend) (env: S3_BUCKET)")
-	clearRemoteFlags.StringVar(&s3Prefix, "s3-prefix", s3PrefixDefault, "S3 key prefix (optional) (env: S3_PREFIX)")
-	clearRemoteFlags.StringVar(&gcsBucket, "gcs-bucket", gcsBucketDefault, "GCS bucket name (required for gcs backend) (env: GCS_BUCKET)")
-	clearRemoteFlags.StringVar(&gcsPrefix, "gcs-prefix", gcsPrefixDefault, "GCS object prefix (optional) (env: GCS_PREFIX)")
+	registerBackendFlags(clearRemoteFlags)
+	clearRemoteFlags.BoolVar(&dryRun, "dry-run", false, "Report the number of objects that would be deleted without deleting anything")
+	clearRemoteFlags.BoolVar(&yes, "yes", false, "Delete without asking for confirmation")
+	clearRemoteFlags.StringVar(&filter.Prefix, "prefix", "", "Only delete entries whose key within the bucket prefix starts with this, e.g. a namespace like branches/")
+	clearRemoteFlags.Var(&olderThan, "older-than", "Only delete objects written at least this long ago (e.g. 30d, 12h)")
+	clearRemoteFlags.Var(&largerThan, "larger-than", "Only delete objects larger than this (e.g. 100MB)")
+	clearRemoteFlags.IntVar(&concurrency, "concurrency", 16, "Number of concurrent delete requests")
 
 	clearRemoteFlags.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s clear-remote [flags]\n\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "Clear only the remote backend cache (e.g., S3).\n\n")
-		fmt.Fprintf(os.Stderr, "Flags (can also be set via environment variables):\n")
-		clearRemoteFlags.PrintDefaults()
-		fmt.Fprintf(os.Stderr, "\nEnvironment Variables:\n")
-		fmt.Fprintf(os.Stderr, "  All variables support both GOBUILDCACHE_<KEY> and <KEY> forms.\n")
-		fmt.Fprintf(os.Stderr, "  The prefixed version takes precedence if both are set.\n\n")
-		fmt.Fprintf(os.Stderr, "  DEBUG          Enable debug logging (true/false)\n")
-		fmt.Fprintf(os.Stderr, "  BACKEND_TYPE   Backend type (disk, s3, gcs)\n")
-		fmt.Fprintf(os.Stderr, "  S3_BUCKET      S3 bucket name\n")
-		fmt.Fprintf(os.Stderr, "  S3_PREFIX      S3 key prefix\n")
-		fmt.Fprintf(os.Stderr, "  GCS_BUCKET     GCS bucket name\n")
-		fmt.Fprintf(os.Stderr, "  GCS_PREFIX     GCS object prefix\n")
-		fmt.Fprintf(os.Stderr, "\nNote: Command-line flags take precedence over environment variables.\n")
+		fmt.Fprintf(os.Stderr, "Clear only the remote backend cache (e.g., S3). The objects to delete are\n")
+		fmt.Fprintf(os.Stderr, "counted first and the deletion must be confirmed, interactively or with -yes.\n")
+		fmt.Fprintf(os.Stderr, "Objects under the prefix whose names gobuildcache didn't generate are kept.\n\n")
+		printFlagDefaults(clearRemoteFlags)
 		fmt.Fprintf(os.Stderr, "\nExamples:\n")
 		fmt.Fprintf(os.Stderr, "  # Clear S3 cache using flags:\n")
 		fmt.Fprintf(os.Stderr, "  %s clear-remote -backend=s3 -s3-bucket=my-cache-bucket\n\n", os.Args[0])
@@ -273,186 +544,1716 @@ func runClearRemoteCommand() {
 		fmt.Fprintf(os.Stderr, "  %s clear-remote -backend=gcs -gcs-bucket=my-cache-bucket\n\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  # Clear S3 cache with prefix:\n")
 		fmt.Fprintf(os.Stderr, "  %s clear-remote -backend=s3 -s3-bucket=my-cache-bucket -s3-prefix=myproject/\n\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "  # Clear using environment variables:\n")
-		fmt.Fprintf(os.Stderr, "  GOBUILDCACHE_BACKEND_TYPE=s3 GOBUILDCACHE_S3_BUCKET=my-cache-bucket %s clear-remote\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  # Count the branch entries older than a week, without deleting them:\n")
+		fmt.Fprintf(os.Stderr, "  %s clear-remote -backend=s3 -s3-bucket=my-cache-bucket -prefix=branches/ -older-than=7d -dry-run\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  # Clear using environment variables, without confirmation (e.g. in CI):\n")
+		fmt.Fprintf(os.Stderr, "  GOBUILDCACHE_BACKEND_TYPE=s3 GOBUILDCACHE_S3_BUCKET=my-cache-bucket %s clear-remote -yes\n", os.Args[0])
 	}
 
+	registerConfigFlags(clearRemoteFlags)
 	clearRemoteFlags.Parse(os.Args[2:])
+	filter.OlderThan = time.Duration(olderThan)
+	filter.LargerThan = int64(largerThan)
 
-	// Create backend
-	backend, err := createBackend()
+	if strings.EqualFold(backendType, "disk") {
+		fmt.Fprintf(os.Stdout, "Nothing to clear: the disk backend has no remote storage\n")
+		return
+	}
+
+	clearRemoteCache(filter, clearOptions{DryRun: dryRun, Concurrency: concurrency}, yes)
+}
+
+// clearRemoteCache deletes the objects of the configured remote backend that
+// match filter, asking for confirmation on the terminal unless yes is set, and
+// prints the report. It exits if the deletion fails or is aborted.
+func clearRemoteCache(filter clearFilter, opts clearOptions, yes bool) {
+	backend, err := createStorageBackend(backendType)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error creating backend: %v\n", err)
 		os.Exit(1)
 	}
+	if debug {
+		backend = backends.NewDebug(backend)
+	}
 	defer backend.Close()
+	lister, canList := backends.Find[backends.Lister](backend)
+	deleter, canDelete := backends.Find[backends.Deleter](backend)
+	if !canList || !canDelete {
+		fmt.Fprintf(os.Stderr, "Error: the %s backend doesn't support listing and deleting objects\n", backendType)
+		os.Exit(1)
+	}
 
-	// Clear the backend (remote storage)
-	if err := backend.Clear(); err != nil {
+	// The prefixes expanded without error when the backend was created.
+	prefix, _ := expandPrefixTemplate(s3Prefix)
+	location := fmt.Sprintf("s3://%s/%s", s3Bucket, prefix)
+	if strings.EqualFold(backendType, "gcs") {
+		prefix, _ := expandPrefixTemplate(gcsPrefix)
+		location = fmt.Sprintf("gs://%s/%s", gcsBucket, prefix)
+	}
+	if !yes && !opts.DryRun {
+		if stat, err := os.Stdin.Stat(); err != nil || stat.Mode()&os.ModeCharDevice == 0 {
+			fmt.Fprintf(os.Stderr, "Error: stdin is not a terminal, pass -yes to delete without confirmation\n")
+			os.Exit(1)
+		}
+		opts.Confirm = func(matched objectCount) bool {
+			return confirmClear(os.Stdin, os.Stderr, location, matched)
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Listing %s...\n", location)
+	report, err := runClearRemote(lister, deleter, filter, opts, time.Now(), os.Stderr)
+	if errors.Is(err, errClearAborted) {
+		fmt.Fprintf(os.Stderr, "Aborted, nothing was deleted\n")
+		os.Exit(1)
+	}
+	if report != nil {
+		printClearReport(os.Stdout, report)
+	}
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error clearing backend cache: %v\n", err)
 		os.Exit(1)
 	}
-
-	fmt.Fprintf(os.Stdout, "Remote cache cleared successfully\n")
+	if report.Failed.Objects > 0 {
+		os.Exit(1)
+	}
 }
 
-func printHelp() {
-	fmt.Fprintf(os.Stderr, "Usage: %s [command] [flags]\n\n", os.Args[0])
-	fmt.Fprintf(os.Stderr, "A remote caching server for Go builds.\n\n")
-	fmt.Fprintf(os.Stderr, "Commands:\n")
-	fmt.Fprintf(os.Stderr, "  (no command)  Run the cache server (default)\n")
-	fmt.Fprintf(os.Stderr, "  clear         Clear both local and remote cache entries\n")
-	fmt.Fprintf(os.Stderr, "  clear-local   Clear only local cache directory\n")
-	fmt.Fprintf(os.Stderr, "  clear-remote  Clear only remote backend cache\n")
-	fmt.Fprintf(os.Stderr, "  help          Show this help message\n\n")
-	fmt.Fprintf(os.Stderr, "Configuration:\n")
-	fmt.Fprintf(os.Stderr, "  Flags can be set via command-line arguments or environment variables.\n")
-	fmt.Fprintf(os.Stderr, "  Command-line flags take precedence over environment variables.\n\n")
-	fmt.Fprintf(os.Stderr, "Run '%s [command] -h' for more information about a command.\n", os.Args[0])
-}
+func runFlushCommand() {
+	// Get defaults from environment variables and the config file.
+	// All variables support both GOBUILDCACHE_<KEY> and <KEY> forms, with prefixed taking precedence.
+	var (
+		flushFlags         = flag.NewFlagSet("flush", flag.ExitOnError)
+		debugDefault       = getEnvBoolWithPrefix("DEBUG", false)
+		spoolDirDefault    = getEnvWithPrefix("SPOOL_DIR", "")
+		parallelismDefault = getEnvIntWithPrefix("FLUSH_PARALLELISM", 16)
+		parallelism        int
+	)
+	flushFlags.BoolVar(&debug, "debug", debugDefault, "Enable debug logging to stderr (env: DEBUG)")
+	registerBackendFlags(flushFlags)
+	flushFlags.StringVar(&spoolDir, "spool-dir", spoolDirDefault, "Upload spool directory (required) (env: SPOOL_DIR)")
+	flushFlags.IntVar(&parallelism, "parallelism", parallelismDefault, "Number of concurrent uploads (env: FLUSH_PARALLELISM)")
 
-func runServer() {
-	// Create backend
-	backend, err := createBackend()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error creating cache backend: %v\n", err)
+	flushFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s flush [flags]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Upload entries left in the upload spool by runs that exited before their\n")
+		fmt.Fprintf(os.Stderr, "uploads completed. Spools owned by running processes are skipped.\n\n")
+		printFlagDefaults(flushFlags)
+		fmt.Fprintf(os.Stderr, "\nExamples:\n")
+		fmt.Fprintf(os.Stderr, "  # Flush pending uploads in a CI post-job step:\n")
+		fmt.Fprintf(os.Stderr, "  %s flush -backend=s3 -s3-bucket=my-cache-bucket -spool-dir=/tmp/gobuildcache/spool\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  # Flush using environment variables:\n")
+		fmt.Fprintf(os.Stderr, "  GOBUILDCACHE_BACKEND_TYPE=s3 GOBUILDCACHE_S3_BUCKET=my-cache-bucket GOBUILDCACHE_SPOOL_DIR=/tmp/gobuildcache/spool %s flush\n", os.Args[0])
+	}
+
+	registerConfigFlags(flushFlags)
+	flushFlags.Parse(os.Args[2:])
+
+	if spoolDir == "" {
+		fmt.Fprintf(os.Stderr, "Error: spool directory is required (set via -spool-dir flag or SPOOL_DIR env var)\n")
 		os.Exit(1)
 	}
-	defer backend.Close()
 
-	lockingGroup, err := createLockingGroup()
+	// Create backend
+	backend, err := createBackend(nil)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error creating lock group: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Error creating backend: %v\n", err)
 		os.Exit(1)
 	}
+	defer backend.Close()
 
-	if readOnly && debug {
-		fmt.Fprintf(os.Stderr, "[INFO] Read-only mode enabled: cache reads allowed, writes skipped\n")
+	logLevel := slog.LevelInfo
+	if debug {
+		logLevel = slog.LevelDebug
 	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level: logLevel,
+	}))
 
-	prog, err := NewCacheProg(backend, lockingGroup, cacheDir, debug, printStats, compression, readOnly)
+	result, err := flushSpool(backend, spoolDir, parallelism, logger)
+	fmt.Fprintf(os.Stdout, "Uploaded %d entries (%s), skipped %d stale entries, %d failed\n",
+		result.Uploaded, formatBytes(result.Bytes), result.Skipped, result.Failed)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error creating cache program: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Error flushing upload spool: %v\n", err)
 		os.Exit(1)
 	}
-	if err := prog.Run(); err != nil {
-		fmt.Fprintf(os.Stderr, "Error running cache program: %v\n", err)
+	if result.Failed > 0 {
 		os.Exit(1)
 	}
 }
 
-func runClear() {
-	// Create backend
-	backend, err := createBackend()
+func runTrimCommand() {
+	// Get defaults from environment variables and the config file.
+	// All variables support both GOBUILDCACHE_<KEY> and <KEY> forms, with prefixed taking precedence.
+	var (
+		trimFlags          = flag.NewFlagSet("trim", flag.ExitOnError)
+		debugDefault       = getEnvBoolWithPrefix("DEBUG", false)
+		maxSizeDefault     = getEnvBytesWithPrefix("LOCAL_MAX_SIZE", 0)
+		maxAgeDefault      = getEnvDurationWithPrefix("LOCAL_MAX_AGE", 0)
+		staleTmpAgeDefault = getEnvDurationWithPrefix("STALE_TMP_AGE", defaultStaleTmpAge)
+		maxSize            byteSize
+		maxAge             time.Duration
+		staleTmpAge        time.Duration
+		dryRun             bool
+	)
+	trimFlags.BoolVar(&debug, "debug", debugDefault, "Enable debug logging to stderr (env: DEBUG)")
+	registerLocalCacheFlags(trimFlags)
+	registerLockFlags(trimFlags)
+	maxSize = maxSizeDefault
+	trimFlags.Var(&maxSize, "max-size", "Evict least recently used entries until the cache is below this size (e.g. 20GB), 0 disables (env: LOCAL_MAX_SIZE)")
+	trimFlags.DurationVar(&maxAge, "max-age", maxAgeDefault, "Evict entries that haven't been used for this long (e.g. 168h), 0 disables (env: LOCAL_MAX_AGE)")
+	trimFlags.DurationVar(&staleTmpAge, "stale-tmp-age", staleTmpAgeDefault, "Remove temp files left by crashed processes once they are this old (env: STALE_TMP_AGE)")
+	trimFlags.BoolVar(&dryRun, "dry-run", false, "Report what would be removed without removing anything")
+
+	trimFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s trim [flags]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Trim the local cache directory by evicting least recently used entries and\n")
+		fmt.Fprintf(os.Stderr, "removing temp files left behind by crashed processes. Entries are evicted\n")
+		fmt.Fprintf(os.Stderr, "under the same locks as the cache server, so it is safe to run concurrently.\n\n")
+		printFlagDefaults(trimFlags)
+		fmt.Fprintf(os.Stderr, "\nExamples:\n")
+		fmt.Fprintf(os.Stderr, "  # Keep the local cache under 20GB:\n")
+		fmt.Fprintf(os.Stderr, "  %s trim -max-size=20GB\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  # Evict entries unused for a week, without removing anything:\n")
+		fmt.Fprintf(os.Stderr, "  %s trim -max-age=168h -dry-run\n", os.Args[0])
+	}
+
+	registerConfigFlags(trimFlags)
+	trimFlags.Parse(os.Args[2:])
+
+	lockingGroup, err := createLockingGroup()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error creating cache backend: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Error creating lock group: %v\n", err)
 		os.Exit(1)
 	}
-	defer backend.Close()
 
-	// Clear the backend (remote storage)
-	if err := backend.Clear(); err != nil {
-		fmt.Fprintf(os.Stderr, "Error clearing backend cache: %v\n", err)
-		os.Exit(1)
+	logLevel := slog.LevelInfo
+	if debug {
+		logLevel = slog.LevelDebug
 	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level: logLevel,
+	}))
 
-	// Clear the local cache directory
-	if err := clearLocalCache(cacheDir); err != nil {
-		fmt.Fprintf(os.Stderr, "Error clearing local cache: %v\n", err)
+	lc, err := newLocalCache(cacheDir, logger)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening local cache: %v\n", err)
 		os.Exit(1)
 	}
 
-	fmt.Fprintf(os.Stdout, "Cache cleared successfully\n")
-}
-
-// clearLocalCache removes all entries from the local cache directory.
-func clearLocalCache(cacheDir string) error {
-	// Remove the entire directory and recreate it
-	// os.RemoveAll is idempotent - it doesn't error if path doesn't exist
-	if err := os.RemoveAll(cacheDir); err != nil {
-		return fmt.Errorf("failed to remove cache directory: %w", err)
+	result, err := lc.trim(trimOptions{
+		MaxSize:     int64(maxSize),
+		MaxAge:      maxAge,
+		StaleTmpAge: staleTmpAge,
+		DryRun:      dryRun,
+	}, lockingGroup)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error trimming local cache: %v\n", err)
+		os.Exit(1)
 	}
 
-	// Recreate the directory
-	if err := os.MkdirAll(cacheDir, 0755); err != nil {
-		return fmt.Errorf("failed to recreate cache directory: %w", err)
+	verb := "Removed"
+	if dryRun {
+		verb = "Would remove"
+	}
+	fmt.Fprintf(os.Stdout, "Local cache: %d entries (%s)\n", result.Entries, formatBytes(result.Bytes))
+	fmt.Fprintf(os.Stdout, "%s %d entries (%s) and %d stale temp files (%s)\n",
+		verb, result.EvictedEntries, formatBytes(result.EvictedBytes), result.StaleFiles, formatBytes(result.StaleBytes))
+	if result.QuarantinedFiles > 0 {
+		fmt.Fprintf(os.Stdout, "%s %d quarantined files (%s)\n",
+			verb, result.QuarantinedFiles, formatBytes(result.QuarantinedBytes))
 	}
-
-	return nil
 }
 
-func createBackend() (backends.Backend, error) {
-	backendType = strings.ToLower(backendType)
-
-	var backend backends.Backend
-	var err error
-
-	switch backendType {
-	case "disk":
-		// Use no-op backend - local caching is handled by server.go
-		backend = backends.NewNoop()
-
-	case "s3":
-		if s3Bucket == "" {
-			return nil, fmt.Errorf("S3 bucket is required for S3 backend (set via -s3-bucket flag or S3_BUCKET env var)")
-		}
+func runExportCommand() {
+	// Get defaults from environment variables and the config file.
+	// All variables support both GOBUILDCACHE_<KEY> and <KEY> forms, with prefixed taking precedence.
+	var (
+		exportFlags  = flag.NewFlagSet("export", flag.ExitOnError)
+		debugDefault = getEnvBoolWithPrefix("DEBUG", false)
+		usedWithin   age
+		maxSize      byteSize
+		format       string
+	)
+	exportFlags.BoolVar(&debug, "debug", debugDefault, "Enable debug logging to stderr (env: DEBUG)")
+	registerLocalCacheFlags(exportFlags)
+	registerLockFlags(exportFlags)
+	exportFlags.Var(&usedWithin, "used-within", "Only export entries used within this long (e.g. 7d, 12h)")
+	exportFlags.Var(&maxSize, "max-size", "Only export the most recently used entries up to this size (e.g. 10GB)")
+	exportFlags.StringVar(&format, "format", "", "Archive compression: zstd, gzip, lz4 or none (default: from the file extension, zstd for stdout)")
 
-		awsCfg, cfgErr := resolveS3Config()
-		if cfgErr != nil {
-			return nil, cfgErr
-		}
-		backend, err = backends.NewS3(s3Bucket, s3Prefix, awsCfg)
+	exportFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s export [flags] <archive>\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Pack the local cache directory, or its most recently used entries, into a\n")
+		fmt.Fprintf(os.Stderr, "compressed tar archive that 'import' restores on another machine, e.g. to\n")
+		fmt.Fprintf(os.Stderr, "seed air-gapped builds or bake a VM image. The archive is written to stdout\n")
+		fmt.Fprintf(os.Stderr, "if it is \"-\". Entries are read under the same locks as the cache server, so\n")
+		fmt.Fprintf(os.Stderr, "it is safe to run concurrently.\n\n")
+		printFlagDefaults(exportFlags)
+		fmt.Fprintf(os.Stderr, "\nExamples:\n")
+		fmt.Fprintf(os.Stderr, "  # Export the whole local cache:\n")
+		fmt.Fprintf(os.Stderr, "  %s export cache.tar.zst\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  # Export the 5GB of entries used most recently in the last week:\n")
+		fmt.Fprintf(os.Stderr, "  %s export -used-within=7d -max-size=5GB cache.tar.lz4\n", os.Args[0])
+	}
 
-	case "gcs":
-		if gcsBucket == "" {
-			return nil, fmt.Errorf("GCS bucket is required for GCS backend (set via -gcs-bucket flag or GCS_BUCKET env var)")
+	registerConfigFlags(exportFlags)
+	exportFlags.Parse(os.Args[2:])
+	if exportFlags.NArg() != 1 {
+		exportFlags.Usage()
+		os.Exit(1)
+	}
+	archivePath := exportFlags.Arg(0)
+	if format == "" {
+		var err error
+		if format, err = archiveFormatFor(archivePath); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
 		}
-
-		backend, err = backends.NewGCS(gcsBucket, gcsPrefix)
-
-	default:
-		return nil, fmt.Errorf("unknown backend type: %s (supported: disk, s3, gcs)", backendType)
 	}
 
+	lockingGroup, err := createLockingGroup()
 	if err != nil {
-		return nil, err
+		fmt.Fprintf(os.Stderr, "Error creating lock group: %v\n", err)
+		os.Exit(1)
 	}
-
-	// Wrap with error backend if error rate is configured
-	if errorRate > 0 {
-		backend = backends.NewError(backend, errorRate)
-		fmt.Fprintf(os.Stderr, "[INFO] Error injection enabled with rate: %.2f%%\n", errorRate*100)
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	lc, err := newLocalCache(cacheDir, logger)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening local cache: %v\n", err)
+		os.Exit(1)
 	}
 
-	// Wrap with async backend if enabled
-	if asyncBackend {
-		// Create logger for async backend
-		logLevel := slog.LevelInfo
-		if debug {
-			logLevel = slog.LevelDebug
-		}
-		logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
-			Level: logLevel,
-		}))
-		backend = backends.NewAsyncBackendWriter(backend, logger)
-		if debug {
-			fmt.Fprintf(os.Stderr, "[INFO] Async backend writer enabled\n")
+	out, reportOut := os.Stdout, os.Stdout
+	if archivePath == "-" {
+		reportOut = os.Stderr
+	} else {
+		out, err = os.Create(archivePath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating archive: %v\n", err)
+			os.Exit(1)
 		}
 	}
 
-	// Wrap with debug backend if debug mode is enabled
-	if debug {
-		backend = backends.NewDebug(backend)
+	report, err := exportLocalCache(lc, lockingGroup, out, exportOptions{
+		UsedWithin: time.Duration(usedWithin),
+		MaxBytes:   int64(maxSize),
+		Format:     format,
+	}, time.Now())
+	if err == nil && archivePath != "-" {
+		err = out.Close()
+	}
+	if err != nil {
+		if archivePath != "-" {
+			out.Close()
+			os.Remove(archivePath)
+		}
+		fmt.Fprintf(os.Stderr, "Error exporting local cache: %v\n", err)
+		os.Exit(1)
 	}
 
-	return backend, nil
+	fmt.Fprintf(reportOut, "Exported %d entries (%s)", report.Exported.Objects, formatBytes(report.Exported.Bytes))
+	if report.Skipped > 0 {
+		fmt.Fprintf(reportOut, ", skipped %d entries that didn't match the filters", report.Skipped)
+	}
+	if report.Corrupt > 0 {
+		fmt.Fprintf(reportOut, ", skipped %d corrupt or removed entries", report.Corrupt)
+	}
+	fmt.Fprintln(reportOut)
 }
 
-// resolveS3Config reads AWS configuration from environment variables using the
-// GOBUILDCACHE_ prefix convention, falling back to standard AWS env vars.
-// Using GOBUILDCACHE_-prefixed vars (e.g., GOBUILDCACHE_AWS_REGION instead of
-// AWS_REGION) allows users to provide AWS config to gobuildcache without those
-// values being inherited by other processes in the same environment, such as
+func runImportCommand() {
+	// Get defaults from environment variables and the config file.
+	// All variables support both GOBUILDCACHE_<KEY> and <KEY> forms, with prefixed taking precedence.
+	var (
+		importFlags      = flag.NewFlagSet("import", flag.ExitOnError)
+		debugDefault     = getEnvBoolWithPrefix("DEBUG", false)
+		namespaceDefault = getEnvWithPrefix("WRITE_NAMESPACE", "")
+		namespace        string
+		push             bool
+		concurrency      int
+	)
+	importFlags.BoolVar(&debug, "debug", debugDefault, "Enable debug logging to stderr (env: DEBUG)")
+	registerLocalCacheFlags(importFlags)
+	registerLockFlags(importFlags)
+	registerBackendFlags(importFlags)
+	importFlags.StringVar(&namespace, "namespace", namespaceDefault, "Namespace to push entries into (env: WRITE_NAMESPACE)")
+	importFlags.BoolVar(&push, "push", false, "Also upload the archive's entries to the remote backend")
+	importFlags.IntVar(&concurrency, "concurrency", 16, "Number of concurrent uploads for -push")
+
+	importFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s import [flags] <archive>\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Restore the entries of an archive written by 'export' into the local cache\n")
+		fmt.Fprintf(os.Stderr, "directory, and optionally upload them to the remote backend. The archive is\n")
+		fmt.Fprintf(os.Stderr, "read from stdin if it is \"-\". Entries that are already cached are kept, and\n")
+		fmt.Fprintf(os.Stderr, "entries whose data doesn't match their checksum are skipped.\n\n")
+		printFlagDefaults(importFlags)
+		fmt.Fprintf(os.Stderr, "\nExamples:\n")
+		fmt.Fprintf(os.Stderr, "  # Seed the local cache:\n")
+		fmt.Fprintf(os.Stderr, "  %s import cache.tar.zst\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  # Seed the local cache and an S3 bucket:\n")
+		fmt.Fprintf(os.Stderr, "  %s import -push -backend=s3 -s3-bucket=my-cache-bucket cache.tar.zst\n", os.Args[0])
+	}
+
+	registerConfigFlags(importFlags)
+	importFlags.Parse(os.Args[2:])
+	if importFlags.NArg() != 1 {
+		importFlags.Usage()
+		os.Exit(1)
+	}
+	if push && strings.EqualFold(backendType, "disk") {
+		fmt.Fprintf(os.Stderr, "Error: -push needs a remote backend, the disk backend only caches locally\n")
+		os.Exit(1)
+	}
+
+	lockingGroup, err := createLockingGroup()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating lock group: %v\n", err)
+		os.Exit(1)
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	lc, err := newLocalCache(cacheDir, logger)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening local cache: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Create the backend before importing anything, so that a bad configuration
+	// fails fast.
+	var backend backends.Backend
+	if push {
+		backend, err = createBackend(nil)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating backend: %v\n", err)
+			os.Exit(1)
+		}
+		defer backend.Close()
+	}
+
+	var in io.Reader = os.Stdin
+	if archivePath := importFlags.Arg(0); archivePath != "-" {
+		f, err := os.Open(archivePath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening archive: %v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	report, err := importLocalCache(lc, lockingGroup, in)
+	if report != nil {
+		fmt.Fprintf(os.Stdout, "Imported %d entries (%s), %d already cached, %d corrupt, %d files ignored\n",
+			report.Imported.Objects, formatBytes(report.Imported.Bytes), report.Existing, report.Corrupt, report.Ignored)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error importing archive: %v\n", err)
+		os.Exit(1)
+	}
+
+	if push {
+		pushed, errs := pushEntries(lc, backend, normalizeNamespace(namespace), compression, report.ActionIDs, concurrency)
+		fmt.Fprintf(os.Stdout, "Pushed %d entries (%s uploaded), %d failed\n", pushed.Objects, formatBytes(pushed.Bytes), len(errs))
+		for i, err := range errs {
+			if i == maxReportedErrors {
+				fmt.Fprintf(os.Stderr, "  ... and %d more\n", len(errs)-i)
+				break
+			}
+			fmt.Fprintf(os.Stderr, "  %v\n", err)
+		}
+		if len(errs) > 0 {
+			os.Exit(1)
+		}
+	}
+}
+
+func runVerifyCommand() {
+	// Get defaults from environment variables and the config file.
+	// All variables support both GOBUILDCACHE_<KEY> and <KEY> forms, with prefixed taking precedence.
+	var (
+		verifyFlags      = flag.NewFlagSet("verify", flag.ExitOnError)
+		debugDefault     = getEnvBoolWithPrefix("DEBUG", false)
+		namespaceDefault = getEnvWithPrefix("WRITE_NAMESPACE", "")
+		verifyLocal      bool
+		verifyRemote     bool
+		repair           bool
+		namespace        string
+	)
+	verifyFlags.BoolVar(&debug, "debug", debugDefault, "Enable debug logging to stderr (env: DEBUG)")
+	registerLocalCacheFlags(verifyFlags)
+	registerLockFlags(verifyFlags)
+	registerBackendFlags(verifyFlags)
+	verifyFlags.StringVar(&namespace, "namespace", namespaceDefault, "Namespace of the remote entries to verify (env: WRITE_NAMESPACE)")
+	verifyFlags.BoolVar(&verifyLocal, "local", false, "Verify the local cache (the default if neither -local nor -remote is set)")
+	verifyFlags.BoolVar(&verifyRemote, "remote", false, "Verify the remote copies of the entries in the local cache")
+	verifyFlags.BoolVar(&repair, "repair", false, "Quarantine corrupt local entries and re-upload corrupt remote entries from the local cache")
+
+	verifyFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s verify [-local|-remote] [-repair] [flags]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Verify the integrity of cache entries. Local entries are checked against the\n")
+		fmt.Fprintf(os.Stderr, "size and checksum recorded in their metadata. Remote entries are downloaded and\n")
+		fmt.Fprintf(os.Stderr, "compared against the local copy, so only entries present locally are checked.\n\n")
+		printFlagDefaults(verifyFlags)
+		fmt.Fprintf(os.Stderr, "\nExamples:\n")
+		fmt.Fprintf(os.Stderr, "  # Verify the local cache and quarantine corrupt entries:\n")
+		fmt.Fprintf(os.Stderr, "  %s verify -local -repair\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  # Verify remote copies of locally cached entries:\n")
+		fmt.Fprintf(os.Stderr, "  %s verify -remote -backend=s3 -s3-bucket=my-cache-bucket\n", os.Args[0])
+	}
+
+	registerConfigFlags(verifyFlags)
+	verifyFlags.Parse(os.Args[2:])
+	if !verifyLocal && !verifyRemote {
+		verifyLocal = true
+	}
+
+	lockingGroup, err := createLockingGroup()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating lock group: %v\n", err)
+		os.Exit(1)
+	}
+
+	logLevel := slog.LevelInfo
+	if debug {
+		logLevel = slog.LevelDebug
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level: logLevel,
+	}))
+
+	lc, err := newLocalCache(cacheDir, logger)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening local cache: %v\n", err)
+		os.Exit(1)
+	}
+
+	failed := false
+	if verifyLocal {
+		result, err := verifyLocalCache(lc, lockingGroup, repair)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error verifying local cache: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stdout, "Local cache: %d entries checked, %d corrupt, %d quarantined, %d errors\n",
+			result.Checked, result.Corrupt, result.Repaired, result.Errors)
+		failed = failed || result.Corrupt > result.Repaired || result.Errors > 0
+	}
+
+	if verifyRemote {
+		backend, err := createBackend(nil)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating backend: %v\n", err)
+			os.Exit(1)
+		}
+		defer backend.Close()
+
+		result, err := verifyRemoteCache(lc, backend, normalizeNamespace(namespace), compression, repair)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error verifying remote cache: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stdout, "Remote cache: %d entries checked, %d missing, %d corrupt, %d re-uploaded, %d errors\n",
+			result.Checked, result.Missing, result.Corrupt, result.Repaired, result.Errors)
+		failed = failed || result.Corrupt > result.Repaired || result.Errors > 0
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func runPromoteCommand() {
+	// Get defaults from environment variables and the config file.
+	// All variables support both GOBUILDCACHE_<KEY> and <KEY> forms, with prefixed taking precedence.
+	var (
+		promoteFlags       = flag.NewFlagSet("promote", flag.ExitOnError)
+		debugDefault       = getEnvBoolWithPrefix("DEBUG", false)
+		namespaceDefault   = getEnvWithPrefix("WRITE_NAMESPACE", "")
+		quarantineDefault  = getEnvWithPrefix("QUARANTINE_NAMESPACE", defaultQuarantineNamespace)
+		runIDDefault       = getEnvWithPrefix("QUARANTINE_RUN_ID", "")
+		parallelismDefault = getEnvIntWithPrefix("PROMOTE_PARALLELISM", 16)
+		namespace          string
+		manifestPath       string
+		verify             bool
+		dryRun             bool
+		parallelism        int
+	)
+	promoteFlags.BoolVar(&debug, "debug", debugDefault, "Enable debug logging to stderr (env: DEBUG)")
+	registerBackendFlags(promoteFlags)
+	promoteFlags.StringVar(&namespace, "namespace", namespaceDefault, "Namespace entries are promoted into (env: WRITE_NAMESPACE)")
+	promoteFlags.StringVar(&quarantineNamespace, "quarantine-namespace", quarantineDefault, "Namespace that untrusted runs write into (env: QUARANTINE_NAMESPACE)")
+	promoteFlags.StringVar(&quarantineRunID, "quarantine-run-id", runIDDefault, "ID of the untrusted run to promote, only entries written by this run are copied (required) (env: QUARANTINE_RUN_ID)")
+	promoteFlags.StringVar(&manifestPath, "manifest", "", "File of action IDs to promote, one per line, as written by -upload-manifest (- for stdin)")
+	promoteFlags.BoolVar(&verify, "verify-output-id", true, "Refuse to promote entries whose body doesn't hash to their output ID")
+	promoteFlags.BoolVar(&dryRun, "dry-run", false, "Report what would be promoted without copying anything")
+	promoteFlags.IntVar(&parallelism, "parallelism", parallelismDefault, "Number of concurrent copies (env: PROMOTE_PARALLELISM)")
+
+	promoteFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s promote [flags] [action IDs...]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Copy entries written by an untrusted run from its quarantine namespace into the\n")
+		fmt.Fprintf(os.Stderr, "regular namespace, where trusted runs read them. Entries are re-signed and\n")
+		fmt.Fprintf(os.Stderr, "re-encrypted with this run's keys. Action IDs are read from the arguments and/or\n")
+		fmt.Fprintf(os.Stderr, "-manifest, and only entries the run given by -quarantine-run-id wrote are copied.\n")
+		fmt.Fprintf(os.Stderr, "Promoting a run trusts its output as if a trusted run had written it.\n")
+		fmt.Fprintf(os.Stderr, "Exits non-zero if any entry is rejected or fails to copy.\n\n")
+		printFlagDefaults(promoteFlags)
+		fmt.Fprintf(os.Stderr, "\nExamples:\n")
+		fmt.Fprintf(os.Stderr, "  # Promote the entries uploaded by a fork PR build once its checks pass:\n")
+		fmt.Fprintf(os.Stderr, "  %s promote -backend=s3 -s3-bucket=my-cache-bucket -quarantine-run-id=1234 -manifest=uploads.txt\n", os.Args[0])
+	}
+
+	registerConfigFlags(promoteFlags)
+	promoteFlags.Parse(os.Args[2:])
+
+	var actionIDs [][]byte
+	if args := promoteFlags.Args(); len(args) > 0 {
+		ids, err := readActionIDs(strings.NewReader(strings.Join(args, "\n")))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		actionIDs = append(actionIDs, ids...)
+	}
+	if manifestPath != "" {
+		var r io.Reader = os.Stdin
+		if manifestPath != "-" {
+			f, err := os.Open(manifestPath)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error opening manifest: %v\n", err)
+				os.Exit(1)
+			}
+			defer f.Close()
+			r = f
+		}
+		ids, err := readActionIDs(r)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading manifest: %v\n", err)
+			os.Exit(1)
+		}
+		actionIDs = append(actionIDs, ids...)
+	}
+	if err := validateRunID(quarantineRunID); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if len(actionIDs) == 0 {
+		fmt.Fprintf(os.Stderr, "Error: no action IDs to promote (pass them as arguments or with -manifest)\n")
+		promoteFlags.Usage()
+		os.Exit(1)
+	}
+
+	backend, err := createBackend(nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating backend: %v\n", err)
+		os.Exit(1)
+	}
+	defer backend.Close()
+
+	from := quarantineNamespaceFor(quarantineNamespace, quarantineRunID, namespace)
+	if signed, ok := backends.Find[*backends.Signed](backend); ok {
+		signed.AllowUnsigned(from)
+	}
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	result := promoteEntries(backend, actionIDs, promoteOptions{
+		From:           from,
+		To:             normalizeNamespace(namespace),
+		Compressed:     compression,
+		VerifyOutputID: verify,
+		DryRun:         dryRun,
+		Parallelism:    parallelism,
+	}, logger)
+
+	verb := "Promoted"
+	if dryRun {
+		verb = "Would promote"
+	}
+	fmt.Fprintf(os.Stdout, "%s %d entries (%s), %d missing, %d rejected, %d failed\n",
+		verb, result.Promoted, formatBytes(result.Bytes), result.Missing, result.Rejected, result.Failed)
+	if result.Rejected > 0 || result.Failed > 0 {
+		os.Exit(1)
+	}
+}
+
+func runDoctorCommand() {
+	// Get defaults from environment variables and the config file.
+	// All variables support both GOBUILDCACHE_<KEY> and <KEY> forms, with prefixed taking precedence.
+	var (
+		doctorFlags    = flag.NewFlagSet("doctor", flag.ExitOnError)
+		debugDefault   = getEnvBoolWithPrefix("DEBUG", false)
+		asyncDefault   = getEnvBoolWithPrefix("ASYNC_BACKEND", true)
+		maxSizeDefault = getEnvBytesWithPrefix("LOCAL_MAX_SIZE", 0)
+		sizes          string
+		samples        int
+		skipLatency    bool
+	)
+	doctorFlags.BoolVar(&debug, "debug", debugDefault, "Enable debug logging to stderr (env: DEBUG)")
+	registerLocalCacheFlags(doctorFlags)
+	registerLockFlags(doctorFlags)
+	registerBackendFlags(doctorFlags)
+	doctorFlags.BoolVar(&asyncBackend, "async-backend", asyncDefault, "Whether the async backend writer is enabled, for recommendations (env: ASYNC_BACKEND)")
+	localMaxSize = maxSizeDefault
+	doctorFlags.Var(&localMaxSize, "local-max-size", "Maximum size of the local cache, checked against the free space (env: LOCAL_MAX_SIZE)")
+	doctorFlags.StringVar(&sizes, "sizes", "1KB,100KB,1MB,10MB", "Comma-separated object sizes to measure latency with")
+	doctorFlags.IntVar(&samples, "samples", 5, "Number of objects of each size to PUT and GET")
+	doctorFlags.BoolVar(&skipLatency, "skip-latency", false, "Skip the latency measurements")
+
+	doctorFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s doctor [flags]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Check that the local cache directories and the backend are set up correctly:\n")
+		fmt.Fprintf(os.Stderr, "every permission the backend needs, its lifecycle policy, GET/PUT latency,\n")
+		fmt.Fprintf(os.Stderr, "free space and lock dir writability. Prints recommendations for anything\n")
+		fmt.Fprintf(os.Stderr, "that should be fixed, and exits non-zero if a check failed. Probe objects\n")
+		fmt.Fprintf(os.Stderr, "are written under the backend prefix and deleted afterwards.\n\n")
+		printFlagDefaults(doctorFlags)
+		fmt.Fprintf(os.Stderr, "\nExamples:\n")
+		fmt.Fprintf(os.Stderr, "  # Check an S3 setup:\n")
+		fmt.Fprintf(os.Stderr, "  %s doctor -backend=s3 -s3-bucket=my-cache-bucket\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  # Measure latency of larger objects more precisely:\n")
+		fmt.Fprintf(os.Stderr, "  %s doctor -sizes=1MB,50MB -samples=20\n", os.Args[0])
+	}
+
+	registerConfigFlags(doctorFlags)
+	doctorFlags.Parse(os.Args[2:])
+
+	var objectSizes []int64
+	for _, s := range strings.Split(sizes, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		n, err := parseByteSize(s)
+		if err != nil || n <= 0 {
+			fmt.Fprintf(os.Stderr, "Error: invalid size in -sizes: %q\n", s)
+			os.Exit(1)
+		}
+		objectSizes = append(objectSizes, n)
+	}
+
+	var (
+		recommendations []string
+		failed          bool
+	)
+	report := func(title string, diagnostics []backends.Diagnostic) {
+		r, f := printDiagnostics(os.Stdout, title, diagnostics)
+		recommendations = append(recommendations, r...)
+		failed = failed || f
+	}
+
+	report("Local", localDiagnostics(cacheDir, lockingType, lockDir, int64(localMaxSize)))
+
+	if strings.EqualFold(backendType, "disk") {
+		report("Backend", []backends.Diagnostic{{
+			Check:  "backend",
+			Status: backends.DiagnosticSkipped,
+			Detail: "the disk backend only caches locally",
+		}})
+	} else if backend, err := createStorageBackend(backendType); err != nil {
+		report("Backend", []backends.Diagnostic{{
+			Check:          "connect to " + backendType,
+			Status:         backends.DiagnosticFailed,
+			Detail:         err.Error(),
+			Recommendation: backendConnectionRecommendation(err),
+		}})
+	} else {
+		defer backend.Close()
+		diagnostics := []backends.Diagnostic{{Check: "connect to " + backendType, Status: backends.DiagnosticOK}}
+		if diagnoser, ok := backend.(backends.Diagnoser); ok {
+			diagnostics = append(diagnostics, diagnoser.Diagnose()...)
+		}
+		report("Backend", diagnostics)
+
+		if !skipLatency && len(objectSizes) > 0 && samples > 0 {
+			tracker := metrics.NewLatencyTracker(0.01) // 1% relative accuracy
+			err := measureLatency(backend, objectSizes, samples, tracker)
+			fmt.Fprintf(os.Stdout, "Latency quantiles (ms):\n")
+			for _, size := range objectSizes {
+				for _, op := range []string{"PUT", "GET"} {
+					if stats, statsErr := tracker.GetStats(op + " " + formatBytes(size)); statsErr == nil {
+						fmt.Fprintf(os.Stdout, "%s\n", stats.String())
+					}
+				}
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stdout, "  [failed] %v\n", err)
+				failed = true
+			}
+			fmt.Fprintln(os.Stdout)
+			recommendations = append(recommendations, latencyRecommendations(tracker, formatBytes(objectSizes[0]), asyncBackend)...)
+		}
+	}
+
+	switch {
+	case len(recommendations) == 0 && failed:
+		fmt.Fprintf(os.Stdout, "Some checks failed, see the details above.\n")
+	case len(recommendations) == 0:
+		fmt.Fprintf(os.Stdout, "No problems found.\n")
+	default:
+		fmt.Fprintf(os.Stdout, "Recommendations:\n")
+		for _, r := range recommendations {
+			fmt.Fprintf(os.Stdout, "  - %s\n", r)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func runBenchCommand() {
+	// The bench command accepts every server flag, so that it measures exactly the
+	// backend stack a server started with the same flags would use.
+	var (
+		benchFlags   = flag.NewFlagSet("bench", flag.ExitOnError)
+		concurrency  int
+		duration     time.Duration
+		ops          int
+		getRatio     float64
+		seedObjects  int
+		sizes        string
+		compressible float64
+		keep         bool
+		jsonOutput   bool
+	)
+	registerServerFlags(benchFlags)
+	benchFlags.IntVar(&concurrency, "concurrency", 32, "Number of concurrent operations")
+	benchFlags.DurationVar(&duration, "duration", 30*time.Second, "How long to run the benchmark for")
+	benchFlags.IntVar(&ops, "ops", 0, "Total number of operations to run, instead of running for -duration")
+	benchFlags.Float64Var(&getRatio, "get-ratio", 0.8, "Fraction (0.0-1.0) of operations that are GETs, the rest are PUTs")
+	benchFlags.IntVar(&seedObjects, "seed-objects", 200, "Number of objects written before the run for GETs to read")
+	benchFlags.StringVar(&sizes, "sizes", defaultBenchSizes, "Object size distribution as comma-separated size:weight pairs")
+	benchFlags.Float64Var(&compressible, "compressible", 0.5, "Fraction (0.0-1.0) of each object that is compressible")
+	benchFlags.BoolVar(&keep, "keep", false, "Keep the benchmark objects in the backend instead of deleting them")
+	benchFlags.BoolVar(&jsonOutput, "json", false, "Print the report as JSON")
+
+	benchFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s bench [flags]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Benchmark the configured backend stack (compression, encryption, signing, the\n")
+		fmt.Fprintf(os.Stderr, "async writer and the locking group) with a concurrent mix of GETs and PUTs,\n")
+		fmt.Fprintf(os.Stderr, "and report their latency and throughput. GETs read previously written objects\n")
+		fmt.Fprintf(os.Stderr, "and always miss the local cache. Objects are written into a temporary\n")
+		fmt.Fprintf(os.Stderr, "namespace under the backend prefix and deleted afterwards.\n\n")
+		fmt.Fprintf(os.Stderr, "Flags (can also be set via environment variables):\n")
+		benchFlags.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nNote: Command-line flags take precedence over environment variables.\n")
+		fmt.Fprintf(os.Stderr, "\nExamples:\n")
+		fmt.Fprintf(os.Stderr, "  # Benchmark an S3 bucket for a minute:\n")
+		fmt.Fprintf(os.Stderr, "  %s bench -backend=s3 -s3-bucket=my-cache-bucket -duration=1m\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  # Write-heavy benchmark of large objects without compression:\n")
+		fmt.Fprintf(os.Stderr, "  %s bench -get-ratio=0.2 -sizes=1MB:1,32MB:1 -compression=false -json\n", os.Args[0])
+	}
+
+	registerConfigFlags(benchFlags)
+	benchFlags.Parse(os.Args[2:])
+
+	if strings.EqualFold(backendType, "disk") {
+		fmt.Fprintf(os.Stderr, "Error: bench needs a remote backend, the disk backend only caches locally\n")
+		os.Exit(1)
+	}
+	sizeDist, err := parseSizeDistribution(sizes)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid -sizes: %v\n", err)
+		os.Exit(1)
+	}
+	if getRatio < 0 || getRatio > 1 || compressible < 0 || compressible > 1 {
+		fmt.Fprintf(os.Stderr, "Error: -get-ratio and -compressible must be between 0.0 and 1.0\n")
+		os.Exit(1)
+	}
+
+	lockingGroup, err := createLockingGroup()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating locking group: %v\n", err)
+		os.Exit(1)
+	}
+
+	report, err := runBench(func() (backends.Backend, error) { return createBackend(nil) }, lockingGroup, benchOptions{
+		Concurrency:  concurrency,
+		Duration:     duration,
+		Ops:          ops,
+		GetRatio:     getRatio,
+		SeedObjects:  seedObjects,
+		Sizes:        sizeDist,
+		Compressible: compressible,
+		Compression:  compression,
+		Namespace:    newScratchNamespace("bench"),
+		Keep:         keep,
+	}, os.Stderr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	} else {
+		printBenchReport(os.Stdout, report)
+	}
+	if report.Get.Errors > 0 || report.Put.Errors > 0 {
+		os.Exit(1)
+	}
+}
+
+func runDuCommand() {
+	// Get defaults from environment variables and the config file.
+	// All variables support both GOBUILDCACHE_<KEY> and <KEY> forms, with prefixed taking precedence.
+	var (
+		duFlags      = flag.NewFlagSet("du", flag.ExitOnError)
+		debugDefault = getEnvBoolWithPrefix("DEBUG", false)
+		duLocalFlag  bool
+		duRemoteFlag bool
+		depth        int
+		jsonOutput   bool
+	)
+	duFlags.BoolVar(&debug, "debug", debugDefault, "Enable debug logging to stderr (env: DEBUG)")
+	registerLocalCacheFlags(duFlags)
+	registerBackendFlags(duFlags)
+	duFlags.BoolVar(&duLocalFlag, "local", false, "Report on the local cache (both are reported if neither -local nor -remote is set)")
+	duFlags.BoolVar(&duRemoteFlag, "remote", false, "Report on the backend's prefix")
+	duFlags.IntVar(&depth, "depth", 0, "Group remote objects by the first N segments of their namespace (0 for the whole namespace)")
+	duFlags.BoolVar(&jsonOutput, "json", false, "Print the report as JSON")
+
+	duFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s du [-local|-remote] [flags]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Report the number of entries, their total size and size and age histograms for\n")
+		fmt.Fprintf(os.Stderr, "the backend's prefix, broken down by namespace, and for the local cache\n")
+		fmt.Fprintf(os.Stderr, "directory. Remote sizes are as stored (compressed when compression is enabled),\n")
+		fmt.Fprintf(os.Stderr, "local sizes are uncompressed; entries found in both are compared to report the\n")
+		fmt.Fprintf(os.Stderr, "compression ratio. Ages are computed from the time entries were written.\n\n")
+		printFlagDefaults(duFlags)
+		fmt.Fprintf(os.Stderr, "\nExamples:\n")
+		fmt.Fprintf(os.Stderr, "  # Report on an S3 bucket and the local cache:\n")
+		fmt.Fprintf(os.Stderr, "  %s du -backend=s3 -s3-bucket=my-cache-bucket\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  # Group a GCS bucket's branch namespaces (branches/<name>/) together, as JSON:\n")
+		fmt.Fprintf(os.Stderr, "  %s du -remote -backend=gcs -gcs-bucket=my-cache-bucket -depth=1 -json\n", os.Args[0])
+	}
+
+	registerConfigFlags(duFlags)
+	duFlags.Parse(os.Args[2:])
+
+	if !duLocalFlag && !duRemoteFlag {
+		duLocalFlag, duRemoteFlag = true, true
+	}
+	isDisk := strings.EqualFold(backendType, "disk")
+	if duRemoteFlag && isDisk && !duLocalFlag {
+		fmt.Fprintf(os.Stderr, "Error: -remote needs a remote backend, the disk backend only caches locally\n")
+		os.Exit(1)
+	}
+
+	var (
+		report     duReport
+		localSizes map[string]int64
+		now        = time.Now()
+	)
+	if duLocalFlag {
+		logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+		lc, err := newLocalCache(cacheDir, logger)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening local cache: %v\n", err)
+			os.Exit(1)
+		}
+		report.Local, localSizes, err = duLocal(lc, now)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error scanning local cache: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if duRemoteFlag && !isDisk {
+		backend, err := createStorageBackend(backendType)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating backend: %v\n", err)
+			os.Exit(1)
+		}
+		defer backend.Close()
+		lister, ok := backends.Find[backends.Lister](backend)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Error: the %s backend doesn't support listing\n", backendType)
+			os.Exit(1)
+		}
+		report.Remote, report.Compression, err = duRemote(lister, localSizes, depth, now, os.Stderr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error listing backend: %v\n", err)
+			os.Exit(1)
+		}
+		report.Remote.Backend = strings.ToLower(backendType)
+		// The prefixes expanded without error when the backend was created.
+		report.Remote.Prefix, _ = expandPrefixTemplate(s3Prefix)
+		if report.Remote.Backend == "gcs" {
+			report.Remote.Prefix, _ = expandPrefixTemplate(gcsPrefix)
+		}
+	}
+
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	printDuReport(os.Stdout, &report)
+}
+
+func runGCRemoteCommand() {
+	// Get defaults from environment variables and the config file.
+	// All variables support both GOBUILDCACHE_<KEY> and <KEY> forms, with prefixed taking precedence.
+	var (
+		gcFlags      = flag.NewFlagSet("gc-remote", flag.ExitOnError)
+		debugDefault = getEnvBoolWithPrefix("DEBUG", false)
+		unusedFor    age
+		maxBytes     byteSize
+		dryRun       bool
+		jsonOutput   bool
+	)
+	gcFlags.BoolVar(&debug, "debug", debugDefault, "Enable debug logging to stderr (env: DEBUG)")
+	registerBackendFlags(gcFlags)
+	gcFlags.Var(&unusedFor, "unused-for", "Delete entries that haven't been used for this long (e.g. 7d, 36h)")
+	gcFlags.Var(&maxBytes, "max-bytes", "Then delete the least recently used entries until the rest fit in this many bytes (e.g. 500GB)")
+	gcFlags.BoolVar(&dryRun, "dry-run", false, "Report what would be deleted without deleting anything")
+	gcFlags.BoolVar(&jsonOutput, "json", false, "Print the report as JSON")
+
+	gcFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s gc-remote [-unused-for=<age>] [-max-bytes=<size>] [flags]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Delete the remote cache entries under the backend's prefix, in every namespace,\n")
+		fmt.Fprintf(os.Stderr, "that haven't been used for -unused-for, then the least recently used entries\n")
+		fmt.Fprintf(os.Stderr, "until the rest fit in -max-bytes. Entries are last used when they were written,\n")
+		fmt.Fprintf(os.Stderr, "or when a server running with -remote-touch-interval last hit them. Objects\n")
+		fmt.Fprintf(os.Stderr, "whose names gobuildcache didn't generate are never deleted.\n\n")
+		printFlagDefaults(gcFlags)
+		fmt.Fprintf(os.Stderr, "\nExamples:\n")
+		fmt.Fprintf(os.Stderr, "  # See what deleting entries unused for a week would free up:\n")
+		fmt.Fprintf(os.Stderr, "  %s gc-remote -backend=s3 -s3-bucket=my-cache-bucket -unused-for=7d -dry-run\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  # Keep a GCS bucket under 500GB, deleting the coldest entries first:\n")
+		fmt.Fprintf(os.Stderr, "  %s gc-remote -backend=gcs -gcs-bucket=my-cache-bucket -unused-for=30d -max-bytes=500GB\n", os.Args[0])
+	}
+
+	registerConfigFlags(gcFlags)
+	gcFlags.Parse(os.Args[2:])
+
+	if strings.EqualFold(backendType, "disk") {
+		fmt.Fprintf(os.Stderr, "Error: gc-remote needs a remote backend, use 'trim' for the local cache\n")
+		os.Exit(1)
+	}
+	if unusedFor <= 0 && maxBytes <= 0 {
+		fmt.Fprintf(os.Stderr, "Error: set -unused-for and/or -max-bytes\n")
+		os.Exit(1)
+	}
+
+	backend, err := createStorageBackend(backendType)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating backend: %v\n", err)
+		os.Exit(1)
+	}
+	defer backend.Close()
+	lister, canList := backends.Find[backends.Lister](backend)
+	deleter, canDelete := backends.Find[backends.Deleter](backend)
+	if !canList || !canDelete {
+		fmt.Fprintf(os.Stderr, "Error: the %s backend doesn't support listing and deleting objects\n", backendType)
+		os.Exit(1)
+	}
+
+	report, err := runGC(lister, deleter, gcOptions{
+		UnusedFor: time.Duration(unusedFor),
+		MaxBytes:  int64(maxBytes),
+		DryRun:    dryRun,
+	}, time.Now(), os.Stderr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	report.Backend = strings.ToLower(backendType)
+	// The prefixes expanded without error when the backend was created.
+	report.Prefix, _ = expandPrefixTemplate(s3Prefix)
+	if report.Backend == "gcs" {
+		report.Prefix, _ = expandPrefixTemplate(gcsPrefix)
+	}
+
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	} else {
+		printGCReport(os.Stdout, report)
+	}
+	if report.Failed > 0 {
+		os.Exit(1)
+	}
+}
+
+func runInspectCommand() {
+	// Get defaults from environment variables and the config file.
+	// All variables support both GOBUILDCACHE_<KEY> and <KEY> forms, with prefixed taking precedence.
+	var (
+		inspectFlags     = flag.NewFlagSet("inspect", flag.ExitOnError)
+		debugDefault     = getEnvBoolWithPrefix("DEBUG", false)
+		namespaceDefault = getEnvWithPrefix("WRITE_NAMESPACE", "")
+		namespace        string
+		opts             inspectOptions
+		jsonOutput       bool
+	)
+	inspectFlags.BoolVar(&debug, "debug", debugDefault, "Enable debug logging to stderr (env: DEBUG)")
+	registerLocalCacheFlags(inspectFlags)
+	registerLockFlags(inspectFlags)
+	registerBackendFlags(inspectFlags)
+	inspectFlags.StringVar(&namespace, "namespace", namespaceDefault, "Namespace of the remote entry, unless the argument is a backend key (env: WRITE_NAMESPACE)")
+	inspectFlags.StringVar(&opts.DumpPath, "dump", "", "Write the entry's uncompressed body to this file (the remote copy if it can be decoded, else the local one)")
+	inspectFlags.BoolVar(&opts.DeleteLocal, "delete-local", false, "Delete the local entry after inspecting it")
+	inspectFlags.BoolVar(&opts.DeleteRemote, "delete-remote", false, "Delete the remote entry after inspecting it")
+	inspectFlags.BoolVar(&jsonOutput, "json", false, "Print the report as JSON")
+
+	inspectFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s inspect [flags] <actionID>\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Show what is stored for a single cache entry: the local metadata, and the\n")
+		fmt.Fprintf(os.Stderr, "remote object's metadata, envelopes (encryption and signature headers),\n")
+		fmt.Fprintf(os.Stderr, "compressed and uncompressed sizes, put time and checksum. The argument is a\n")
+		fmt.Fprintf(os.Stderr, "hex action ID, or a backend key such as main/v2<action ID> to inspect the\n")
+		fmt.Fprintf(os.Stderr, "entry of another namespace. The entry can also be dumped or deleted.\n\n")
+		printFlagDefaults(inspectFlags)
+		fmt.Fprintf(os.Stderr, "\nExamples:\n")
+		fmt.Fprintf(os.Stderr, "  # Inspect an entry locally and in S3, and save its body:\n")
+		fmt.Fprintf(os.Stderr, "  %s inspect -backend=s3 -s3-bucket=my-cache-bucket -dump=/tmp/body <actionID>\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  # Delete a bad entry everywhere:\n")
+		fmt.Fprintf(os.Stderr, "  %s inspect -backend=s3 -s3-bucket=my-cache-bucket -delete-local -delete-remote <actionID>\n", os.Args[0])
+	}
+
+	registerConfigFlags(inspectFlags)
+	inspectFlags.Parse(os.Args[2:])
+	opts.Compressed = compression
+	if inspectFlags.NArg() != 1 {
+		inspectFlags.Usage()
+		os.Exit(1)
+	}
+	actionID, namespace, err := parseInspectTarget(inspectFlags.Arg(0), normalizeNamespace(namespace))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	lockingGroup, err := createLockingGroup()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating lock group: %v\n", err)
+		os.Exit(1)
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	lc, err := newLocalCache(cacheDir, logger)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening local cache: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Fetch the remote entry through the storage backend and then each of the
+	// wrappers that add an envelope, so that every envelope can be reported.
+	var layers []inspectLayer
+	if !strings.EqualFold(backendType, "disk") {
+		backend, err := createStorageBackend(backendType)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating backend: %v\n", err)
+			os.Exit(1)
+		}
+		if debug {
+			backend = backends.NewDebug(backend)
+		}
+		defer backend.Close()
+		layers = append(layers, inspectLayer{"storage", backend})
+
+		keyring, err := loadEncryptionKeyring(encryptionKeyFile, "")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if keyring != nil {
+			backend = backends.NewEncrypted(backend, keyring, logger)
+			layers = append(layers, inspectLayer{"encryption", backend})
+		}
+		signingKeyring, err := loadSigningKeyring(signingKeyFile, trustedKeysFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if signingKeyring != nil {
+			signed := backends.NewSigned(backend, signingKeyring, logger)
+			// Unsigned entries are reported as such rather than rejected.
+			signed.AllowUnsigned("")
+			layers = append(layers, inspectLayer{"signing", signed})
+		}
+	}
+
+	report, err := inspectEntry(lc, lockingGroup, layers, namespace, actionID, opts)
+	if report != nil {
+		if jsonOutput {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(report); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+		} else {
+			printInspectReport(os.Stdout, report)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if !report.Local.Found && (report.Remote == nil || !report.Remote.Found) {
+		os.Exit(1)
+	}
+}
+
+func runReplayCommand() {
+	// Like bench, replay accepts every server flag so that the trace can be
+	// replayed against exactly the stack a server would use.
+	var (
+		replayFlags  = flag.NewFlagSet("replay", flag.ExitOnError)
+		speed        float64
+		concurrency  int
+		seed         bool
+		compressible float64
+		keep         bool
+		jsonOutput   bool
+	)
+	registerServerFlags(replayFlags)
+	replayFlags.Float64Var(&speed, "speed", 1, "Timing multiplier: 1 replays at the original timing, 10 ten times faster, 0 as fast as possible")
+	replayFlags.IntVar(&concurrency, "concurrency", 64, "Maximum number of requests in flight")
+	replayFlags.BoolVar(&seed, "seed", true, "Write the entries the original run hit before replaying, so hit rates are comparable")
+	replayFlags.Float64Var(&compressible, "compressible", 0.5, "Fraction (0.0-1.0) of each generated body that is compressible")
+	replayFlags.BoolVar(&keep, "keep", false, "Keep the replayed objects in the backend instead of deleting them")
+	replayFlags.BoolVar(&jsonOutput, "json", false, "Print the report as JSON")
+
+	replayFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s replay [flags] <trace-file>...\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Replay the GETs and PUTs of traces written with -trace-file against the\n")
+		fmt.Fprintf(os.Stderr, "configured backend stack, at the original timing or faster, and report the\n")
+		fmt.Fprintf(os.Stderr, "hit rate and latency next to those of the original run. Events of several\n")
+		fmt.Fprintf(os.Stderr, "trace files are merged by time. The replay starts with an empty local cache,\n")
+		fmt.Fprintf(os.Stderr, "PUT bodies are generated with the recorded sizes, and objects are written\n")
+		fmt.Fprintf(os.Stderr, "into a temporary namespace under the backend prefix and deleted afterwards.\n\n")
+		fmt.Fprintf(os.Stderr, "Flags (can also be set via environment variables):\n")
+		replayFlags.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nNote: Command-line flags take precedence over environment variables.\n")
+		fmt.Fprintf(os.Stderr, "\nExamples:\n")
+		fmt.Fprintf(os.Stderr, "  # Record a trace of a build:\n")
+		fmt.Fprintf(os.Stderr, "  GOBUILDCACHE_TRACE_FILE=trace.jsonl go build ./...\n\n")
+		fmt.Fprintf(os.Stderr, "  # Replay it against a GCS bucket ten times faster:\n")
+		fmt.Fprintf(os.Stderr, "  %s replay -backend=gcs -gcs-bucket=my-cache-bucket -speed=10 trace.jsonl\n", os.Args[0])
+	}
+
+	registerConfigFlags(replayFlags)
+	replayFlags.Parse(os.Args[2:])
+
+	if replayFlags.NArg() == 0 {
+		replayFlags.Usage()
+		os.Exit(1)
+	}
+	if speed < 0 || compressible < 0 || compressible > 1 {
+		fmt.Fprintf(os.Stderr, "Error: -speed must not be negative and -compressible must be between 0.0 and 1.0\n")
+		os.Exit(1)
+	}
+
+	var events []traceEvent
+	for _, path := range replayFlags.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening trace: %v\n", err)
+			os.Exit(1)
+		}
+		fileEvents, err := readTrace(f)
+		f.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading trace %s: %v\n", path, err)
+			os.Exit(1)
+		}
+		events = append(events, fileEvents...)
+	}
+	sortTrace(events)
+
+	lockingGroup, err := createLockingGroup()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating locking group: %v\n", err)
+		os.Exit(1)
+	}
+
+	report, err := runReplay(events, func() (backends.Backend, error) { return createBackend(nil) }, lockingGroup, replayOptions{
+		Speed:        speed,
+		Concurrency:  concurrency,
+		Seed:         seed,
+		Compressible: compressible,
+		Compression:  compression,
+		Namespace:    newScratchNamespace("replay"),
+		Keep:         keep,
+	}, os.Stderr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	} else {
+		printReplayReport(os.Stdout, report)
+	}
+	if report.Get.Errors > 0 || report.Put.Errors > 0 {
+		os.Exit(1)
+	}
+}
+
+func runConfigCommand() {
+	// The config command accepts every server flag, so that it shows exactly the
+	// configuration a server started with the same flags would use.
+	configFlags := flag.NewFlagSet("config", flag.ExitOnError)
+	registerServerFlags(configFlags)
+
+	configFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s config [flags]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Print the effective value of every setting and where it came from: a flag,\n")
+		fmt.Fprintf(os.Stderr, "an environment variable, a config file profile, the config file or the default.\n\n")
+		fmt.Fprintf(os.Stderr, "Flags (same as the server's):\n")
+		configFlags.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nExamples:\n")
+		fmt.Fprintf(os.Stderr, "  # Show the configuration the server would use:\n")
+		fmt.Fprintf(os.Stderr, "  %s config\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  # Show the configuration of the ci profile:\n")
+		fmt.Fprintf(os.Stderr, "  %s config -profile=ci\n", os.Args[0])
+	}
+
+	registerConfigFlags(configFlags)
+	configFlags.Parse(os.Args[2:])
+	recordFlagSettings(configFlags)
+
+	// AWS settings are resolved when the S3 backend is created, and the secret
+	// keys are only ever read from the environment.
+	resolveS3Config()
+	for _, envVar := range []string{encryptionKeyEnvVar, signingKeyEnvVar, trustedKeysEnvVar} {
+		key := strings.TrimPrefix(envVar, "GOBUILDCACHE_")
+		if os.Getenv(envVar) != "" {
+			recordSetting(key, os.Getenv(envVar), "env "+envVar)
+		} else {
+			recordSetting(key, "", "default")
+		}
+	}
+
+	if c := activeConfig; c != nil {
+		fmt.Fprintf(os.Stdout, "Config file: %s\n", c.path)
+		if c.profile != "" {
+			fmt.Fprintf(os.Stdout, "Profile:     %s\n", c.profile)
+		}
+	} else {
+		fmt.Fprintf(os.Stdout, "Config file: none\n")
+	}
+	fmt.Fprintln(os.Stdout)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "SETTING\tVALUE\tSOURCE\n")
+	for _, s := range effectiveSettings() {
+		value := s.Value
+		if isSecretSetting(s.Key) && value != "" {
+			value = "<redacted>"
+		}
+		if value == "" {
+			value = `""`
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", s.Key, value, s.Source)
+	}
+	w.Flush()
+
+	for _, key := range unusedConfigKeys() {
+		fmt.Fprintf(os.Stderr, "Warning: unknown setting %s in config file\n", key)
+	}
+}
+
+func printHelp() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [command] [flags]\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "A remote caching server for Go builds.\n\n")
+	fmt.Fprintf(os.Stderr, "Commands:\n")
+	fmt.Fprintf(os.Stderr, "  (no command)  Run the cache server (default)\n")
+	fmt.Fprintf(os.Stderr, "  clear         Clear both local and remote cache entries\n")
+	fmt.Fprintf(os.Stderr, "  clear-local   Clear only local cache directory\n")
+	fmt.Fprintf(os.Stderr, "  clear-remote  Clear only remote backend cache\n")
+	fmt.Fprintf(os.Stderr, "  flush         Upload entries left in the upload spool by previous runs\n")
+	fmt.Fprintf(os.Stderr, "  trim          Evict least recently used local cache entries and stale temp files\n")
+	fmt.Fprintf(os.Stderr, "  export        Pack the local cache into a compressed tar archive\n")
+	fmt.Fprintf(os.Stderr, "  import        Restore an exported archive into the local cache, optionally pushing it to the backend\n")
+	fmt.Fprintf(os.Stderr, "  verify        Verify the integrity of local and/or remote cache entries\n")
+	fmt.Fprintf(os.Stderr, "  promote       Copy entries written by untrusted runs out of quarantine\n")
+	fmt.Fprintf(os.Stderr, "  config        Print the effective value and source of every setting\n")
+	fmt.Fprintf(os.Stderr, "  doctor        Check the backend's permissions, lifecycle policy and latency, and local disk setup\n")
+	fmt.Fprintf(os.Stderr, "  bench         Benchmark concurrent GETs and PUTs against the configured backend\n")
+	fmt.Fprintf(os.Stderr, "  du            Report the size and age of the remote and local cache entries\n")
+	fmt.Fprintf(os.Stderr, "  gc-remote     Delete remote cache entries that haven't been used recently\n")
+	fmt.Fprintf(os.Stderr, "  inspect       Show the local and remote metadata of a single cache entry\n")
+	fmt.Fprintf(os.Stderr, "  replay        Replay a trace of GETs and PUTs against the configured backend\n")
+	fmt.Fprintf(os.Stderr, "  help          Show this help message\n\n")
+	fmt.Fprintf(os.Stderr, "Configuration:\n")
+	fmt.Fprintf(os.Stderr, "  Flags can be set via command-line arguments, environment variables or a\n")
+	fmt.Fprintf(os.Stderr, "  %s config file (see -config and -profile).\n", configFileName)
+	fmt.Fprintf(os.Stderr, "  Command-line flags take precedence over environment variables, which take\n")
+	fmt.Fprintf(os.Stderr, "  precedence over the config file.\n\n")
+	fmt.Fprintf(os.Stderr, "Run '%s [command] -h' for more information about a command.\n", os.Args[0])
+}
+
+func runServer() {
+	// Create the upload spool if enabled. It's only useful when uploads can
+	// actually be lost, i.e. when there is a remote backend to upload to.
+	var spool *uploadSpool
+	if spoolDir != "" && !readOnly && !strings.EqualFold(backendType, "disk") {
+		logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+		var err error
+		spool, err = newUploadSpool(spoolDir, logger)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating upload spool: %v\n", err)
+			os.Exit(1)
+		}
+		defer spool.close()
+	}
+
+	// Create backend
+	backend, err := createBackend(spool)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating cache backend: %v\n", err)
+		os.Exit(1)
+	}
+
+	lockingGroup, err := createLockingGroup()
+	if err != nil {
+		backend.Close()
+		fmt.Fprintf(os.Stderr, "Error creating lock group: %v\n", err)
+		os.Exit(1)
+	}
+
+	if readOnly && debug {
+		fmt.Fprintf(os.Stderr, "[INFO] Read-only mode enabled: cache reads allowed, writes skipped\n")
+	}
+
+	prog, err := NewCacheProg(backend, lockingGroup, cacheDir, debug, printStats, compression, readOnly)
+	if err != nil {
+		backend.Close()
+		fmt.Fprintf(os.Stderr, "Error creating cache program: %v\n", err)
+		os.Exit(1)
+	}
+	prog.backendGetBudget = backendGetBudget
+	prog.setNamespaces(writeNamespace, strings.Split(readNamespaces, ","))
+	level, err := parseTrustLevel(strings.ToLower(trust))
+	if err != nil {
+		backend.Close()
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if level.isUntrusted(backend) {
+		if err := validateRunID(quarantineRunID); err != nil {
+			backend.Close()
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		prog.enableQuarantine(quarantineNamespace, quarantineRunID)
+		if debug {
+			fmt.Fprintf(os.Stderr, "[INFO] Untrusted run: PUTs are written to namespace %q\n", prog.writeNamespace)
+		}
+	}
+	if uploadManifestPath != "" && !readOnly {
+		manifest, err := newUploadManifest(uploadManifestPath)
+		if err != nil {
+			backend.Close()
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		defer manifest.close()
+		prog.uploadManifest = manifest
+	}
+	if traceFile != "" {
+		trace, err := newTraceWriter(traceFile)
+		if err != nil {
+			backend.Close()
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		defer trace.close()
+		prog.trace = trace
+	}
+	if remoteTouchInterval > 0 && !readOnly && !strings.EqualFold(backendType, "disk") {
+		toucher, ok := newRemoteToucher(backend, remoteTouchInterval, prog.logger)
+		if ok {
+			prog.toucher = toucher
+		} else if debug {
+			fmt.Fprintf(os.Stderr, "[INFO] The %s backend doesn't track access times, -remote-touch-interval is ignored\n", backendType)
+		}
+	}
+	prog.localTrim = trimOptions{
+		MaxSize: int64(localMaxSize),
+		MaxAge:  localMaxAge,
+	}
+	prog.localTrimInterval = localTrimInterval
+	verifyMode, err := parseLocalVerifyMode(strings.ToLower(localVerify))
+	if err != nil {
+		backend.Close()
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	prog.localCache.verify = verifyMode
+	prog.verifyOutputIDs = verifyOutputIDs
+	prog.egressBudget = int64(egressBudget)
+	if downloadRateLimit > 0 {
+		prog.downloadLimiter = ratelimit.NewTokenBucket(int64(downloadRateLimit))
+	}
+	prog.attachDownloadMeter()
+	prog.attachUploadManifest()
+	prog.closeTimeout = closeTimeout
+	prog.admission = newAdmissionPolicy(admissionPolicyConfig{
+		MinSize:    int64(uploadMinSize),
+		MaxSize:    int64(uploadMaxSize),
+		Budget:     int64(uploadBudget),
+		RateLimit:  int64(uploadRateLimit),
+		SampleRate: uploadSampleRate,
+	})
+	prog.spool = spool
+	defer func() {
+		// If the close command gave up waiting for pending uploads, closing the
+		// backend again would block on them, so just exit and leave them in the
+		// spool.
+		if !prog.closeTimedOut.Load() {
+			backend.Close()
+		}
+	}()
+
+	if spool != nil && spoolDrainOnStart {
+		go prog.drainOrphanedSpools()
+	}
+
+	if err := prog.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error running cache program: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// runClear clears the remote backend the way clear-remote does, and then the
+// local cache directory unless opts.DryRun is set.
+func runClear(opts clearOptions, yes bool) {
+	// Clear the backend (remote storage)
+	if !strings.EqualFold(backendType, "disk") {
+		clearRemoteCache(clearFilter{}, opts, yes)
+	}
+	if opts.DryRun {
+		return
+	}
+
+	// Clear the local cache directory
+	if err := clearLocalCache(cacheDir); err != nil {
+		fmt.Fprintf(os.Stderr, "Error clearing local cache: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Fprintf(os.Stdout, "Cache cleared successfully\n")
+}
+
+// clearLocalCache removes all entries from the local cache directory.
+func clearLocalCache(cacheDir string) error {
+	// Remove the entire directory and recreate it
+	// os.RemoveAll is idempotent - it doesn't error if path doesn't exist
+	if err := os.RemoveAll(cacheDir); err != nil {
+		return fmt.Errorf("failed to remove cache directory: %w", err)
+	}
+
+	// Recreate the directory
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return fmt.Errorf("failed to recreate cache directory: %w", err)
+	}
+
+	return nil
+}
+
+// createBackend creates the backend configured by the global flags along with all
+// of its wrappers. If spool is non-nil, uploads are removed from it once they have
+// been written to the backend.
+func createBackend(spool *uploadSpool) (backends.Backend, error) {
+	backend, err := createStorageBackend(backendType)
+	if err != nil {
+		return nil, err
+	}
+
+	// Throttle and time downloads directly above the storage backend, below the
+	// wrappers that read whole bodies before returning them. See downloadMeter.
+	backend = &downloadMeter{Backend: backend}
+
+	// Create logger for backend wrappers
+	logLevel := slog.LevelInfo
+	if debug {
+		logLevel = slog.LevelDebug
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level: logLevel,
+	}))
+
+	// Wrap with error backend if error rate is configured
+	if errorRate > 0 {
+		backend = backends.NewError(backend, errorRate)
+		fmt.Fprintf(os.Stderr, "[INFO] Error injection enabled with rate: %.2f%%\n", errorRate*100)
+	}
+
+	// Wrap with adaptive concurrency limits if enabled. This sits below the
+	// circuit breaker so that operations skipped by an open circuit don't
+	// occupy concurrency slots.
+	if adaptiveConcurrency {
+		backend = backends.NewAdaptiveConcurrency(backend, backends.AdaptiveConcurrencyConfig{
+			InitialLimit: adaptiveConcurrencyInitial,
+			MaxLimit:     adaptiveConcurrencyMax,
+		}, logger)
+		if debug {
+			fmt.Fprintf(os.Stderr, "[INFO] Adaptive concurrency enabled\n")
+		}
+	}
+
+	// Wrap with circuit breaker if enabled. This sits below the async writer so
+	// that asynchronous PUT failures also count towards opening the circuit.
+	if circuitBreaker {
+		var fallback backends.Backend
+		if circuitBreakerFallback != "" {
+			if strings.EqualFold(circuitBreakerFallback, backendType) {
+				backend.Close()
+				return nil, fmt.Errorf("circuit breaker fallback backend must differ from the primary backend: %s", circuitBreakerFallback)
+			}
+			fallback, err = createStorageBackend(circuitBreakerFallback)
+			if err != nil {
+				backend.Close()
+				return nil, fmt.Errorf("failed to create circuit breaker fallback backend: %w", err)
+			}
+		}
+		backend = backends.NewCircuitBreaker(backend, backends.CircuitBreakerConfig{
+			FailureThreshold:   circuitBreakerFailures,
+			ErrorRateThreshold: circuitBreakerErrorRate,
+			CoolDown:           circuitBreakerCoolDown,
+			Fallback:           fallback,
+		}, logger)
+		if debug {
+			fmt.Fprintf(os.Stderr, "[INFO] Circuit breaker enabled\n")
+		}
+	}
+
+	// Wrap with encryption if keys are configured. This sits above the circuit
+	// breaker so that objects written to its fallback backend are encrypted too,
+	// and below the spool and async writer so that only ciphertext is uploaded
+	// while plaintext never leaves the machine.
+	keyring, err := loadEncryptionKeyring(encryptionKeyFile, encryptionKeyID)
+	if err != nil {
+		backend.Close()
+		return nil, err
+	}
+	if keyring != nil {
+		backend = backends.NewEncrypted(backend, keyring, logger)
+		if debug {
+			fmt.Fprintf(os.Stderr, "[INFO] Encryption enabled with key ID: %s\n", keyring.ActiveKeyID())
+		}
+	}
+
+	// Wrap with signing if keys are configured. This sits above encryption so that
+	// signatures are verified over the decrypted entry.
+	signingKeyring, err := loadSigningKeyring(signingKeyFile, trustedKeysFile)
+	if err != nil {
+		backend.Close()
+		return nil, err
+	}
+	if signingKeyring != nil {
+		backend = backends.NewSigned(backend, signingKeyring, logger)
+		if signingKeyring.SignerID() == "" {
+			fmt.Fprintf(os.Stderr, "[INFO] No signing key configured, uploaded entries will be unsigned and ignored by other readers\n")
+		} else if debug {
+			fmt.Fprintf(os.Stderr, "[INFO] Signing enabled with key ID: %s\n", signingKeyring.SignerID())
+		}
+	}
+
+	// Remove uploads from the spool once they complete. This sits below the async
+	// writer so that entries are only removed once the upload actually happened.
+	if spool != nil {
+		backend = &spoolingBackend{Backend: backend, spool: spool}
+	}
+
+	// Record completed uploads in the upload manifest. This sits below the async
+	// writer for the same reason. See manifestRecorder.
+	backend = &manifestRecorder{Backend: backend}
+
+	// Wrap with async backend if enabled
+	if asyncBackend {
+		overflowPolicy, err := backends.ParseOverflowPolicy(strings.ToLower(asyncOverflow))
+		if err != nil {
+			backend.Close()
+			return nil, err
+		}
+		backend = backends.NewAsyncBackendWriter(backend, backends.AsyncBackendWriterConfig{
+			MaxQueuedItems: asyncQueueMaxItems,
+			MaxQueuedBytes: int64(asyncQueueMaxBytes),
+			Workers:        asyncWorkers,
+			OverflowPolicy: overflowPolicy,
+			SpillDir:       asyncSpillDir,
+		}, logger)
+		if debug {
+			fmt.Fprintf(os.Stderr, "[INFO] Async backend writer enabled\n")
+		}
+	}
+
+	// Wrap with debug backend if debug mode is enabled
+	if debug {
+		backend = backends.NewDebug(backend)
+	}
+
+	return backend, nil
+}
+
+// createStorageBackend creates the storage backend of the given type without any
+// of the wrappers (error injection, async writes, debug logging, etc).
+func createStorageBackend(backendType string) (backends.Backend, error) {
+	backendType = strings.ToLower(backendType)
+
+	switch backendType {
+	case "disk":
+		// Use no-op backend - local caching is handled by server.go
+		return backends.NewNoop(), nil
+
+	case "s3":
+		if s3Bucket == "" {
+			return nil, fmt.Errorf("S3 bucket is required for S3 backend (set via -s3-bucket flag or S3_BUCKET env var)")
+		}
+
+		prefix, err := expandPrefixTemplate(s3Prefix)
+		if err != nil {
+			return nil, err
+		}
+
+		awsCfg, err := resolveS3Config()
+		if err != nil {
+			return nil, err
+		}
+		return backends.NewS3(s3Bucket, prefix, awsCfg)
+
+	case "gcs":
+		if gcsBucket == "" {
+			return nil, fmt.Errorf("GCS bucket is required for GCS backend (set via -gcs-bucket flag or GCS_BUCKET env var)")
+		}
+
+		prefix, err := expandPrefixTemplate(gcsPrefix)
+		if err != nil {
+			return nil, err
+		}
+		return backends.NewGCS(gcsBucket, prefix)
+
+	default:
+		return nil, fmt.Errorf("unknown backend type: %s (supported: disk, s3, gcs)", backendType)
+	}
+}
+
+// resolveS3Config reads AWS configuration from environment variables using the
+// GOBUILDCACHE_ prefix convention, falling back to standard AWS env vars.
+// Using GOBUILDCACHE_-prefixed vars (e.g., GOBUILDCACHE_AWS_REGION instead of
+// AWS_REGION) allows users to provide AWS config to gobuildcache without those
+// values being inherited by other processes in the same environment, such as
 // test binaries spawned by go test.
 func resolveS3Config() (backends.S3Config, error) {
 	cfg := backends.S3Config{
@@ -507,69 +2308,150 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
-// getEnvWithPrefix gets an environment variable, checking for GOBUILDCACHE_ prefix first.
+// getEnvWithPrefix resolves a setting, checking the GOBUILDCACHE_ prefixed
+// environment variable first, then the unprefixed one, then the config file.
 // This allows users to use either GOBUILDCACHE_<KEY> or <KEY> for configuration.
 // The prefixed version takes precedence if set.
 func getEnvWithPrefix(key, defaultValue string) string {
-	// Check for GOBUILDCACHE_ prefixed version first
-	if value := os.Getenv("GOBUILDCACHE_" + key); value != "" {
-		return value
-	}
-	// Fall back to unprefixed version
-	return getEnv(key, defaultValue)
+	return resolveSetting(key, defaultValue, func(value string) (string, bool) {
+		return value, true
+	})
 }
 
-// getEnvBool gets a boolean environment variable or returns a default value.
+// getEnvBoolWithPrefix resolves a boolean setting like getEnvWithPrefix.
 // Accepts: true, false, 1, 0, yes, no (case insensitive).
-func getEnvBool(key string, defaultValue bool) bool {
-	value := strings.ToLower(os.Getenv(key))
-	if value == "" {
-		return defaultValue
+// Invalid values fall through to the next source.
+func getEnvBoolWithPrefix(key string, defaultValue bool) bool {
+	return resolveSetting(key, defaultValue, func(value string) (bool, bool) {
+		switch strings.ToLower(value) {
+		case "true", "1", "yes":
+			return true, true
+		case "false", "0", "no":
+			return false, true
+		default:
+			return false, false
+		}
+	})
+}
+
+// getEnvFloatWithPrefix resolves a float64 setting like getEnvWithPrefix.
+// Invalid values fall through to the next source.
+func getEnvFloatWithPrefix(key string, defaultValue float64) float64 {
+	return resolveSetting(key, defaultValue, func(value string) (float64, bool) {
+		var f float64
+		_, err := fmt.Sscanf(value, "%f", &f)
+		return f, err == nil
+	})
+}
+
+// getEnvIntWithPrefix resolves an int setting like getEnvWithPrefix.
+// Invalid values fall through to the next source.
+func getEnvIntWithPrefix(key string, defaultValue int) int {
+	return resolveSetting(key, defaultValue, func(value string) (int, bool) {
+		i, err := strconv.Atoi(value)
+		return i, err == nil
+	})
+}
+
+// getEnvDurationWithPrefix resolves a time.Duration setting (e.g. "30s", "5m")
+// like getEnvWithPrefix. Invalid values fall through to the next source.
+func getEnvDurationWithPrefix(key string, defaultValue time.Duration) time.Duration {
+	return resolveSetting(key, defaultValue, func(value string) (time.Duration, bool) {
+		d, err := time.ParseDuration(value)
+		return d, err == nil
+	})
+}
+
+// byteSize is a number of bytes that can be parsed from human-readable strings
+// like "512MB" or "2GiB". It implements flag.Value.
+type byteSize int64
+
+// String formats the size as a plain number of bytes.
+func (b *byteSize) String() string {
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+// Set parses a human-readable size.
+func (b *byteSize) Set(value string) error {
+	n, err := parseByteSize(value)
+	if err != nil {
+		return err
 	}
-	return value == "true" || value == "1" || value == "yes"
+	*b = byteSize(n)
+	return nil
 }
 
-// getEnvBoolWithPrefix gets a boolean environment variable, checking for GOBUILDCACHE_ prefix first.
-// This allows users to use either GOBUILDCACHE_<KEY> or <KEY> for configuration.
-// The prefixed version takes precedence if set, but falls back to unprefixed if the prefixed value is invalid.
-func getEnvBoolWithPrefix(key string, defaultValue bool) bool {
-	prefixedKey := "GOBUILDCACHE_" + key
-	if value := strings.ToLower(os.Getenv(prefixedKey)); value != "" {
-		if value == "true" || value == "1" || value == "yes" {
-			return true
-		}
-		if value == "false" || value == "0" || value == "no" {
-			return false
+// parseByteSize parses a human-readable size such as "1024", "64KB", "512MB" or "2GiB".
+// Units are powers of 1024 (matching formatBytes) and are case insensitive.
+func parseByteSize(value string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(value))
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"TIB", 1 << 40}, {"TB", 1 << 40}, {"T", 1 << 40},
+		{"GIB", 1 << 30}, {"GB", 1 << 30}, {"G", 1 << 30},
+		{"MIB", 1 << 20}, {"MB", 1 << 20}, {"M", 1 << 20},
+		{"KIB", 1 << 10}, {"KB", 1 << 10}, {"K", 1 << 10},
+		{"B", 1},
+	} {
+		if strings.HasSuffix(s, unit.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix))
+			multiplier = unit.multiplier
+			break
 		}
-		// Invalid prefixed value, fall through to unprefixed
 	}
-	return getEnvBool(key, defaultValue)
-}
 
-// getEnvFloat gets a float64 environment variable or returns a default value.
-func getEnvFloat(key string, defaultValue float64) float64 {
-	value := os.Getenv(key)
-	if value == "" {
-		return defaultValue
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("invalid size: %q", value)
 	}
-	var f float64
-	if _, err := fmt.Sscanf(value, "%f", &f); err != nil {
-		return defaultValue
+	return int64(f * float64(multiplier)), nil
+}
+
+// age is a duration that can also be given in days, e.g. "7d" or "36h". It
+// implements flag.Value.
+type age time.Duration
+
+// String formats the age as a time.Duration.
+func (a *age) String() string {
+	return time.Duration(*a).String()
+}
+
+// Set parses an age.
+func (a *age) Set(value string) error {
+	d, err := parseAge(value)
+	if err != nil {
+		return err
 	}
-	return f
+	*a = age(d)
+	return nil
 }
 
-// getEnvFloatWithPrefix gets a float64 environment variable, checking for GOBUILDCACHE_ prefix first.
-// This allows users to use either GOBUILDCACHE_<KEY> or <KEY> for configuration.
-// The prefixed version takes precedence if set, but falls back to unprefixed if the prefixed value is invalid.
-func getEnvFloatWithPrefix(key string, defaultValue float64) float64 {
-	prefixedKey := "GOBUILDCACHE_" + key
-	if value := os.Getenv(prefixedKey); value != "" {
-		var f float64
-		if _, err := fmt.Sscanf(value, "%f", &f); err == nil {
-			return f
+// parseAge parses a number of days such as "7d" or "1.5d", or a duration
+// accepted by time.ParseDuration.
+func parseAge(value string) (time.Duration, error) {
+	s := strings.TrimSpace(value)
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.ParseFloat(days, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid age: %q", value)
 		}
-		// Invalid prefixed value, fall through to unprefixed
+		return time.Duration(n * float64(24*time.Hour)), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid age: %q", value)
 	}
-	return getEnvFloat(key, defaultValue)
+	return d, nil
+}
+
+// getEnvBytesWithPrefix resolves a size setting (e.g. "512MB") like getEnvWithPrefix.
+// Invalid values fall through to the next source.
+func getEnvBytesWithPrefix(key string, defaultValue byteSize) byteSize {
+	return resolveSetting(key, defaultValue, func(value string) (byteSize, bool) {
+		n, err := parseByteSize(value)
+		return byteSize(n), err == nil
+	})
 }
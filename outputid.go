@@ -0,0 +1,22 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// errOutputIDMismatch is returned when a body doesn't hash to the output ID it
+// was stored or served with.
+var errOutputIDMismatch = errors.New("output ID does not match content hash")
+
+// verifyOutputID checks that a body's SHA-256 checksum matches the output ID it
+// was stored or served with. The go command uses the content hash of a build
+// output as its output ID, so a mismatch means the body was corrupted or an
+// entry was written by someone other than the go command.
+func verifyOutputID(outputID, checksum []byte) error {
+	if !bytes.Equal(outputID, checksum) {
+		return fmt.Errorf("%w: output ID is %x, content hashes to %x", errOutputIDMismatch, outputID, checksum)
+	}
+	return nil
+}
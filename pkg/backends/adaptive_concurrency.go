@@ -0,0 +1,324 @@
+package backends
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AdaptiveConcurrencyConfig configures an AdaptiveConcurrency backend.
+type AdaptiveConcurrencyConfig struct {
+	// InitialLimit is the number of concurrent operations allowed before any
+	// feedback has been received from the backend.
+	InitialLimit int
+	// MinLimit is the lowest the limit will ever shrink to.
+	MinLimit int
+	// MaxLimit is the highest the limit will ever grow to.
+	MaxLimit int
+	// DecreaseFactor is the multiplicative factor applied to the limit when the
+	// backend throttles or times out (e.g. 0.5 halves the limit).
+	DecreaseFactor float64
+	// DecreaseInterval is the minimum time between two consecutive decreases, so
+	// that a burst of throttling responses caused by a single overload event only
+	// shrinks the limit once.
+	DecreaseInterval time.Duration
+}
+
+// AdaptiveConcurrency wraps a Backend and limits the number of concurrent GET and
+// PUT operations using independent AIMD (additive increase, multiplicative decrease)
+// limits. Each limit shrinks when the backend responds with a throttling or timeout
+// error and grows slowly while operations succeed, so that large bursts of requests
+// settle at whatever concurrency the backend can actually sustain.
+type AdaptiveConcurrency struct {
+	backend Backend
+	logger  *slog.Logger
+
+	getLimiter *AIMDLimiter
+	putLimiter *AIMDLimiter
+}
+
+// NewAdaptiveConcurrency creates a new adaptive concurrency limiter around an existing backend.
+func NewAdaptiveConcurrency(backend Backend, config AdaptiveConcurrencyConfig, logger *slog.Logger) *AdaptiveConcurrency {
+	return &AdaptiveConcurrency{
+		backend:    backend,
+		logger:     logger,
+		getLimiter: NewAIMDLimiter("get", config, logger),
+		putLimiter: NewAIMDLimiter("put", config, logger),
+	}
+}
+
+// Put waits for a PUT slot and then stores the object in the underlying backend.
+func (ac *AdaptiveConcurrency) Put(actionID, outputID []byte, body io.Reader, bodySize int64) error {
+	ac.putLimiter.Acquire()
+	err := ac.backend.Put(actionID, outputID, body, bodySize)
+	ac.putLimiter.Release(err)
+	return err
+}
+
+// Get waits for a GET slot and then retrieves the object from the underlying backend.
+// On a hit the slot is held until the returned body is closed, so that the limit
+// also bounds the number of concurrent downloads and not just the request headers.
+func (ac *AdaptiveConcurrency) Get(actionID []byte) ([]byte, io.ReadCloser, int64, *time.Time, bool, error) {
+	ac.getLimiter.Acquire()
+	outputID, body, size, putTime, miss, err := ac.backend.Get(actionID)
+	if err != nil || miss || body == nil {
+		ac.getLimiter.Release(err)
+		return outputID, body, size, putTime, miss, err
+	}
+	return outputID, &limitedReadCloser{ReadCloser: body, limiter: ac.getLimiter}, size, putTime, miss, err
+}
+
+// Close closes the underlying backend.
+func (ac *AdaptiveConcurrency) Close() error {
+	return ac.backend.Close()
+}
+
+// Clear passes through to the underlying backend.
+func (ac *AdaptiveConcurrency) Clear() error {
+	return ac.backend.Clear()
+}
+
+// Unwrap returns the wrapped backend.
+func (ac *AdaptiveConcurrency) Unwrap() Backend {
+	return ac.backend
+}
+
+// Stats returns current statistics about the GET and PUT limiters.
+func (ac *AdaptiveConcurrency) Stats() (get, put AIMDLimiterStats) {
+	return ac.getLimiter.Stats(), ac.putLimiter.Stats()
+}
+
+// limitedReadCloser releases a limiter slot when the body is closed. A read error
+// (e.g. a timeout mid-download) is reported to the limiter as a failure.
+type limitedReadCloser struct {
+	io.ReadCloser
+	limiter *AIMDLimiter
+	readErr error
+	once    sync.Once
+}
+
+func (l *limitedReadCloser) Read(p []byte) (int, error) {
+	n, err := l.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		l.readErr = err
+	}
+	return n, err
+}
+
+func (l *limitedReadCloser) Close() error {
+	err := l.ReadCloser.Close()
+	l.once.Do(func() {
+		l.limiter.Release(l.readErr)
+	})
+	return err
+}
+
+// AIMDLimiter is a concurrency limiter whose limit is adjusted using additive
+// increase / multiplicative decrease based on the outcome of each operation.
+type AIMDLimiter struct {
+	name   string
+	config AdaptiveConcurrencyConfig
+	logger *slog.Logger
+
+	mu           sync.Mutex
+	cond         *sync.Cond
+	limit        float64
+	minSeen      float64
+	inflight     int
+	lastDecrease time.Time
+
+	// Stats
+	successes atomic.Int64
+	throttles atomic.Int64
+	timeouts  atomic.Int64
+	errors    atomic.Int64
+	waits     atomic.Int64
+	waitTime  atomic.Int64 // nanoseconds
+}
+
+// NewAIMDLimiter creates a new AIMD limiter. Invalid or zero config values are
+// replaced with defaults.
+func NewAIMDLimiter(name string, config AdaptiveConcurrencyConfig, logger *slog.Logger) *AIMDLimiter {
+	if config.MinLimit <= 0 {
+		config.MinLimit = 1
+	}
+	if config.MaxLimit <= 0 {
+		config.MaxLimit = 1024
+	}
+	if config.MaxLimit < config.MinLimit {
+		config.MaxLimit = config.MinLimit
+	}
+	if config.InitialLimit <= 0 {
+		config.InitialLimit = 64
+	}
+	if config.InitialLimit < config.MinLimit {
+		config.InitialLimit = config.MinLimit
+	}
+	if config.InitialLimit > config.MaxLimit {
+		config.InitialLimit = config.MaxLimit
+	}
+	if config.DecreaseFactor <= 0 || config.DecreaseFactor >= 1 {
+		config.DecreaseFactor = 0.5
+	}
+	if config.DecreaseInterval <= 0 {
+		config.DecreaseInterval = 100 * time.Millisecond
+	}
+
+	l := &AIMDLimiter{
+		name:    name,
+		config:  config,
+		logger:  logger,
+		limit:   float64(config.InitialLimit),
+		minSeen: float64(config.InitialLimit),
+	}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// Acquire blocks until an operation is allowed to start under the current limit.
+func (l *AIMDLimiter) Acquire() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.inflight < int(l.limit) {
+		l.inflight++
+		return
+	}
+
+	l.waits.Add(1)
+	start := time.Now()
+	for l.inflight >= int(l.limit) {
+		l.cond.Wait()
+	}
+	l.inflight++
+	l.waitTime.Add(int64(time.Since(start)))
+}
+
+// Release marks an operation started with Acquire as finished and adjusts the limit
+// based on its outcome. Throttling and timeout errors shrink the limit, successes
+// grow it, and other errors leave it unchanged.
+func (l *AIMDLimiter) Release(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.inflight--
+
+	switch {
+	case err == nil:
+		l.successes.Add(1)
+		// Grow by roughly one slot per limit's worth of successful operations.
+		l.limit = math.Min(float64(l.config.MaxLimit), l.limit+1/l.limit)
+
+	case IsThrottleError(err) || IsTimeoutError(err):
+		if IsThrottleError(err) {
+			l.throttles.Add(1)
+		} else {
+			l.timeouts.Add(1)
+		}
+		if time.Since(l.lastDecrease) >= l.config.DecreaseInterval {
+			previous := l.limit
+			l.limit = math.Max(float64(l.config.MinLimit), l.limit*l.config.DecreaseFactor)
+			l.minSeen = math.Min(l.minSeen, l.limit)
+			l.lastDecrease = time.Now()
+			l.logger.Debug("backend throttled, decreasing concurrency limit",
+				"operation", l.name,
+				"previousLimit", int(previous),
+				"limit", int(l.limit),
+				"error", err)
+		}
+
+	default:
+		l.errors.Add(1)
+	}
+
+	l.cond.Broadcast()
+}
+
+// Limit returns the current concurrency limit.
+func (l *AIMDLimiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.limit)
+}
+
+// Stats returns current statistics about the limiter.
+func (l *AIMDLimiter) Stats() AIMDLimiterStats {
+	l.mu.Lock()
+	limit, minSeen := l.limit, l.minSeen
+	l.mu.Unlock()
+
+	return AIMDLimiterStats{
+		Limit:     int(limit),
+		MinLimit:  int(minSeen),
+		Successes: l.successes.Load(),
+		Throttles: l.throttles.Load(),
+		Timeouts:  l.timeouts.Load(),
+		Errors:    l.errors.Load(),
+		Waits:     l.waits.Load(),
+		WaitTime:  time.Duration(l.waitTime.Load()),
+	}
+}
+
+// AIMDLimiterStats holds statistics for an AIMD limiter.
+type AIMDLimiterStats struct {
+	Limit     int // Current limit
+	MinLimit  int // Lowest limit reached during the run
+	Successes int64
+	Throttles int64
+	Timeouts  int64
+	Errors    int64 // Errors that were neither throttling nor timeouts
+	Waits     int64 // Operations that had to wait for a slot
+	WaitTime  time.Duration
+}
+
+// throttleErrorMarkers are substrings of error messages that S3, S3-compatible
+// stores and GCS use when asking clients to back off.
+var throttleErrorMarkers = []string{
+	"SlowDown",
+	"Throttling",
+	"ThrottlingException",
+	"RequestLimitExceeded",
+	"TooManyRequests",
+	"Too Many Requests",
+	"rateLimitExceeded",
+	"StatusCode: 429",
+	"StatusCode: 503",
+	"Error 429",
+	"Error 503",
+}
+
+// IsThrottleError reports whether err indicates that the backend is throttling requests.
+func IsThrottleError(err error) bool {
+	if err == nil {
+		return false
+	}
+	errMsg := err.Error()
+	for _, marker := range throttleErrorMarkers {
+		if strings.Contains(errMsg, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsTimeoutError reports whether err is a timeout talking to the backend.
+func IsTimeoutError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return false
+}
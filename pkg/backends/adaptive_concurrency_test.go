@@ -0,0 +1,113 @@
+package backends
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAIMDLimiterAdjustsLimit(t *testing.T) {
+	l := NewAIMDLimiter("test", AdaptiveConcurrencyConfig{
+		InitialLimit:     8,
+		MinLimit:         2,
+		MaxLimit:         16,
+		DecreaseInterval: time.Nanosecond,
+	}, testLogger())
+
+	l.Acquire()
+	l.Release(errors.New("api error SlowDown: Please reduce your request rate."))
+	if got := l.Limit(); got != 4 {
+		t.Errorf("Expected limit to halve to 4 after throttling, got %d", got)
+	}
+
+	l.Acquire()
+	l.Release(fmt.Errorf("failed to get S3 object: %w", context.DeadlineExceeded))
+	if got := l.Limit(); got != 2 {
+		t.Errorf("Expected limit to halve to 2 after timeout, got %d", got)
+	}
+
+	// The limit never drops below MinLimit.
+	l.Acquire()
+	l.Release(errors.New("googleapi: Error 429: rateLimitExceeded"))
+	if got := l.Limit(); got != 2 {
+		t.Errorf("Expected limit to stay at MinLimit 2, got %d", got)
+	}
+
+	// Unrelated errors leave the limit untouched.
+	l.Acquire()
+	l.Release(errors.New("access denied"))
+	if got := l.Limit(); got != 2 {
+		t.Errorf("Expected limit to stay at 2 after unrelated error, got %d", got)
+	}
+
+	// Successes grow the limit additively.
+	for i := 0; i < 100; i++ {
+		l.Acquire()
+		l.Release(nil)
+	}
+	if got := l.Limit(); got <= 2 || got > 16 {
+		t.Errorf("Expected limit to grow above 2 (max 16) after successes, got %d", got)
+	}
+
+	stats := l.Stats()
+	if stats.Throttles != 2 || stats.Timeouts != 1 || stats.Errors != 1 || stats.Successes != 100 || stats.MinLimit != 2 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+// blockingBackend blocks every Put until release is closed and tracks the
+// maximum number of concurrent Puts.
+type blockingBackend struct {
+	fakeBackend
+	release     chan struct{}
+	inflight    atomic.Int64
+	maxInflight atomic.Int64
+}
+
+func (b *blockingBackend) Put(actionID, outputID []byte, body io.Reader, bodySize int64) error {
+	n := b.inflight.Add(1)
+	for {
+		current := b.maxInflight.Load()
+		if n <= current || b.maxInflight.CompareAndSwap(current, n) {
+			break
+		}
+	}
+	<-b.release
+	b.inflight.Add(-1)
+	return nil
+}
+
+func TestAdaptiveConcurrencyLimitsPuts(t *testing.T) {
+	backend := &blockingBackend{release: make(chan struct{})}
+	ac := NewAdaptiveConcurrency(backend, AdaptiveConcurrencyConfig{
+		InitialLimit: 3,
+		MaxLimit:     3,
+	}, testLogger())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ac.Put([]byte{byte(i)}, nil, bytes.NewReader(nil), 0)
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(backend.release)
+	wg.Wait()
+
+	if got := backend.maxInflight.Load(); got != 3 {
+		t.Errorf("Expected at most 3 concurrent PUTs, got %d", got)
+	}
+	_, putStats := ac.Stats()
+	if putStats.Waits == 0 {
+		t.Error("Expected some PUTs to wait for a slot")
+	}
+}
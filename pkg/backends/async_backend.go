@@ -2,98 +2,380 @@ package backends
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"os"
+	"path/filepath"
 	"runtime"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
+// errAsyncWriterClosed is returned by Put after the writer has been closed.
+var errAsyncWriterClosed = errors.New("async backend writer is closed")
+
+// OverflowPolicy determines what AsyncBackendWriter.Put does when the upload queue is full.
+type OverflowPolicy string
+
+const (
+	// OverflowBlock blocks Put until there is room in the queue.
+	OverflowBlock = OverflowPolicy("block")
+	// OverflowDropOldest drops the oldest queued uploads to make room for the new one.
+	OverflowDropOldest = OverflowPolicy("drop-oldest")
+	// OverflowSpill writes the upload to a file in the spill directory instead of
+	// keeping it in memory. Spilled uploads don't count towards the queue limits.
+	OverflowSpill = OverflowPolicy("spill")
+)
+
+// ParseOverflowPolicy parses an overflow policy name.
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	switch policy := OverflowPolicy(s); policy {
+	case OverflowBlock, OverflowDropOldest, OverflowSpill:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown overflow policy: %s (supported: block, drop-oldest, spill)", s)
+	}
+}
+
+// AsyncBackendWriterConfig configures an AsyncBackendWriter.
+type AsyncBackendWriterConfig struct {
+	// MaxQueuedItems is the maximum number of uploads held in memory. Defaults to 128*GOMAXPROCS.
+	MaxQueuedItems int
+	// MaxQueuedBytes is the maximum number of body bytes held in memory. Defaults to 512MiB.
+	MaxQueuedBytes int64
+	// Workers is the maximum number of concurrent uploads. Defaults to 16*GOMAXPROCS.
+	Workers int
+	// OverflowPolicy determines what happens when the queue is full. Defaults to OverflowBlock.
+	OverflowPolicy OverflowPolicy
+	// SpillDir is the directory used by OverflowSpill. Defaults to os.TempDir()/gobuildcache/spill.
+	SpillDir string
+}
+
+// asyncPut is a single queued upload. The body is either held in memory (data)
+// or spilled to a file on disk (spillPath).
+type asyncPut struct {
+	actionID  []byte
+	outputID  []byte
+	data      []byte
+	spillPath string
+	size      int64
+}
+
 // AsyncBackendWriter wraps a Backend and provides asynchronous PUT operations.
 // GET operations are still synchronous as they're in the critical path for builds.
-// PUT operations spawn a goroutine on demand.
+//
+// PUT operations are added to a bounded queue (limited by both count and bytes)
+// which is drained by a pool of workers. Workers don't start new uploads while
+// GETs are in flight so that uploads never compete with critical-path downloads
+// for connections or bandwidth.
 type AsyncBackendWriter struct {
-	backend   Backend
-	logger    *slog.Logger
-	semaphore chan struct{}
-	wg        sync.WaitGroup
+	backend Backend
+	logger  *slog.Logger
+	config  AsyncBackendWriterConfig
+
+	mu          sync.Mutex
+	cond        *sync.Cond // Signaled whenever the queue changes or the writer is closed.
+	queue       []*asyncPut
+	memItems    int   // Number of queued uploads held in memory.
+	memBytes    int64 // Number of queued body bytes held in memory.
+	workers     int
+	idleWorkers int
+	closed      bool
+	wg          sync.WaitGroup
+
+	inflightGets atomic.Int64
 
 	// Stats
-	startedPuts  atomic.Int64
-	failedPuts   atomic.Int64
-	successPuts  atomic.Int64
-	totalPutTime atomic.Int64 // microseconds
+	startedPuts   atomic.Int64
+	failedPuts    atomic.Int64
+	successPuts   atomic.Int64
+	totalPutTime  atomic.Int64 // microseconds
+	droppedPuts   atomic.Int64
+	spilledPuts   atomic.Int64
+	blockedPuts   atomic.Int64
+	blockedTime   atomic.Int64 // nanoseconds
+	deferredPuts  atomic.Int64 // Uploads that waited for in-flight GETs before starting
+	maxQueueDepth atomic.Int64
+	maxQueueBytes atomic.Int64
 }
 
+// NewAsyncBackendWriter creates a new asynchronous writer around an existing backend.
+// Zero config values are replaced with defaults.
 func NewAsyncBackendWriter(
 	backend Backend,
+	config AsyncBackendWriterConfig,
 	logger *slog.Logger,
 ) *AsyncBackendWriter {
-	return &AsyncBackendWriter{
-		backend:   backend,
-		logger:    logger,
-		semaphore: make(chan struct{}, 128*runtime.GOMAXPROCS(0)),
+	if config.MaxQueuedItems <= 0 {
+		config.MaxQueuedItems = 128 * runtime.GOMAXPROCS(0)
+	}
+	if config.MaxQueuedBytes <= 0 {
+		config.MaxQueuedBytes = 512 * 1024 * 1024
+	}
+	if config.Workers <= 0 {
+		config.Workers = 16 * runtime.GOMAXPROCS(0)
+	}
+	if config.OverflowPolicy == "" {
+		config.OverflowPolicy = OverflowBlock
+	}
+	if config.SpillDir == "" {
+		config.SpillDir = filepath.Join(os.TempDir(), "gobuildcache", "spill")
+	}
+
+	abw := &AsyncBackendWriter{
+		backend: backend,
+		logger:  logger,
+		config:  config,
 	}
+	abw.cond = sync.NewCond(&abw.mu)
+	return abw
 }
 
-// Put spawns a goroutine to execute the PUT operation asynchronously.
+// Put adds the PUT operation to the upload queue and returns immediately, unless
+// the queue is full and the overflow policy is OverflowBlock.
 // The body is copied to avoid holding references to the original data.
 func (abw *AsyncBackendWriter) Put(actionID, outputID []byte, body io.Reader, bodySize int64) error {
-	// Try to acquire semaphore slot
-	select {
-	case abw.semaphore <- struct{}{}:
-		// Successfully acquired
-	default:
-		return fmt.Errorf("too many concurrent PUT operations")
-	}
-
 	// Copy the body data since we're processing asynchronously
 	bodyData, err := io.ReadAll(body)
 	if err != nil {
-		<-abw.semaphore // Release semaphore on error
 		return fmt.Errorf("failed to read body: %w", err)
 	}
 
-	abw.wg.Add(1)
+	item := &asyncPut{
+		actionID: actionID,
+		outputID: outputID,
+		data:     bodyData,
+		size:     bodySize,
+	}
+
+	abw.mu.Lock()
+	defer abw.mu.Unlock()
+
+	if abw.closed {
+		return errAsyncWriterClosed
+	}
+
+	var blockedStart time.Time
+	for !abw.fitsLocked(int64(len(bodyData))) {
+		switch abw.config.OverflowPolicy {
+		case OverflowDropOldest:
+			abw.dropOldestLocked()
+			continue
+
+		case OverflowSpill:
+			// Don't hold the lock while writing to disk.
+			abw.mu.Unlock()
+			spillPath, err := abw.spill(bodyData)
+			abw.mu.Lock()
+			if err != nil {
+				return fmt.Errorf("failed to spill upload to disk: %w", err)
+			}
+			if abw.closed {
+				os.Remove(spillPath)
+				return errAsyncWriterClosed
+			}
+			item.data = nil
+			item.spillPath = spillPath
+			abw.spilledPuts.Add(1)
+			abw.enqueueLocked(item)
+			return nil
+
+		default:
+			if blockedStart.IsZero() {
+				blockedStart = time.Now()
+				abw.blockedPuts.Add(1)
+			}
+			abw.cond.Wait()
+			if abw.closed {
+				return errAsyncWriterClosed
+			}
+		}
+	}
+	if !blockedStart.IsZero() {
+		abw.blockedTime.Add(int64(time.Since(blockedStart)))
+	}
+
+	abw.enqueueLocked(item)
+	return nil
+}
+
+// fitsLocked returns whether an in-memory upload of the given size fits in the queue.
+// A single upload larger than MaxQueuedBytes is accepted once the queue is empty so
+// that it can't block forever. abw.mu must be held.
+func (abw *AsyncBackendWriter) fitsLocked(size int64) bool {
+	if abw.memItems == 0 {
+		return true
+	}
+	return abw.memItems < abw.config.MaxQueuedItems &&
+		abw.memBytes+size <= abw.config.MaxQueuedBytes
+}
+
+// enqueueLocked adds an upload to the queue and makes sure a worker is available
+// to process it. abw.mu must be held.
+func (abw *AsyncBackendWriter) enqueueLocked(item *asyncPut) {
+	abw.queue = append(abw.queue, item)
+	if item.spillPath == "" {
+		abw.memItems++
+		abw.memBytes += int64(len(item.data))
+	}
 	abw.startedPuts.Add(1)
-	go func() {
-		defer abw.wg.Done()
-		defer func() { <-abw.semaphore }() // Release semaphore when done
 
-		start := time.Now()
-		err := abw.backend.Put(actionID, outputID, bytes.NewReader(bodyData), bodySize)
-		duration := time.Since(start)
+	if depth := int64(len(abw.queue)); depth > abw.maxQueueDepth.Load() {
+		abw.maxQueueDepth.Store(depth)
+	}
+	if abw.memBytes > abw.maxQueueBytes.Load() {
+		abw.maxQueueBytes.Store(abw.memBytes)
+	}
+
+	if abw.idleWorkers == 0 && abw.workers < abw.config.Workers {
+		abw.workers++
+		abw.wg.Add(1)
+		go abw.worker()
+	}
+	abw.cond.Broadcast()
+}
 
-		abw.totalPutTime.Add(int64(duration.Microseconds()))
+// dropOldestLocked drops the oldest in-memory upload from the queue. abw.mu must be held.
+func (abw *AsyncBackendWriter) dropOldestLocked() {
+	for i, item := range abw.queue {
+		if item.spillPath != "" {
+			continue
+		}
+		abw.queue = append(abw.queue[:i], abw.queue[i+1:]...)
+		abw.memItems--
+		abw.memBytes -= int64(len(item.data))
+		abw.droppedPuts.Add(1)
+		abw.logger.Warn("async upload queue full, dropped oldest upload",
+			"actionID", fmt.Sprintf("%x", item.actionID[:min(8, len(item.actionID))]),
+			"size", item.size)
+		return
+	}
+}
 
+// spill writes an upload body to a new file in the spill directory.
+func (abw *AsyncBackendWriter) spill(data []byte) (string, error) {
+	if err := os.MkdirAll(abw.config.SpillDir, 0755); err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp(abw.config.SpillDir, "upload-*")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(data)
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// worker processes queued uploads until the writer is closed and the queue is drained.
+func (abw *AsyncBackendWriter) worker() {
+	defer abw.wg.Done()
+
+	for {
+		abw.mu.Lock()
+		for len(abw.queue) == 0 && !abw.closed {
+			abw.idleWorkers++
+			abw.cond.Wait()
+			abw.idleWorkers--
+		}
+		if len(abw.queue) == 0 {
+			abw.mu.Unlock()
+			return
+		}
+
+		item := abw.queue[0]
+		abw.queue[0] = nil
+		abw.queue = abw.queue[1:]
+		if item.spillPath == "" {
+			abw.memItems--
+			abw.memBytes -= int64(len(item.data))
+		}
+		// Wake up any Puts blocked on a full queue.
+		abw.cond.Broadcast()
+		abw.mu.Unlock()
+
+		abw.waitForGets()
+		abw.upload(item)
+	}
+}
+
+// waitForGets delays the start of an upload while GETs are in flight so that
+// uploads don't compete with critical-path downloads. To avoid starving uploads
+// entirely during a long stream of GETs, it gives up waiting after one second.
+func (abw *AsyncBackendWriter) waitForGets() {
+	if abw.inflightGets.Load() == 0 {
+		return
+	}
+	abw.deferredPuts.Add(1)
+	deadline := time.Now().Add(time.Second)
+	for abw.inflightGets.Load() > 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// upload performs a single queued PUT against the underlying backend.
+func (abw *AsyncBackendWriter) upload(item *asyncPut) {
+	var body io.Reader = bytes.NewReader(item.data)
+	if item.spillPath != "" {
+		defer os.Remove(item.spillPath)
+		f, err := os.Open(item.spillPath)
 		if err != nil {
 			abw.failedPuts.Add(1)
-			abw.logger.Warn("async backend PUT failed",
-				"actionID", fmt.Sprintf("%x", actionID[:min(8, len(actionID))]),
-				"size", bodySize,
-				"duration", duration,
+			abw.logger.Warn("async backend PUT failed to open spilled upload",
+				"actionID", fmt.Sprintf("%x", item.actionID[:min(8, len(item.actionID))]),
 				"error", err)
-		} else {
-			abw.successPuts.Add(1)
-			abw.logger.Debug("async backend PUT succeeded",
-				"actionID", fmt.Sprintf("%x", actionID[:min(8, len(actionID))]),
-				"size", bodySize,
-				"duration", duration)
+			return
 		}
-	}()
+		defer f.Close()
+		body = f
+	}
 
-	return nil
+	start := time.Now()
+	err := abw.backend.Put(item.actionID, item.outputID, body, item.size)
+	duration := time.Since(start)
+
+	abw.totalPutTime.Add(int64(duration.Microseconds()))
+
+	if err != nil {
+		abw.failedPuts.Add(1)
+		abw.logger.Warn("async backend PUT failed",
+			"actionID", fmt.Sprintf("%x", item.actionID[:min(8, len(item.actionID))]),
+			"size", item.size,
+			"duration", duration,
+			"error", err)
+	} else {
+		abw.successPuts.Add(1)
+		abw.logger.Debug("async backend PUT succeeded",
+			"actionID", fmt.Sprintf("%x", item.actionID[:min(8, len(item.actionID))]),
+			"size", item.size,
+			"duration", duration)
+	}
 }
 
 // Get passes through to the underlying backend (synchronous).
-// GET operations remain synchronous as they're in the critical path.
+// GET operations remain synchronous as they're in the critical path. The GET is
+// considered in flight until its body is closed, and no new uploads are started
+// in the meantime.
 func (abw *AsyncBackendWriter) Get(actionID []byte) (outputID []byte, body io.ReadCloser, size int64, putTime *time.Time, miss bool, err error) {
-	return abw.backend.Get(actionID)
+	abw.inflightGets.Add(1)
+	outputID, body, size, putTime, miss, err = abw.backend.Get(actionID)
+	if err != nil || miss || body == nil {
+		abw.inflightGets.Add(-1)
+		return outputID, body, size, putTime, miss, err
+	}
+	return outputID, &onCloseReadCloser{ReadCloser: body, onClose: func() { abw.inflightGets.Add(-1) }}, size, putTime, miss, err
 }
 
-// Close gracefully shuts down the async writer and waits for all in-flight operations to complete.
+// Close gracefully shuts down the async writer and waits for all queued operations to complete.
 // It also closes the underlying backend.
 func (abw *AsyncBackendWriter) Close() error {
 	abw.logger.Debug("shutting down async backend writer",
@@ -101,7 +383,11 @@ func (abw *AsyncBackendWriter) Close() error {
 		"successPuts", abw.successPuts.Load(),
 		"failedPuts", abw.failedPuts.Load())
 
-	// Wait for all in-flight PUTs to finish
+	// Wait for all queued PUTs to finish
+	abw.mu.Lock()
+	abw.closed = true
+	abw.cond.Broadcast()
+	abw.mu.Unlock()
 	abw.wg.Wait()
 
 	// Close the underlying backend
@@ -121,13 +407,79 @@ func (abw *AsyncBackendWriter) Clear() error {
 	return abw.backend.Clear()
 }
 
+// List passes through to the underlying backend. Queued uploads aren't listed.
+func (abw *AsyncBackendWriter) List(pageToken string, pageSize int) ([]ObjectInfo, string, error) {
+	return listNext(abw.backend, pageToken, pageSize)
+}
+
+// Stat passes through to the underlying backend. Queued uploads aren't found.
+func (abw *AsyncBackendWriter) Stat(actionID []byte) (ObjectInfo, bool, error) {
+	return statNext(abw.backend, actionID)
+}
+
+// Touch passes through to the underlying backend. Queued uploads aren't touched,
+// they get a fresh access time when they are written.
+func (abw *AsyncBackendWriter) Touch(actionID []byte, interval time.Duration) (bool, error) {
+	return touchNext(abw.backend, actionID, interval)
+}
+
+// Delete drops the queued uploads of actionIDs that haven't started yet, so that
+// they can't recreate the objects afterwards, and deletes the objects from the
+// underlying backend. Uploads already in progress may still complete.
+func (abw *AsyncBackendWriter) Delete(actionIDs [][]byte) error {
+	deleted := make(map[string]bool, len(actionIDs))
+	for _, actionID := range actionIDs {
+		deleted[string(actionID)] = true
+	}
+
+	abw.mu.Lock()
+	queue := abw.queue[:0]
+	for _, item := range abw.queue {
+		if !deleted[string(item.actionID)] {
+			queue = append(queue, item)
+			continue
+		}
+		if item.spillPath != "" {
+			os.Remove(item.spillPath)
+		} else {
+			abw.memItems--
+			abw.memBytes -= int64(len(item.data))
+		}
+	}
+	clear(abw.queue[len(queue):])
+	abw.queue = queue
+	// Wake up any Puts blocked on a full queue.
+	abw.cond.Broadcast()
+	abw.mu.Unlock()
+
+	return deleteNext(abw.backend, actionIDs)
+}
+
+// Unwrap returns the wrapped backend.
+func (abw *AsyncBackendWriter) Unwrap() Backend {
+	return abw.backend
+}
+
 // Stats returns current statistics about the async writer
 func (abw *AsyncBackendWriter) Stats() AsyncBackendStats {
+	abw.mu.Lock()
+	queuedPuts, queuedBytes := int64(len(abw.queue)), abw.memBytes
+	abw.mu.Unlock()
+
 	return AsyncBackendStats{
 		StartedPuts:        abw.startedPuts.Load(),
 		SuccessPuts:        abw.successPuts.Load(),
 		FailedPuts:         abw.failedPuts.Load(),
 		TotalPutTimeMicros: abw.totalPutTime.Load(),
+		QueuedPuts:         queuedPuts,
+		QueuedBytes:        queuedBytes,
+		MaxQueueDepth:      abw.maxQueueDepth.Load(),
+		MaxQueueBytes:      abw.maxQueueBytes.Load(),
+		DroppedPuts:        abw.droppedPuts.Load(),
+		SpilledPuts:        abw.spilledPuts.Load(),
+		BlockedPuts:        abw.blockedPuts.Load(),
+		BlockedTime:        time.Duration(abw.blockedTime.Load()),
+		DeferredPuts:       abw.deferredPuts.Load(),
 	}
 }
 
@@ -137,6 +489,28 @@ type AsyncBackendStats struct {
 	SuccessPuts        int64
 	FailedPuts         int64
 	TotalPutTimeMicros int64
+	QueuedPuts         int64 // Uploads currently waiting in the queue
+	QueuedBytes        int64 // In-memory bytes currently waiting in the queue
+	MaxQueueDepth      int64
+	MaxQueueBytes      int64
+	DroppedPuts        int64 // Uploads dropped by OverflowDropOldest
+	SpilledPuts        int64 // Uploads spilled to disk by OverflowSpill
+	BlockedPuts        int64 // Puts that blocked on a full queue with OverflowBlock
+	BlockedTime        time.Duration
+	DeferredPuts       int64 // Uploads that waited for in-flight GETs before starting
+}
+
+// onCloseReadCloser calls onClose exactly once when the body is closed.
+type onCloseReadCloser struct {
+	io.ReadCloser
+	onClose func()
+	once    sync.Once
+}
+
+func (o *onCloseReadCloser) Close() error {
+	err := o.ReadCloser.Close()
+	o.once.Do(o.onClose)
+	return err
 }
 
 func min(a, b int) int {
@@ -0,0 +1,153 @@
+package backends
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// gatedBackend blocks every Put until gate is closed.
+type gatedBackend struct {
+	*fakeBackend
+	gate chan struct{}
+}
+
+func (g *gatedBackend) Put(actionID, outputID []byte, body io.Reader, bodySize int64) error {
+	<-g.gate
+	return g.fakeBackend.Put(actionID, outputID, body, bodySize)
+}
+
+func TestAsyncBackendWriterUploadsEverythingOnClose(t *testing.T) {
+	backend := newFakeBackend()
+	abw := NewAsyncBackendWriter(backend, AsyncBackendWriterConfig{
+		MaxQueuedItems: 2,
+		Workers:        1,
+	}, testLogger())
+
+	for i := 0; i < 10; i++ {
+		if err := abw.Put([]byte{byte(i)}, []byte("output"), bytes.NewReader([]byte("body")), 4); err != nil {
+			t.Fatalf("Put %d returned error: %v", i, err)
+		}
+	}
+	if err := abw.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+
+	if puts, _ := backend.counts(); puts != 10 {
+		t.Errorf("Expected 10 uploads, got %d", puts)
+	}
+	stats := abw.Stats()
+	if stats.SuccessPuts != 10 || stats.DroppedPuts != 0 || stats.QueuedPuts != 0 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+	if err := abw.Put([]byte("late"), nil, bytes.NewReader(nil), 0); err != errAsyncWriterClosed {
+		t.Errorf("Expected errAsyncWriterClosed after Close, got %v", err)
+	}
+}
+
+func TestAsyncBackendWriterBlocksWhenFull(t *testing.T) {
+	backend := &gatedBackend{fakeBackend: newFakeBackend(), gate: make(chan struct{})}
+	abw := NewAsyncBackendWriter(backend, AsyncBackendWriterConfig{
+		MaxQueuedItems: 1,
+		Workers:        1,
+	}, testLogger())
+
+	// The first upload is picked up by the worker, the second fills the queue.
+	abw.Put([]byte("a"), nil, bytes.NewReader([]byte("a")), 1)
+	time.Sleep(20 * time.Millisecond)
+	abw.Put([]byte("b"), nil, bytes.NewReader([]byte("b")), 1)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	returned := make(chan struct{})
+	go func() {
+		defer wg.Done()
+		abw.Put([]byte("c"), nil, bytes.NewReader([]byte("c")), 1)
+		close(returned)
+	}()
+
+	select {
+	case <-returned:
+		t.Fatal("Expected Put to block while the queue is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(backend.gate)
+	wg.Wait()
+	abw.Close()
+
+	stats := abw.Stats()
+	if stats.BlockedPuts != 1 || stats.SuccessPuts != 3 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestAsyncBackendWriterDropOldest(t *testing.T) {
+	backend := &gatedBackend{fakeBackend: newFakeBackend(), gate: make(chan struct{})}
+	abw := NewAsyncBackendWriter(backend, AsyncBackendWriterConfig{
+		MaxQueuedItems: 2,
+		Workers:        1,
+		OverflowPolicy: OverflowDropOldest,
+	}, testLogger())
+
+	abw.Put([]byte("a"), nil, bytes.NewReader([]byte("a")), 1)
+	time.Sleep(20 * time.Millisecond)
+	for _, id := range []string{"b", "c", "d"} {
+		if err := abw.Put([]byte(id), nil, bytes.NewReader([]byte(id)), 1); err != nil {
+			t.Fatalf("Put %s returned error: %v", id, err)
+		}
+	}
+
+	close(backend.gate)
+	abw.Close()
+
+	// "a" was in flight, "b" was dropped to make room for "d".
+	if _, _, _, _, miss, _ := backend.Get([]byte("b")); !miss {
+		t.Error("Expected oldest queued upload to be dropped")
+	}
+	for _, id := range []string{"a", "c", "d"} {
+		if _, _, _, _, miss, _ := backend.Get([]byte(id)); miss {
+			t.Errorf("Expected upload %s to succeed", id)
+		}
+	}
+	if stats := abw.Stats(); stats.DroppedPuts != 1 {
+		t.Errorf("Expected 1 dropped upload, got %+v", stats)
+	}
+}
+
+func TestAsyncBackendWriterSpill(t *testing.T) {
+	spillDir := t.TempDir()
+	backend := &gatedBackend{fakeBackend: newFakeBackend(), gate: make(chan struct{})}
+	abw := NewAsyncBackendWriter(backend, AsyncBackendWriterConfig{
+		MaxQueuedItems: 1,
+		Workers:        1,
+		OverflowPolicy: OverflowSpill,
+		SpillDir:       spillDir,
+	}, testLogger())
+
+	abw.Put([]byte("a"), nil, bytes.NewReader([]byte("a")), 1)
+	time.Sleep(20 * time.Millisecond)
+	abw.Put([]byte("b"), nil, bytes.NewReader([]byte("b")), 1)
+	abw.Put([]byte("c"), []byte("output-c"), bytes.NewReader([]byte("spilled")), 7)
+
+	close(backend.gate)
+	abw.Close()
+
+	_, body, _, _, miss, _ := backend.Get([]byte("c"))
+	if miss {
+		t.Fatal("Expected spilled upload to succeed")
+	}
+	data, _ := io.ReadAll(body)
+	if string(data) != "spilled" {
+		t.Errorf("Expected spilled body %q, got %q", "spilled", data)
+	}
+	if stats := abw.Stats(); stats.SpilledPuts != 1 {
+		t.Errorf("Expected 1 spilled upload, got %+v", stats)
+	}
+	if entries, _ := os.ReadDir(spillDir); len(entries) != 0 {
+		t.Errorf("Expected spill directory to be cleaned up, found %d files", len(entries))
+	}
+}
@@ -1,8 +1,15 @@
 package backends
 
 import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
+	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 // Backend defines the interface for cache storage backends.
@@ -36,3 +43,182 @@ type Backend interface {
 	// Clear removes all entries from the cache backend storage.
 	Clear() error
 }
+
+// ObjectInfo describes an object stored by a backend.
+type ObjectInfo struct {
+	// ActionID is the key the object was Put under, or nil if the object's name
+	// isn't one the backend generated.
+	ActionID []byte
+	Name     string    // Name of the object in the storage system
+	Size     int64     // Stored size in bytes
+	PutTime  time.Time // When the object was written
+	OutputID []byte    // nil if the listing doesn't include it
+
+	// AccessTime is when the object was last written or touched (see Toucher),
+	// or zero if the backend doesn't track it.
+	AccessTime time.Time
+}
+
+// Lister is implemented by backends that can enumerate the objects they store.
+type Lister interface {
+	Backend
+
+	// List returns the next page of at most pageSize objects, starting at
+	// pageToken ("" for the first page), along with the token of the following
+	// page, which is "" after the last page.
+	List(pageToken string, pageSize int) (objects []ObjectInfo, nextPageToken string, err error)
+}
+
+// ListAll calls fn for every object of lister, in pages of pageSize objects.
+// It stops at the first error returned by fn.
+func ListAll(lister Lister, pageSize int, fn func(ObjectInfo) error) error {
+	pageToken := ""
+	for {
+		objects, next, err := lister.List(pageToken, pageSize)
+		if err != nil {
+			return err
+		}
+		for _, obj := range objects {
+			if err := fn(obj); err != nil {
+				return err
+			}
+		}
+		if next == "" {
+			return nil
+		}
+		pageToken = next
+	}
+}
+
+// Deleter is implemented by backends that can delete individual objects.
+type Deleter interface {
+	Backend
+
+	// Delete removes the objects stored for actionIDs. Objects that don't exist
+	// are ignored. It attempts every deletion and returns the joined errors of
+	// the ones that failed.
+	Delete(actionIDs [][]byte) error
+}
+
+// Stater is implemented by backends that can look up an object's metadata
+// without downloading it.
+type Stater interface {
+	Backend
+
+	// Stat returns the metadata of the object stored for actionID, or miss=true
+	// if there is none.
+	Stat(actionID []byte) (info ObjectInfo, miss bool, err error)
+}
+
+// Toucher is implemented by backends that can record that an object was used,
+// so that unused objects can be told apart from old but frequently used ones.
+type Toucher interface {
+	Backend
+
+	// Touch sets the access time of the object stored for actionID to now,
+	// unless it was already written or touched within the last interval.
+	// It returns whether the object was touched. Missing objects are ignored.
+	Touch(actionID []byte, interval time.Duration) (touched bool, err error)
+}
+
+// unsupportedError returns the error of a wrapper asked to perform an optional
+// operation that the backends it wraps don't support.
+func unsupportedError(backend Backend, op string) error {
+	return fmt.Errorf("%T does not support %s: %w", backend, op, errors.ErrUnsupported)
+}
+
+// listNext, deleteNext, statNext and touchNext forward an optional operation to the first
+// backend below a wrapper that supports it.
+func listNext(backend Backend, pageToken string, pageSize int) ([]ObjectInfo, string, error) {
+	lister, ok := Find[Lister](backend)
+	if !ok {
+		return nil, "", unsupportedError(backend, "List")
+	}
+	return lister.List(pageToken, pageSize)
+}
+
+func deleteNext(backend Backend, actionIDs [][]byte) error {
+	deleter, ok := Find[Deleter](backend)
+	if !ok {
+		return unsupportedError(backend, "Delete")
+	}
+	return deleter.Delete(actionIDs)
+}
+
+func statNext(backend Backend, actionID []byte) (ObjectInfo, bool, error) {
+	stater, ok := Find[Stater](backend)
+	if !ok {
+		return ObjectInfo{}, false, unsupportedError(backend, "Stat")
+	}
+	return stater.Stat(actionID)
+}
+
+func touchNext(backend Backend, actionID []byte, interval time.Duration) (bool, error) {
+	toucher, ok := Find[Toucher](backend)
+	if !ok {
+		return false, unsupportedError(backend, "Touch")
+	}
+	return toucher.Touch(actionID, interval)
+}
+
+// Wrapper is implemented by backends that wrap another backend (for example
+// Debug, Error and AsyncBackendWriter) so that callers can inspect the stack.
+type Wrapper interface {
+	// Unwrap returns the wrapped backend.
+	Unwrap() Backend
+}
+
+// Find walks the chain of wrapped backends starting at backend and returns the
+// first one of type T, similar to errors.As.
+func Find[T Backend](backend Backend) (T, bool) {
+	for backend != nil {
+		if t, ok := backend.(T); ok {
+			return t, true
+		}
+		wrapper, ok := backend.(Wrapper)
+		if !ok {
+			break
+		}
+		backend = wrapper.Unwrap()
+	}
+	var zero T
+	return zero, false
+}
+
+// actionIDToName returns the name of the object that a bucket backend stores
+// actionID under, below prefix. Everything up to the last "/" of the action ID
+// (the server's namespace, e.g. "branches/foo/") is kept as it is, so that
+// namespaces are real object prefixes that lifecycle rules and access policies
+// can match, and the rest is hex encoded.
+func actionIDToName(prefix string, actionID []byte) string {
+	dir, file := splitNamespace(actionID)
+	return prefix + string(dir) + hex.EncodeToString(file)
+}
+
+// splitNamespace splits actionID after its last "/". Action IDs whose part up to
+// the last "/" isn't printable UTF-8 are hex encoded as a whole instead.
+func splitNamespace(actionID []byte) (dir, file []byte) {
+	i := bytes.LastIndexByte(actionID, '/')
+	if i < 0 || !utf8.Valid(actionID[:i+1]) || bytes.ContainsFunc(actionID[:i+1], func(r rune) bool { return !unicode.IsPrint(r) }) {
+		return nil, actionID
+	}
+	return actionID[:i+1], actionID[i+1:]
+}
+
+// keyToActionID returns the action ID that the object name was generated from by
+// actionIDToName with prefix, or nil if it wasn't.
+func keyToActionID(name, prefix string) []byte {
+	if !strings.HasPrefix(name, prefix) {
+		return nil
+	}
+	name = strings.TrimPrefix(name, prefix)
+	dir, file := "", name
+	if i := strings.LastIndexByte(name, '/'); i >= 0 {
+		dir, file = name[:i+1], name[i+1:]
+	}
+	decoded, err := hex.DecodeString(file)
+	if err != nil || len(decoded) == 0 {
+		return nil
+	}
+	return append([]byte(dir), decoded...)
+}
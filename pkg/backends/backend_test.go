@@ -0,0 +1,183 @@
+package backends
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var errFakeBackend = errors.New("fake backend error")
+
+// fakeBackend is an in-memory Backend used in tests. Operations fail with
+// errFakeBackend while failing is set.
+type fakeBackend struct {
+	mu      sync.Mutex
+	objects map[string]fakeObject
+	failing bool
+	puts    int
+	gets    int
+}
+
+type fakeObject struct {
+	outputID   []byte
+	body       []byte
+	putTime    time.Time
+	accessTime time.Time
+}
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{objects: make(map[string]fakeObject)}
+}
+
+func (f *fakeBackend) setFailing(failing bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failing = failing
+}
+
+func (f *fakeBackend) Put(actionID, outputID []byte, body io.Reader, bodySize int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.puts++
+	if f.failing {
+		return errFakeBackend
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	f.objects[string(actionID)] = fakeObject{outputID: outputID, body: data, putTime: now, accessTime: now}
+	return nil
+}
+
+func (f *fakeBackend) Get(actionID []byte) ([]byte, io.ReadCloser, int64, *time.Time, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.gets++
+	if f.failing {
+		return nil, nil, 0, nil, false, errFakeBackend
+	}
+	obj, ok := f.objects[string(actionID)]
+	if !ok {
+		return nil, nil, 0, nil, true, nil
+	}
+	putTime := obj.putTime
+	return obj.outputID, io.NopCloser(bytes.NewReader(obj.body)), int64(len(obj.body)), &putTime, false, nil
+}
+
+func (f *fakeBackend) Close() error {
+	return nil
+}
+
+func (f *fakeBackend) Clear() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects = make(map[string]fakeObject)
+	return nil
+}
+
+// List returns the objects sorted by name, named by their hex action IDs. Page
+// tokens are the index of the first object of the page.
+func (f *fakeBackend) List(pageToken string, pageSize int) ([]ObjectInfo, string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failing {
+		return nil, "", errFakeBackend
+	}
+	names := make([]string, 0, len(f.objects))
+	for actionID := range f.objects {
+		names = append(names, hex.EncodeToString([]byte(actionID)))
+	}
+	sort.Strings(names)
+
+	start := 0
+	if pageToken != "" {
+		var err error
+		if start, err = strconv.Atoi(pageToken); err != nil {
+			return nil, "", err
+		}
+	}
+	end := min(start+pageSize, len(names))
+	var objects []ObjectInfo
+	for _, name := range names[start:end] {
+		actionID := keyToActionID(name, "")
+		obj := f.objects[string(actionID)]
+		objects = append(objects, ObjectInfo{
+			ActionID:   actionID,
+			Name:       name,
+			Size:       int64(len(obj.body)),
+			PutTime:    obj.putTime,
+			OutputID:   obj.outputID,
+			AccessTime: obj.accessTime,
+		})
+	}
+	next := ""
+	if end < len(names) {
+		next = strconv.Itoa(end)
+	}
+	return objects, next, nil
+}
+
+func (f *fakeBackend) Delete(actionIDs [][]byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failing {
+		return errFakeBackend
+	}
+	for _, actionID := range actionIDs {
+		delete(f.objects, string(actionID))
+	}
+	return nil
+}
+
+func (f *fakeBackend) Stat(actionID []byte) (ObjectInfo, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failing {
+		return ObjectInfo{}, false, errFakeBackend
+	}
+	obj, ok := f.objects[string(actionID)]
+	if !ok {
+		return ObjectInfo{}, true, nil
+	}
+	return ObjectInfo{
+		ActionID:   actionID,
+		Name:       hex.EncodeToString(actionID),
+		Size:       int64(len(obj.body)),
+		PutTime:    obj.putTime,
+		OutputID:   obj.outputID,
+		AccessTime: obj.accessTime,
+	}, false, nil
+}
+
+func (f *fakeBackend) Touch(actionID []byte, interval time.Duration) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failing {
+		return false, errFakeBackend
+	}
+	obj, ok := f.objects[string(actionID)]
+	if !ok || time.Since(obj.accessTime) < interval {
+		return false, nil
+	}
+	obj.accessTime = time.Now()
+	f.objects[string(actionID)] = obj
+	return true, nil
+}
+
+func (f *fakeBackend) counts() (puts, gets int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.puts, f.gets
+}
+
+func testLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
@@ -0,0 +1,132 @@
+package backends
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+// basicBackend hides the optional methods of a fakeBackend.
+type basicBackend struct {
+	Backend
+}
+
+func TestWrappers_ForwardOptionalOperations(t *testing.T) {
+	backend := newFakeBackend()
+	wrappers := map[string]Backend{
+		"Debug": NewDebug(backend),
+		"Error": NewError(backend, 0),
+		"Async": NewAsyncBackendWriter(backend, AsyncBackendWriterConfig{}, testLogger()),
+	}
+	for name, wrapper := range wrappers {
+		if err := backend.Put([]byte("key"), []byte("output"), bytes.NewReader([]byte("body")), 4); err != nil {
+			t.Fatal(err)
+		}
+
+		objects, next, err := wrapper.(Lister).List("", 10)
+		if err != nil || next != "" || len(objects) != 1 || string(objects[0].ActionID) != "key" {
+			t.Errorf("%s: List = %+v, %q, %v", name, objects, next, err)
+		}
+		info, miss, err := wrapper.(Stater).Stat([]byte("key"))
+		if err != nil || miss || info.Size != 4 || string(info.OutputID) != "output" {
+			t.Errorf("%s: Stat = %+v, %v, %v", name, info, miss, err)
+		}
+		if touched, err := wrapper.(Toucher).Touch([]byte("key"), time.Hour); err != nil || touched {
+			t.Errorf("%s: Touch of a fresh object = %v, %v, want it skipped", name, touched, err)
+		}
+		if touched, err := wrapper.(Toucher).Touch([]byte("key"), 0); err != nil || !touched {
+			t.Errorf("%s: Touch = %v, %v, want touched", name, touched, err)
+		}
+		if err := wrapper.(Deleter).Delete([][]byte{[]byte("key"), []byte("missing")}); err != nil {
+			t.Errorf("%s: Delete failed: %v", name, err)
+		}
+		if _, miss, _ := backend.Stat([]byte("key")); !miss {
+			t.Errorf("%s: object still exists after Delete", name)
+		}
+	}
+}
+
+func TestWrappers_UnsupportedOperations(t *testing.T) {
+	backend := basicBackend{newFakeBackend()}
+	for _, wrapper := range []Backend{NewDebug(backend), NewError(backend, 0), NewAsyncBackendWriter(backend, AsyncBackendWriterConfig{}, testLogger())} {
+		if _, _, err := wrapper.(Lister).List("", 10); !errors.Is(err, errors.ErrUnsupported) {
+			t.Errorf("%T: List returned %v, want ErrUnsupported", wrapper, err)
+		}
+		if _, _, err := wrapper.(Stater).Stat([]byte("key")); !errors.Is(err, errors.ErrUnsupported) {
+			t.Errorf("%T: Stat returned %v, want ErrUnsupported", wrapper, err)
+		}
+		if _, err := wrapper.(Toucher).Touch([]byte("key"), 0); !errors.Is(err, errors.ErrUnsupported) {
+			t.Errorf("%T: Touch returned %v, want ErrUnsupported", wrapper, err)
+		}
+		if err := wrapper.(Deleter).Delete([][]byte{[]byte("key")}); !errors.Is(err, errors.ErrUnsupported) {
+			t.Errorf("%T: Delete returned %v, want ErrUnsupported", wrapper, err)
+		}
+	}
+}
+
+func TestWrappers_SkipTransparentWrappers(t *testing.T) {
+	backend := newFakeBackend()
+	backend.Put([]byte("key"), []byte("output"), bytes.NewReader([]byte("body")), 4)
+	// CircuitBreaker doesn't implement Stat, so Debug finds the backend below it.
+	debug := NewDebug(NewCircuitBreaker(backend, CircuitBreakerConfig{}, testLogger()))
+	if _, miss, err := debug.Stat([]byte("key")); err != nil || miss {
+		t.Errorf("Stat through a circuit breaker = %v, %v", miss, err)
+	}
+}
+
+func TestAsyncBackendWriterDeleteDropsQueuedUploads(t *testing.T) {
+	backend := &gatedBackend{fakeBackend: newFakeBackend(), gate: make(chan struct{})}
+	abw := NewAsyncBackendWriter(backend, AsyncBackendWriterConfig{
+		MaxQueuedItems: 1,
+		Workers:        1,
+		OverflowPolicy: OverflowSpill,
+		SpillDir:       t.TempDir(),
+	}, testLogger())
+
+	// The first upload is picked up by the worker, the second is queued in
+	// memory and the third is spilled.
+	abw.Put([]byte("a"), nil, bytes.NewReader([]byte("a")), 1)
+	time.Sleep(20 * time.Millisecond)
+	abw.Put([]byte("b"), nil, bytes.NewReader([]byte("b")), 1)
+	abw.Put([]byte("c"), nil, bytes.NewReader([]byte("c")), 1)
+
+	if err := abw.Delete([][]byte{[]byte("b"), []byte("c")}); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if stats := abw.Stats(); stats.QueuedPuts != 0 || stats.QueuedBytes != 0 {
+		t.Errorf("Expected an empty queue after Delete, got %+v", stats)
+	}
+	close(backend.gate)
+	if err := abw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, want := range map[string]bool{"a": false, "b": true, "c": true} {
+		if _, miss, _ := backend.Stat([]byte(key)); miss != want {
+			t.Errorf("Stat(%s) miss = %v, want %v", key, miss, want)
+		}
+	}
+	files, _ := os.ReadDir(abw.config.SpillDir)
+	if len(files) != 0 {
+		t.Errorf("Expected spill files to be removed, found %d", len(files))
+	}
+}
+
+func TestEncrypted_ListAndStatHideSealedOutputIDs(t *testing.T) {
+	inner := newFakeBackend()
+	enc := NewEncrypted(inner, mustKeyring(t, map[string][]byte{"k1": testKey(1)}, "k1"), testLogger())
+	if err := enc.Put([]byte("key"), []byte("output"), bytes.NewReader([]byte("body")), 4); err != nil {
+		t.Fatal(err)
+	}
+
+	objects, _, err := enc.List("", 10)
+	if err != nil || len(objects) != 1 || objects[0].OutputID != nil || objects[0].Size <= 4 {
+		t.Errorf("List = %+v, %v, want one envelope without an output ID", objects, err)
+	}
+	info, miss, err := enc.Stat([]byte("key"))
+	if err != nil || miss || info.OutputID != nil {
+		t.Errorf("Stat = %+v, %v, %v, want no output ID", info, miss, err)
+	}
+}
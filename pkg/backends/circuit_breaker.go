@@ -0,0 +1,320 @@
+package backends
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrCircuitOpen is returned by CircuitBreaker.Put when the circuit is open and
+// no fallback backend is configured. Callers can use errors.Is to distinguish
+// it from real backend failures.
+var ErrCircuitOpen = errors.New("circuit breaker is open: remote backend is unhealthy")
+
+// CircuitState is the state of a CircuitBreaker.
+type CircuitState int32
+
+const (
+	// CircuitClosed means the remote backend is healthy and all operations are passed through.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen means the remote backend is considered unhealthy and is not called at all.
+	CircuitOpen
+	// CircuitHalfOpen means the cool-down has elapsed and a single probe operation is
+	// allowed through to determine whether the remote backend has recovered.
+	CircuitHalfOpen
+)
+
+// String returns a human-readable name for the state.
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("unknown(%d)", int32(s))
+	}
+}
+
+// CircuitBreakerConfig configures a CircuitBreaker.
+type CircuitBreakerConfig struct {
+	// FailureThreshold is the number of consecutive failures that trips the breaker.
+	// Zero disables the consecutive failure check.
+	FailureThreshold int
+	// ErrorRateThreshold is the error rate (0.0-1.0) over the last WindowSize operations
+	// that trips the breaker. Zero disables the error rate check.
+	ErrorRateThreshold float64
+	// WindowSize is the number of recent operations used to compute the error rate.
+	// The error rate check only applies once the window is full.
+	WindowSize int
+	// CoolDown is how long the breaker stays open before probing the remote backend again.
+	CoolDown time.Duration
+	// Fallback is an optional backend that serves operations while the breaker is open.
+	// If nil, GETs become misses and PUTs fail with ErrCircuitOpen while the breaker is open.
+	Fallback Backend
+}
+
+// CircuitBreaker wraps a Backend and stops calling it for a cool-down period after it
+// becomes unhealthy, so that an outage of the remote storage degrades builds to
+// local-only caching (or a fallback backend) instead of making every operation wait
+// for a timeout.
+type CircuitBreaker struct {
+	backend Backend
+	config  CircuitBreakerConfig
+	logger  *slog.Logger
+
+	mu                  sync.Mutex
+	state               CircuitState
+	openedAt            time.Time
+	probeInFlight       bool
+	consecutiveFailures int
+	window              []bool // Ring buffer of recent outcomes, true means failure.
+	windowNext          int
+	windowFilled        bool
+	windowFailures      int
+
+	// Stats
+	opens        atomic.Int64
+	halfOpens    atomic.Int64
+	closes       atomic.Int64
+	rejectedGets atomic.Int64
+	rejectedPuts atomic.Int64
+	fallbackGets atomic.Int64
+	fallbackPuts atomic.Int64
+}
+
+// NewCircuitBreaker creates a new circuit breaker around an existing backend.
+func NewCircuitBreaker(backend Backend, config CircuitBreakerConfig, logger *slog.Logger) *CircuitBreaker {
+	if config.WindowSize <= 0 {
+		config.WindowSize = 20
+	}
+	if config.CoolDown <= 0 {
+		config.CoolDown = 30 * time.Second
+	}
+
+	return &CircuitBreaker{
+		backend: backend,
+		config:  config,
+		logger:  logger,
+		window:  make([]bool, config.WindowSize),
+	}
+}
+
+// Put stores an object in the backend if the circuit allows it, otherwise in the
+// fallback backend (if any).
+func (cb *CircuitBreaker) Put(actionID, outputID []byte, body io.Reader, bodySize int64) error {
+	allowed, probe := cb.allow()
+	if !allowed {
+		if cb.config.Fallback != nil {
+			cb.fallbackPuts.Add(1)
+			return cb.config.Fallback.Put(actionID, outputID, body, bodySize)
+		}
+		cb.rejectedPuts.Add(1)
+		return ErrCircuitOpen
+	}
+
+	err := cb.backend.Put(actionID, outputID, body, bodySize)
+	cb.record(err != nil, probe)
+	return err
+}
+
+// Get retrieves an object from the backend if the circuit allows it, otherwise from
+// the fallback backend (if any). Without a fallback, an open circuit is reported as
+// a miss so the caller falls back to building locally.
+func (cb *CircuitBreaker) Get(actionID []byte) ([]byte, io.ReadCloser, int64, *time.Time, bool, error) {
+	allowed, probe := cb.allow()
+	if !allowed {
+		if cb.config.Fallback != nil {
+			cb.fallbackGets.Add(1)
+			return cb.config.Fallback.Get(actionID)
+		}
+		cb.rejectedGets.Add(1)
+		return nil, nil, 0, nil, true, nil
+	}
+
+	outputID, body, size, putTime, miss, err := cb.backend.Get(actionID)
+	cb.record(err != nil, probe)
+	return outputID, body, size, putTime, miss, err
+}
+
+// Close closes the underlying backend and the fallback backend (if any).
+func (cb *CircuitBreaker) Close() error {
+	err := cb.backend.Close()
+	if cb.config.Fallback != nil {
+		err = errors.Join(err, cb.config.Fallback.Close())
+	}
+	return err
+}
+
+// Clear passes through to the underlying backend and the fallback backend (if any),
+// regardless of the circuit state.
+func (cb *CircuitBreaker) Clear() error {
+	err := cb.backend.Clear()
+	if cb.config.Fallback != nil {
+		err = errors.Join(err, cb.config.Fallback.Clear())
+	}
+	return err
+}
+
+// Unwrap returns the wrapped backend.
+func (cb *CircuitBreaker) Unwrap() Backend {
+	return cb.backend
+}
+
+// State returns the current state of the circuit.
+func (cb *CircuitBreaker) State() CircuitState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state
+}
+
+// allow reports whether an operation may be sent to the underlying backend, and
+// whether that operation is the half-open probe.
+func (cb *CircuitBreaker) allow() (allowed, probe bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case CircuitClosed:
+		return true, false
+	case CircuitOpen:
+		if time.Since(cb.openedAt) < cb.config.CoolDown {
+			return false, false
+		}
+		cb.transitionLocked(CircuitHalfOpen)
+		cb.probeInFlight = true
+		return true, true
+	case CircuitHalfOpen:
+		// Only a single probe is allowed in flight at a time, everything else
+		// is treated as if the circuit were still open.
+		if cb.probeInFlight {
+			return false, false
+		}
+		cb.probeInFlight = true
+		return true, true
+	}
+	return true, false
+}
+
+// record records the outcome of an operation that was sent to the underlying backend
+// and updates the circuit state accordingly.
+func (cb *CircuitBreaker) record(failed, probe bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if probe {
+		cb.probeInFlight = false
+		if failed {
+			cb.transitionLocked(CircuitOpen)
+		} else {
+			cb.transitionLocked(CircuitClosed)
+		}
+		return
+	}
+
+	if cb.state != CircuitClosed {
+		// Operation was started before the circuit opened, ignore it.
+		return
+	}
+
+	if failed {
+		cb.consecutiveFailures++
+	} else {
+		cb.consecutiveFailures = 0
+	}
+
+	if cb.window[cb.windowNext] {
+		cb.windowFailures--
+	}
+	cb.window[cb.windowNext] = failed
+	if failed {
+		cb.windowFailures++
+	}
+	cb.windowNext = (cb.windowNext + 1) % len(cb.window)
+	if cb.windowNext == 0 {
+		cb.windowFilled = true
+	}
+
+	if cb.config.FailureThreshold > 0 && cb.consecutiveFailures >= cb.config.FailureThreshold {
+		cb.transitionLocked(CircuitOpen)
+		return
+	}
+	if cb.config.ErrorRateThreshold > 0 && cb.windowFilled {
+		errorRate := float64(cb.windowFailures) / float64(len(cb.window))
+		if errorRate >= cb.config.ErrorRateThreshold {
+			cb.transitionLocked(CircuitOpen)
+		}
+	}
+}
+
+// transitionLocked moves the circuit to a new state. cb.mu must be held.
+func (cb *CircuitBreaker) transitionLocked(state CircuitState) {
+	if cb.state == state {
+		if state == CircuitOpen {
+			cb.openedAt = time.Now()
+		}
+		return
+	}
+
+	previous := cb.state
+	cb.state = state
+	switch state {
+	case CircuitOpen:
+		cb.opens.Add(1)
+		cb.openedAt = time.Now()
+		cb.logger.Warn("circuit breaker opened, remote backend will not be used until cool-down elapses",
+			"previousState", previous,
+			"consecutiveFailures", cb.consecutiveFailures,
+			"coolDown", cb.config.CoolDown,
+			"fallback", cb.config.Fallback != nil)
+	case CircuitHalfOpen:
+		cb.halfOpens.Add(1)
+		cb.logger.Info("circuit breaker half-open, probing remote backend",
+			"previousState", previous)
+	case CircuitClosed:
+		cb.closes.Add(1)
+		cb.logger.Info("circuit breaker closed, remote backend recovered",
+			"previousState", previous)
+	}
+
+	// Start from a clean slate in every new state.
+	cb.consecutiveFailures = 0
+	cb.windowFailures = 0
+	cb.windowNext = 0
+	cb.windowFilled = false
+	for i := range cb.window {
+		cb.window[i] = false
+	}
+}
+
+// Stats returns current statistics about the circuit breaker.
+func (cb *CircuitBreaker) Stats() CircuitBreakerStats {
+	return CircuitBreakerStats{
+		State:        cb.State(),
+		Opens:        cb.opens.Load(),
+		HalfOpens:    cb.halfOpens.Load(),
+		Closes:       cb.closes.Load(),
+		RejectedGets: cb.rejectedGets.Load(),
+		RejectedPuts: cb.rejectedPuts.Load(),
+		FallbackGets: cb.fallbackGets.Load(),
+		FallbackPuts: cb.fallbackPuts.Load(),
+	}
+}
+
+// CircuitBreakerStats holds statistics for the circuit breaker.
+type CircuitBreakerStats struct {
+	State        CircuitState
+	Opens        int64
+	HalfOpens    int64
+	Closes       int64
+	RejectedGets int64
+	RejectedPuts int64
+	FallbackGets int64
+	FallbackPuts int64
+}
@@ -0,0 +1,141 @@
+package backends
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerOpensAfterConsecutiveFailures(t *testing.T) {
+	primary := newFakeBackend()
+	primary.setFailing(true)
+	cb := NewCircuitBreaker(primary, CircuitBreakerConfig{
+		FailureThreshold: 3,
+		CoolDown:         time.Hour,
+	}, testLogger())
+
+	for i := 0; i < 3; i++ {
+		if _, _, _, _, _, err := cb.Get([]byte("action")); err == nil {
+			t.Fatalf("Get %d: expected error from failing backend", i)
+		}
+	}
+	if cb.State() != CircuitOpen {
+		t.Fatalf("Expected circuit to be open, got %s", cb.State())
+	}
+
+	// While open, the primary backend must not be called at all.
+	_, _, _, _, miss, err := cb.Get([]byte("action"))
+	if err != nil || !miss {
+		t.Errorf("Expected miss without error while open, got miss=%v err=%v", miss, err)
+	}
+	if err := cb.Put([]byte("action"), []byte("output"), bytes.NewReader(nil), 0); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Expected ErrCircuitOpen from Put while open, got %v", err)
+	}
+	if _, gets := primary.counts(); gets != 3 {
+		t.Errorf("Expected primary to see 3 GETs, got %d", gets)
+	}
+
+	stats := cb.Stats()
+	if stats.Opens != 1 || stats.RejectedGets != 1 || stats.RejectedPuts != 1 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestCircuitBreakerOpensOnErrorRate(t *testing.T) {
+	primary := newFakeBackend()
+	cb := NewCircuitBreaker(primary, CircuitBreakerConfig{
+		ErrorRateThreshold: 0.5,
+		WindowSize:         4,
+		CoolDown:           time.Hour,
+	}, testLogger())
+
+	// Alternate failures and successes so there are never two consecutive failures.
+	for i := 0; i < 4; i++ {
+		primary.setFailing(i%2 == 0)
+		cb.Get([]byte("action"))
+	}
+	if cb.State() != CircuitOpen {
+		t.Fatalf("Expected circuit to be open after 50%% errors, got %s", cb.State())
+	}
+}
+
+func TestCircuitBreakerHalfOpenProbe(t *testing.T) {
+	primary := newFakeBackend()
+	primary.setFailing(true)
+	cb := NewCircuitBreaker(primary, CircuitBreakerConfig{
+		FailureThreshold: 1,
+		CoolDown:         20 * time.Millisecond,
+	}, testLogger())
+
+	cb.Get([]byte("action"))
+	if cb.State() != CircuitOpen {
+		t.Fatalf("Expected circuit to be open, got %s", cb.State())
+	}
+
+	// A failed probe re-opens the circuit.
+	time.Sleep(30 * time.Millisecond)
+	if _, _, _, _, _, err := cb.Get([]byte("action")); err == nil {
+		t.Fatal("Expected probe to reach the failing backend")
+	}
+	if cb.State() != CircuitOpen {
+		t.Fatalf("Expected circuit to re-open after failed probe, got %s", cb.State())
+	}
+
+	// A successful probe closes the circuit.
+	primary.setFailing(false)
+	time.Sleep(30 * time.Millisecond)
+	if _, _, _, _, _, err := cb.Get([]byte("action")); err != nil {
+		t.Fatalf("Expected successful probe, got %v", err)
+	}
+	if cb.State() != CircuitClosed {
+		t.Fatalf("Expected circuit to be closed after successful probe, got %s", cb.State())
+	}
+
+	stats := cb.Stats()
+	if stats.Opens != 2 || stats.HalfOpens != 2 || stats.Closes != 1 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestCircuitBreakerFallback(t *testing.T) {
+	primary := newFakeBackend()
+	primary.setFailing(true)
+	fallback := newFakeBackend()
+	cb := NewCircuitBreaker(primary, CircuitBreakerConfig{
+		FailureThreshold: 1,
+		CoolDown:         time.Hour,
+		Fallback:         fallback,
+	}, testLogger())
+
+	cb.Get([]byte("action"))
+	if err := cb.Put([]byte("action"), []byte("output"), bytes.NewReader([]byte("body")), 4); err != nil {
+		t.Fatalf("Expected Put to succeed via fallback, got %v", err)
+	}
+	outputID, body, _, _, miss, err := cb.Get([]byte("action"))
+	if err != nil || miss {
+		t.Fatalf("Expected hit from fallback, got miss=%v err=%v", miss, err)
+	}
+	body.Close()
+	if string(outputID) != "output" {
+		t.Errorf("Expected outputID %q, got %q", "output", outputID)
+	}
+
+	stats := cb.Stats()
+	if stats.FallbackPuts != 1 || stats.FallbackGets != 1 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestFindUnwrapsBackends(t *testing.T) {
+	cb := NewCircuitBreaker(newFakeBackend(), CircuitBreakerConfig{}, testLogger())
+	backend := NewDebug(NewAsyncBackendWriter(cb, AsyncBackendWriterConfig{}, testLogger()))
+
+	found, ok := Find[*CircuitBreaker](backend)
+	if !ok || found != cb {
+		t.Fatalf("Expected Find to return the circuit breaker, got %v, %v", found, ok)
+	}
+	if _, ok := Find[*Error](backend); ok {
+		t.Error("Expected Find to not find an Error backend")
+	}
+}
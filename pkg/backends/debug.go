@@ -97,3 +97,79 @@ func (d *Debug) Clear() error {
 	return nil
 }
 
+// List returns a page of the wrapped backend's objects with debug logging.
+func (d *Debug) List(pageToken string, pageSize int) ([]ObjectInfo, string, error) {
+	fmt.Fprintf(os.Stderr, "[DEBUG] List: pageToken=%q, pageSize=%d\n", pageToken, pageSize)
+
+	start := time.Now()
+	objects, next, err := listNext(d.backend, pageToken, pageSize)
+	duration := time.Since(start)
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[DEBUG] List: ERROR: %v (duration: %v)\n", err, duration)
+		return objects, next, err
+	}
+
+	fmt.Fprintf(os.Stderr, "[DEBUG] List: %d objects, more=%v (duration: %v)\n", len(objects), next != "", duration)
+	return objects, next, nil
+}
+
+// Delete removes objects from the wrapped backend with debug logging.
+func (d *Debug) Delete(actionIDs [][]byte) error {
+	fmt.Fprintf(os.Stderr, "[DEBUG] Delete: %d actionIDs\n", len(actionIDs))
+
+	start := time.Now()
+	err := deleteNext(d.backend, actionIDs)
+	duration := time.Since(start)
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[DEBUG] Delete: ERROR: %v (duration: %v)\n", err, duration)
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "[DEBUG] Delete: success (duration: %v)\n", duration)
+	return nil
+}
+
+// Stat looks up an object's metadata in the wrapped backend with debug logging.
+func (d *Debug) Stat(actionID []byte) (ObjectInfo, bool, error) {
+	fmt.Fprintf(os.Stderr, "[DEBUG] Stat: actionID=%s\n", hex.EncodeToString(actionID))
+
+	start := time.Now()
+	info, miss, err := statNext(d.backend, actionID)
+	duration := time.Since(start)
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[DEBUG] Stat: ERROR: %v (duration: %v)\n", err, duration)
+		return info, miss, err
+	}
+
+	if miss {
+		fmt.Fprintf(os.Stderr, "[DEBUG] Stat: MISS (duration: %v)\n", duration)
+	} else {
+		fmt.Fprintf(os.Stderr, "[DEBUG] Stat: HIT, size=%d (duration: %v)\n", info.Size, duration)
+	}
+	return info, miss, nil
+}
+
+// Touch refreshes an object's access time in the wrapped backend with debug logging.
+func (d *Debug) Touch(actionID []byte, interval time.Duration) (bool, error) {
+	fmt.Fprintf(os.Stderr, "[DEBUG] Touch: actionID=%s, interval=%v\n", hex.EncodeToString(actionID), interval)
+
+	start := time.Now()
+	touched, err := touchNext(d.backend, actionID, interval)
+	duration := time.Since(start)
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[DEBUG] Touch: ERROR: %v (duration: %v)\n", err, duration)
+		return touched, err
+	}
+
+	fmt.Fprintf(os.Stderr, "[DEBUG] Touch: touched=%v (duration: %v)\n", touched, duration)
+	return touched, nil
+}
+
+// Unwrap returns the wrapped backend.
+func (d *Debug) Unwrap() Backend {
+	return d.backend
+}
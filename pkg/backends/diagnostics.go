@@ -0,0 +1,64 @@
+package backends
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+)
+
+// DiagnosticStatus is the outcome of a diagnostic check.
+type DiagnosticStatus string
+
+const (
+	DiagnosticOK      DiagnosticStatus = "ok"
+	DiagnosticWarning DiagnosticStatus = "warning"
+	DiagnosticFailed  DiagnosticStatus = "failed"
+	DiagnosticSkipped DiagnosticStatus = "skipped"
+)
+
+// Diagnostic is the result of a single diagnostic check.
+type Diagnostic struct {
+	Check          string // What was checked, e.g. the permission being exercised
+	Status         DiagnosticStatus
+	Detail         string
+	Recommendation string // How to fix a failure or warning, if known
+}
+
+// Diagnoser is implemented by storage backends that can check their own setup:
+// that every permission they need is granted and that the bucket is configured
+// as recommended.
+type Diagnoser interface {
+	// Diagnose runs the checks. It writes, reads and deletes a probe object
+	// under the backend's prefix.
+	Diagnose() []Diagnostic
+}
+
+// probeObjectName returns a unique object name for a diagnostic probe object.
+func probeObjectName(prefix string) string {
+	suffix := make([]byte, 8)
+	rand.Read(suffix)
+	return prefix + "gobuildcache-doctor-" + hex.EncodeToString(suffix)
+}
+
+// probeBody is the content of diagnostic probe objects.
+var probeBody = []byte("gobuildcache doctor probe object\n")
+
+// skippedDiagnostics marks checks that depend on a failed check as skipped.
+func skippedDiagnostics(reason string, checks ...string) []Diagnostic {
+	diagnostics := make([]Diagnostic, 0, len(checks))
+	for _, check := range checks {
+		diagnostics = append(diagnostics, Diagnostic{Check: check, Status: DiagnosticSkipped, Detail: reason})
+	}
+	return diagnostics
+}
+
+// errorContainsAny reports whether err's message contains any of substrs.
+func errorContainsAny(err error, substrs ...string) bool {
+	msg := err.Error()
+	for _, s := range substrs {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
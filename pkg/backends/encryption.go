@@ -0,0 +1,326 @@
+package backends
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// EncryptionKeySize is the size in bytes of the AES-256 keys used by Encrypted.
+const EncryptionKeySize = 32
+
+// encryptionMagic identifies objects written by Encrypted, and its last byte is
+// the envelope format version.
+var encryptionMagic = []byte("GBE\x01")
+
+const (
+	gcmNonceSize     = 12
+	gcmTagSize       = 16
+	maxKeyIDLength   = 255
+	wrappedKeyLength = gcmNonceSize + EncryptionKeySize + gcmTagSize
+)
+
+var (
+	// ErrNotEncrypted is returned when an object wasn't written by Encrypted.
+	ErrNotEncrypted = errors.New("object is not encrypted")
+	// ErrUnknownKeyID is returned when an object was encrypted with a key that
+	// isn't in the keyring.
+	ErrUnknownKeyID = errors.New("object was encrypted with an unknown key")
+)
+
+// Keyring holds the key encryption keys used by Encrypted, indexed by key ID.
+// New objects are encrypted with the active key, and objects encrypted with any
+// key in the keyring can be decrypted, so keys can be rotated by adding a new
+// active key while keeping the old ones around until their objects expire.
+type Keyring struct {
+	keys     map[string]cipher.AEAD
+	activeID string
+}
+
+// NewKeyring creates a keyring from keys indexed by key ID. activeID selects the
+// key that new objects are encrypted with.
+func NewKeyring(keys map[string][]byte, activeID string) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("keyring has no keys")
+	}
+	if _, ok := keys[activeID]; !ok {
+		return nil, fmt.Errorf("active key ID %q is not in the keyring", activeID)
+	}
+
+	kr := &Keyring{keys: make(map[string]cipher.AEAD, len(keys)), activeID: activeID}
+	for id, key := range keys {
+		if id == "" || len(id) > maxKeyIDLength {
+			return nil, fmt.Errorf("invalid key ID %q: must be 1-%d bytes", id, maxKeyIDLength)
+		}
+		aead, err := newGCM(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %w", id, err)
+		}
+		kr.keys[id] = aead
+	}
+	return kr, nil
+}
+
+// ActiveKeyID returns the ID of the key that new objects are encrypted with.
+func (kr *Keyring) ActiveKeyID() string {
+	return kr.activeID
+}
+
+// KeyIDs returns the IDs of all keys in the keyring, sorted.
+func (kr *Keyring) KeyIDs() []string {
+	ids := make([]string, 0, len(kr.keys))
+	for id := range kr.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != EncryptionKeySize {
+		return nil, fmt.Errorf("key must be %d bytes, got %d", EncryptionKeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypted wraps a Backend and encrypts object bodies and output IDs with
+// AES-256-GCM before they are stored, so that the storage provider only ever
+// sees ciphertext.
+//
+// Every object is encrypted with its own random data key, which is itself
+// encrypted ("wrapped") with the keyring's active key and stored in the object's
+// header along with that key's ID. Both the body and the output ID are
+// authenticated against the action ID, so objects can't be swapped between keys
+// without detection.
+//
+// Objects that can't be decrypted (unencrypted objects written before encryption
+// was enabled, objects encrypted with a key that's no longer in the keyring, or
+// tampered objects) are logged and treated as misses.
+//
+// An object can only be authenticated once all of it has been read, so Get
+// downloads the whole body into memory before it returns. Anything that should
+// apply to the download itself, such as a bandwidth limit or a timeout, has to
+// wrap the backend below Encrypted rather than the body Get returns.
+type Encrypted struct {
+	backend Backend
+	keyring *Keyring
+	logger  *slog.Logger
+
+	// Stats
+	encryptedPuts     atomic.Int64
+	decryptedGets     atomic.Int64
+	failedDecryptions atomic.Int64
+}
+
+// NewEncrypted creates a new encrypting wrapper around an existing backend.
+func NewEncrypted(backend Backend, keyring *Keyring, logger *slog.Logger) *Encrypted {
+	return &Encrypted{
+		backend: backend,
+		keyring: keyring,
+		logger:  logger,
+	}
+}
+
+// Put encrypts an object and stores it in the wrapped backend.
+func (e *Encrypted) Put(actionID, outputID []byte, body io.Reader, bodySize int64) error {
+	plaintext := make([]byte, bodySize)
+	if _, err := io.ReadFull(body, plaintext); err != nil {
+		return fmt.Errorf("failed to read body: %w", err)
+	}
+
+	sealedOutputID, envelope, err := e.seal(actionID, outputID, plaintext)
+	if err != nil {
+		return err
+	}
+	if err := e.backend.Put(actionID, sealedOutputID, bytes.NewReader(envelope), int64(len(envelope))); err != nil {
+		return err
+	}
+	e.encryptedPuts.Add(1)
+	return nil
+}
+
+// Get retrieves an object from the wrapped backend and decrypts it.
+func (e *Encrypted) Get(actionID []byte) ([]byte, io.ReadCloser, int64, *time.Time, bool, error) {
+	sealedOutputID, body, _, putTime, miss, err := e.backend.Get(actionID)
+	if err != nil || miss {
+		return nil, nil, 0, nil, miss, err
+	}
+	envelope, err := io.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return nil, nil, 0, nil, false, fmt.Errorf("failed to read encrypted body: %w", err)
+	}
+
+	outputID, plaintext, err := e.open(actionID, sealedOutputID, envelope)
+	if err != nil {
+		e.failedDecryptions.Add(1)
+		e.logger.Warn("failed to decrypt backend object, treating it as a miss",
+			"actionID", hex.EncodeToString(actionID),
+			"error", err)
+		return nil, nil, 0, nil, true, nil
+	}
+	e.decryptedGets.Add(1)
+	return outputID, io.NopCloser(bytes.NewReader(plaintext)), int64(len(plaintext)), putTime, false, nil
+}
+
+// seal encrypts an object. The envelope is laid out as:
+//
+//	magic | key ID length (1 byte) | key ID | wrapped data key | body nonce | body ciphertext
+//
+// and the sealed output ID as:
+//
+//	nonce | output ID ciphertext
+func (e *Encrypted) seal(actionID, outputID, plaintext []byte) (sealedOutputID, envelope []byte, err error) {
+	dataKey := make([]byte, EncryptionKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+	dataAEAD, err := newGCM(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyID := e.keyring.activeID
+	wrapped, err := sealWithNonce(e.keyring.keys[keyID], nil, dataKey, []byte(keyID))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	envelope = make([]byte, 0, len(encryptionMagic)+1+len(keyID)+wrappedKeyLength+gcmNonceSize+len(plaintext)+gcmTagSize)
+	envelope = append(envelope, encryptionMagic...)
+	envelope = append(envelope, byte(len(keyID)))
+	envelope = append(envelope, keyID...)
+	envelope = append(envelope, wrapped...)
+	envelope, err = sealWithNonce(dataAEAD, envelope, plaintext, actionID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sealedOutputID, err = sealWithNonce(dataAEAD, nil, outputID, actionID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sealedOutputID, envelope, nil
+}
+
+// open decrypts an object sealed by seal.
+func (e *Encrypted) open(actionID, sealedOutputID, envelope []byte) (outputID, plaintext []byte, err error) {
+	if !bytes.HasPrefix(envelope, encryptionMagic) {
+		return nil, nil, ErrNotEncrypted
+	}
+	rest := envelope[len(encryptionMagic):]
+	if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+		return nil, nil, errors.New("truncated envelope header")
+	}
+	keyID := string(rest[1 : 1+int(rest[0])])
+	rest = rest[1+int(rest[0]):]
+
+	kek, ok := e.keyring.keys[keyID]
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: %q", ErrUnknownKeyID, keyID)
+	}
+	if len(rest) < wrappedKeyLength {
+		return nil, nil, errors.New("truncated envelope header")
+	}
+	dataKey, err := openWithNonce(kek, rest[:wrappedKeyLength], []byte(keyID))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	dataAEAD, err := newGCM(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	plaintext, err = openWithNonce(dataAEAD, rest[wrappedKeyLength:], actionID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decrypt body: %w", err)
+	}
+	outputID, err = openWithNonce(dataAEAD, sealedOutputID, actionID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decrypt output ID: %w", err)
+	}
+	return outputID, plaintext, nil
+}
+
+// sealWithNonce encrypts plaintext with a random nonce and appends the nonce
+// followed by the ciphertext to dst.
+func sealWithNonce(aead cipher.AEAD, dst, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, gcmNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	dst = append(dst, nonce...)
+	return aead.Seal(dst, nonce, plaintext, additionalData), nil
+}
+
+// openWithNonce decrypts data produced by sealWithNonce.
+func openWithNonce(aead cipher.AEAD, data, additionalData []byte) ([]byte, error) {
+	if len(data) < gcmNonceSize {
+		return nil, errors.New("ciphertext too short")
+	}
+	return aead.Open(nil, data[:gcmNonceSize], data[gcmNonceSize:], additionalData)
+}
+
+// Close closes the wrapped backend.
+func (e *Encrypted) Close() error {
+	return e.backend.Close()
+}
+
+// Clear removes all entries from the wrapped backend.
+func (e *Encrypted) Clear() error {
+	return e.backend.Clear()
+}
+
+// List returns a page of the wrapped backend's objects. Their output IDs are
+// sealed and can't be opened without the envelope, so they are cleared.
+func (e *Encrypted) List(pageToken string, pageSize int) ([]ObjectInfo, string, error) {
+	objects, next, err := listNext(e.backend, pageToken, pageSize)
+	for i := range objects {
+		objects[i].OutputID = nil
+	}
+	return objects, next, err
+}
+
+// Stat looks up an object's metadata in the wrapped backend, clearing its sealed
+// output ID like List.
+func (e *Encrypted) Stat(actionID []byte) (ObjectInfo, bool, error) {
+	info, miss, err := statNext(e.backend, actionID)
+	info.OutputID = nil
+	return info, miss, err
+}
+
+// Unwrap returns the wrapped backend.
+func (e *Encrypted) Unwrap() Backend {
+	return e.backend
+}
+
+// Stats returns current statistics about encryption.
+func (e *Encrypted) Stats() EncryptedStats {
+	return EncryptedStats{
+		ActiveKeyID:       e.keyring.activeID,
+		EncryptedPuts:     e.encryptedPuts.Load(),
+		DecryptedGets:     e.decryptedGets.Load(),
+		FailedDecryptions: e.failedDecryptions.Load(),
+	}
+}
+
+// EncryptedStats holds statistics for the encrypting wrapper.
+type EncryptedStats struct {
+	ActiveKeyID       string
+	EncryptedPuts     int64
+	DecryptedGets     int64
+	FailedDecryptions int64 // Objects treated as misses because they couldn't be decrypted
+}
@@ -0,0 +1,121 @@
+package backends
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, EncryptionKeySize)
+}
+
+func mustKeyring(t *testing.T, keys map[string][]byte, activeID string) *Keyring {
+	t.Helper()
+	kr, err := NewKeyring(keys, activeID)
+	if err != nil {
+		t.Fatalf("Failed to create keyring: %v", err)
+	}
+	return kr
+}
+
+func mustGet(t *testing.T, backend Backend, actionID []byte) (outputID, body []byte, miss bool) {
+	t.Helper()
+	outputID, rc, size, _, miss, err := backend.Get(actionID)
+	if err != nil {
+		t.Fatalf("Get returned error: %v", err)
+	}
+	if miss {
+		return nil, nil, true
+	}
+	defer rc.Close()
+	body, err = io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("Failed to read body: %v", err)
+	}
+	if int64(len(body)) != size {
+		t.Fatalf("Expected size %d, got %d", len(body), size)
+	}
+	return outputID, body, false
+}
+
+func TestEncryptedRoundTrip(t *testing.T) {
+	inner := newFakeBackend()
+	enc := NewEncrypted(inner, mustKeyring(t, map[string][]byte{"k1": testKey(1)}, "k1"), testLogger())
+
+	body := []byte("build output that embeds source-derived data")
+	if err := enc.Put([]byte("action"), []byte("output"), bytes.NewReader(body), int64(len(body))); err != nil {
+		t.Fatalf("Put returned error: %v", err)
+	}
+
+	stored := inner.objects["action"]
+	if bytes.Contains(stored.body, body) || bytes.Equal(stored.outputID, []byte("output")) {
+		t.Fatalf("Expected the backend to only see ciphertext")
+	}
+
+	outputID, got, miss := mustGet(t, enc, []byte("action"))
+	if miss || !bytes.Equal(outputID, []byte("output")) || !bytes.Equal(got, body) {
+		t.Errorf("Expected to decrypt the original object, got miss=%v outputID=%q body=%q", miss, outputID, got)
+	}
+}
+
+func TestEncryptedKeyRotation(t *testing.T) {
+	inner := newFakeBackend()
+	old := NewEncrypted(inner, mustKeyring(t, map[string][]byte{"k1": testKey(1)}, "k1"), testLogger())
+	if err := old.Put([]byte("action"), []byte("output"), bytes.NewReader([]byte("data")), 4); err != nil {
+		t.Fatalf("Put returned error: %v", err)
+	}
+
+	// Objects written with an old key stay readable after rotating to a new one.
+	rotated := NewEncrypted(inner, mustKeyring(t, map[string][]byte{"k1": testKey(1), "k2": testKey(2)}, "k2"), testLogger())
+	if _, got, miss := mustGet(t, rotated, []byte("action")); miss || string(got) != "data" {
+		t.Fatalf("Expected object encrypted with the old key to be readable")
+	}
+
+	// Once the old key is retired, its objects become misses.
+	retired := NewEncrypted(inner, mustKeyring(t, map[string][]byte{"k2": testKey(2)}, "k2"), testLogger())
+	if _, _, miss := mustGet(t, retired, []byte("action")); !miss {
+		t.Errorf("Expected object encrypted with a retired key to be a miss")
+	}
+	if got := retired.Stats().FailedDecryptions; got != 1 {
+		t.Errorf("Expected 1 failed decryption, got %d", got)
+	}
+}
+
+func TestEncryptedRejectsTamperedAndUnencryptedObjects(t *testing.T) {
+	inner := newFakeBackend()
+	enc := NewEncrypted(inner, mustKeyring(t, map[string][]byte{"k1": testKey(1)}, "k1"), testLogger())
+
+	// Written before encryption was enabled.
+	inner.Put([]byte("plain"), []byte("output"), bytes.NewReader([]byte("data")), 4)
+	if _, _, miss := mustGet(t, enc, []byte("plain")); !miss {
+		t.Errorf("Expected unencrypted object to be a miss")
+	}
+
+	// An encrypted object copied to a different action ID.
+	if err := enc.Put([]byte("a"), []byte("output"), bytes.NewReader([]byte("data")), 4); err != nil {
+		t.Fatalf("Put returned error: %v", err)
+	}
+	inner.objects["b"] = inner.objects["a"]
+	if _, _, miss := mustGet(t, enc, []byte("b")); !miss {
+		t.Errorf("Expected object moved to another action ID to be a miss")
+	}
+
+	// A flipped bit in the ciphertext.
+	obj := inner.objects["a"]
+	obj.body = bytes.Clone(obj.body)
+	obj.body[len(obj.body)-1] ^= 1
+	inner.objects["a"] = obj
+	if _, _, miss := mustGet(t, enc, []byte("a")); !miss {
+		t.Errorf("Expected tampered object to be a miss")
+	}
+}
+
+func TestNewKeyringValidatesKeys(t *testing.T) {
+	if _, err := NewKeyring(map[string][]byte{"k1": []byte("short")}, "k1"); err == nil {
+		t.Errorf("Expected error for a key of the wrong size")
+	}
+	if _, err := NewKeyring(map[string][]byte{"k1": testKey(1)}, "k2"); err == nil {
+		t.Errorf("Expected error for an active key ID that isn't in the keyring")
+	}
+}
@@ -0,0 +1,67 @@
+package backends
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Envelope types, see EnvelopeHeader.
+const (
+	EnvelopeEncrypted = "encrypted"
+	EnvelopeSigned    = "signed"
+)
+
+// EnvelopeHeader describes the header that Encrypted or Signed stores in front
+// of an object's body, for tools that inspect stored objects.
+type EnvelopeHeader struct {
+	Type    string // EnvelopeEncrypted or EnvelopeSigned
+	Version int    // Envelope format version
+	KeyID   string // ID of the key the object was encrypted or signed with
+	Size    int    // Size of the header in bytes
+}
+
+// ParseEnvelopeHeader parses the header of an object written by Encrypted or
+// Signed. It returns false if data doesn't start with a complete header, e.g.
+// because the object was written without either wrapper.
+//
+// The header is parsed without any keys, so it says nothing about whether the
+// object can be decrypted or its signature is valid.
+func ParseEnvelopeHeader(data []byte) (EnvelopeHeader, bool) {
+	var (
+		header EnvelopeHeader
+		magic  []byte
+	)
+	switch {
+	case bytes.HasPrefix(data, encryptionMagic):
+		header.Type, magic = EnvelopeEncrypted, encryptionMagic
+	case bytes.HasPrefix(data, signatureMagic):
+		header.Type, magic = EnvelopeSigned, signatureMagic
+	default:
+		return EnvelopeHeader{}, false
+	}
+	header.Version = int(magic[len(magic)-1])
+
+	rest := data[len(magic):]
+	if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+		return EnvelopeHeader{}, false
+	}
+	header.KeyID = string(rest[1 : 1+int(rest[0])])
+	rest = rest[1+int(rest[0]):]
+
+	switch header.Type {
+	case EnvelopeEncrypted:
+		// The wrapped data key and the body nonce, see Encrypted.seal.
+		if len(rest) < wrappedKeyLength+gcmNonceSize {
+			return EnvelopeHeader{}, false
+		}
+		rest = rest[wrappedKeyLength+gcmNonceSize:]
+	case EnvelopeSigned:
+		// The signature, see Signed.verify.
+		if len(rest) < 2 || len(rest)-2 < int(binary.BigEndian.Uint16(rest)) {
+			return EnvelopeHeader{}, false
+		}
+		rest = rest[2+int(binary.BigEndian.Uint16(rest)):]
+	}
+	header.Size = len(data) - len(rest)
+	return header, true
+}
@@ -0,0 +1,44 @@
+package backends
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseEnvelopeHeader(t *testing.T) {
+	inner := newFakeBackend()
+	ci := testSigningKey(t, "ci", 1)
+	enc := NewEncrypted(inner, mustKeyring(t, map[string][]byte{"k1": testKey(1)}, "k1"), testLogger())
+	signed := NewSigned(enc, mustSigningKeyring(t, &ci), testLogger())
+
+	body := []byte("data")
+	if err := signed.Put([]byte("action"), []byte("output"), bytes.NewReader(body), int64(len(body))); err != nil {
+		t.Fatalf("Put returned error: %v", err)
+	}
+
+	// The stored object only shows the outer encryption envelope.
+	stored := inner.objects["action"].body
+	header, ok := ParseEnvelopeHeader(stored)
+	if !ok || header.Type != EnvelopeEncrypted || header.KeyID != "k1" || header.Version != 1 {
+		t.Fatalf("Unexpected header of the stored object: %+v, ok=%v", header, ok)
+	}
+
+	// The signature envelope is inside it.
+	_, decrypted, miss := mustGet(t, enc, []byte("action"))
+	if miss {
+		t.Fatal("Expected to decrypt the stored object")
+	}
+	header, ok = ParseEnvelopeHeader(decrypted)
+	if !ok || header.Type != EnvelopeSigned || header.KeyID != "ci" {
+		t.Fatalf("Unexpected header of the decrypted object: %+v, ok=%v", header, ok)
+	}
+	if !bytes.Equal(decrypted[header.Size:], body) {
+		t.Errorf("Expected the body to follow the signature header, got %q", decrypted[header.Size:])
+	}
+
+	for _, data := range [][]byte{body, nil, decrypted[:header.Size-1]} {
+		if header, ok := ParseEnvelopeHeader(data); ok {
+			t.Errorf("Expected no header in %q, got %+v", data, header)
+		}
+	}
+}
@@ -85,6 +85,43 @@ func (e *Error) Clear() error {
 	return e.backend.Clear()
 }
 
+// List returns a page of the wrapped backend's objects, potentially returning an error.
+func (e *Error) List(pageToken string, pageSize int) ([]ObjectInfo, string, error) {
+	if e.shouldError() {
+		return nil, "", fmt.Errorf("error backend: simulated List error (error rate: %.2f%%)", e.errorRate*100)
+	}
+	return listNext(e.backend, pageToken, pageSize)
+}
+
+// Delete removes objects from the wrapped backend, potentially returning an error.
+func (e *Error) Delete(actionIDs [][]byte) error {
+	if e.shouldError() {
+		return fmt.Errorf("error backend: simulated Delete error (error rate: %.2f%%)", e.errorRate*100)
+	}
+	return deleteNext(e.backend, actionIDs)
+}
+
+// Stat looks up an object's metadata in the wrapped backend, potentially returning an error.
+func (e *Error) Stat(actionID []byte) (ObjectInfo, bool, error) {
+	if e.shouldError() {
+		return ObjectInfo{}, false, fmt.Errorf("error backend: simulated Stat error (error rate: %.2f%%)", e.errorRate*100)
+	}
+	return statNext(e.backend, actionID)
+}
+
+// Touch refreshes an object's access time in the wrapped backend, potentially returning an error.
+func (e *Error) Touch(actionID []byte, interval time.Duration) (bool, error) {
+	if e.shouldError() {
+		return false, fmt.Errorf("error backend: simulated Touch error (error rate: %.2f%%)", e.errorRate*100)
+	}
+	return touchNext(e.backend, actionID, interval)
+}
+
+// Unwrap returns the wrapped backend.
+func (e *Error) Unwrap() Backend {
+	return e.backend
+}
+
 // GetStats returns the number of errors injected for each operation type.
 // This method is thread-safe.
 func (e *Error) GetStats() (putErrors, getErrors, closeErrors, clearErrors int64) {
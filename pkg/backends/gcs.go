@@ -1,12 +1,14 @@
 package backends
 
 import (
+	"bytes"
 	"context"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"strconv"
+	"strings"
 	"time"
 
 	"cloud.google.com/go/storage"
@@ -156,60 +158,240 @@ func (g *GCS) Close() error {
 	return nil
 }
 
-// Clear removes all entries from the cache in GCS.
+// Clear removes all objects under the prefix from GCS. Each page of the listing
+// is deleted before the next one is listed, so the whole listing is never held
+// in memory.
 func (g *GCS) Clear() error {
-	// List all objects with the prefix
-	query := &storage.Query{
-		Prefix: g.prefix,
+	pageToken := ""
+	for {
+		objects, next, err := g.List(pageToken, 1000)
+		if err != nil {
+			return err
+		}
+		names := make([]string, 0, len(objects))
+		for _, obj := range objects {
+			names = append(names, obj.Name)
+		}
+		if err := g.deleteObjects(names); err != nil {
+			return err
+		}
+		if next == "" {
+			return nil
+		}
+		pageToken = next
 	}
+}
 
-	it := g.bucket.Objects(g.ctx, query)
+// List returns a page of the objects under the prefix.
+func (g *GCS) List(pageToken string, pageSize int) ([]ObjectInfo, string, error) {
+	query := &storage.Query{Prefix: g.prefix}
+	if err := query.SetAttrSelection([]string{"Name", "Size", "Created", "CustomTime", "Metadata"}); err != nil {
+		return nil, "", err
+	}
 
-	// Collect objects to delete (GCS allows up to 100 objects per batch delete)
-	var objectsToDelete []string
-	for {
-		attrs, err := it.Next()
-		if err == iterator.Done {
-			break
+	var attrs []*storage.ObjectAttrs
+	next, err := iterator.NewPager(g.bucket.Objects(g.ctx, query), pageSize, pageToken).NextPage(&attrs)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to list GCS objects: %w", err)
+	}
+
+	objects := make([]ObjectInfo, 0, len(attrs))
+	for _, a := range attrs {
+		objects = append(objects, g.objectInfo(a))
+	}
+	return objects, next, nil
+}
+
+// objectInfo converts the attributes of an object to an ObjectInfo, preferring
+// the put time and output ID recorded in its metadata.
+func (g *GCS) objectInfo(attrs *storage.ObjectAttrs) ObjectInfo {
+	info := ObjectInfo{
+		Name:     attrs.Name,
+		ActionID: keyToActionID(attrs.Name, g.prefix),
+		Size:     attrs.Size,
+		PutTime:  attrs.Created,
+	}
+	if putTimeUnix, err := strconv.ParseInt(attrs.Metadata["time"], 10, 64); err == nil {
+		info.PutTime = time.Unix(putTimeUnix, 0)
+	}
+	if outputID, err := hex.DecodeString(attrs.Metadata["outputid"]); err == nil && len(outputID) > 0 {
+		info.OutputID = outputID
+	}
+	info.AccessTime = info.PutTime
+	if attrs.CustomTime.After(info.AccessTime) {
+		info.AccessTime = attrs.CustomTime
+	}
+	return info
+}
+
+// Touch sets the object's custom time, which GCS lifecycle rules can match with
+// the daysSinceCustomTime condition to expire objects that haven't been used for
+// a number of days.
+func (g *GCS) Touch(actionID []byte, interval time.Duration) (bool, error) {
+	obj := g.bucket.Object(g.actionIDToKey(actionID))
+	attrs, err := obj.Attrs(g.ctx)
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return false, nil
 		}
+		return false, fmt.Errorf("failed to get GCS object attrs: %w", err)
+	}
+	if time.Since(g.objectInfo(attrs).AccessTime) < interval {
+		return false, nil
+	}
+
+	_, err = obj.Update(g.ctx, storage.ObjectAttrsToUpdate{CustomTime: time.Now()})
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to touch GCS object: %w", err)
+	}
+	return true, nil
+}
+
+// actionIDToKey converts an actionID to a GCS object name (see actionIDToName).
+func (g *GCS) actionIDToKey(actionID []byte) string {
+	return actionIDToName(g.prefix, actionID)
+}
+
+// Delete removes the objects stored for the given action IDs. Objects that don't
+// exist are ignored.
+func (g *GCS) Delete(actionIDs [][]byte) error {
+	names := make([]string, 0, len(actionIDs))
+	for _, actionID := range actionIDs {
+		names = append(names, g.actionIDToKey(actionID))
+	}
+	return g.deleteObjects(names)
+}
+
+// deleteObjects deletes objects by name and returns the errors of every object
+// that couldn't be deleted. Objects that don't exist are ignored.
+func (g *GCS) deleteObjects(names []string) error {
+	var errs []error
+	for _, name := range names {
+		err := g.bucket.Object(name).Delete(g.ctx)
+		if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+			errs = append(errs, fmt.Errorf("failed to delete GCS object %s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Stat returns the metadata of the object stored for actionID without
+// downloading it.
+func (g *GCS) Stat(actionID []byte) (ObjectInfo, bool, error) {
+	key := g.actionIDToKey(actionID)
+	attrs, err := g.bucket.Object(key).Attrs(g.ctx)
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return ObjectInfo{}, true, nil
+		}
+		return ObjectInfo{}, false, fmt.Errorf("failed to get GCS object attrs: %w", err)
+	}
+	return g.objectInfo(attrs), false, nil
+}
+
+// Diagnose checks every permission the GCS backend needs by exercising it on a
+// probe object, and checks that the bucket has a lifecycle rule that deletes
+// cache entries.
+func (g *GCS) Diagnose() []Diagnostic {
+	var diagnostics []Diagnostic
+	check := func(permission string, err error, detail string) bool {
+		d := Diagnostic{Check: permission, Status: DiagnosticOK, Detail: detail}
 		if err != nil {
-			return fmt.Errorf("failed to list GCS objects: %w", err)
+			d.Status = DiagnosticFailed
+			d.Detail = err.Error()
+			d.Recommendation = gcsRecommendation(permission, err)
 		}
-		objectsToDelete = append(objectsToDelete, attrs.Name)
+		diagnostics = append(diagnostics, d)
+		return err == nil
+	}
+
+	bucketAttrs, err := g.bucket.Attrs(g.ctx)
+	detail := ""
+	if err == nil {
+		detail = fmt.Sprintf("bucket %s is accessible in location %s", bucketAttrs.Name, bucketAttrs.Location)
 	}
+	check("storage.buckets.get", err, detail)
 
-	if len(objectsToDelete) == 0 {
-		return nil
+	name := probeObjectName(g.prefix)
+	obj := g.bucket.Object(name)
+	writer := obj.NewWriter(g.ctx)
+	_, err = writer.Write(probeBody)
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	if !check("storage.objects.create", err, "wrote "+name) {
+		return append(append(diagnostics, skippedDiagnostics("the probe object couldn't be written",
+			"storage.objects.get", "storage.objects.list", "storage.objects.delete")...), g.diagnoseLifecycle(bucketAttrs))
 	}
 
-	// Delete objects in batches (GCS allows up to 100 objects per batch)
-	batchSize := 100
-	for i := 0; i < len(objectsToDelete); i += batchSize {
-		end := i + batchSize
-		if end > len(objectsToDelete) {
-			end = len(objectsToDelete)
+	reader, err := obj.NewReader(g.ctx)
+	if err == nil {
+		var data []byte
+		data, err = io.ReadAll(reader)
+		reader.Close()
+		if err == nil && !bytes.Equal(data, probeBody) {
+			err = errors.New("probe object content doesn't match what was written")
 		}
-		batch := objectsToDelete[i:end]
+	}
+	check("storage.objects.get", err, "")
+
+	it := g.bucket.Objects(g.ctx, &storage.Query{Prefix: name})
+	_, err = it.Next()
+	if err == iterator.Done {
+		err = errors.New("probe object missing from listing")
+	}
+	check("storage.objects.list", err, "")
+
+	check("storage.objects.delete", obj.Delete(g.ctx), "")
+
+	return append(diagnostics, g.diagnoseLifecycle(bucketAttrs))
+}
 
-		// Delete each object in the batch
-		for _, objName := range batch {
-			obj := g.bucket.Object(objName)
-			if err := obj.Delete(g.ctx); err != nil {
-				// Continue deleting other objects even if one fails
-				// Log error but don't fail the entire operation
-				_ = err
+// diagnoseLifecycle checks for a lifecycle rule that deletes objects under the
+// backend's prefix.
+func (g *GCS) diagnoseLifecycle(attrs *storage.BucketAttrs) Diagnostic {
+	const check = "lifecycle policy"
+	if attrs == nil {
+		return Diagnostic{Check: check, Status: DiagnosticSkipped, Detail: "the bucket's attributes couldn't be read"}
+	}
+
+	for _, rule := range attrs.Lifecycle.Rules {
+		if rule.Action.Type != storage.DeleteAction || rule.Condition.AgeInDays <= 0 {
+			continue
+		}
+		matches := len(rule.Condition.MatchesPrefix) == 0
+		for _, prefix := range rule.Condition.MatchesPrefix {
+			matches = matches || strings.HasPrefix(g.prefix, prefix)
+		}
+		if matches {
+			return Diagnostic{
+				Check:  check,
+				Status: DiagnosticOK,
+				Detail: fmt.Sprintf("rule deletes objects after %d days", rule.Condition.AgeInDays),
 			}
 		}
 	}
-
-	return nil
+	return Diagnostic{
+		Check:          check,
+		Status:         DiagnosticWarning,
+		Detail:         "no lifecycle rule deletes objects under the prefix, cache entries never expire",
+		Recommendation: fmt.Sprintf("Add a lifecycle rule to bucket %s that deletes objects under %q after a few days (see the README's Lifecycle Policies)", attrs.Name, g.prefix),
+	}
 }
 
-// actionIDToKey converts an actionID to a GCS object name.
-func (g *GCS) actionIDToKey(actionID []byte) string {
-	hexID := hex.EncodeToString(actionID)
-	if g.prefix != "" {
-		return g.prefix + hexID
+// gcsRecommendation suggests a fix for a failed GCS call.
+func gcsRecommendation(permission string, err error) string {
+	switch {
+	case errorContainsAny(err, "403", "Forbidden", "does not have"):
+		return fmt.Sprintf("Grant %s to the service account, e.g. with the Storage Object Admin role (see the README's GCS Credentials Permissions)", permission)
+	case errors.Is(err, storage.ErrBucketNotExist):
+		return "Check that the bucket exists"
+	case errorContainsAny(err, "could not find default credentials", "invalid_grant"):
+		return "Check the application default credentials (GOOGLE_APPLICATION_CREDENTIALS or gcloud auth application-default login)"
+	default:
+		return ""
 	}
-	return hexID
 }
@@ -0,0 +1,86 @@
+package backends
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestListAll_FollowsPages(t *testing.T) {
+	backend := newFakeBackend()
+	for i := 0; i < 7; i++ {
+		body := strings.Repeat("x", i)
+		if err := backend.Put([]byte(fmt.Sprintf("key-%d", i)), []byte("output"), strings.NewReader(body), int64(len(body))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var (
+		listed []string
+		total  int64
+	)
+	err := ListAll(backend, 3, func(obj ObjectInfo) error {
+		listed = append(listed, string(obj.ActionID))
+		total += obj.Size
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ListAll failed: %v", err)
+	}
+	if len(listed) != 7 || listed[0] != "key-0" || listed[6] != "key-6" {
+		t.Errorf("listed %v, want key-0 through key-6", listed)
+	}
+	if total != 21 {
+		t.Errorf("listed %d bytes, want 21", total)
+	}
+
+	backend.setFailing(true)
+	if err := ListAll(backend, 3, func(ObjectInfo) error { return nil }); err == nil {
+		t.Error("expected ListAll to return the backend's error")
+	}
+}
+
+func TestKeyToActionID(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string
+		want   []byte
+	}{
+		{"cache/0102", "cache/", []byte{1, 2}},
+		{"0102", "", []byte{1, 2}},
+		{"other/0102", "cache/", nil},
+		{"cache/", "cache/", nil},
+		{"cache/not-hex", "cache/", nil},
+		{"cache/branches/foo/7632", "cache/", []byte("branches/foo/v2")},
+		{"cache/branches/foo/", "cache/", nil},
+	}
+	for _, tt := range tests {
+		if got := keyToActionID(tt.name, tt.prefix); !bytes.Equal(got, tt.want) {
+			t.Errorf("keyToActionID(%q, %q) = %x, want %x", tt.name, tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestActionIDToName(t *testing.T) {
+	tests := []struct {
+		actionID []byte
+		want     string
+	}{
+		{[]byte("v2"), "cache/7632"},
+		// Namespaces are kept as object prefixes.
+		{[]byte("branches/foo/v2"), "cache/branches/foo/7632"},
+		// Unless they can't be used in object names.
+		{[]byte("a\nb/v2"), "cache/610a622f7632"},
+		{[]byte{0xff, '/', 1}, "cache/ff2f01"},
+	}
+	for _, tt := range tests {
+		name := actionIDToName("cache/", tt.actionID)
+		if name != tt.want {
+			t.Errorf("actionIDToName(%q) = %q, want %q", tt.actionID, name, tt.want)
+		}
+		if got := keyToActionID(name, "cache/"); !bytes.Equal(got, tt.actionID) {
+			t.Errorf("keyToActionID(%q) = %q, want %q", name, got, tt.actionID)
+		}
+	}
+}
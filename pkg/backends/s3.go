@@ -4,9 +4,12 @@ import (
 	"bytes"
 	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -183,75 +186,340 @@ func (s *S3) Close() error {
 	return nil
 }
 
-// Clear removes all entries from the cache in S3.
+// Clear removes all objects under the prefix from S3. Each page of the listing
+// is deleted before the next one is listed, so the whole listing is never held
+// in memory.
 func (s *S3) Clear() error {
-	// List all objects with the prefix
+	pageToken := ""
+	for {
+		objects, next, err := s.List(pageToken, 1000)
+		if err != nil {
+			return err
+		}
+		keys := make([]string, 0, len(objects))
+		for _, obj := range objects {
+			keys = append(keys, obj.Name)
+		}
+		if err := s.deleteKeys(keys); err != nil {
+			return err
+		}
+		if next == "" {
+			return nil
+		}
+		pageToken = next
+	}
+}
+
+// List returns a page of the objects under the prefix. S3 listings don't include
+// user metadata, so put times are the objects' last modified times, which Touch
+// moves forward, and output IDs aren't returned.
+func (s *S3) List(pageToken string, pageSize int) ([]ObjectInfo, string, error) {
 	listInput := &s3.ListObjectsV2Input{
 		Bucket: aws.String(s.bucket),
 		Prefix: aws.String(s.prefix),
 	}
+	if pageToken != "" {
+		listInput.ContinuationToken = aws.String(pageToken)
+	}
+	if pageSize > 0 {
+		listInput.MaxKeys = aws.Int32(int32(min(pageSize, 1000)))
+	}
 
-	paginator := s3.NewListObjectsV2Paginator(s.client, listInput)
+	page, err := s.client.ListObjectsV2(s.ctx, listInput)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to list S3 objects: %w", err)
+	}
 
-	var deleteObjects []types.ObjectIdentifier
-	for paginator.HasMorePages() {
-		page, err := paginator.NextPage(s.ctx)
-		if err != nil {
-			return fmt.Errorf("failed to list S3 objects: %w", err)
+	objects := make([]ObjectInfo, 0, len(page.Contents))
+	for _, obj := range page.Contents {
+		info := ObjectInfo{
+			Name:     aws.ToString(obj.Key),
+			ActionID: keyToActionID(aws.ToString(obj.Key), s.prefix),
+			Size:     aws.ToInt64(obj.Size),
+		}
+		if obj.LastModified != nil {
+			info.PutTime = *obj.LastModified
+			info.AccessTime = *obj.LastModified
 		}
+		objects = append(objects, info)
+	}
+
+	var next string
+	if aws.ToBool(page.IsTruncated) {
+		next = aws.ToString(page.NextContinuationToken)
+	}
+	return objects, next, nil
+}
 
-		for _, obj := range page.Contents {
-			deleteObjects = append(deleteObjects, types.ObjectIdentifier{
-				Key: obj.Key,
-			})
+// Touch copies the object onto itself, which moves its last modified time
+// forward. Lifecycle rules that expire objects by age therefore only expire
+// objects that haven't been used for that long. The object's metadata, including
+// its original put time, is preserved.
+func (s *S3) Touch(actionID []byte, interval time.Duration) (bool, error) {
+	key := s.actionIDToKey(actionID)
+	head, err := s.client.HeadObject(s.ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if s.isNotFoundError(err) {
+			return false, nil
 		}
+		return false, fmt.Errorf("failed to head S3 object: %w", err)
+	}
+	if head.LastModified != nil && time.Since(*head.LastModified) < interval {
+		return false, nil
 	}
 
-	if len(deleteObjects) == 0 {
-		return nil
+	// Copying an object onto itself is only allowed when something changes, so
+	// the metadata is replaced with itself.
+	_, err = s.client.CopyObject(s.ctx, &s3.CopyObjectInput{
+		Bucket:            aws.String(s.bucket),
+		Key:               aws.String(key),
+		CopySource:        aws.String((&url.URL{Path: s.bucket + "/" + key}).EscapedPath()),
+		MetadataDirective: types.MetadataDirectiveReplace,
+		Metadata:          head.Metadata,
+		ContentType:       head.ContentType,
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to touch S3 object: %w", err)
 	}
+	return true, nil
+}
 
-	// Delete objects (S3 allows up to 1000 objects per request)
-	for i := 0; i < len(deleteObjects); i += 1000 {
-		end := i + 1000
-		if end > len(deleteObjects) {
-			end = len(deleteObjects)
+// actionIDToKey converts an actionID to an S3 key (see actionIDToName).
+func (s *S3) actionIDToKey(actionID []byte) string {
+	return actionIDToName(s.prefix, actionID)
+}
+
+// isNotFoundError checks if an error is a "not found" error from S3.
+func (s *S3) isNotFoundError(err error) bool {
+	if err == nil {
+		return false
+	}
+	// Check for common not found error types
+	errMsg := err.Error()
+	return bytes.Contains([]byte(errMsg), []byte("NotFound")) ||
+		bytes.Contains([]byte(errMsg), []byte("NoSuchKey"))
+}
+
+// Delete removes the objects stored for the given action IDs. Objects that don't
+// exist are ignored.
+func (s *S3) Delete(actionIDs [][]byte) error {
+	keys := make([]string, 0, len(actionIDs))
+	for _, actionID := range actionIDs {
+		keys = append(keys, s.actionIDToKey(actionID))
+	}
+	return s.deleteKeys(keys)
+}
+
+// deleteKeys deletes objects in batches of 1000, the most S3 allows per request,
+// and returns the errors of every object that couldn't be deleted.
+func (s *S3) deleteKeys(keys []string) error {
+	var errs []error
+	for i := 0; i < len(keys); i += 1000 {
+		end := min(i+1000, len(keys))
+		objects := make([]types.ObjectIdentifier, 0, end-i)
+		for _, key := range keys[i:end] {
+			objects = append(objects, types.ObjectIdentifier{Key: aws.String(key)})
 		}
-		batch := deleteObjects[i:end]
 
-		deleteInput := &s3.DeleteObjectsInput{
+		result, err := s.client.DeleteObjects(s.ctx, &s3.DeleteObjectsInput{
 			Bucket: aws.String(s.bucket),
 			Delete: &types.Delete{
-				Objects: batch,
+				Objects: objects,
 				Quiet:   aws.Bool(true),
 			},
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to delete S3 objects: %w", err))
+			continue
 		}
+		for _, e := range result.Errors {
+			errs = append(errs, fmt.Errorf("failed to delete S3 object %s: %s: %s",
+				aws.ToString(e.Key), aws.ToString(e.Code), aws.ToString(e.Message)))
+		}
+	}
+	return errors.Join(errs...)
+}
 
-		_, err := s.client.DeleteObjects(s.ctx, deleteInput)
+// Stat returns the metadata of the object stored for actionID without
+// downloading it.
+func (s *S3) Stat(actionID []byte) (ObjectInfo, bool, error) {
+	key := s.actionIDToKey(actionID)
+	result, err := s.client.HeadObject(s.ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if s.isNotFoundError(err) {
+			return ObjectInfo{}, true, nil
+		}
+		return ObjectInfo{}, false, fmt.Errorf("failed to head S3 object: %w", err)
+	}
+
+	info := ObjectInfo{
+		ActionID: actionID,
+		Name:     key,
+		Size:     aws.ToInt64(result.ContentLength),
+	}
+	if result.LastModified != nil {
+		info.PutTime = *result.LastModified
+		info.AccessTime = *result.LastModified
+	}
+	if putTimeUnix, err := strconv.ParseInt(result.Metadata["time"], 10, 64); err == nil {
+		info.PutTime = time.Unix(putTimeUnix, 0)
+	}
+	if outputID, err := hex.DecodeString(result.Metadata["outputid"]); err == nil && len(outputID) > 0 {
+		info.OutputID = outputID
+	}
+	return info, false, nil
+}
+
+// Diagnose checks every permission the S3 backend needs by exercising it on a
+// probe object, and checks that the bucket has a lifecycle policy that expires
+// cache entries.
+func (s *S3) Diagnose() []Diagnostic {
+	var diagnostics []Diagnostic
+	check := func(action string, err error, detail string) bool {
+		d := Diagnostic{Check: action, Status: DiagnosticOK, Detail: detail}
 		if err != nil {
-			return fmt.Errorf("failed to delete S3 objects: %w", err)
+			d.Status = DiagnosticFailed
+			d.Detail = err.Error()
+			d.Recommendation = s3Recommendation(action, s.bucket, err)
 		}
+		diagnostics = append(diagnostics, d)
+		return err == nil
 	}
 
-	return nil
+	_, err := s.client.HeadBucket(s.ctx, &s3.HeadBucketInput{Bucket: aws.String(s.bucket)})
+	check("s3:HeadBucket", err, fmt.Sprintf("bucket %s is accessible in region %s", s.bucket, s.awsConfig.Region))
+
+	if isDirectoryBucket(s.bucket) {
+		_, err := s.client.CreateSession(s.ctx, &s3.CreateSessionInput{Bucket: aws.String(s.bucket)})
+		check("s3express:CreateSession", err, "session created")
+	} else {
+		diagnostics = append(diagnostics, Diagnostic{
+			Check:  "s3express:CreateSession",
+			Status: DiagnosticSkipped,
+			Detail: "not an S3 Express One Zone directory bucket",
+		})
+	}
+
+	key := probeObjectName(s.prefix)
+	_, err = s.client.PutObject(s.ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(probeBody),
+	})
+	if !check("s3:PutObject", err, "wrote "+key) {
+		return append(append(diagnostics, skippedDiagnostics("the probe object couldn't be written",
+			"s3:HeadObject", "s3:GetObject", "s3:ListBucket", "s3:DeleteObject")...), s.diagnoseLifecycle())
+	}
+
+	_, err = s.client.HeadObject(s.ctx, &s3.HeadObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(key)})
+	check("s3:HeadObject", err, "")
+
+	result, err := s.client.GetObject(s.ctx, &s3.GetObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(key)})
+	if err == nil {
+		var data []byte
+		data, err = io.ReadAll(result.Body)
+		result.Body.Close()
+		if err == nil && !bytes.Equal(data, probeBody) {
+			err = errors.New("probe object content doesn't match what was written")
+		}
+	}
+	check("s3:GetObject", err, "")
+
+	list, err := s.client.ListObjectsV2(s.ctx, &s3.ListObjectsV2Input{
+		Bucket:  aws.String(s.bucket),
+		Prefix:  aws.String(key),
+		MaxKeys: aws.Int32(1),
+	})
+	if err == nil && len(list.Contents) == 0 {
+		err = errors.New("probe object missing from listing")
+	}
+	check("s3:ListBucket", err, "")
+
+	_, err = s.client.DeleteObject(s.ctx, &s3.DeleteObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(key)})
+	check("s3:DeleteObject", err, "")
+
+	return append(diagnostics, s.diagnoseLifecycle())
 }
 
-// actionIDToKey converts an actionID to an S3 key.
-func (s *S3) actionIDToKey(actionID []byte) string {
-	hexID := hex.EncodeToString(actionID)
-	if s.prefix != "" {
-		return s.prefix + hexID
+// diagnoseLifecycle checks for an enabled lifecycle rule that expires objects
+// under the backend's prefix.
+func (s *S3) diagnoseLifecycle() Diagnostic {
+	const check = "lifecycle policy"
+	recommendation := fmt.Sprintf("Add a lifecycle rule to bucket %s that expires objects under %q after a few days (see the README's Lifecycle Policies)", s.bucket, s.prefix)
+
+	result, err := s.client.GetBucketLifecycleConfiguration(s.ctx, &s3.GetBucketLifecycleConfigurationInput{
+		Bucket: aws.String(s.bucket),
+	})
+	if err != nil {
+		if errorContainsAny(err, "NoSuchLifecycleConfiguration") {
+			return Diagnostic{Check: check, Status: DiagnosticWarning, Detail: "bucket has no lifecycle policy, cache entries never expire", Recommendation: recommendation}
+		}
+		return Diagnostic{
+			Check:          check,
+			Status:         DiagnosticWarning,
+			Detail:         "couldn't read the lifecycle policy: " + err.Error(),
+			Recommendation: "Grant s3:GetLifecycleConfiguration to check the lifecycle policy, or verify it manually",
+		}
 	}
-	return hexID
+
+	for _, rule := range result.Rules {
+		if rule.Status != types.ExpirationStatusEnabled || rule.Expiration == nil || rule.Expiration.Days == nil {
+			continue
+		}
+		if strings.HasPrefix(s.prefix, lifecycleRulePrefix(rule)) {
+			return Diagnostic{
+				Check:  check,
+				Status: DiagnosticOK,
+				Detail: fmt.Sprintf("rule %q expires objects after %d days", aws.ToString(rule.ID), aws.ToInt32(rule.Expiration.Days)),
+			}
+		}
+	}
+	return Diagnostic{Check: check, Status: DiagnosticWarning, Detail: "no enabled lifecycle rule expires objects under the prefix", Recommendation: recommendation}
 }
 
-// isNotFoundError checks if an error is a "not found" error from S3.
-func (s *S3) isNotFoundError(err error) bool {
-	if err == nil {
-		return false
+// lifecycleRulePrefix returns the key prefix a lifecycle rule applies to.
+func lifecycleRulePrefix(rule types.LifecycleRule) string {
+	if rule.Filter != nil {
+		if rule.Filter.Prefix != nil {
+			return *rule.Filter.Prefix
+		}
+		if rule.Filter.And != nil {
+			return aws.ToString(rule.Filter.And.Prefix)
+		}
+	}
+	return aws.ToString(rule.Prefix)
+}
+
+// isDirectoryBucket reports whether bucket is an S3 Express One Zone directory
+// bucket, whose names end with --x-s3.
+func isDirectoryBucket(bucket string) bool {
+	return strings.HasSuffix(bucket, "--x-s3")
+}
+
+// s3Recommendation suggests a fix for a failed S3 call.
+func s3Recommendation(action, bucket string, err error) string {
+	switch {
+	case errorContainsAny(err, "AccessDenied", "Forbidden", "StatusCode: 403"):
+		resource := "arn:aws:s3:::" + bucket + "/*"
+		if action == "s3:HeadBucket" || action == "s3:ListBucket" {
+			resource = "arn:aws:s3:::" + bucket
+		} else if action == "s3express:CreateSession" {
+			resource = "arn:aws:s3express:<region>:<account ID>:bucket/" + bucket
+		}
+		return fmt.Sprintf("Grant %s on %s (see the README's AWS Credentials Permissions)", action, resource)
+	case errorContainsAny(err, "PermanentRedirect", "StatusCode: 301", "AuthorizationHeaderMalformed", "IllegalLocationConstraint"):
+		return "The bucket is in a different region, set GOBUILDCACHE_AWS_REGION to the bucket's region"
+	case errorContainsAny(err, "NoSuchBucket", "StatusCode: 404"):
+		return fmt.Sprintf("Check that bucket %s exists and that GOBUILDCACHE_AWS_REGION is its region", bucket)
+	case errorContainsAny(err, "failed to retrieve credentials", "no EC2 IMDS role found", "InvalidAccessKeyId", "SignatureDoesNotMatch", "ExpiredToken"):
+		return "Check the AWS credentials (GOBUILDCACHE_AWS_ACCESS_KEY_ID, GOBUILDCACHE_AWS_SECRET_ACCESS_KEY, GOBUILDCACHE_AWS_SESSION_TOKEN or the default credential chain)"
+	default:
+		return ""
 	}
-	// Check for common not found error types
-	errMsg := err.Error()
-	return bytes.Contains([]byte(errMsg), []byte("NotFound")) ||
-		bytes.Contains([]byte(errMsg), []byte("NoSuchKey"))
 }
@@ -0,0 +1,348 @@
+package backends
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// signatureMagic identifies objects written by Signed, and its last byte is the
+// envelope format version.
+var signatureMagic = []byte("GBS\x01")
+
+// signatureContext is prepended to every signed message so that signatures
+// can't be confused with signatures over other kinds of data.
+const signatureContext = "gobuildcache-entry-v1\x00"
+
+var (
+	// ErrUnsigned is returned when an object doesn't carry a signature.
+	ErrUnsigned = errors.New("object is not signed")
+	// ErrUntrustedKey is returned when an object was signed with a key that isn't
+	// trusted.
+	ErrUntrustedKey = errors.New("object was signed with an untrusted key")
+	// ErrBadSignature is returned when an object's signature doesn't match its
+	// contents.
+	ErrBadSignature = errors.New("signature does not match object")
+)
+
+// SigningAlgorithm is the algorithm of a SigningKey.
+type SigningAlgorithm string
+
+const (
+	// SigningEd25519 signs entries with an ed25519 private key, and verifies them
+	// with the corresponding public key. Readers only need the public key, so it
+	// can be handed out to untrusted jobs.
+	SigningEd25519 SigningAlgorithm = "ed25519"
+	// SigningHMAC signs and verifies entries with a shared HMAC-SHA256 secret.
+	// Anyone who can verify entries can also sign them.
+	SigningHMAC SigningAlgorithm = "hmac"
+)
+
+// SigningKey is a key used to sign or verify entries. For ed25519, PrivateKey is
+// only needed for signing. For HMAC, Secret is used for both.
+type SigningKey struct {
+	ID         string
+	Algorithm  SigningAlgorithm
+	PrivateKey ed25519.PrivateKey
+	PublicKey  ed25519.PublicKey
+	Secret     []byte
+}
+
+func (k SigningKey) sign(message []byte) []byte {
+	if k.Algorithm == SigningHMAC {
+		mac := hmac.New(sha256.New, k.Secret)
+		mac.Write(message)
+		return mac.Sum(nil)
+	}
+	return ed25519.Sign(k.PrivateKey, message)
+}
+
+func (k SigningKey) verify(message, signature []byte) bool {
+	if k.Algorithm == SigningHMAC {
+		return hmac.Equal(k.sign(message), signature)
+	}
+	return ed25519.Verify(k.PublicKey, message, signature)
+}
+
+func (k SigningKey) validate(signing bool) error {
+	if k.ID == "" || len(k.ID) > maxKeyIDLength {
+		return fmt.Errorf("invalid key ID %q: must be 1-%d bytes", k.ID, maxKeyIDLength)
+	}
+	switch k.Algorithm {
+	case SigningEd25519:
+		if signing && len(k.PrivateKey) != ed25519.PrivateKeySize {
+			return fmt.Errorf("key %q: ed25519 private key must be %d bytes", k.ID, ed25519.PrivateKeySize)
+		}
+		if !signing && len(k.PublicKey) != ed25519.PublicKeySize {
+			return fmt.Errorf("key %q: ed25519 public key must be %d bytes", k.ID, ed25519.PublicKeySize)
+		}
+	case SigningHMAC:
+		if len(k.Secret) < 16 {
+			return fmt.Errorf("key %q: HMAC secret must be at least 16 bytes", k.ID)
+		}
+	default:
+		return fmt.Errorf("key %q: unknown signing algorithm %q (supported: ed25519, hmac)", k.ID, k.Algorithm)
+	}
+	return nil
+}
+
+// SigningKeyring holds the key new entries are signed with (if any) and the keys
+// whose signatures are trusted, indexed by key ID.
+type SigningKeyring struct {
+	signer  *SigningKey
+	trusted map[string]SigningKey
+}
+
+// NewSigningKeyring creates a signing keyring. signer may be nil for readers
+// that only verify entries, in which case entries are written unsigned. The
+// signer's own key is always trusted.
+func NewSigningKeyring(signer *SigningKey, trusted []SigningKey) (*SigningKeyring, error) {
+	kr := &SigningKeyring{trusted: make(map[string]SigningKey, len(trusted)+1)}
+	for _, key := range trusted {
+		if err := key.validate(false); err != nil {
+			return nil, err
+		}
+		if _, ok := kr.trusted[key.ID]; ok {
+			return nil, fmt.Errorf("duplicate trusted key ID %q", key.ID)
+		}
+		kr.trusted[key.ID] = key
+	}
+
+	if signer != nil {
+		if err := signer.validate(true); err != nil {
+			return nil, err
+		}
+		if signer.Algorithm == SigningEd25519 {
+			signer.PublicKey = signer.PrivateKey.Public().(ed25519.PublicKey)
+		}
+		if existing, ok := kr.trusted[signer.ID]; ok && !existing.verify([]byte(signatureContext), signer.sign([]byte(signatureContext))) {
+			return nil, fmt.Errorf("trusted key %q does not match the signing key with the same ID", signer.ID)
+		}
+		kr.trusted[signer.ID] = *signer
+		kr.signer = signer
+	}
+
+	if len(kr.trusted) == 0 {
+		return nil, errors.New("signing keyring has no keys")
+	}
+	return kr, nil
+}
+
+// SignerID returns the ID of the key new entries are signed with, or "" if
+// entries are written unsigned.
+func (kr *SigningKeyring) SignerID() string {
+	if kr.signer == nil {
+		return ""
+	}
+	return kr.signer.ID
+}
+
+// TrustedKeyIDs returns the IDs of all trusted keys, sorted.
+func (kr *SigningKeyring) TrustedKeyIDs() []string {
+	ids := make([]string, 0, len(kr.trusted))
+	for id := range kr.trusted {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Signed wraps a Backend and signs every entry at PUT time, and only serves
+// entries at GET time whose signature was made with a trusted key. Unsigned,
+// untrusted and tampered entries are logged and treated as misses, so only
+// writers holding a signing key can produce entries that others consume.
+//
+// The signature covers the action ID, output ID, body size and body digest, and
+// is stored in a small header in front of the body. Like Encrypted, Get reads
+// the whole body into memory to verify it before returning it.
+type Signed struct {
+	backend Backend
+	keyring *SigningKeyring
+	logger  *slog.Logger
+
+	// unsignedPrefixes are action ID prefixes whose unsigned entries are served
+	// anyway. See AllowUnsigned.
+	unsignedPrefixes []string
+
+	// Stats
+	signedPuts    atomic.Int64
+	unsignedPuts  atomic.Int64
+	verifiedGets  atomic.Int64
+	unsignedGets  atomic.Int64
+	untrustedGets atomic.Int64
+}
+
+// NewSigned creates a new signing wrapper around an existing backend.
+func NewSigned(backend Backend, keyring *SigningKeyring, logger *slog.Logger) *Signed {
+	return &Signed{
+		backend: backend,
+		keyring: keyring,
+		logger:  logger,
+	}
+}
+
+// AllowUnsigned makes Get serve unsigned entries whose action ID starts with
+// prefix, such as the quarantine namespace that untrusted writers write their
+// (unsigned) entries into and read them back from. Entries that are signed must
+// still be signed by a trusted key. It must be called before the backend is used.
+func (s *Signed) AllowUnsigned(prefix string) {
+	s.unsignedPrefixes = append(s.unsignedPrefixes, prefix)
+}
+
+// Put signs an entry and stores it in the wrapped backend. Without a signing
+// key, the entry is stored unsigned.
+func (s *Signed) Put(actionID, outputID []byte, body io.Reader, bodySize int64) error {
+	signer := s.keyring.signer
+	if signer == nil {
+		s.unsignedPuts.Add(1)
+		return s.backend.Put(actionID, outputID, body, bodySize)
+	}
+
+	data := make([]byte, bodySize)
+	if _, err := io.ReadFull(body, data); err != nil {
+		return fmt.Errorf("failed to read body: %w", err)
+	}
+
+	signature := signer.sign(signedMessage(actionID, outputID, data))
+	envelope := make([]byte, 0, len(signatureMagic)+1+len(signer.ID)+2+len(signature)+len(data))
+	envelope = append(envelope, signatureMagic...)
+	envelope = append(envelope, byte(len(signer.ID)))
+	envelope = append(envelope, signer.ID...)
+	envelope = binary.BigEndian.AppendUint16(envelope, uint16(len(signature)))
+	envelope = append(envelope, signature...)
+	envelope = append(envelope, data...)
+
+	if err := s.backend.Put(actionID, outputID, bytes.NewReader(envelope), int64(len(envelope))); err != nil {
+		return err
+	}
+	s.signedPuts.Add(1)
+	return nil
+}
+
+// Get retrieves an entry from the wrapped backend and verifies its signature.
+func (s *Signed) Get(actionID []byte) ([]byte, io.ReadCloser, int64, *time.Time, bool, error) {
+	outputID, body, _, putTime, miss, err := s.backend.Get(actionID)
+	if err != nil || miss {
+		return nil, nil, 0, nil, miss, err
+	}
+	envelope, err := io.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return nil, nil, 0, nil, false, fmt.Errorf("failed to read signed body: %w", err)
+	}
+
+	data, err := s.verify(actionID, outputID, envelope)
+	if errors.Is(err, ErrUnsigned) && s.allowsUnsigned(actionID) {
+		s.unsignedGets.Add(1)
+		return outputID, io.NopCloser(bytes.NewReader(envelope)), int64(len(envelope)), putTime, false, nil
+	}
+	if err != nil {
+		s.untrustedGets.Add(1)
+		s.logger.Warn("backend entry is not signed by a trusted key, treating it as a miss",
+			"actionID", hex.EncodeToString(actionID),
+			"error", err)
+		return nil, nil, 0, nil, true, nil
+	}
+	s.verifiedGets.Add(1)
+	return outputID, io.NopCloser(bytes.NewReader(data)), int64(len(data)), putTime, false, nil
+}
+
+func (s *Signed) allowsUnsigned(actionID []byte) bool {
+	for _, prefix := range s.unsignedPrefixes {
+		if bytes.HasPrefix(actionID, []byte(prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// verify checks an entry's signature and returns its body. The envelope is laid
+// out as:
+//
+//	magic | key ID length (1 byte) | key ID | signature length (2 bytes) | signature | body
+func (s *Signed) verify(actionID, outputID, envelope []byte) ([]byte, error) {
+	if !bytes.HasPrefix(envelope, signatureMagic) {
+		return nil, ErrUnsigned
+	}
+	rest := envelope[len(signatureMagic):]
+	if len(rest) < 1 || len(rest) < 1+int(rest[0])+2 {
+		return nil, errors.New("truncated signature header")
+	}
+	keyID := string(rest[1 : 1+int(rest[0])])
+	rest = rest[1+int(rest[0]):]
+	sigLen := int(binary.BigEndian.Uint16(rest))
+	rest = rest[2:]
+	if len(rest) < sigLen {
+		return nil, errors.New("truncated signature header")
+	}
+	signature, data := rest[:sigLen], rest[sigLen:]
+
+	key, ok := s.keyring.trusted[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUntrustedKey, keyID)
+	}
+	if !key.verify(signedMessage(actionID, outputID, data), signature) {
+		return nil, fmt.Errorf("%w (key %q)", ErrBadSignature, keyID)
+	}
+	return data, nil
+}
+
+// signedMessage returns the message that is signed for an entry.
+func signedMessage(actionID, outputID, body []byte) []byte {
+	digest := sha256.Sum256(body)
+	message := make([]byte, 0, len(signatureContext)+4+len(actionID)+4+len(outputID)+8+len(digest))
+	message = append(message, signatureContext...)
+	message = binary.BigEndian.AppendUint32(message, uint32(len(actionID)))
+	message = append(message, actionID...)
+	message = binary.BigEndian.AppendUint32(message, uint32(len(outputID)))
+	message = append(message, outputID...)
+	message = binary.BigEndian.AppendUint64(message, uint64(len(body)))
+	return append(message, digest[:]...)
+}
+
+// Close closes the wrapped backend.
+func (s *Signed) Close() error {
+	return s.backend.Close()
+}
+
+// Clear removes all entries from the wrapped backend.
+func (s *Signed) Clear() error {
+	return s.backend.Clear()
+}
+
+// Unwrap returns the wrapped backend.
+func (s *Signed) Unwrap() Backend {
+	return s.backend
+}
+
+// Stats returns current statistics about signing.
+func (s *Signed) Stats() SignedStats {
+	return SignedStats{
+		SignerID:      s.keyring.SignerID(),
+		SignedPuts:    s.signedPuts.Load(),
+		UnsignedPuts:  s.unsignedPuts.Load(),
+		VerifiedGets:  s.verifiedGets.Load(),
+		UnsignedGets:  s.unsignedGets.Load(),
+		UntrustedGets: s.untrustedGets.Load(),
+	}
+}
+
+// SignedStats holds statistics for the signing wrapper.
+type SignedStats struct {
+	SignerID      string
+	SignedPuts    int64
+	UnsignedPuts  int64 // Entries written without a signature because no signing key is configured
+	VerifiedGets  int64
+	UnsignedGets  int64 // Unsigned entries served from prefixes that allow them
+	UntrustedGets int64 // Entries treated as misses because they weren't signed by a trusted key
+}
@@ -0,0 +1,102 @@
+package backends
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"testing"
+)
+
+func testSigningKey(t *testing.T, id string, seed byte) SigningKey {
+	t.Helper()
+	private := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{seed}, ed25519.SeedSize))
+	return SigningKey{ID: id, Algorithm: SigningEd25519, PrivateKey: private}
+}
+
+func mustSigningKeyring(t *testing.T, signer *SigningKey, trusted ...SigningKey) *SigningKeyring {
+	t.Helper()
+	kr, err := NewSigningKeyring(signer, trusted)
+	if err != nil {
+		t.Fatalf("Failed to create signing keyring: %v", err)
+	}
+	return kr
+}
+
+func TestSignedOnlyServesTrustedEntries(t *testing.T) {
+	inner := newFakeBackend()
+	ci := testSigningKey(t, "ci", 1)
+	writer := NewSigned(inner, mustSigningKeyring(t, &ci), testLogger())
+	if err := writer.Put([]byte("action"), []byte("output"), bytes.NewReader([]byte("data")), 4); err != nil {
+		t.Fatalf("Put returned error: %v", err)
+	}
+
+	// A reader holding only the public key can verify the entry.
+	public := SigningKey{ID: "ci", Algorithm: SigningEd25519, PublicKey: ci.PrivateKey.Public().(ed25519.PublicKey)}
+	reader := NewSigned(inner, mustSigningKeyring(t, nil, public), testLogger())
+	outputID, body, miss := mustGet(t, reader, []byte("action"))
+	if miss || string(outputID) != "output" || string(body) != "data" {
+		t.Fatalf("Expected signed entry to be served, got miss=%v outputID=%q body=%q", miss, outputID, body)
+	}
+
+	// An untrusted writer's entries are written unsigned, and are misses.
+	untrusted := NewSigned(inner, mustSigningKeyring(t, nil, public), testLogger())
+	if err := untrusted.Put([]byte("fork"), []byte("output"), bytes.NewReader([]byte("evil")), 4); err != nil {
+		t.Fatalf("Put returned error: %v", err)
+	}
+	if _, _, miss := mustGet(t, reader, []byte("fork")); !miss {
+		t.Errorf("Expected unsigned entry to be a miss")
+	}
+
+	// So are entries signed with a key that isn't trusted.
+	other := testSigningKey(t, "other", 2)
+	NewSigned(inner, mustSigningKeyring(t, &other), testLogger()).
+		Put([]byte("other"), []byte("output"), bytes.NewReader([]byte("evil")), 4)
+	if _, _, miss := mustGet(t, reader, []byte("other")); !miss {
+		t.Errorf("Expected entry signed with an untrusted key to be a miss")
+	}
+
+	if stats := reader.Stats(); stats.VerifiedGets != 1 || stats.UntrustedGets != 2 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestSignedDetectsTampering(t *testing.T) {
+	inner := newFakeBackend()
+	secret := SigningKey{ID: "ci", Algorithm: SigningHMAC, Secret: bytes.Repeat([]byte{1}, 32)}
+	signed := NewSigned(inner, mustSigningKeyring(t, &secret), testLogger())
+	if err := signed.Put([]byte("action"), []byte("output"), bytes.NewReader([]byte("data")), 4); err != nil {
+		t.Fatalf("Put returned error: %v", err)
+	}
+
+	// Swapping the output ID, moving the entry to another action ID, or changing
+	// the body all invalidate the signature.
+	obj := inner.objects["action"]
+	inner.objects["moved"] = obj
+	inner.objects["relabeled"] = fakeObject{outputID: []byte("other"), body: obj.body}
+	tampered := bytes.Clone(obj.body)
+	tampered[len(tampered)-1] ^= 1
+	inner.objects["tampered"] = fakeObject{outputID: obj.outputID, body: tampered}
+
+	for _, actionID := range []string{"moved", "relabeled", "tampered"} {
+		if _, _, miss := mustGet(t, signed, []byte(actionID)); !miss {
+			t.Errorf("Expected %s entry to be a miss", actionID)
+		}
+	}
+	if _, _, miss := mustGet(t, signed, []byte("action")); miss {
+		t.Errorf("Expected untouched entry to be served")
+	}
+}
+
+func TestNewSigningKeyringValidatesKeys(t *testing.T) {
+	if _, err := NewSigningKeyring(nil, nil); err == nil {
+		t.Errorf("Expected error for an empty keyring")
+	}
+	short := SigningKey{ID: "ci", Algorithm: SigningHMAC, Secret: []byte("short")}
+	if _, err := NewSigningKeyring(&short, nil); err == nil {
+		t.Errorf("Expected error for a short HMAC secret")
+	}
+	ci := testSigningKey(t, "ci", 1)
+	mismatched := SigningKey{ID: "ci", Algorithm: SigningEd25519, PublicKey: testSigningKey(t, "ci", 2).PrivateKey.Public().(ed25519.PublicKey)}
+	if _, err := NewSigningKeyring(&ci, []SigningKey{mismatched}); err == nil {
+		t.Errorf("Expected error for a trusted key that doesn't match the signing key with the same ID")
+	}
+}
@@ -0,0 +1,39 @@
+package ratelimit
+
+import (
+	"io"
+	"time"
+)
+
+// Reader wraps an io.Reader and limits the rate at which it can be read using a
+// TokenBucket. A single TokenBucket can be shared by many readers to limit their
+// combined bandwidth.
+type Reader struct {
+	r      io.Reader
+	bucket *TokenBucket
+	onWait func(time.Duration)
+}
+
+// NewReader creates a new rate limited reader. onWait, if non-nil, is called with
+// the duration of every wait so callers can track how long reads were throttled.
+func NewReader(r io.Reader, bucket *TokenBucket, onWait func(time.Duration)) *Reader {
+	return &Reader{r: r, bucket: bucket, onWait: onWait}
+}
+
+// Read reads from the underlying reader, then waits until the bytes read fit
+// within the rate limit.
+func (r *Reader) Read(p []byte) (int, error) {
+	// Don't read more than a burst at a time, so that a single large read doesn't
+	// leave the bucket deep in debt for every other reader sharing it.
+	if burst := int(r.bucket.burst); burst > 0 && len(p) > burst {
+		p = p[:burst]
+	}
+
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if wait := r.bucket.Wait(int64(n)); wait > 0 && r.onWait != nil {
+			r.onWait(wait)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,81 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// TokenBucket is a token bucket rate limiter measured in bytes. Tokens refill
+// continuously at rate bytes per second, up to a burst of one second's worth.
+//
+// Operations larger than the burst are allowed once the bucket is full and then
+// leave the bucket in debt, so that a single large object can't be starved
+// forever while the average rate is still respected.
+type TokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // Bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+	sleep  func(time.Duration)
+}
+
+// NewTokenBucket creates a new token bucket that allows rate bytes per second.
+// The bucket starts full.
+func NewTokenBucket(rate int64) *TokenBucket {
+	return &TokenBucket{
+		rate:   float64(rate),
+		burst:  float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+		now:    time.Now,
+		sleep:  time.Sleep,
+	}
+}
+
+// TryTake takes n tokens if any tokens are available without waiting, and
+// reports whether it did.
+func (tb *TokenBucket) TryTake(n int64) bool {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.refill()
+	if tb.tokens <= 0 {
+		return false
+	}
+	tb.tokens -= float64(n)
+	return true
+}
+
+// Wait takes n tokens, blocking until the bucket is no longer in debt. It
+// returns how long it waited.
+func (tb *TokenBucket) Wait(n int64) time.Duration {
+	tb.mu.Lock()
+	tb.refill()
+	tb.tokens -= float64(n)
+	var wait time.Duration
+	if tb.tokens < 0 {
+		// Everyone waits for their own share of the debt, so concurrent callers
+		// queue up behind each other instead of all waking up at once.
+		wait = time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+	}
+	tb.mu.Unlock()
+
+	if wait > 0 {
+		tb.sleep(wait)
+	}
+	return wait
+}
+
+// refill adds the tokens accumulated since the last refill. Must be called with
+// mu held.
+func (tb *TokenBucket) refill() {
+	now := tb.now()
+	elapsed := now.Sub(tb.last).Seconds()
+	tb.last = now
+	tb.tokens += elapsed * tb.rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+}
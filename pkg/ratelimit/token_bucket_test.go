@@ -0,0 +1,79 @@
+package ratelimit
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestTokenBucket creates a token bucket driven by a fake clock. Sleeping
+// advances the clock.
+func newTestTokenBucket(rate int64) (*TokenBucket, *time.Time) {
+	now := time.Unix(0, 0)
+	tb := NewTokenBucket(rate)
+	tb.last = now
+	tb.now = func() time.Time { return now }
+	tb.sleep = func(d time.Duration) { now = now.Add(d) }
+	return tb, &now
+}
+
+func TestTokenBucket_TryTake(t *testing.T) {
+	tb, now := newTestTokenBucket(100)
+
+	if !tb.TryTake(60) {
+		t.Fatalf("Expected first take to succeed")
+	}
+	if !tb.TryTake(60) {
+		t.Fatalf("Expected second take to succeed while tokens remain")
+	}
+	// The bucket is now in debt (-20 tokens).
+	if tb.TryTake(1) {
+		t.Fatalf("Expected take to fail while the bucket is in debt")
+	}
+
+	*now = now.Add(100 * time.Millisecond) // +10 tokens, still in debt
+	if tb.TryTake(1) {
+		t.Fatalf("Expected take to fail while the bucket is still in debt")
+	}
+
+	*now = now.Add(time.Second) // Refills up to the burst
+	if !tb.TryTake(1) {
+		t.Fatalf("Expected take to succeed after refilling")
+	}
+}
+
+func TestTokenBucket_Wait(t *testing.T) {
+	tb, _ := newTestTokenBucket(100)
+
+	if wait := tb.Wait(100); wait != 0 {
+		t.Errorf("Expected no wait for the initial burst, got: %v", wait)
+	}
+	if wait := tb.Wait(50); wait != 500*time.Millisecond {
+		t.Errorf("Expected 500ms wait, got: %v", wait)
+	}
+	if wait := tb.Wait(100); wait != time.Second {
+		t.Errorf("Expected 1s wait, got: %v", wait)
+	}
+}
+
+func TestReader_ThrottlesReads(t *testing.T) {
+	tb, _ := newTestTokenBucket(100)
+
+	var waited time.Duration
+	r := NewReader(strings.NewReader(strings.Repeat("x", 350)), tb, func(d time.Duration) {
+		waited += d
+	})
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if len(data) != 350 {
+		t.Fatalf("Expected 350 bytes, got: %d", len(data))
+	}
+	// The first 100 bytes fit in the initial burst, the remaining 250 take 2.5s.
+	if waited != 2500*time.Millisecond {
+		t.Errorf("Expected 2.5s of throttling, got: %v", waited)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// prefixTemplateVar matches a {variable} in a prefix template.
+var prefixTemplateVar = regexp.MustCompile(`\{([a-z-]+)\}`)
+
+// unsafePrefixChars matches characters that are replaced in values substituted
+// into prefix templates, so that e.g. branch names can't produce odd keys.
+var unsafePrefixChars = regexp.MustCompile(`[^A-Za-z0-9._/-]+`)
+
+// ciBranchEnvVars are the environment variables CI providers use to expose the
+// branch being built, in order of preference. GITHUB_HEAD_REF is only set for
+// pull requests, where GITHUB_REF_NAME would be the merge ref.
+var ciBranchEnvVars = []string{
+	"GITHUB_HEAD_REF",
+	"GITHUB_REF_NAME",
+	"CI_COMMIT_REF_NAME",  // GitLab
+	"BUILDKITE_BRANCH",    // Buildkite
+	"CIRCLE_BRANCH",       // CircleCI
+	"BITBUCKET_BRANCH",    // Bitbucket Pipelines
+	"GIT_BRANCH",          // Jenkins
+	"GOBUILDCACHE_BRANCH", // Explicit override for other environments
+}
+
+// ciRepoEnvVars are the environment variables CI providers use to expose the
+// repository being built, in order of preference.
+var ciRepoEnvVars = []string{
+	"GITHUB_REPOSITORY",
+	"CI_PROJECT_PATH",          // GitLab
+	"BUILDKITE_PIPELINE_SLUG",  // Buildkite
+	"CIRCLE_PROJECT_REPONAME",  // CircleCI
+	"BITBUCKET_REPO_FULL_NAME", // Bitbucket Pipelines
+	"GOBUILDCACHE_REPO",        // Explicit override for other environments
+}
+
+// prefixTemplateContext provides the values substituted into prefix templates.
+// Its functions can be replaced in tests.
+type prefixTemplateContext struct {
+	getenv func(string) string
+	goEnv  func(vars ...string) (map[string]string, error)
+	now    func() time.Time
+}
+
+// defaultPrefixTemplateContext resolves template variables from the real
+// environment and Go toolchain.
+var defaultPrefixTemplateContext = prefixTemplateContext{
+	getenv: os.Getenv,
+	goEnv:  runGoEnv,
+	now:    time.Now,
+}
+
+// expandPrefixTemplate expands the variables in a templated S3/GCS prefix:
+//
+//	{goversion}  Go toolchain version (from `go env GOVERSION`)
+//	{goos}       Target operating system (from `go env GOOS`)
+//	{goarch}     Target architecture (from `go env GOARCH`)
+//	{module}     Main module path (from go.mod)
+//	{branch}     Branch being built (from CI environment variables)
+//	{repo}       Repository being built (from CI environment variables)
+//	{yyyy-mm}    Current year and month in UTC
+//
+// Prefixes without any variables are returned unchanged.
+func expandPrefixTemplate(prefix string) (string, error) {
+	return defaultPrefixTemplateContext.expand(prefix)
+}
+
+func (c prefixTemplateContext) expand(prefix string) (string, error) {
+	if !strings.Contains(prefix, "{") {
+		return prefix, nil
+	}
+
+	var (
+		goEnv    map[string]string
+		goEnvErr error
+		loaded   bool
+	)
+	lookupGoEnv := func(name string) (string, error) {
+		if !loaded {
+			goEnv, goEnvErr = c.goEnv("GOVERSION", "GOOS", "GOARCH", "GOMOD")
+			loaded = true
+		}
+		if goEnvErr != nil {
+			return "", goEnvErr
+		}
+		if goEnv[name] == "" {
+			return "", fmt.Errorf("go env %s is empty", name)
+		}
+		return goEnv[name], nil
+	}
+
+	var errs []string
+	expanded := prefixTemplateVar.ReplaceAllStringFunc(prefix, func(match string) string {
+		name := match[1 : len(match)-1]
+
+		var (
+			value string
+			err   error
+		)
+		switch name {
+		case "goversion":
+			value, err = lookupGoEnv("GOVERSION")
+		case "goos":
+			value, err = lookupGoEnv("GOOS")
+		case "goarch":
+			value, err = lookupGoEnv("GOARCH")
+		case "module":
+			var goMod string
+			goMod, err = lookupGoEnv("GOMOD")
+			if err == nil {
+				value, err = readModulePath(goMod)
+			}
+		case "branch":
+			value, err = c.firstEnv(ciBranchEnvVars)
+			// Jenkins reports remote branches as e.g. origin/main.
+			value = strings.TrimPrefix(value, "origin/")
+		case "repo":
+			value, err = c.firstEnv(ciRepoEnvVars)
+		case "yyyy-mm":
+			value = c.now().UTC().Format("2006-01")
+		default:
+			err = fmt.Errorf("unknown variable")
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", match, err))
+			return match
+		}
+		return unsafePrefixChars.ReplaceAllString(value, "-")
+	})
+	if len(errs) > 0 {
+		return "", fmt.Errorf("failed to expand prefix template %q: %s", prefix, strings.Join(errs, "; "))
+	}
+	return expanded, nil
+}
+
+// firstEnv returns the value of the first environment variable in names that is set.
+func (c prefixTemplateContext) firstEnv(names []string) (string, error) {
+	for _, name := range names {
+		if value := c.getenv(name); value != "" {
+			return value, nil
+		}
+	}
+	return "", fmt.Errorf("none of %s are set", strings.Join(names, ", "))
+}
+
+// runGoEnv returns the values of the given `go env` variables.
+func runGoEnv(vars ...string) (map[string]string, error) {
+	out, err := exec.Command("go", append([]string{"env"}, vars...)...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to run go env: %w", err)
+	}
+
+	lines := strings.Split(strings.TrimRight(string(out), "\n"), "\n")
+	if len(lines) != len(vars) {
+		return nil, fmt.Errorf("unexpected go env output: %q", out)
+	}
+	values := make(map[string]string, len(vars))
+	for i, name := range vars {
+		values[name] = strings.TrimSpace(lines[i])
+	}
+	return values, nil
+}
+
+// readModulePath returns the module path declared in a go.mod file.
+func readModulePath(goModPath string) (string, error) {
+	if goModPath == os.DevNull {
+		return "", fmt.Errorf("not in a module")
+	}
+
+	f, err := os.Open(goModPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open go.mod: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if rest, ok := strings.CutPrefix(line, "module"); ok && (rest == "" || rest[0] == ' ' || rest[0] == '\t') {
+			return strings.Trim(strings.TrimSpace(rest), `"`), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("failed to read go.mod: %w", err)
+	}
+	return "", fmt.Errorf("no module directive in %s", goModPath)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpandPrefixTemplate(t *testing.T) {
+	goModPath := filepath.Join(t.TempDir(), "go.mod")
+	if err := os.WriteFile(goModPath, []byte("// comment\nmodule github.com/example/repo\n\ngo 1.25\n"), 0644); err != nil {
+		t.Fatalf("Failed to write go.mod: %v", err)
+	}
+
+	env := map[string]string{
+		"GITHUB_REF_NAME":   "feature/new thing",
+		"GITHUB_REPOSITORY": "example/repo",
+	}
+	ctx := prefixTemplateContext{
+		getenv: func(key string) string { return env[key] },
+		goEnv: func(vars ...string) (map[string]string, error) {
+			return map[string]string{
+				"GOVERSION": "go1.25.1",
+				"GOOS":      "linux",
+				"GOARCH":    "amd64",
+				"GOMOD":     goModPath,
+			}, nil
+		},
+		now: func() time.Time { return time.Date(2026, 3, 15, 0, 0, 0, 0, time.UTC) },
+	}
+
+	tests := []struct {
+		prefix   string
+		expected string
+	}{
+		{"", ""},
+		{"gobuildcache/", "gobuildcache/"},
+		{"cache/{goversion}/{goos}-{goarch}/", "cache/go1.25.1/linux-amd64/"},
+		{"{module}/", "github.com/example/repo/"},
+		{"{repo}/{branch}/", "example/repo/feature/new-thing/"},
+		{"{yyyy-mm}/", "2026-03/"},
+	}
+	for _, tt := range tests {
+		got, err := ctx.expand(tt.prefix)
+		if err != nil {
+			t.Errorf("expand(%q) returned error: %v", tt.prefix, err)
+			continue
+		}
+		if got != tt.expected {
+			t.Errorf("expand(%q) = %q, expected %q", tt.prefix, got, tt.expected)
+		}
+	}
+}
+
+func TestExpandPrefixTemplate_Errors(t *testing.T) {
+	ctx := prefixTemplateContext{
+		getenv: func(string) string { return "" },
+		goEnv: func(vars ...string) (map[string]string, error) {
+			return nil, errors.New("go not found")
+		},
+		now: time.Now,
+	}
+
+	tests := []struct {
+		prefix   string
+		contains string
+	}{
+		{"{unknown}/", "unknown variable"},
+		{"{branch}/", "GITHUB_HEAD_REF"},
+		{"{goversion}/", "go not found"},
+	}
+	for _, tt := range tests {
+		_, err := ctx.expand(tt.prefix)
+		if err == nil {
+			t.Errorf("expand(%q) expected error", tt.prefix)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.contains) {
+			t.Errorf("expand(%q) error %q does not contain %q", tt.prefix, err, tt.contains)
+		}
+	}
+}
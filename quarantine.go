@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/richardartoul/gobuildcache/pkg/backends"
+)
+
+// defaultQuarantineNamespace is the namespace untrusted runs write into.
+const defaultQuarantineNamespace = "quarantine/"
+
+// trustLevel determines where a run's PUTs are written.
+type trustLevel string
+
+const (
+	// trustTrusted writes PUTs into the write namespace, where everyone reads them.
+	trustTrusted trustLevel = "trusted"
+	// trustUntrusted writes PUTs into the quarantine namespace, where only other
+	// untrusted runs read them until they're promoted.
+	trustUntrusted trustLevel = "untrusted"
+	// trustAuto is untrusted if signing is configured without a signing key, and
+	// trusted otherwise.
+	trustAuto trustLevel = "auto"
+)
+
+// parseTrustLevel parses a trust level.
+func parseTrustLevel(s string) (trustLevel, error) {
+	switch level := trustLevel(s); level {
+	case trustTrusted, trustUntrusted, trustAuto:
+		return level, nil
+	case "":
+		return trustTrusted, nil
+	default:
+		return "", fmt.Errorf("unknown trust level: %s (supported: trusted, untrusted, auto)", s)
+	}
+}
+
+// isUntrusted resolves a trust level for the given backend.
+func (level trustLevel) isUntrusted(backend backends.Backend) bool {
+	switch level {
+	case trustUntrusted:
+		return true
+	case trustAuto:
+		signed, ok := backends.Find[*backends.Signed](backend)
+		return ok && signed.Stats().SignerID == ""
+	default:
+		return false
+	}
+}
+
+// quarantineNamespaceFor returns the namespace that the untrusted run runID
+// with the given write namespace writes into. Every run has its own
+// sub-namespace, so promoting a run only ever copies entries that run wrote.
+func quarantineNamespaceFor(quarantine, runID, namespace string) string {
+	return normalizeNamespace(quarantine) + normalizeNamespace(runID) + normalizeNamespace(namespace)
+}
+
+// validateRunID checks that runID can be used as a quarantine sub-namespace.
+func validateRunID(runID string) error {
+	if runID == "" {
+		return errors.New("untrusted runs and promote require a quarantine run ID (-quarantine-run-id)")
+	}
+	if runID == "." || runID == ".." {
+		return fmt.Errorf("invalid quarantine run ID: %q", runID)
+	}
+	for _, r := range runID {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return fmt.Errorf("invalid quarantine run ID: %q (only letters, digits, '-', '_' and '.' are allowed)", runID)
+		}
+	}
+	return nil
+}
+
+// normalizeNamespace trims a namespace and makes sure it ends with a "/".
+func normalizeNamespace(namespace string) string {
+	namespace = strings.TrimSpace(namespace)
+	if namespace != "" && !strings.HasSuffix(namespace, "/") {
+		namespace += "/"
+	}
+	return namespace
+}
+
+// enableQuarantine routes PUTs into the run's quarantine namespace (mirroring
+// the write namespace within it), and makes GETs consult it before the
+// configured read namespaces, so an untrusted run can reuse its own entries
+// without them ever being read by trusted runs or other untrusted runs.
+// Entries in the run's quarantine namespace are allowed to be unsigned.
+func (cp *CacheProg) enableQuarantine(quarantine, runID string) {
+	namespace := quarantineNamespaceFor(quarantine, runID, cp.writeNamespace)
+	cp.writeNamespace = namespace
+	cp.readNamespaces = append([]string{namespace}, cp.readNamespaces...)
+	cp.namespaceHits = make([]atomic.Int64, len(cp.readNamespaces))
+
+	if signed, ok := backends.Find[*backends.Signed](cp.backend); ok {
+		signed.AllowUnsigned(namespace)
+	}
+}
+
+// uploadManifest records the action IDs of uploaded entries, one hex action ID
+// per line, so that they can later be promoted out of quarantine.
+type uploadManifest struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func newUploadManifest(path string) (*uploadManifest, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open upload manifest: %w", err)
+	}
+	return &uploadManifest{f: f}, nil
+}
+
+func (m *uploadManifest) add(actionID []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err := fmt.Fprintln(m.f, hex.EncodeToString(actionID))
+	return err
+}
+
+func (m *uploadManifest) close() error {
+	return m.f.Close()
+}
+
+// manifestRecorder wraps the backend and reports the keys of completed uploads so
+// that the server can record them in its upload manifest. It sits below the async
+// writer, whose Put returns as soon as the upload is queued, so that entries are
+// only recorded once they have actually been uploaded.
+//
+// It passes everything through until the server attaches itself with
+// attachUploadManifest.
+type manifestRecorder struct {
+	backends.Backend
+
+	onPut func(key []byte) // called with the key of every successful Put
+}
+
+// Put stores the object and reports its key on success.
+func (r *manifestRecorder) Put(key, outputID []byte, body io.Reader, bodySize int64) error {
+	err := r.Backend.Put(key, outputID, body, bodySize)
+	if err == nil && r.onPut != nil {
+		r.onPut(key)
+	}
+	return err
+}
+
+// Unwrap returns the wrapped backend.
+func (r *manifestRecorder) Unwrap() backends.Backend {
+	return r.Backend
+}
+
+// attachUploadManifest makes the manifest recorder in the backend stack, if
+// there is one, record completed uploads in place of handlePut.
+func (cp *CacheProg) attachUploadManifest() {
+	recorder, ok := backends.Find[*manifestRecorder](cp.backend)
+	if !ok {
+		return
+	}
+	recorder.onPut = cp.recordUpload
+	cp.manifestRecorder = recorder
+}
+
+// recordUpload adds the action ID of an uploaded entry to the upload manifest.
+// Only entries written to this run's namespace are recorded, not the ones it
+// uploaded on behalf of other runs from their orphaned spools.
+func (cp *CacheProg) recordUpload(key []byte) {
+	if cp.uploadManifest == nil {
+		return
+	}
+	hexActionID, ok := strings.CutPrefix(string(key), cp.writeNamespace+fileFormatVersion)
+	if !ok {
+		return
+	}
+	actionID, err := hex.DecodeString(hexActionID)
+	if err != nil {
+		return
+	}
+	if err := cp.uploadManifest.add(actionID); err != nil {
+		cp.logger.Warn("failed to record upload in manifest",
+			"actionID", hexActionID,
+			"error", err)
+	}
+}
+
+// readActionIDs reads hex action IDs, one per line, skipping blank lines,
+// comments and duplicates.
+func readActionIDs(r io.Reader) ([][]byte, error) {
+	var (
+		ids     [][]byte
+		seen    = make(map[string]bool)
+		scanner = bufio.NewScanner(r)
+	)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || seen[line] {
+			continue
+		}
+		id, err := hex.DecodeString(line)
+		if err != nil || len(id) == 0 {
+			return nil, fmt.Errorf("invalid action ID: %q", line)
+		}
+		seen[line] = true
+		ids = append(ids, id)
+	}
+	return ids, scanner.Err()
+}
+
+// promoteOptions configures a promotion out of quarantine.
+type promoteOptions struct {
+	From       string // Namespace entries are copied from, the quarantine namespace of a single run
+	To         string // Namespace entries are copied to
+	Compressed bool   // Whether entries are LZ4 compressed
+	// VerifyOutputID only promotes entries whose body hashes to their output
+	// ID. This catches corruption, but as the run chose the output ID, it
+	// doesn't prove anything about where the body came from.
+	VerifyOutputID bool
+	DryRun         bool
+	Parallelism    int
+}
+
+// promoteResult summarizes a promotion.
+type promoteResult struct {
+	Promoted int   // Entries copied (or that would be copied in a dry run)
+	Missing  int   // Entries not found in the source namespace
+	Rejected int   // Entries that failed output ID verification
+	Failed   int   // Entries that couldn't be read or written
+	Bytes    int64 // Bytes copied
+}
+
+// errPromoteRejected is returned for entries that fail verification.
+var errPromoteRejected = errors.New("entry rejected")
+
+// promoteEntries copies entries between namespaces through the backend, so the
+// copies are signed and encrypted with the promoting run's keys.
+func promoteEntries(backend backends.Backend, actionIDs [][]byte, opts promoteOptions, logger *slog.Logger) promoteResult {
+	if opts.Parallelism <= 0 {
+		opts.Parallelism = 1
+	}
+
+	var (
+		result promoteResult
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		sem    = make(chan struct{}, opts.Parallelism)
+	)
+	for _, actionID := range actionIDs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(actionID []byte) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			n, err := promoteEntry(backend, actionID, opts)
+
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case errors.Is(err, errRemoteMissing):
+				result.Missing++
+			case errors.Is(err, errPromoteRejected):
+				result.Rejected++
+				logger.Error("refusing to promote entry",
+					"actionID", hex.EncodeToString(actionID),
+					"error", err)
+			case err != nil:
+				result.Failed++
+				logger.Warn("failed to promote entry",
+					"actionID", hex.EncodeToString(actionID),
+					"error", err)
+			default:
+				result.Promoted++
+				result.Bytes += n
+			}
+		}(actionID)
+	}
+	wg.Wait()
+	return result
+}
+
+func promoteEntry(backend backends.Backend, actionID []byte, opts promoteOptions) (int64, error) {
+	suffix := fileFormatVersion + hex.EncodeToString(actionID)
+	outputID, body, _, _, miss, err := backend.Get([]byte(opts.From + suffix))
+	if err != nil {
+		return 0, err
+	}
+	if miss {
+		return 0, errRemoteMissing
+	}
+	data, err := io.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read entry: %w", err)
+	}
+
+	if opts.VerifyOutputID {
+		content := data
+		if opts.Compressed && len(data) > 0 {
+			content, err = decompressData(data)
+			if err != nil {
+				return 0, fmt.Errorf("%w: failed to decompress: %v", errPromoteRejected, err)
+			}
+		}
+		checksum := sha256.Sum256(content)
+		if err := verifyOutputID(outputID, checksum[:]); err != nil {
+			return 0, fmt.Errorf("%w: %v", errPromoteRejected, err)
+		}
+	}
+
+	if opts.DryRun {
+		return int64(len(data)), nil
+	}
+	if err := backend.Put([]byte(opts.To+suffix), outputID, bytes.NewReader(data), int64(len(data))); err != nil {
+		return 0, err
+	}
+	return int64(len(data)), nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/richardartoul/gobuildcache/pkg/backends"
+	"github.com/richardartoul/gobuildcache/pkg/locking"
+)
+
+// newSignedTestBackends returns a trusted (signing) and an untrusted (verifying
+// only) backend sharing the same storage.
+func newSignedTestBackends(t *testing.T, storage backends.Backend) (trusted, untrusted *backends.Signed) {
+	t.Helper()
+	signer := backends.SigningKey{
+		ID:         "ci",
+		Algorithm:  backends.SigningEd25519,
+		PrivateKey: ed25519.NewKeyFromSeed(bytes.Repeat([]byte{1}, ed25519.SeedSize)),
+	}
+	public := backends.SigningKey{
+		ID:        "ci",
+		Algorithm: backends.SigningEd25519,
+		PublicKey: signer.PrivateKey.Public().(ed25519.PublicKey),
+	}
+	trustedKeyring, err := backends.NewSigningKeyring(&signer, nil)
+	if err != nil {
+		t.Fatalf("Failed to create keyring: %v", err)
+	}
+	untrustedKeyring, err := backends.NewSigningKeyring(nil, []backends.SigningKey{public})
+	if err != nil {
+		t.Fatalf("Failed to create keyring: %v", err)
+	}
+	return backends.NewSigned(storage, trustedKeyring, testSpoolLogger()),
+		backends.NewSigned(storage, untrustedKeyring, testSpoolLogger())
+}
+
+func putTestEntry(t *testing.T, cp *CacheProg, actionID byte, body string) {
+	t.Helper()
+	outputID := sha256.Sum256([]byte(body))
+	_, err := cp.handlePut(&Request{
+		ID:       int64(actionID),
+		Command:  CmdPut,
+		ActionID: []byte{actionID},
+		OutputID: outputID[:],
+		BodySize: int64(len(body)),
+		Body:     strings.NewReader(body),
+	})
+	if err != nil {
+		t.Fatalf("handlePut returned error: %v", err)
+	}
+}
+
+func getTestEntry(t *testing.T, cp *CacheProg, actionID byte) bool {
+	t.Helper()
+	resp, err := cp.handleGet(&Request{ID: 100, Command: CmdGet, ActionID: []byte{actionID}})
+	if err != nil {
+		t.Fatalf("handleGet returned error: %v", err)
+	}
+	return !resp.Miss
+}
+
+func TestQuarantine_UntrustedRunsArePromotedAfterChecks(t *testing.T) {
+	storage := newRecordingBackend()
+	trustedBackend, untrustedBackend := newSignedTestBackends(t, storage)
+
+	fork, err := NewCacheProg(untrustedBackend, locking.NewNoOpGroup(), t.TempDir(), false, false, true, false)
+	if err != nil {
+		t.Fatalf("Failed to create CacheProg: %v", err)
+	}
+	fork.setNamespaces("main", nil)
+	if !trustAuto.isUntrusted(fork.backend) {
+		t.Fatalf("Expected a run without a signing key to be untrusted in auto mode")
+	}
+	fork.enableQuarantine(defaultQuarantineNamespace, "run-1")
+	manifestPath := filepath.Join(t.TempDir(), "uploads.txt")
+	fork.uploadManifest, err = newUploadManifest(manifestPath)
+	if err != nil {
+		t.Fatalf("Failed to create manifest: %v", err)
+	}
+
+	putTestEntry(t, fork, 1, "fork output")
+	fork.uploadManifest.close()
+	if _, ok := storage.get([]byte("quarantine/run-1/main/" + fileFormatVersion + "01")); !ok {
+		t.Fatalf("Expected untrusted PUT to be written to the quarantine namespace")
+	}
+
+	// The untrusted run reads its own (unsigned) entries back from quarantine...
+	forkAgain, _ := NewCacheProg(untrustedBackend, locking.NewNoOpGroup(), t.TempDir(), false, false, true, false)
+	forkAgain.setNamespaces("main", nil)
+	forkAgain.enableQuarantine(defaultQuarantineNamespace, "run-1")
+	if !getTestEntry(t, forkAgain, 1) {
+		t.Errorf("Expected untrusted run to hit its own quarantined entry")
+	}
+
+	// ...while other untrusted runs neither read them nor get their own
+	// entries promoted along with them.
+	otherFork, _ := NewCacheProg(untrustedBackend, locking.NewNoOpGroup(), t.TempDir(), false, false, true, false)
+	otherFork.setNamespaces("main", nil)
+	otherFork.enableQuarantine(defaultQuarantineNamespace, "run-2")
+	if getTestEntry(t, otherFork, 1) {
+		t.Errorf("Expected untrusted run to miss another run's quarantined entry")
+	}
+	putTestEntry(t, otherFork, 3, "planted output")
+
+	// ...but trusted runs don't see them until they're promoted.
+	trusted, _ := NewCacheProg(trustedBackend, locking.NewNoOpGroup(), t.TempDir(), false, false, true, false)
+	trusted.setNamespaces("main", nil)
+	if getTestEntry(t, trusted, 1) {
+		t.Fatalf("Expected trusted run to miss quarantined entry")
+	}
+
+	f, err := os.Open(manifestPath)
+	if err != nil {
+		t.Fatalf("Failed to open manifest: %v", err)
+	}
+	defer f.Close()
+	actionIDs, err := readActionIDs(f)
+	if err != nil || len(actionIDs) != 1 {
+		t.Fatalf("Expected 1 action ID in the manifest, got %d (err: %v)", len(actionIDs), err)
+	}
+
+	from := quarantineNamespaceFor(defaultQuarantineNamespace, "run-1", "main")
+	trustedBackend.AllowUnsigned(from)
+	result := promoteEntries(trustedBackend, append(actionIDs, []byte{2}, []byte{3}), promoteOptions{
+		From:           from,
+		To:             "main/",
+		Compressed:     true,
+		VerifyOutputID: true,
+	}, testSpoolLogger())
+	if result.Promoted != 1 || result.Missing != 2 {
+		t.Fatalf("Unexpected promote result: %+v", result)
+	}
+
+	trustedAgain, _ := NewCacheProg(trustedBackend, locking.NewNoOpGroup(), t.TempDir(), false, false, true, false)
+	trustedAgain.setNamespaces("main", nil)
+	if !getTestEntry(t, trustedAgain, 1) {
+		t.Errorf("Expected trusted run to hit promoted entry")
+	}
+}
+
+func TestPromote_RejectsMismatchedOutputIDs(t *testing.T) {
+	storage := newRecordingBackend()
+	body, err := compressData([]byte("evil"))
+	if err != nil {
+		t.Fatalf("Failed to compress body: %v", err)
+	}
+	claimed := sha256.Sum256([]byte("good"))
+	storage.Put([]byte("quarantine/"+fileFormatVersion+"01"), claimed[:], bytes.NewReader(body), int64(len(body)))
+
+	result := promoteEntries(storage, [][]byte{{1}}, promoteOptions{
+		From:           "quarantine/",
+		Compressed:     true,
+		VerifyOutputID: true,
+	}, testSpoolLogger())
+	if result.Rejected != 1 || result.Promoted != 0 {
+		t.Fatalf("Unexpected promote result: %+v", result)
+	}
+	if _, ok := storage.get([]byte(fileFormatVersion + "01")); ok {
+		t.Errorf("Expected rejected entry not to be promoted")
+	}
+}
+
+func TestValidateRunID(t *testing.T) {
+	for _, runID := range []string{"1234", "pr-42.attempt_2"} {
+		if err := validateRunID(runID); err != nil {
+			t.Errorf("validateRunID(%q) returned error: %v", runID, err)
+		}
+	}
+	for _, runID := range []string{"", "..", "a/b", "run 1"} {
+		if err := validateRunID(runID); err == nil {
+			t.Errorf("Expected validateRunID(%q) to return an error", runID)
+		}
+	}
+}
+
+func TestManifestRecorder_RecordsUploadsOnceCompleted(t *testing.T) {
+	storage := newRecordingBackend()
+	manifestPath := filepath.Join(t.TempDir(), "uploads.txt")
+	manifest, err := newUploadManifest(manifestPath)
+	if err != nil {
+		t.Fatalf("Failed to create manifest: %v", err)
+	}
+	defer manifest.close()
+
+	run := func(actionID byte) {
+		backend := backends.NewAsyncBackendWriter(&manifestRecorder{Backend: storage}, backends.AsyncBackendWriterConfig{}, testSpoolLogger())
+		cp, err := NewCacheProg(backend, locking.NewNoOpGroup(), t.TempDir(), false, false, false, false)
+		if err != nil {
+			t.Fatalf("Failed to create CacheProg: %v", err)
+		}
+		cp.setNamespaces("main", nil)
+		cp.uploadManifest = manifest
+		cp.attachUploadManifest()
+
+		putTestEntry(t, cp, actionID, "output")
+		// Uploads of other runs' entries, e.g. from their orphaned spools, aren't recorded.
+		if err := backend.Put([]byte("other/"+fileFormatVersion+"09"), []byte("out"), strings.NewReader("data"), 4); err != nil {
+			t.Fatalf("PUT failed: %v", err)
+		}
+		backend.Close()
+	}
+
+	// The async writer accepts the PUT, but the upload fails.
+	storage.failing = true
+	run(1)
+	storage.failing = false
+	run(2)
+
+	f, err := os.Open(manifestPath)
+	if err != nil {
+		t.Fatalf("Failed to open manifest: %v", err)
+	}
+	defer f.Close()
+	actionIDs, err := readActionIDs(f)
+	if err != nil {
+		t.Fatalf("Failed to read manifest: %v", err)
+	}
+	if len(actionIDs) != 1 || !bytes.Equal(actionIDs[0], []byte{2}) {
+		t.Errorf("Expected only the completed upload in the manifest, got: %x", actionIDs)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/richardartoul/gobuildcache/pkg/backends"
+)
+
+const (
+	// remoteTouchWorkers is the number of touches performed concurrently.
+	remoteTouchWorkers = 8
+	// remoteTouchQueueSize is the number of touches that can be pending before
+	// new ones are dropped.
+	remoteTouchQueueSize = 1024
+)
+
+// remoteToucher refreshes the access time of backend entries when they are hit,
+// so that `gobuildcache gc-remote` and lifecycle rules can tell unused entries
+// apart from old but frequently used ones.
+//
+// Touches are best effort and happen in the background so they never delay a
+// GET. Each entry is touched at most once per process, entries written or
+// touched within the interval are skipped, and touches are dropped while the
+// queue is full.
+type remoteToucher struct {
+	toucher  backends.Toucher
+	interval time.Duration
+	logger   *slog.Logger
+
+	mu     sync.Mutex
+	queue  chan []byte
+	seen   map[string]bool
+	closed bool
+	wg     sync.WaitGroup
+
+	touched atomic.Int64
+	skipped atomic.Int64 // Entries written or touched within the interval
+	dropped atomic.Int64 // Touches dropped because the queue was full
+	failed  atomic.Int64
+}
+
+// newRemoteToucher starts a toucher for backend, or returns false if the backend
+// doesn't support touching.
+func newRemoteToucher(backend backends.Backend, interval time.Duration, logger *slog.Logger) (*remoteToucher, bool) {
+	toucher, ok := backends.Find[backends.Toucher](backend)
+	if !ok {
+		return nil, false
+	}
+	t := &remoteToucher{
+		toucher:  toucher,
+		interval: interval,
+		logger:   logger,
+		queue:    make(chan []byte, remoteTouchQueueSize),
+		seen:     make(map[string]bool),
+	}
+	for i := 0; i < remoteTouchWorkers; i++ {
+		t.wg.Add(1)
+		go t.worker()
+	}
+	return t, true
+}
+
+// touch queues a touch of the backend object stored under key, which was
+// written at putTime.
+func (t *remoteToucher) touch(key []byte, putTime time.Time) {
+	if time.Since(putTime) < t.interval {
+		t.skipped.Add(1)
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed || t.seen[string(key)] {
+		return
+	}
+	t.seen[string(key)] = true
+	select {
+	case t.queue <- key:
+	default:
+		t.dropped.Add(1)
+	}
+}
+
+func (t *remoteToucher) worker() {
+	defer t.wg.Done()
+	for key := range t.queue {
+		touched, err := t.toucher.Touch(key, t.interval)
+		switch {
+		case err != nil:
+			t.failed.Add(1)
+			if !errors.Is(err, errors.ErrUnsupported) {
+				t.logger.Debug("failed to touch backend object", "key", string(key), "error", err)
+			}
+		case touched:
+			t.touched.Add(1)
+		default:
+			t.skipped.Add(1)
+		}
+	}
+}
+
+// close waits for the pending touches to complete. Later touches are ignored.
+func (t *remoteToucher) close() {
+	t.mu.Lock()
+	if !t.closed {
+		t.closed = true
+		close(t.queue)
+	}
+	t.mu.Unlock()
+	t.wg.Wait()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/gobuildcache/pkg/locking"
+)
+
+// touchingBackend is a recordingBackend whose entries were written a day ago
+// and that records touches.
+type touchingBackend struct {
+	*recordingBackend
+	touchMu sync.Mutex
+	touches []string
+}
+
+func (b *touchingBackend) Get(actionID []byte) ([]byte, io.ReadCloser, int64, *time.Time, bool, error) {
+	outputID, body, size, _, miss, err := b.recordingBackend.Get(actionID)
+	dayAgo := time.Now().Add(-24 * time.Hour)
+	return outputID, body, size, &dayAgo, miss, err
+}
+
+func (b *touchingBackend) Touch(actionID []byte, interval time.Duration) (bool, error) {
+	b.touchMu.Lock()
+	defer b.touchMu.Unlock()
+	b.touches = append(b.touches, string(actionID))
+	return true, nil
+}
+
+func TestRemoteToucher_TouchesBackendHitsOnce(t *testing.T) {
+	backend := &touchingBackend{recordingBackend: newRecordingBackend()}
+	cp, err := NewCacheProg(backend, locking.NewNoOpGroup(), t.TempDir(), false, false, false, false)
+	if err != nil {
+		t.Fatalf("Failed to create CacheProg: %v", err)
+	}
+	cp.setNamespaces("main/", nil)
+	toucher, ok := newRemoteToucher(backend, time.Hour, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if !ok {
+		t.Fatal("backend should support touching")
+	}
+	cp.toucher = toucher
+
+	key := cp.generateBackendKey([]byte{1})
+	if err := backend.Put(key, []byte("output"), strings.NewReader("hello"), 5); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		// Evict the entry locally so that every GET is served by the backend.
+		if err := cp.localCache.remove([]byte{1}); err != nil {
+			t.Fatal(err)
+		}
+		if resp, err := cp.handleGet(&Request{Command: CmdGet, ActionID: []byte{1}}); err != nil || resp.Miss {
+			t.Fatalf("GET failed: %+v, %v", resp, err)
+		}
+	}
+	if err := cp.closeBackend(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(backend.touches) != 1 || backend.touches[0] != string(key) {
+		t.Errorf("touches = %q, want one touch of %q", backend.touches, key)
+	}
+	if toucher.touched.Load() != 1 {
+		t.Errorf("touched = %d, want 1", toucher.touched.Load())
+	}
+
+	// Touches after close are ignored.
+	toucher.touch(key, time.Time{})
+}
+
+func TestRemoteToucher_SkipsFreshEntries(t *testing.T) {
+	backend := &touchingBackend{recordingBackend: newRecordingBackend()}
+	toucher, _ := newRemoteToucher(backend, 48*time.Hour, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	toucher.touch([]byte("key"), time.Now().Add(-24*time.Hour))
+	toucher.close()
+	if len(backend.touches) != 0 || toucher.skipped.Load() != 1 {
+		t.Errorf("fresh entry was touched: %q", backend.touches)
+	}
+}
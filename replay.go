@@ -0,0 +1,336 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/richardartoul/gobuildcache/pkg/backends"
+	"github.com/richardartoul/gobuildcache/pkg/locking"
+	"github.com/richardartoul/gobuildcache/pkg/metrics"
+)
+
+// replayOptions configures the replay of a trace.
+type replayOptions struct {
+	Speed        float64 // Timing multiplier, 1 replays at the original timing, 0 as fast as possible
+	Concurrency  int     // Maximum requests in flight
+	Seed         bool    // Write the entries the original run hit before replaying
+	Compressible float64 // Fraction (0.0-1.0) of each generated body that is zeros
+	Compression  bool
+	WorkDir      string // Directory for the replay's temporary local caches
+	Namespace    string // Namespace all replayed objects are written into
+	Keep         bool   // Don't delete the replayed objects afterwards
+}
+
+// replayReport is the result of replaying a trace.
+type replayReport struct {
+	Backend       string
+	Events        int
+	Seeded        int // Entries written before the replay
+	Speed         float64
+	TraceDuration time.Duration // Time between the first and last event of the trace
+	Elapsed       time.Duration
+	DrainTime     time.Duration // Time spent waiting for queued uploads after the replay
+	LocalHits     int64
+	RemoteHits    int64
+	HitRate       float64 // Fraction of GETs that hit
+	TraceHitRate  float64 // Fraction of GETs that hit in the original run
+	Get           benchOpStats
+	Put           benchOpStats
+	TraceGet      metrics.Stats // Latency of GETs in the original run
+	TracePut      metrics.Stats // Latency of PUTs in the original run
+}
+
+// replaySeeds returns the entries that GETs of the trace hit without an earlier
+// PUT in the trace, i.e. the entries that were already cached when the original
+// run started, split by where they were served from. Sizes are keyed by hex
+// action ID.
+func replaySeeds(events []traceEvent) (local, remote map[string]int64) {
+	local = make(map[string]int64)
+	remote = make(map[string]int64)
+	seen := make(map[string]bool)
+	for _, e := range events {
+		if seen[e.ActionID] {
+			continue
+		}
+		if e.Command == CmdPut {
+			seen[e.ActionID] = true
+			continue
+		}
+		switch e.Source {
+		case traceSourceLocal:
+			local[e.ActionID] = e.Size
+			seen[e.ActionID] = true
+		case traceSourceRemote:
+			remote[e.ActionID] = e.Size
+			seen[e.ActionID] = true
+		}
+	}
+	return local, remote
+}
+
+// replayPutSeeds PUTs generated bodies for seeds through cp.
+func replayPutSeeds(cp *CacheProg, bodies *benchBodies, seeds map[string]int64, concurrency int) error {
+	var (
+		mu       sync.Mutex
+		firstErr error
+		wg       sync.WaitGroup
+		sem      = make(chan struct{}, concurrency)
+	)
+	for id, size := range seeds {
+		actionID, _ := hex.DecodeString(id)
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := benchPut(cp, bodies, actionID, size); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// runReplay replays the GETs and PUTs of a trace, sorted by time, through a full
+// cache server with an empty local cache and the backend stack returned by
+// newBackend. PUT bodies are generated with the recorded sizes. When seeding,
+// the entries the original run hit are written first (locally if it hit them
+// locally), so that hits and misses can be compared with the original run.
+func runReplay(events []traceEvent, newBackend func() (backends.Backend, error), locker locking.Group, opts replayOptions, progress io.Writer) (*replayReport, error) {
+	if len(events) == 0 {
+		return nil, fmt.Errorf("trace has no GET or PUT events")
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 1
+	}
+	workDir, err := os.MkdirTemp(opts.WorkDir, "gobuildcache-replay-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create replay directory: %w", err)
+	}
+	defer os.RemoveAll(workDir)
+
+	var maxSize int64
+	for _, e := range events {
+		maxSize = max(maxSize, e.Size)
+	}
+	bodies := newBenchBodies(maxSize, opts.Compressible)
+	benchOpts := benchOptions{Compression: opts.Compression, Namespace: opts.Namespace}
+
+	// Every action ID in the trace may end up in the backend, so clean all of
+	// them up afterwards.
+	var written [][]byte
+	seenIDs := make(map[string]bool)
+	for _, e := range events {
+		if !seenIDs[e.ActionID] {
+			seenIDs[e.ActionID] = true
+			actionID, _ := hex.DecodeString(e.ActionID)
+			written = append(written, actionID)
+		}
+	}
+
+	var localSeeds, remoteSeeds map[string]int64
+	if opts.Seed {
+		localSeeds, remoteSeeds = replaySeeds(events)
+	}
+	if len(remoteSeeds) > 0 {
+		fmt.Fprintf(progress, "Seeding %d remote entries...\n", len(remoteSeeds))
+		seedBackend, err := newBackend()
+		if err != nil {
+			return nil, err
+		}
+		seedProg, err := newBenchProg(seedBackend, locker, workDir+"/seed", benchOpts)
+		if err != nil {
+			seedBackend.Close()
+			return nil, err
+		}
+		err = replayPutSeeds(seedProg, bodies, remoteSeeds, opts.Concurrency)
+		if closeErr := seedBackend.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to seed entries: %w", err)
+		}
+	}
+
+	backend, err := newBackend()
+	if err != nil {
+		return nil, err
+	}
+	cp, err := newBenchProg(backend, locker, workDir+"/run", benchOpts)
+	if err != nil {
+		backend.Close()
+		return nil, err
+	}
+	if len(localSeeds) > 0 {
+		fmt.Fprintf(progress, "Seeding %d local entries...\n", len(localSeeds))
+		if err := replayPutSeeds(cp, bodies, localSeeds, opts.Concurrency); err != nil {
+			backend.Close()
+			return nil, fmt.Errorf("failed to seed entries: %w", err)
+		}
+	}
+
+	traceDuration := events[len(events)-1].Time.Sub(events[0].Time)
+	if opts.Speed > 0 {
+		fmt.Fprintf(progress, "Replaying %d events from %s of traffic at %gx speed...\n", len(events), traceDuration.Round(time.Millisecond), opts.Speed)
+	} else {
+		fmt.Fprintf(progress, "Replaying %d events as fast as possible...\n", len(events))
+	}
+
+	var (
+		tracker    = metrics.NewLatencyTracker(0.01) // 1% relative accuracy
+		gets       benchOp
+		puts       benchOp
+		localHits  atomic.Int64
+		remoteHits atomic.Int64
+		wg         sync.WaitGroup
+		sem        = make(chan struct{}, opts.Concurrency)
+		start      = time.Now()
+	)
+	for _, e := range events {
+		if opts.Speed > 0 {
+			offset := time.Duration(float64(e.Time.Sub(events[0].Time)) / opts.Speed)
+			if wait := time.Until(start.Add(offset)); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(e traceEvent) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			actionID, _ := hex.DecodeString(e.ActionID)
+
+			if e.Command == CmdPut {
+				opStart := time.Now()
+				err := benchPut(cp, bodies, actionID, e.Size)
+				tracker.Record("PUT", time.Since(opStart))
+				puts.count.Add(1)
+				if err != nil {
+					puts.recordError(err)
+					return
+				}
+				puts.bytes.Add(e.Size)
+				return
+			}
+
+			opStart := time.Now()
+			resp, err := cp.handleGet(&Request{Command: CmdGet, ActionID: actionID})
+			tracker.Record("GET", time.Since(opStart))
+			gets.count.Add(1)
+			switch {
+			case err != nil:
+				gets.recordError(err)
+			case resp.Miss:
+				gets.misses.Add(1)
+			default:
+				gets.bytes.Add(resp.Size)
+				if resp.source == traceSourceLocal {
+					localHits.Add(1)
+				} else {
+					remoteHits.Add(1)
+				}
+			}
+		}(e)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	drainStart := time.Now()
+	closeErr := backend.Close()
+	report := &replayReport{
+		Backend:       backendType,
+		Events:        len(events),
+		Seeded:        len(localSeeds) + len(remoteSeeds),
+		Speed:         opts.Speed,
+		TraceDuration: traceDuration,
+		Elapsed:       elapsed,
+		DrainTime:     time.Since(drainStart),
+		LocalHits:     localHits.Load(),
+		RemoteHits:    remoteHits.Load(),
+		Get:           gets.stats("GET", tracker, elapsed),
+		Put:           puts.stats("PUT", tracker, elapsed),
+	}
+	if report.Get.Count > 0 {
+		report.HitRate = float64(report.LocalHits+report.RemoteHits) / float64(report.Get.Count)
+	}
+	report.TraceHitRate, report.TraceGet, report.TracePut = traceStats(events)
+	if closeErr != nil {
+		fmt.Fprintf(progress, "Warning: failed to close backend: %v\n", closeErr)
+	}
+
+	if !opts.Keep {
+		benchCleanup(newBackend, cp, written, progress)
+	}
+	return report, nil
+}
+
+// traceStats returns the hit rate and GET and PUT latencies of the original run.
+func traceStats(events []traceEvent) (hitRate float64, get, put metrics.Stats) {
+	var (
+		tracker = metrics.NewLatencyTracker(0.01) // 1% relative accuracy
+		gets    int
+		hits    int
+	)
+	for _, e := range events {
+		duration := time.Duration(e.DurationMs * float64(time.Millisecond))
+		if e.Command == CmdPut {
+			tracker.Record("PUT", duration)
+			continue
+		}
+		tracker.Record("GET", duration)
+		gets++
+		if e.Source == traceSourceLocal || e.Source == traceSourceRemote {
+			hits++
+		}
+	}
+	if gets > 0 {
+		hitRate = float64(hits) / float64(gets)
+	}
+	get, _ = tracker.GetStats("GET")
+	get.Operation = "GET"
+	put, _ = tracker.GetStats("PUT")
+	put.Operation = "PUT"
+	return hitRate, get, put
+}
+
+// printReplayReport prints a human-readable replay report.
+func printReplayReport(w io.Writer, r *replayReport) {
+	speed := "as fast as possible"
+	if r.Speed > 0 {
+		speed = fmt.Sprintf("%gx speed", r.Speed)
+	}
+	fmt.Fprintf(w, "\nBackend: %s, replayed %d events (%s of traffic) in %s at %s, %d entries seeded\n",
+		r.Backend, r.Events, r.TraceDuration.Round(time.Millisecond), r.Elapsed.Round(time.Millisecond), speed, r.Seeded)
+	fmt.Fprintf(w, "Upload drain: %s\n\n", r.DrainTime.Round(time.Millisecond))
+
+	var localRate, remoteRate float64
+	if r.Get.Count > 0 {
+		localRate = float64(r.LocalHits) / float64(r.Get.Count)
+		remoteRate = float64(r.RemoteHits) / float64(r.Get.Count)
+	}
+	fmt.Fprintf(w, "Hit rate: %.1f%% (local %.1f%%, remote %.1f%%), original run: %.1f%%\n\n",
+		r.HitRate*100, localRate*100, remoteRate*100, r.TraceHitRate*100)
+
+	printBenchOps(w, r.Get, r.Put)
+
+	fmt.Fprintf(w, "\nOriginal run latency (ms):\n")
+	for _, stats := range []metrics.Stats{r.TraceGet, r.TracePut} {
+		if stats.Count > 0 {
+			fmt.Fprintf(w, "%s\n", stats.String())
+		}
+	}
+}
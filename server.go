@@ -3,13 +3,17 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"log/slog"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -18,6 +22,7 @@ import (
 	"github.com/richardartoul/gobuildcache/pkg/backends"
 	"github.com/richardartoul/gobuildcache/pkg/locking"
 	"github.com/richardartoul/gobuildcache/pkg/metrics"
+	"github.com/richardartoul/gobuildcache/pkg/ratelimit"
 
 	"github.com/pierrec/lz4/v4"
 )
@@ -56,6 +61,10 @@ type Response struct {
 	Size          int64      `json:",omitempty"`
 	Time          *time.Time `json:",omitempty"`
 	DiskPath      string     `json:",omitempty"`
+
+	// Where a GET was served from, for traces. Not part of the protocol.
+	source    traceSource
+	namespace string
 }
 
 // CacheProg implements the GOCACHEPROG protocol.
@@ -90,6 +99,88 @@ type CacheProg struct {
 	// the same cache directory.
 	locker locking.Group
 
+	// backendGetBudget is the total amount of time this run is allowed to spend
+	// blocked on backend GETs. Once it's exhausted, the backend is no longer
+	// consulted for GETs and local cache misses are reported as misses
+	// immediately. This protects CI wall-clock time from a slow backend that
+	// can't be detected up front. Zero disables the budget.
+	backendGetBudget         time.Duration
+	backendGetTime           atomic.Int64 // Total nanoseconds spent in backend GETs
+	backendGetBudgetExceeded atomic.Bool
+
+	// downloadLimiter optionally limits the bandwidth used to download backend GET
+	// bodies. It's shared by all concurrent requests, so it bounds the combined
+	// download bandwidth of the run.
+	downloadLimiter       *ratelimit.TokenBucket
+	downloadThrottledTime atomic.Int64 // Total nanoseconds GET bodies spent throttled
+
+	// downloadMeter is the meter in the backend stack that applies the download
+	// limiter and records backend GET time, if there is one. Otherwise handleGet
+	// does both itself. See attachDownloadMeter.
+	downloadMeter *downloadMeter
+
+	// egressBudget is the total number of bytes this run is allowed to download
+	// from the backend. Once it's used up, local cache misses are reported as
+	// misses without consulting the backend. Zero disables the budget.
+	egressBudget         int64
+	egressBudgetExceeded atomic.Bool
+	egressSkippedGets    atomic.Int64 // GETs that skipped the backend because the egress budget was used up
+
+	// writeNamespace is prepended to backend keys for PUTs, and readNamespaces is
+	// the ordered list of namespaces GETs are looked up in until one of them hits.
+	// This lets branch builds write into their own namespace while still reading
+	// from e.g. main's namespace, without polluting it. Both default to the empty
+	// namespace. See setNamespaces.
+	writeNamespace string
+	readNamespaces []string
+	namespaceHits  []atomic.Int64 // Backend hits served by each read namespace
+
+	// localTrim optionally caps the size and/or age of the local cache. When set,
+	// the local cache is trimmed in the background every localTrimInterval.
+	localTrim         trimOptions
+	localTrimInterval time.Duration
+	trimmedEntries    atomic.Int64
+	trimmedBytes      atomic.Int64
+	trimmedStaleFiles atomic.Int64
+
+	// admission is an optional policy that decides which PUTs are uploaded to the
+	// backend. Rejected PUTs are still written to the local cache.
+	admission *admissionPolicy
+
+	// verifyOutputIDs checks that bodies hash to their claimed output ID before
+	// uploading them and after downloading them, so that corrupt or poisoned
+	// backend entries are never served to the go command.
+	verifyOutputIDs      bool
+	outputIDMismatchPuts atomic.Int64 // PUTs not uploaded because the body didn't match its output ID
+	outputIDMismatchGets atomic.Int64 // Backend hits treated as misses because the body didn't match its output ID
+
+	// uploadManifest optionally records the action IDs of uploaded entries, e.g.
+	// so that entries written into quarantine can be promoted later.
+	uploadManifest *uploadManifest
+	// manifestRecorder is the recorder in the backend stack that adds completed
+	// uploads to the upload manifest, if there is one. Otherwise handlePut adds
+	// them itself. See attachUploadManifest.
+	manifestRecorder *manifestRecorder
+
+	// trace optionally records every GET and PUT, so that the build's cache
+	// traffic can be replayed later with `gobuildcache replay`.
+	trace *traceWriter
+
+	// toucher optionally refreshes the access time of backend entries that are
+	// hit, for `gobuildcache gc-remote` and lifecycle rules.
+	toucher *remoteToucher
+
+	// spool is an optional durable journal of pending backend uploads. Uploads
+	// that haven't completed when the process exits are left in the spool and can
+	// be drained later with `gobuildcache flush` or by the next process.
+	spool        *uploadSpool
+	spoolDrained atomic.Int64 // Uploads adopted from spools left behind by previous processes
+
+	// closeTimeout bounds how long the close command waits for pending backend
+	// uploads before giving up and letting the process exit. Zero waits forever.
+	closeTimeout  time.Duration
+	closeTimedOut atomic.Bool
+
 	// Stats.
 	seenActionIDs struct {
 		sync.Mutex
@@ -104,6 +195,7 @@ type CacheProg struct {
 	localCacheHits        atomic.Int64
 	backendCacheHits      atomic.Int64
 	deduplicatedGets      atomic.Int64
+	budgetSkippedGets     atomic.Int64 // GETs that skipped the backend because the budget was exhausted
 	deduplicatedPuts      atomic.Int64
 	retriedRequests       atomic.Int64
 	totalRetries          atomic.Int64
@@ -154,9 +246,32 @@ func NewCacheProg(
 	}
 	cp.writer.w = bufio.NewWriter(os.Stdout)
 	cp.seenActionIDs.ids = make(map[string]int)
+	cp.setNamespaces("", nil)
 	return cp, nil
 }
 
+// setNamespaces configures the namespace backend keys are written to and the
+// ordered list of namespaces they're read from. If no read namespaces are
+// provided, reads only consult the write namespace. Namespaces are normalized
+// to end with a "/".
+func (cp *CacheProg) setNamespaces(write string, reads []string) {
+	cp.writeNamespace = normalizeNamespace(write)
+	cp.readNamespaces = nil
+	seen := make(map[string]bool)
+	for _, namespace := range reads {
+		namespace = normalizeNamespace(namespace)
+		if namespace == "" || seen[namespace] {
+			continue
+		}
+		seen[namespace] = true
+		cp.readNamespaces = append(cp.readNamespaces, namespace)
+	}
+	if len(cp.readNamespaces) == 0 {
+		cp.readNamespaces = []string{cp.writeNamespace}
+	}
+	cp.namespaceHits = make([]atomic.Int64, len(cp.readNamespaces))
+}
+
 // Run starts the cache program and processes requests concurrently.
 func (cp *CacheProg) Run() error {
 	// Send initial response with capabilities
@@ -164,6 +279,11 @@ func (cp *CacheProg) Run() error {
 		return fmt.Errorf("failed to send initial response: %w", err)
 	}
 
+	if cp.localTrim.MaxSize > 0 || cp.localTrim.MaxAge > 0 {
+		stopTrimmer := cp.startLocalCacheTrimmer()
+		defer stopTrimmer()
+	}
+
 	var wg sync.WaitGroup
 	errChan := make(chan error, 1)
 	done := make(chan struct{})
@@ -261,6 +381,8 @@ func (cp *CacheProg) Run() error {
 			duplicateGets         = cp.duplicateGets.Load()
 			duplicatePuts         = cp.duplicatePuts.Load()
 			deduplicatedGets      = cp.deduplicatedGets.Load()
+			budgetSkippedGets     = cp.budgetSkippedGets.Load()
+			backendGetTime        = time.Duration(cp.backendGetTime.Load())
 			deduplicatedPuts      = cp.deduplicatedPuts.Load()
 			retriedRequests       = cp.retriedRequests.Load()
 			totalRetries          = cp.totalRetries.Load()
@@ -294,11 +416,33 @@ func (cp *CacheProg) Run() error {
 			localCacheHits, localHitRate)
 		fmt.Fprintf(os.Stderr, "    Backend cache hits: %d (%.1f%% of GETs)\n",
 			backendCacheHits, backendHitRate)
+		if len(cp.readNamespaces) > 1 || cp.readNamespaces[0] != "" {
+			for i, namespace := range cp.readNamespaces {
+				fmt.Fprintf(os.Stderr, "      Hits from namespace %q: %d\n", namespace, cp.namespaceHits[i].Load())
+			}
+		}
 		fmt.Fprintf(os.Stderr, "    Duplicate GETs: %d (%.1f%% of GETs)\n",
 			duplicateGets, float64(duplicateGets)/float64(getCount)*100)
 		fmt.Fprintf(os.Stderr, "    Deduplicated GETs (singleflight): %d (%.1f%% of GETs)\n",
 			deduplicatedGets, float64(deduplicatedGets)/float64(getCount)*100)
 		fmt.Fprintf(os.Stderr, "    Backend bytes read: %s\n", formatBytes(backendBytesRead))
+		if cp.backendGetBudget > 0 {
+			fmt.Fprintf(os.Stderr, "    Backend GET time: %s (budget: %s)\n",
+				backendGetTime.Round(time.Millisecond), cp.backendGetBudget)
+			if cp.backendGetBudgetExceeded.Load() {
+				fmt.Fprintf(os.Stderr, "    Skipped backend GETs (budget exhausted): %d\n", budgetSkippedGets)
+			}
+		}
+		if cp.egressBudget > 0 {
+			fmt.Fprintf(os.Stderr, "    Egress budget: %s\n", formatBytes(cp.egressBudget))
+			if cp.egressBudgetExceeded.Load() {
+				fmt.Fprintf(os.Stderr, "    Skipped backend GETs (egress budget used up): %d\n", cp.egressSkippedGets.Load())
+			}
+		}
+		if cp.downloadLimiter != nil {
+			fmt.Fprintf(os.Stderr, "    Download time throttled: %s\n",
+				time.Duration(cp.downloadThrottledTime.Load()).Round(time.Millisecond))
+		}
 		fmt.Fprintf(os.Stderr, "  PUT operations: %d\n", putCount)
 		if skippedPuts > 0 {
 			fmt.Fprintf(os.Stderr, "    Skipped PUTs (read-only mode): %d\n", skippedPuts)
@@ -340,6 +484,125 @@ func (cp *CacheProg) Run() error {
 				totalRetries, avgRetries)
 		}
 
+		if abw, ok := backends.Find[*backends.AsyncBackendWriter](cp.backend); ok {
+			asyncStats := abw.Stats()
+			fmt.Fprintf(os.Stderr, "\nAsync upload statistics:\n")
+			fmt.Fprintf(os.Stderr, "  Uploads: %d accepted, %d succeeded, %d failed, %d still queued (%s in memory)\n",
+				asyncStats.StartedPuts, asyncStats.SuccessPuts, asyncStats.FailedPuts, asyncStats.QueuedPuts, formatBytes(asyncStats.QueuedBytes))
+			fmt.Fprintf(os.Stderr, "  Peak queue: %d uploads, %s in memory\n",
+				asyncStats.MaxQueueDepth, formatBytes(asyncStats.MaxQueueBytes))
+			if asyncStats.DeferredPuts > 0 {
+				fmt.Fprintf(os.Stderr, "  Uploads deferred behind GETs: %d\n", asyncStats.DeferredPuts)
+			}
+			if asyncStats.BlockedPuts > 0 {
+				fmt.Fprintf(os.Stderr, "  PUTs blocked on a full queue: %d (%s)\n",
+					asyncStats.BlockedPuts, asyncStats.BlockedTime.Round(time.Millisecond))
+			}
+			if asyncStats.DroppedPuts > 0 {
+				fmt.Fprintf(os.Stderr, "  Uploads dropped (queue full): %d\n", asyncStats.DroppedPuts)
+			}
+			if asyncStats.SpilledPuts > 0 {
+				fmt.Fprintf(os.Stderr, "  Uploads spilled to disk: %d\n", asyncStats.SpilledPuts)
+			}
+		}
+
+		if quarantined := cp.localCache.quarantinedEntries.Load(); quarantined > 0 {
+			fmt.Fprintf(os.Stderr, "\nCorrupt local cache entries quarantined: %d (see %s)\n",
+				quarantined, filepath.Join(cp.localCache.cacheDir, quarantineDir))
+		}
+
+		if mismatchPuts, mismatchGets := cp.outputIDMismatchPuts.Load(), cp.outputIDMismatchGets.Load(); mismatchPuts > 0 || mismatchGets > 0 {
+			fmt.Fprintf(os.Stderr, "\nOutput ID mismatches: %d PUTs not uploaded, %d backend hits treated as misses\n",
+				mismatchPuts, mismatchGets)
+		}
+
+		if cp.localTrim.MaxSize > 0 || cp.localTrim.MaxAge > 0 {
+			fmt.Fprintf(os.Stderr, "\nLocal cache trimming:\n")
+			fmt.Fprintf(os.Stderr, "  Evicted entries: %d (%s)\n",
+				cp.trimmedEntries.Load(), formatBytes(cp.trimmedBytes.Load()))
+			fmt.Fprintf(os.Stderr, "  Stale temp files removed: %d\n", cp.trimmedStaleFiles.Load())
+		}
+
+		if cp.admission != nil {
+			counts := cp.admission.rejectionCounts()
+			var rejected int64
+			for _, n := range counts {
+				rejected += n
+			}
+			fmt.Fprintf(os.Stderr, "\nUpload admission statistics:\n")
+			fmt.Fprintf(os.Stderr, "  Bytes admitted for upload: %s\n", formatBytes(cp.admission.uploadedBytes.Load()))
+			fmt.Fprintf(os.Stderr, "  Uploads rejected: %d\n", rejected)
+			for reason := admissionRejection(1); reason < numAdmissionRejections; reason++ {
+				if n := counts[reason]; n > 0 {
+					fmt.Fprintf(os.Stderr, "    %s: %d\n", reason, n)
+				}
+			}
+		}
+
+		if cp.toucher != nil {
+			fmt.Fprintf(os.Stderr, "\nRemote access times:\n")
+			fmt.Fprintf(os.Stderr, "  Entries touched: %d, skipped (used within %s): %d, dropped: %d, failed: %d\n",
+				cp.toucher.touched.Load(), cp.toucher.interval, cp.toucher.skipped.Load(),
+				cp.toucher.dropped.Load(), cp.toucher.failed.Load())
+		}
+
+		if cp.spool != nil {
+			fmt.Fprintf(os.Stderr, "\nUpload spool statistics:\n")
+			fmt.Fprintf(os.Stderr, "  Uploads adopted from previous runs: %d\n", cp.spoolDrained.Load())
+			if pending := cp.spool.pending(); pending > 0 {
+				fmt.Fprintf(os.Stderr, "  Uploads left pending: %d (run 'gobuildcache flush' to upload them)\n", pending)
+			}
+			if cp.closeTimedOut.Load() {
+				fmt.Fprintf(os.Stderr, "  Close timeout reached after %s\n", cp.closeTimeout)
+			}
+		}
+
+		if cb, ok := backends.Find[*backends.CircuitBreaker](cp.backend); ok {
+			cbStats := cb.Stats()
+			fmt.Fprintf(os.Stderr, "\nCircuit breaker statistics:\n")
+			fmt.Fprintf(os.Stderr, "  Final state: %s\n", cbStats.State)
+			fmt.Fprintf(os.Stderr, "  State changes: %d opened, %d half-open, %d closed\n",
+				cbStats.Opens, cbStats.HalfOpens, cbStats.Closes)
+			fmt.Fprintf(os.Stderr, "  Skipped backend operations: %d GETs, %d PUTs\n",
+				cbStats.RejectedGets, cbStats.RejectedPuts)
+			if cbStats.FallbackGets > 0 || cbStats.FallbackPuts > 0 {
+				fmt.Fprintf(os.Stderr, "  Fallback backend operations: %d GETs, %d PUTs\n",
+					cbStats.FallbackGets, cbStats.FallbackPuts)
+			}
+		}
+
+		if signed, ok := backends.Find[*backends.Signed](cp.backend); ok {
+			signedStats := signed.Stats()
+			fmt.Fprintf(os.Stderr, "\nSigning statistics:\n")
+			if signedStats.SignerID != "" {
+				fmt.Fprintf(os.Stderr, "  Signing key ID: %s\n", signedStats.SignerID)
+			}
+			fmt.Fprintf(os.Stderr, "  Uploads: %d signed, %d unsigned\n", signedStats.SignedPuts, signedStats.UnsignedPuts)
+			fmt.Fprintf(os.Stderr, "  Backend hits: %d verified, %d unsigned from quarantine, %d untrusted (treated as misses)\n",
+				signedStats.VerifiedGets, signedStats.UnsignedGets, signedStats.UntrustedGets)
+		}
+
+		if enc, ok := backends.Find[*backends.Encrypted](cp.backend); ok {
+			encStats := enc.Stats()
+			fmt.Fprintf(os.Stderr, "\nEncryption statistics:\n")
+			fmt.Fprintf(os.Stderr, "  Active key ID: %s\n", encStats.ActiveKeyID)
+			fmt.Fprintf(os.Stderr, "  Objects: %d encrypted, %d decrypted, %d undecryptable (treated as misses)\n",
+				encStats.EncryptedPuts, encStats.DecryptedGets, encStats.FailedDecryptions)
+		}
+
+		if ac, ok := backends.Find[*backends.AdaptiveConcurrency](cp.backend); ok {
+			getStats, putStats := ac.Stats()
+			fmt.Fprintf(os.Stderr, "\nAdaptive concurrency statistics:\n")
+			for _, op := range []struct {
+				name  string
+				stats backends.AIMDLimiterStats
+			}{{"GET", getStats}, {"PUT", putStats}} {
+				fmt.Fprintf(os.Stderr, "  %s limit: %d (lowest: %d), throttled: %d, timeouts: %d, waited: %d (%s)\n",
+					op.name, op.stats.Limit, op.stats.MinLimit, op.stats.Throttles, op.stats.Timeouts,
+					op.stats.Waits, op.stats.WaitTime.Round(time.Millisecond))
+			}
+		}
+
 		// Print latency quantiles
 		fmt.Fprintf(os.Stderr, "\nLatency quantiles (ms):\n")
 		allStats := cp.latencyTracker.GetAllStats()
@@ -356,19 +619,26 @@ func (cp *CacheProg) Run() error {
 }
 
 // handleRequest processes a single request and returns a response.
-func (cp *CacheProg) handleRequest(req *Request) (Response, error) {
-	var resp Response
+func (cp *CacheProg) handleRequest(req *Request) (resp Response, err error) {
 	resp.ID = req.ID
 
 	switch req.Command {
-	case CmdPut:
-		return cp.handlePut(req)
-
-	case CmdGet:
-		return cp.handleGet(req)
+	case CmdPut, CmdGet:
+		start := time.Now()
+		if req.Command == CmdPut {
+			resp, err = cp.handlePut(req)
+		} else {
+			resp, err = cp.handleGet(req)
+		}
+		if cp.trace != nil {
+			if traceErr := cp.trace.record(newTraceEvent(req, resp, start, time.Since(start))); traceErr != nil {
+				cp.logger.Warn("failed to write trace event", "error", traceErr)
+			}
+		}
+		return resp, err
 
 	case CmdClose:
-		if err := cp.backend.Close(); err != nil {
+		if err := cp.closeBackend(); err != nil {
 			resp.Err = err.Error()
 			return resp, err
 		}
@@ -380,6 +650,86 @@ func (cp *CacheProg) handleRequest(req *Request) (Response, error) {
 	}
 }
 
+// startLocalCacheTrimmer trims the local cache in the background, once right
+// away and then every localTrimInterval. It returns a function that stops it.
+// Stopping doesn't wait for an in-progress trim, since an interrupted eviction
+// never leaves behind an entry that could be served.
+func (cp *CacheProg) startLocalCacheTrimmer() (stop func()) {
+	interval := cp.localTrimInterval
+	if interval <= 0 {
+		interval = 5 * time.Minute
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			result, err := cp.localCache.trim(cp.localTrim, cp.locker)
+			if err != nil {
+				cp.logger.Warn("failed to trim local cache", "error", err)
+			} else if result.EvictedEntries > 0 || result.StaleFiles > 0 || result.QuarantinedFiles > 0 {
+				cp.logger.Debug("trimmed local cache",
+					"evictedEntries", result.EvictedEntries,
+					"evictedBytes", result.EvictedBytes,
+					"staleFiles", result.StaleFiles,
+					"quarantinedFiles", result.QuarantinedFiles)
+			}
+			cp.trimmedEntries.Add(int64(result.EvictedEntries))
+			cp.trimmedBytes.Add(result.EvictedBytes)
+			cp.trimmedStaleFiles.Add(int64(result.StaleFiles))
+
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+	}
+}
+
+// closeBackend closes the backend, waiting for pending uploads to complete. If a
+// close timeout is configured and it expires first, closeBackend returns without
+// waiting any longer so the process can exit; any uploads that are still pending
+// stay in the spool (if enabled) to be uploaded later.
+func (cp *CacheProg) closeBackend() error {
+	closeBackend := func() error {
+		if cp.toucher != nil {
+			cp.toucher.close()
+		}
+		return cp.backend.Close()
+	}
+	if cp.closeTimeout <= 0 {
+		return closeBackend()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- closeBackend()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(cp.closeTimeout):
+		cp.closeTimedOut.Store(true)
+		if cp.spool != nil {
+			cp.logger.Warn("close timeout reached, leaving pending uploads in the spool",
+				"timeout", cp.closeTimeout,
+				"pending", cp.spool.pending(),
+				"spoolDir", cp.spool.dir)
+		} else {
+			cp.logger.Warn("close timeout reached, abandoning pending uploads",
+				"timeout", cp.closeTimeout)
+		}
+		return nil
+	}
+}
+
 // putResult holds the result of a Put operation for singleflight
 type putResult struct {
 	diskPath string
@@ -453,6 +803,29 @@ func (cp *CacheProg) handlePut(req *Request) (Response, error) {
 			return &putResult{diskPath: diskPath}, nil
 		}
 
+		if cp.verifyOutputIDs {
+			checksum := sha256.Sum256(bodyData)
+			if err := verifyOutputID(req.OutputID, checksum[:]); err != nil {
+				// The local cache still has to be written so the go command gets a
+				// disk path back, but don't spread the entry to other machines.
+				cp.outputIDMismatchPuts.Add(1)
+				cp.logger.Error("PUT body does not match its output ID, skipping backend write",
+					"actionID", hex.EncodeToString(req.ActionID),
+					"error", err)
+				return &putResult{diskPath: diskPath}, nil
+			}
+		}
+
+		if cp.admission != nil {
+			if reason := cp.admission.checkObject(req.ActionID, req.BodySize); reason != admitted {
+				cp.logger.Debug("PUT backend write skipped by admission policy",
+					"actionID", hex.EncodeToString(req.ActionID),
+					"size", req.BodySize,
+					"reason", reason)
+				return &putResult{diskPath: diskPath}, nil
+			}
+		}
+
 		var (
 			backendPutStart = time.Now()
 			dataToStore     []byte
@@ -477,11 +850,41 @@ func (cp *CacheProg) handlePut(req *Request) (Response, error) {
 			dataSize = req.BodySize
 		}
 
+		if cp.admission != nil {
+			if reason := cp.admission.reserve(dataSize); reason != admitted {
+				cp.logger.Debug("PUT backend write skipped by admission policy",
+					"actionID", hex.EncodeToString(req.ActionID),
+					"size", dataSize,
+					"reason", reason)
+				return &putResult{diskPath: diskPath}, nil
+			}
+		}
+
 		backendKey := cp.generateBackendKey(req.ActionID)
+		if cp.spool != nil {
+			// Record the upload in the spool before handing it to the backend so
+			// that it survives the process exiting before the upload completes.
+			if err := cp.spool.add(backendKey, spoolEntry{
+				OutputID:   hex.EncodeToString(req.OutputID),
+				Size:       req.BodySize,
+				DiskPath:   diskPath,
+				Compressed: cp.compression && req.BodySize > 0,
+				QueuedAt:   time.Now(),
+			}); err != nil {
+				cp.logger.Warn("failed to record upload in spool",
+					"actionID", hex.EncodeToString(req.ActionID),
+					"error", err)
+			}
+		}
 		err = cp.backend.Put(backendKey, req.OutputID, bytes.NewReader(dataToStore), dataSize)
 		cp.latencyTracker.Record("put_backend", time.Since(backendPutStart))
 
-		if err != nil {
+		if errors.Is(err, backends.ErrCircuitOpen) {
+			// The circuit breaker already logged that the backend is unhealthy,
+			// so don't log a warning for every PUT while it stays open.
+			cp.logger.Debug("backend PUT skipped, circuit breaker is open",
+				"actionID", hex.EncodeToString(req.ActionID))
+		} else if err != nil {
 			// Local cache is still valid even if backend fails
 			cp.logger.Warn("backend PUT failed, but local cache succeeded",
 				"actionID", hex.EncodeToString(req.ActionID),
@@ -489,6 +892,9 @@ func (cp *CacheProg) handlePut(req *Request) (Response, error) {
 		} else {
 			// Track bytes written to backend on success (actual bytes transferred)
 			cp.backendBytesWritten.Add(dataSize)
+			if cp.manifestRecorder == nil {
+				cp.recordUpload(backendKey)
+			}
 		}
 
 		return &putResult{diskPath: diskPath}, nil
@@ -511,7 +917,8 @@ type getResult struct {
 	size           int64
 	putTime        *time.Time
 	miss           bool
-	fromLocalCache bool // true if hit was from local cache, false if from backend
+	fromLocalCache bool   // true if hit was from local cache, false if from backend
+	namespace      string // Read namespace a backend hit was served from
 }
 
 // handleGet processes a GET request.
@@ -543,6 +950,7 @@ func (cp *CacheProg) handleGet(req *Request) (Response, error) {
 		if meta != nil {
 			// Local cache hit with metadata
 			diskPath := cp.localCache.getPath(req.ActionID)
+			cp.localCache.touch(req.ActionID)
 
 			return &getResult{
 				outputID:       meta.OutputID,
@@ -554,17 +962,61 @@ func (cp *CacheProg) handleGet(req *Request) (Response, error) {
 			}, nil
 		}
 
-		// Local cache miss - get from backend
-		backendGetStart := time.Now()
-		backendKey := cp.generateBackendKey(req.ActionID)
-		outputID, body, size, putTime, miss, err := cp.backend.Get(backendKey)
-		cp.latencyTracker.Record("get_backend", time.Since(backendGetStart))
+		// Local cache miss - get from backend, unless we've already spent our
+		// entire budget waiting on it.
+		if cp.backendGetBudgetExceeded.Load() {
+			cp.budgetSkippedGets.Add(1)
+			return &getResult{
+				miss: true,
+			}, nil
+		}
 
-		if err != nil {
-			return nil, err
+		if cp.egressBudgetExceeded.Load() {
+			cp.egressSkippedGets.Add(1)
+			return &getResult{
+				miss: true,
+			}, nil
+		}
+
+		// Look the action up in each read namespace in order until one of them hits.
+		// A namespace that fails doesn't stop the fallback to the next one, its
+		// error is only returned if none of them hit.
+		var (
+			outputID     []byte
+			body         io.ReadCloser
+			size         int64
+			putTime      *time.Time
+			miss         = true
+			hitNamespace string
+			getErr       error
+		)
+		for i, namespace := range cp.readNamespaces {
+			backendGetStart := time.Now()
+			backendKey := cp.generateNamespacedBackendKey(namespace, req.ActionID)
+			var err error
+			outputID, body, size, putTime, miss, err = cp.backend.Get(backendKey)
+			backendGetDuration := time.Since(backendGetStart)
+			cp.latencyTracker.Record("get_backend", backendGetDuration)
+			if cp.downloadMeter == nil {
+				cp.recordBackendGetTime(backendGetDuration)
+			}
+
+			if err != nil {
+				miss = true
+				getErr = err
+				continue
+			}
+			if !miss {
+				cp.namespaceHits[i].Add(1)
+				hitNamespace = namespace
+				break
+			}
 		}
 
 		if miss {
+			if getErr != nil {
+				return nil, getErr
+			}
 			// Backend miss
 			return &getResult{
 				miss: true,
@@ -572,17 +1024,24 @@ func (cp *CacheProg) handleGet(req *Request) (Response, error) {
 		}
 
 		// Backend hit - track bytes read from backend (compressed size)
-		cp.backendBytesRead.Add(size)
+		cp.recordBackendBytesRead(size)
 
 		// Backend hit - decompress if needed, then write to local cache with metadata
 		defer body.Close()
 
+		var bodyReader io.Reader = body
+		if cp.downloadLimiter != nil && cp.downloadMeter == nil {
+			bodyReader = ratelimit.NewReader(body, cp.downloadLimiter, func(wait time.Duration) {
+				cp.downloadThrottledTime.Add(int64(wait))
+			})
+		}
+
 		var dataToCache io.Reader
 		var actualSize int64
 
 		if cp.compression && size > 0 {
 			// Read compressed data from backend
-			compressedData, err := io.ReadAll(body)
+			compressedData, err := io.ReadAll(bodyReader)
 			if err != nil {
 				return nil, fmt.Errorf("failed to read compressed data from backend: %w", err)
 			}
@@ -603,7 +1062,7 @@ func (cp *CacheProg) handleGet(req *Request) (Response, error) {
 			dataToCache = bytes.NewReader(decompressed)
 			actualSize = int64(len(decompressed))
 		} else {
-			dataToCache = body
+			dataToCache = bodyReader
 			actualSize = size
 		}
 
@@ -613,6 +1072,14 @@ func (cp *CacheProg) handleGet(req *Request) (Response, error) {
 			PutTime:  *putTime,
 		}
 
+		// Hash the body as it's written so that uncompressed bodies can be verified
+		// without buffering them in memory.
+		var bodyHash hash.Hash
+		if cp.verifyOutputIDs {
+			bodyHash = sha256.New()
+			dataToCache = io.TeeReader(dataToCache, bodyHash)
+		}
+
 		localCacheWriteStart := time.Now()
 		diskPath, err := cp.localCache.writeWithMetadata(req.ActionID, dataToCache, metaForWrite)
 		cp.latencyTracker.Record("get_local_cache_write", time.Since(localCacheWriteStart))
@@ -626,6 +1093,27 @@ func (cp *CacheProg) handleGet(req *Request) (Response, error) {
 			return nil, fmt.Errorf("failed to cache locally: %w", err)
 		}
 
+		if bodyHash != nil {
+			if err := verifyOutputID(outputID, bodyHash.Sum(nil)); err != nil {
+				cp.outputIDMismatchGets.Add(1)
+				cp.logger.Error("backend entry does not match its output ID, treating it as a miss",
+					"actionID", hex.EncodeToString(req.ActionID),
+					"error", err)
+				if err := cp.localCache.remove(req.ActionID); err != nil {
+					cp.logger.Warn("failed to remove mismatched entry from local cache",
+						"actionID", hex.EncodeToString(req.ActionID),
+						"error", err)
+				}
+				return &getResult{
+					miss: true,
+				}, nil
+			}
+		}
+
+		if cp.toucher != nil {
+			cp.toucher.touch(cp.generateNamespacedBackendKey(hitNamespace, req.ActionID), *putTime)
+		}
+
 		return &getResult{
 			outputID:       outputID,
 			diskPath:       diskPath,
@@ -633,6 +1121,7 @@ func (cp *CacheProg) handleGet(req *Request) (Response, error) {
 			putTime:        putTime,
 			miss:           false,
 			fromLocalCache: false,
+			namespace:      hitNamespace,
 		}, nil
 	})
 
@@ -644,12 +1133,16 @@ func (cp *CacheProg) handleGet(req *Request) (Response, error) {
 
 	result := v.(*getResult)
 	resp.Miss = result.miss
+	resp.source = traceSourceMiss
 	if !result.miss {
 		cp.hitCount.Add(1)
 		if result.fromLocalCache {
 			cp.localCacheHits.Add(1)
+			resp.source = traceSourceLocal
 		} else {
 			cp.backendCacheHits.Add(1)
+			resp.source = traceSourceRemote
+			resp.namespace = result.namespace
 		}
 		resp.OutputID = result.outputID
 		resp.DiskPath = result.diskPath
@@ -659,6 +1152,35 @@ func (cp *CacheProg) handleGet(req *Request) (Response, error) {
 	return resp, nil
 }
 
+// recordBackendGetTime adds the duration of a backend GET to the total for this
+// run and stops consulting the backend for GETs once the budget is exhausted.
+func (cp *CacheProg) recordBackendGetTime(duration time.Duration) {
+	total := time.Duration(cp.backendGetTime.Add(int64(duration)))
+	if cp.backendGetBudget <= 0 || total < cp.backendGetBudget {
+		return
+	}
+	if cp.backendGetBudgetExceeded.CompareAndSwap(false, true) {
+		cp.logger.Warn("backend GET time budget exhausted, backend will not be consulted for the rest of this run",
+			"budget", cp.backendGetBudget,
+			"totalBackendGetTime", total)
+	}
+}
+
+// recordBackendBytesRead adds to the number of bytes downloaded from the backend
+// during this run and stops consulting the backend for GETs once the egress
+// budget is used up.
+func (cp *CacheProg) recordBackendBytesRead(n int64) {
+	total := cp.backendBytesRead.Add(n)
+	if cp.egressBudget <= 0 || total < cp.egressBudget {
+		return
+	}
+	if cp.egressBudgetExceeded.CompareAndSwap(false, true) {
+		cp.logger.Warn("backend egress budget used up, backend will not be consulted for the rest of this run",
+			"budget", formatBytes(cp.egressBudget),
+			"backendBytesRead", formatBytes(total))
+	}
+}
+
 // sendResponse sends a response to stdout (thread-safe).
 func (cp *CacheProg) sendResponse(resp Response) error {
 	data, err := json.Marshal(resp)
@@ -765,9 +1287,16 @@ func (cp *CacheProg) trackActionID(actionID []byte) bool {
 }
 
 // generateBackendKey generates the key to use for backend storage operations.
-// This allows for versioning, prefixing, or other key transformations.
+// This allows for versioning, prefixing, or other key transformations. Keys are
+// generated in the write namespace, use generateNamespacedBackendKey for reads.
 func (cp *CacheProg) generateBackendKey(actionID []byte) []byte {
-	return []byte(fileFormatVersion + hex.EncodeToString(actionID))
+	return cp.generateNamespacedBackendKey(cp.writeNamespace, actionID)
+}
+
+// generateNamespacedBackendKey generates the backend key for actionID in the
+// given namespace.
+func (cp *CacheProg) generateNamespacedBackendKey(namespace string, actionID []byte) []byte {
+	return []byte(namespace + fileFormatVersion + hex.EncodeToString(actionID))
 }
 
 // formatBytes formats a byte count as a human-readable string.
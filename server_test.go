@@ -1,12 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"log/slog"
 	"os"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/richardartoul/gobuildcache/pkg/backends"
 	"github.com/richardartoul/gobuildcache/pkg/locking"
+	"github.com/richardartoul/gobuildcache/pkg/ratelimit"
 )
 
 func TestFormatBytes(t *testing.T) {
@@ -174,3 +182,312 @@ func TestReadOnlyMode_MultipleSkippedPuts(t *testing.T) {
 		t.Errorf("Expected putCount to be 5, got: %d", cp.putCount.Load())
 	}
 }
+
+// slowBackend is a backend that always misses, but only after a delay.
+type slowBackend struct {
+	backends.Noop
+	delay time.Duration
+	gets  atomic.Int64
+}
+
+func (s *slowBackend) Get(actionID []byte) ([]byte, io.ReadCloser, int64, *time.Time, bool, error) {
+	s.gets.Add(1)
+	time.Sleep(s.delay)
+	return nil, nil, 0, nil, true, nil
+}
+
+func TestBackendGetBudget_SkipsBackendOnceExhausted(t *testing.T) {
+	cacheDir := t.TempDir()
+	backend := &slowBackend{delay: 20 * time.Millisecond}
+
+	cp, err := NewCacheProg(backend, locking.NewNoOpGroup(), cacheDir, false, false, false, false)
+	if err != nil {
+		t.Fatalf("Failed to create CacheProg: %v", err)
+	}
+	cp.backendGetBudget = 10 * time.Millisecond
+
+	for i := 0; i < 3; i++ {
+		resp, err := cp.handleGet(&Request{
+			ID:       int64(i),
+			Command:  CmdGet,
+			ActionID: []byte{byte(i)},
+		})
+		if err != nil {
+			t.Fatalf("handleGet %d returned error: %v", i, err)
+		}
+		if !resp.Miss {
+			t.Errorf("Expected GET %d to be a miss", i)
+		}
+	}
+
+	// The first GET exhausts the budget, so the remaining GETs never reach the backend.
+	if got := backend.gets.Load(); got != 1 {
+		t.Errorf("Expected backend to see 1 GET, got: %d", got)
+	}
+	if got := cp.budgetSkippedGets.Load(); got != 2 {
+		t.Errorf("Expected budgetSkippedGets to be 2, got: %d", got)
+	}
+}
+
+// hitBackend is a backend that always hits with a body of the given size.
+type hitBackend struct {
+	backends.Noop
+	size int64
+	gets atomic.Int64
+}
+
+func (h *hitBackend) Get(actionID []byte) ([]byte, io.ReadCloser, int64, *time.Time, bool, error) {
+	h.gets.Add(1)
+	now := time.Now()
+	body := io.NopCloser(strings.NewReader(strings.Repeat("x", int(h.size))))
+	return []byte("output"), body, h.size, &now, false, nil
+}
+
+func TestEgressBudget_SkipsBackendOnceUsedUp(t *testing.T) {
+	backend := &hitBackend{size: 100}
+
+	cp, err := NewCacheProg(backend, locking.NewNoOpGroup(), t.TempDir(), false, false, false, false)
+	if err != nil {
+		t.Fatalf("Failed to create CacheProg: %v", err)
+	}
+	cp.egressBudget = 150
+
+	for i := 0; i < 4; i++ {
+		resp, err := cp.handleGet(&Request{
+			ID:       int64(i),
+			Command:  CmdGet,
+			ActionID: []byte{byte(i)},
+		})
+		if err != nil {
+			t.Fatalf("handleGet %d returned error: %v", i, err)
+		}
+		// The second GET uses up the budget, but is still served.
+		if expectMiss := i >= 2; resp.Miss != expectMiss {
+			t.Errorf("GET %d: expected miss=%v, got miss=%v", i, expectMiss, resp.Miss)
+		}
+	}
+
+	if got := backend.gets.Load(); got != 2 {
+		t.Errorf("Expected backend to see 2 GETs, got: %d", got)
+	}
+	if got := cp.egressSkippedGets.Load(); got != 2 {
+		t.Errorf("Expected egressSkippedGets to be 2, got: %d", got)
+	}
+}
+
+func TestDownloadLimiter_ThrottlesBackendBodies(t *testing.T) {
+	backend := &hitBackend{size: 150 * 1024}
+
+	cp, err := NewCacheProg(backend, locking.NewNoOpGroup(), t.TempDir(), false, false, false, false)
+	if err != nil {
+		t.Fatalf("Failed to create CacheProg: %v", err)
+	}
+	cp.downloadLimiter = ratelimit.NewTokenBucket(100 * 1024)
+
+	resp, err := cp.handleGet(&Request{ID: 1, Command: CmdGet, ActionID: []byte{1}})
+	if err != nil {
+		t.Fatalf("handleGet returned error: %v", err)
+	}
+	if resp.Miss {
+		t.Fatalf("Expected GET to hit")
+	}
+
+	// The first 100KB fit in the initial burst, the remaining 50KB take ~500ms.
+	if throttled := time.Duration(cp.downloadThrottledTime.Load()); throttled < 400*time.Millisecond {
+		t.Errorf("Expected download to be throttled for ~500ms, got: %v", throttled)
+	}
+}
+
+func TestDownloadMeter_ThrottlesAndTimesBelowBufferingWrappers(t *testing.T) {
+	// Signed reads the whole body before its Get returns, so the download has to
+	// be throttled and timed below it.
+	storage := &hitBackend{size: 150 * 1024}
+	keyring, err := backends.NewSigningKeyring(&backends.SigningKey{
+		ID:        "ci",
+		Algorithm: backends.SigningHMAC,
+		Secret:    bytes.Repeat([]byte{1}, 32),
+	}, nil)
+	if err != nil {
+		t.Fatalf("Failed to create signing keyring: %v", err)
+	}
+	signed := backends.NewSigned(&downloadMeter{Backend: storage}, keyring, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	signed.AllowUnsigned("")
+
+	cp, err := NewCacheProg(signed, locking.NewNoOpGroup(), t.TempDir(), false, false, false, false)
+	if err != nil {
+		t.Fatalf("Failed to create CacheProg: %v", err)
+	}
+	cp.downloadLimiter = ratelimit.NewTokenBucket(100 * 1024)
+	cp.backendGetBudget = time.Minute
+	cp.attachDownloadMeter()
+
+	resp, err := cp.handleGet(&Request{ID: 1, Command: CmdGet, ActionID: []byte{1}})
+	if err != nil {
+		t.Fatalf("handleGet returned error: %v", err)
+	}
+	if resp.Miss {
+		t.Fatalf("Expected GET to hit")
+	}
+
+	throttled := time.Duration(cp.downloadThrottledTime.Load())
+	if throttled < 400*time.Millisecond {
+		t.Errorf("Expected download to be throttled for ~500ms, got: %v", throttled)
+	}
+	// The throttling happened while Signed downloaded the body inside its Get, not
+	// afterwards on the copy it returned.
+	if stats, err := cp.latencyTracker.GetStats("get_backend"); err != nil || stats.Max < 400 {
+		t.Errorf("Expected the backend GET to include the throttled download, got: %+v, %v", stats, err)
+	}
+	// Only the wait for the backend to respond counts against the GET budget,
+	// not the throttled download.
+	if got := time.Duration(cp.backendGetTime.Load()); got >= throttled {
+		t.Errorf("Expected backend GET time to exclude the %v spent throttled, got: %v", throttled, got)
+	}
+}
+
+func TestNamespaces_ReadFallbackChain(t *testing.T) {
+	backend := newRecordingBackend()
+	cp, err := NewCacheProg(backend, locking.NewNoOpGroup(), t.TempDir(), false, false, false, false)
+	if err != nil {
+		t.Fatalf("Failed to create CacheProg: %v", err)
+	}
+	cp.setNamespaces("branches/feature", []string{"branches/feature", "main/"})
+
+	// Seed main's namespace directly in the backend.
+	mainKey := cp.generateNamespacedBackendKey("main/", []byte{1})
+	if err := backend.Put(mainKey, []byte("output"), strings.NewReader("main"), 4); err != nil {
+		t.Fatalf("Failed to seed backend: %v", err)
+	}
+
+	resp, err := cp.handleGet(&Request{ID: 1, Command: CmdGet, ActionID: []byte{1}})
+	if err != nil {
+		t.Fatalf("handleGet returned error: %v", err)
+	}
+	if resp.Miss {
+		t.Fatalf("Expected GET to hit in main's namespace")
+	}
+	if hits := cp.namespaceHits[1].Load(); hits != 1 {
+		t.Errorf("Expected 1 hit from main's namespace, got: %d", hits)
+	}
+
+	// PUTs only go to the write namespace.
+	body := "branch"
+	if _, err := cp.handlePut(&Request{
+		ID:       2,
+		Command:  CmdPut,
+		ActionID: []byte{2},
+		OutputID: []byte("output"),
+		BodySize: int64(len(body)),
+		Body:     strings.NewReader(body),
+	}); err != nil {
+		t.Fatalf("handlePut returned error: %v", err)
+	}
+	if _, ok := backend.get([]byte("branches/feature/" + fileFormatVersion + "02")); !ok {
+		t.Errorf("Expected PUT to be written to the branch namespace")
+	}
+	if _, ok := backend.get(cp.generateNamespacedBackendKey("main/", []byte{2})); ok {
+		t.Errorf("Expected PUT not to be written to main's namespace")
+	}
+}
+
+// namespaceErrorBackend is a recordingBackend whose GETs fail for keys in one
+// namespace.
+type namespaceErrorBackend struct {
+	*recordingBackend
+	namespace string
+}
+
+func (b *namespaceErrorBackend) Get(actionID []byte) ([]byte, io.ReadCloser, int64, *time.Time, bool, error) {
+	if strings.HasPrefix(string(actionID), b.namespace) {
+		return nil, nil, 0, nil, false, errors.New("backend unavailable")
+	}
+	return b.recordingBackend.Get(actionID)
+}
+
+func TestNamespaces_ReadFallbackContinuesAfterErrors(t *testing.T) {
+	backend := &namespaceErrorBackend{recordingBackend: newRecordingBackend(), namespace: "branches/"}
+	cp, err := NewCacheProg(backend, locking.NewNoOpGroup(), t.TempDir(), false, false, false, false)
+	if err != nil {
+		t.Fatalf("Failed to create CacheProg: %v", err)
+	}
+	cp.setNamespaces("branches/feature", []string{"branches/feature", "main/"})
+
+	mainKey := cp.generateNamespacedBackendKey("main/", []byte{1})
+	if err := backend.Put(mainKey, []byte("output"), strings.NewReader("main"), 4); err != nil {
+		t.Fatalf("Failed to seed backend: %v", err)
+	}
+
+	resp, err := cp.handleGet(&Request{ID: 1, Command: CmdGet, ActionID: []byte{1}})
+	if err != nil {
+		t.Fatalf("Expected the failing branch namespace to fall back to main's, got: %v", err)
+	}
+	if resp.Miss {
+		t.Fatalf("Expected GET to hit in main's namespace")
+	}
+
+	// When no namespace hits, the error is returned rather than a miss.
+	if _, err := cp.handleGet(&Request{ID: 2, Command: CmdGet, ActionID: []byte{2}}); err == nil {
+		t.Errorf("Expected GET to return the branch namespace's error when no namespace hits")
+	}
+}
+
+func TestVerifyOutputIDs_RejectsMismatchedBodies(t *testing.T) {
+	backend := newRecordingBackend()
+	cp, err := NewCacheProg(backend, locking.NewNoOpGroup(), t.TempDir(), false, false, true, false)
+	if err != nil {
+		t.Fatalf("Failed to create CacheProg: %v", err)
+	}
+	cp.verifyOutputIDs = true
+
+	put := func(id byte, outputID []byte, body string) {
+		t.Helper()
+		resp, err := cp.handlePut(&Request{
+			ID:       int64(id),
+			Command:  CmdPut,
+			ActionID: []byte{id},
+			OutputID: outputID,
+			BodySize: int64(len(body)),
+			Body:     strings.NewReader(body),
+		})
+		if err != nil || resp.DiskPath == "" {
+			t.Fatalf("Expected PUT to succeed locally, got: %v %+v", err, resp)
+		}
+	}
+
+	goodID := sha256.Sum256([]byte("good"))
+	put(1, goodID[:], "good")
+	put(2, goodID[:], "evil")
+	if _, ok := backend.get(cp.generateBackendKey([]byte{1})); !ok {
+		t.Errorf("Expected matching PUT to be uploaded")
+	}
+	if _, ok := backend.get(cp.generateBackendKey([]byte{2})); ok {
+		t.Errorf("Expected mismatched PUT not to be uploaded")
+	}
+	if got := cp.outputIDMismatchPuts.Load(); got != 1 {
+		t.Errorf("Expected 1 mismatched PUT, got %d", got)
+	}
+
+	// Plant a poisoned entry that claims the good output ID. Drop the good entry
+	// from the local cache so that its GET is served by the backend too.
+	poisoned, err := compressData([]byte("evil"))
+	if err != nil {
+		t.Fatalf("Failed to compress body: %v", err)
+	}
+	backend.Put(cp.generateBackendKey([]byte{3}), goodID[:], bytes.NewReader(poisoned), int64(len(poisoned)))
+	cp.localCache.remove([]byte{1})
+
+	resp, err := cp.handleGet(&Request{ID: 4, Command: CmdGet, ActionID: []byte{1}})
+	if err != nil || resp.Miss {
+		t.Fatalf("Expected matching backend entry to hit, got: %v %+v", err, resp)
+	}
+	resp, err = cp.handleGet(&Request{ID: 5, Command: CmdGet, ActionID: []byte{3}})
+	if err != nil || !resp.Miss {
+		t.Fatalf("Expected poisoned backend entry to miss, got: %v %+v", err, resp)
+	}
+	if got := cp.outputIDMismatchGets.Load(); got != 1 {
+		t.Errorf("Expected 1 mismatched GET, got %d", got)
+	}
+	if cp.localCache.check([]byte{3}) != nil {
+		t.Errorf("Expected poisoned entry not to be left in the local cache")
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/richardartoul/gobuildcache/pkg/backends"
+)
+
+// The signing and trusted keys are, like encryptionKeyEnvVar, only read from the
+// prefixed form of these environment variables, so that unrelated variables in
+// the environment can't silently change what's trusted.
+const (
+	signingKeyEnvVar  = "GOBUILDCACHE_SIGNING_KEY"
+	trustedKeysEnvVar = "GOBUILDCACHE_TRUSTED_KEYS"
+)
+
+// readKeySpecs returns the keys in an environment variable (comma or newline
+// separated) and a key file (one per line). Blank lines and lines starting with
+// # are skipped.
+func readKeySpecs(envVar, keyFile string) ([]string, error) {
+	var lines []string
+	if env := os.Getenv(envVar); env != "" {
+		lines = append(lines, strings.FieldsFunc(env, func(r rune) bool {
+			return r == ',' || r == '\n'
+		})...)
+	}
+	if keyFile != "" {
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file: %w", err)
+		}
+		lines = append(lines, strings.Split(string(data), "\n")...)
+	}
+
+	var specs []string
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		specs = append(specs, line)
+	}
+	return specs, nil
+}
+
+// loadSigningKeyring builds the keyring used to sign and verify backend entries
+// from the signing key in signingKeyEnvVar or signingKeyFile, and the trusted
+// keys in trustedKeysEnvVar and trustedKeysFile. Keys are in the form
+// <key ID>:<algorithm>:<base64 key>, where algorithm is ed25519 or hmac. Ed25519
+// private keys can be raw seeds or PKCS #8 DER, and public keys raw or PKIX DER.
+// It returns nil if no keys are configured.
+func loadSigningKeyring(signingKeyFile, trustedKeysFile string) (*backends.SigningKeyring, error) {
+	signerSpecs, err := readKeySpecs(signingKeyEnvVar, signingKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	trustedSpecs, err := readKeySpecs(trustedKeysEnvVar, trustedKeysFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(signerSpecs) == 0 && len(trustedSpecs) == 0 {
+		return nil, nil
+	}
+	if len(signerSpecs) > 1 {
+		return nil, fmt.Errorf("only one signing key can be configured, got %d", len(signerSpecs))
+	}
+
+	var signer *backends.SigningKey
+	if len(signerSpecs) == 1 {
+		key, err := parseSigningKey(signerSpecs[0], true)
+		if err != nil {
+			return nil, err
+		}
+		signer = &key
+	}
+
+	var trusted []backends.SigningKey
+	for _, spec := range trustedSpecs {
+		key, err := parseSigningKey(spec, false)
+		if err != nil {
+			return nil, err
+		}
+		trusted = append(trusted, key)
+	}
+	return backends.NewSigningKeyring(signer, trusted)
+}
+
+// parseSigningKey parses a <key ID>:<algorithm>:<base64 key> signing key.
+func parseSigningKey(spec string, private bool) (backends.SigningKey, error) {
+	parts := strings.SplitN(spec, ":", 3)
+	if len(parts) != 3 {
+		return backends.SigningKey{}, fmt.Errorf("invalid signing key: expected <key ID>:<algorithm>:<base64 key>")
+	}
+	key := backends.SigningKey{
+		ID:        strings.TrimSpace(parts[0]),
+		Algorithm: backends.SigningAlgorithm(strings.ToLower(strings.TrimSpace(parts[1]))),
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(parts[2]))
+	if err != nil {
+		return key, fmt.Errorf("invalid signing key %q: not valid base64", key.ID)
+	}
+
+	switch key.Algorithm {
+	case backends.SigningHMAC:
+		key.Secret = raw
+	case backends.SigningEd25519:
+		if private {
+			key.PrivateKey, err = parseEd25519PrivateKey(raw)
+		} else {
+			key.PublicKey, err = parseEd25519PublicKey(raw)
+		}
+		if err != nil {
+			return key, fmt.Errorf("invalid signing key %q: %w", key.ID, err)
+		}
+	}
+	return key, nil
+}
+
+func parseEd25519PrivateKey(raw []byte) (ed25519.PrivateKey, error) {
+	switch len(raw) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(raw), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(raw), nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("not a raw or PKCS #8 ed25519 private key")
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("PKCS #8 key is not an ed25519 key")
+	}
+	return key, nil
+}
+
+func parseEd25519PublicKey(raw []byte) (ed25519.PublicKey, error) {
+	if len(raw) == ed25519.PublicKeySize {
+		return ed25519.PublicKey(raw), nil
+	}
+	parsed, err := x509.ParsePKIXPublicKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("not a raw or PKIX ed25519 public key")
+	}
+	key, ok := parsed.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("PKIX key is not an ed25519 key")
+	}
+	return key, nil
+}
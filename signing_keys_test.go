@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadSigningKeyring(t *testing.T) {
+	seed := []byte(strings.Repeat("s", ed25519.SeedSize))
+	public := ed25519.NewKeyFromSeed(seed).Public().(ed25519.PublicKey)
+	publicDER, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		t.Fatalf("Failed to marshal public key: %v", err)
+	}
+
+	t.Setenv(signingKeyEnvVar, "")
+	t.Setenv(trustedKeysEnvVar, "")
+	if keyring, err := loadSigningKeyring("", ""); err != nil || keyring != nil {
+		t.Fatalf("Expected no keyring without keys, got: %v, %v", keyring, err)
+	}
+
+	// Readers only need the public key, which can be in PKIX DER form.
+	trustedFile := filepath.Join(t.TempDir(), "trusted")
+	os.WriteFile(trustedFile, []byte("ci:ed25519:"+base64.StdEncoding.EncodeToString(publicDER)+"\n"), 0644)
+	t.Setenv(trustedKeysEnvVar, "shared:hmac:"+base64.StdEncoding.EncodeToString([]byte(strings.Repeat("h", 32))))
+	keyring, err := loadSigningKeyring("", trustedFile)
+	if err != nil {
+		t.Fatalf("loadSigningKeyring returned error: %v", err)
+	}
+	if keyring.SignerID() != "" || strings.Join(keyring.TrustedKeyIDs(), ",") != "ci,shared" {
+		t.Errorf("Unexpected keyring: signer %q, trusted %v", keyring.SignerID(), keyring.TrustedKeyIDs())
+	}
+
+	// Writers hold the private key, which is trusted along with the other keys.
+	t.Setenv(signingKeyEnvVar, "ci:ed25519:"+base64.StdEncoding.EncodeToString(seed))
+	keyring, err = loadSigningKeyring("", trustedFile)
+	if err != nil {
+		t.Fatalf("loadSigningKeyring returned error: %v", err)
+	}
+	if keyring.SignerID() != "ci" {
+		t.Errorf("Expected signing key ID ci, got %q", keyring.SignerID())
+	}
+
+	t.Setenv(signingKeyEnvVar, "ci:rsa:"+base64.StdEncoding.EncodeToString(seed))
+	if _, err := loadSigningKeyring("", ""); err == nil {
+		t.Errorf("Expected error for an unknown algorithm")
+	}
+}
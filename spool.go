@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofrs/flock"
+	"github.com/richardartoul/gobuildcache/pkg/backends"
+)
+
+const (
+	spoolLockFile    = ".lock"
+	spoolEntrySuffix = ".json"
+)
+
+// errSpoolEntryGone is returned when the local cache file referenced by a spool
+// entry no longer exists (or no longer matches), so the entry can't be uploaded.
+var errSpoolEntryGone = errors.New("local cache file for spool entry is missing or changed")
+
+// spoolEntry is a single pending upload recorded in the spool journal. The body
+// isn't duplicated in the spool, the entry just points at the file that was
+// already written to the local cache.
+type spoolEntry struct {
+	BackendKey string    // Hex-encoded backend key
+	OutputID   string    // Hex-encoded output ID
+	Size       int64     // Uncompressed size of the local cache file
+	DiskPath   string    // Absolute path to the local cache file
+	Compressed bool      // Whether the body must be LZ4 compressed before upload
+	QueuedAt   time.Time // When the upload was first queued
+
+	path string // Path to the journal file for this entry
+}
+
+// uploadSpool is a durable journal of pending backend uploads. Every PUT that is
+// sent to the backend is recorded in the spool first and removed once the upload
+// succeeds, so uploads that are still pending when the process exits (or is
+// killed) can be uploaded later by `gobuildcache flush` or by the next process
+// that starts.
+//
+// Each process owns a subdirectory of the spool root and holds a filesystem lock
+// on it for its entire lifetime. Subdirectories whose lock can be acquired belong
+// to processes that have exited and can safely be drained by someone else.
+type uploadSpool struct {
+	root   string
+	dir    string
+	lock   *flock.Flock
+	logger *slog.Logger
+}
+
+// newUploadSpool creates a new spool directory for this process under root.
+func newUploadSpool(root string, logger *slog.Logger) (*uploadSpool, error) {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get absolute path: %w", err)
+	}
+	if err := os.MkdirAll(absRoot, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+
+	dir, err := os.MkdirTemp(absRoot, fmt.Sprintf("%d-", os.Getpid()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+
+	lock := flock.New(filepath.Join(dir, spoolLockFile))
+	locked, err := lock.TryLock()
+	if err != nil || !locked {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("failed to lock spool directory: %v", err)
+	}
+
+	return &uploadSpool{
+		root:   absRoot,
+		dir:    dir,
+		lock:   lock,
+		logger: logger,
+	}, nil
+}
+
+// add records a pending upload in the journal.
+func (s *uploadSpool) add(backendKey []byte, entry spoolEntry) error {
+	entry.BackendKey = hex.EncodeToString(backendKey)
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal spool entry: %w", err)
+	}
+
+	// Write to temp file first for atomic operation.
+	entryPath := s.entryPath(backendKey)
+	tmpPath := entryPath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write spool entry: %w", err)
+	}
+	if err := os.Rename(tmpPath, entryPath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to rename spool entry: %w", err)
+	}
+	return nil
+}
+
+// remove removes a pending upload from the journal once it has been uploaded.
+func (s *uploadSpool) remove(backendKey []byte) {
+	if err := os.Remove(s.entryPath(backendKey)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		s.logger.Warn("failed to remove spool entry", "error", err)
+	}
+}
+
+// adopt moves an entry from another (orphaned) spool directory into this one.
+func (s *uploadSpool) adopt(entry spoolEntry) (spoolEntry, error) {
+	newPath := filepath.Join(s.dir, filepath.Base(entry.path))
+	if err := os.Rename(entry.path, newPath); err != nil {
+		return entry, err
+	}
+	entry.path = newPath
+	return entry, nil
+}
+
+// pending returns the number of uploads in this process' journal that have not
+// completed yet.
+func (s *uploadSpool) pending() int {
+	entries, _ := readSpoolEntries(s.dir)
+	return len(entries)
+}
+
+// close releases the spool. If there are no pending uploads left the spool
+// directory is removed, otherwise it's left behind to be drained later.
+func (s *uploadSpool) close() {
+	if s.pending() == 0 {
+		os.RemoveAll(s.dir)
+	}
+	s.lock.Unlock()
+}
+
+// entryPath returns the journal file path for a backend key.
+func (s *uploadSpool) entryPath(backendKey []byte) string {
+	return filepath.Join(s.dir, hex.EncodeToString(backendKey)+spoolEntrySuffix)
+}
+
+// readSpoolEntries reads all journal entries in a spool directory. Unreadable
+// entries are skipped.
+func readSpoolEntries(dir string) ([]spoolEntry, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []spoolEntry
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), spoolEntrySuffix) {
+			continue
+		}
+		path := filepath.Join(dir, file.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var entry spoolEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			continue
+		}
+		entry.path = path
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// claimOrphanedSpools calls fn for every spool directory under root that isn't
+// owned by a running process (except exclude). The directory is locked while fn
+// runs and removed afterwards if fn left it without any entries.
+func claimOrphanedSpools(root, exclude string, fn func(dir string) error) error {
+	dirs, err := os.ReadDir(root)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("failed to read spool directory: %w", err)
+	}
+
+	var errs []error
+	for _, d := range dirs {
+		dir := filepath.Join(root, d.Name())
+		if !d.IsDir() || dir == exclude {
+			continue
+		}
+
+		lock := flock.New(filepath.Join(dir, spoolLockFile))
+		locked, err := lock.TryLock()
+		if err != nil || !locked {
+			// Still owned by a running process.
+			continue
+		}
+
+		if err := fn(dir); err != nil {
+			errs = append(errs, err)
+		}
+		if entries, err := readSpoolEntries(dir); err == nil && len(entries) == 0 {
+			os.RemoveAll(dir)
+		}
+		lock.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+// uploadSpoolEntry uploads the local cache file referenced by a spool entry to
+// the backend. It returns errSpoolEntryGone if the file no longer exists or has
+// changed size, in which case the entry should simply be discarded.
+func uploadSpoolEntry(backend backends.Backend, entry spoolEntry) (int64, error) {
+	backendKey, err := hex.DecodeString(entry.BackendKey)
+	if err != nil {
+		return 0, fmt.Errorf("%w: invalid backend key: %v", errSpoolEntryGone, err)
+	}
+	outputID, err := hex.DecodeString(entry.OutputID)
+	if err != nil {
+		return 0, fmt.Errorf("%w: invalid output ID: %v", errSpoolEntryGone, err)
+	}
+
+	data, err := os.ReadFile(entry.DiskPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, errSpoolEntryGone
+		}
+		return 0, fmt.Errorf("failed to read local cache file: %w", err)
+	}
+	if int64(len(data)) != entry.Size {
+		return 0, errSpoolEntryGone
+	}
+
+	if entry.Compressed && len(data) > 0 {
+		data, err = compressData(data)
+		if err != nil {
+			return 0, fmt.Errorf("failed to compress data: %w", err)
+		}
+	}
+
+	if err := backend.Put(backendKey, outputID, bytes.NewReader(data), int64(len(data))); err != nil {
+		return 0, err
+	}
+	return int64(len(data)), nil
+}
+
+// spoolingBackend wraps a Backend and removes uploads from the spool journal once
+// they have been written to the backend successfully. It sits below the async
+// writer so that entries are only removed after the asynchronous upload completes.
+type spoolingBackend struct {
+	backends.Backend
+	spool *uploadSpool
+}
+
+// Put stores the object and removes it from the spool journal on success.
+func (s *spoolingBackend) Put(actionID, outputID []byte, body io.Reader, bodySize int64) error {
+	err := s.Backend.Put(actionID, outputID, body, bodySize)
+	if err == nil {
+		s.spool.remove(actionID)
+	}
+	return err
+}
+
+// Unwrap returns the wrapped backend.
+func (s *spoolingBackend) Unwrap() backends.Backend {
+	return s.Backend
+}
+
+// drainOrphanedSpools adopts the pending uploads left behind by processes that
+// have exited and hands them to the backend, so that they're uploaded alongside
+// this process' own uploads.
+func (cp *CacheProg) drainOrphanedSpools() {
+	err := claimOrphanedSpools(cp.spool.root, cp.spool.dir, func(dir string) error {
+		entries, err := readSpoolEntries(dir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			adopted, err := cp.spool.adopt(entry)
+			if err != nil {
+				cp.logger.Warn("failed to adopt spooled upload", "path", entry.path, "error", err)
+				continue
+			}
+			cp.spoolDrained.Add(1)
+
+			n, err := uploadSpoolEntry(cp.backend, adopted)
+			if errors.Is(err, errSpoolEntryGone) {
+				os.Remove(adopted.path)
+				continue
+			}
+			if err != nil {
+				cp.logger.Debug("failed to upload spooled entry, leaving it in the spool",
+					"path", adopted.path, "error", err)
+				continue
+			}
+			cp.backendBytesWritten.Add(n)
+		}
+		return nil
+	})
+	if err != nil {
+		cp.logger.Warn("failed to drain upload spool", "error", err)
+	}
+}
+
+// flushResult summarizes a flushSpool run.
+type flushResult struct {
+	Uploaded int64 // Entries uploaded successfully
+	Skipped  int64 // Entries discarded because their local cache file is gone
+	Failed   int64 // Entries that failed to upload and were left in the spool
+	Bytes    int64 // Bytes uploaded
+}
+
+// flushSpool uploads every entry left in spool directories under root that
+// aren't owned by a running process, using up to parallelism concurrent uploads.
+// Entries are removed from the spool once they're uploaded.
+func flushSpool(backend backends.Backend, root string, parallelism int, logger *slog.Logger) (flushResult, error) {
+	if parallelism <= 0 {
+		parallelism = 1
+	}
+
+	var (
+		result flushResult
+		mu     sync.Mutex
+	)
+	err := claimOrphanedSpools(root, "", func(dir string) error {
+		entries, err := readSpoolEntries(dir)
+		if err != nil {
+			return err
+		}
+
+		var (
+			wg  sync.WaitGroup
+			sem = make(chan struct{}, parallelism)
+		)
+		for _, entry := range entries {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(entry spoolEntry) {
+				defer wg.Done()
+				defer func() { <-sem }()
+
+				n, err := uploadSpoolEntry(backend, entry)
+
+				mu.Lock()
+				defer mu.Unlock()
+				switch {
+				case errors.Is(err, errSpoolEntryGone):
+					result.Skipped++
+					os.Remove(entry.path)
+				case err != nil:
+					result.Failed++
+					logger.Warn("failed to upload spooled entry", "path", entry.path, "error", err)
+				default:
+					result.Uploaded++
+					result.Bytes += n
+					os.Remove(entry.path)
+				}
+			}(entry)
+		}
+		wg.Wait()
+		return nil
+	})
+	return result, err
+}
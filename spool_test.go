@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/gobuildcache/pkg/backends"
+	"github.com/richardartoul/gobuildcache/pkg/locking"
+)
+
+// recordingBackend records the bodies and output IDs of all successful PUTs and
+// serves them to GETs. Entries seeded directly into puts are served with the
+// output ID "output".
+type recordingBackend struct {
+	backends.Noop
+	mu        sync.Mutex
+	puts      map[string][]byte
+	outputIDs map[string][]byte
+	failing   bool
+}
+
+func newRecordingBackend() *recordingBackend {
+	return &recordingBackend{puts: make(map[string][]byte), outputIDs: make(map[string][]byte)}
+}
+
+func (r *recordingBackend) Put(actionID, outputID []byte, body io.Reader, bodySize int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.failing {
+		return errors.New("backend unavailable")
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	r.puts[string(actionID)] = data
+	r.outputIDs[string(actionID)] = outputID
+	return nil
+}
+
+func (r *recordingBackend) Get(actionID []byte) ([]byte, io.ReadCloser, int64, *time.Time, bool, error) {
+	data, ok := r.get(actionID)
+	if !ok {
+		return nil, nil, 0, nil, true, nil
+	}
+	r.mu.Lock()
+	outputID, ok := r.outputIDs[string(actionID)]
+	r.mu.Unlock()
+	if !ok {
+		outputID = []byte("output")
+	}
+	now := time.Now()
+	return outputID, io.NopCloser(bytes.NewReader(data)), int64(len(data)), &now, false, nil
+}
+
+func (r *recordingBackend) get(actionID []byte) ([]byte, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	data, ok := r.puts[string(actionID)]
+	return data, ok
+}
+
+func testSpoolLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// writeSpooledUpload writes a local cache file and records it in the spool.
+func writeSpooledUpload(t *testing.T, spool *uploadSpool, backendKey, body []byte, compressed bool) string {
+	t.Helper()
+	diskPath := filepath.Join(t.TempDir(), "data")
+	if err := os.WriteFile(diskPath, body, 0644); err != nil {
+		t.Fatalf("Failed to write local cache file: %v", err)
+	}
+	err := spool.add(backendKey, spoolEntry{
+		OutputID:   "abcd",
+		Size:       int64(len(body)),
+		DiskPath:   diskPath,
+		Compressed: compressed,
+		QueuedAt:   time.Now(),
+	})
+	if err != nil {
+		t.Fatalf("Failed to add spool entry: %v", err)
+	}
+	return diskPath
+}
+
+func TestUploadSpool_FlushUploadsEntriesFromExitedProcesses(t *testing.T) {
+	root := t.TempDir()
+	spool, err := newUploadSpool(root, testSpoolLogger())
+	if err != nil {
+		t.Fatalf("Failed to create spool: %v", err)
+	}
+
+	body := bytes.Repeat([]byte("hello world "), 100)
+	writeSpooledUpload(t, spool, []byte("v2plain"), body, false)
+	writeSpooledUpload(t, spool, []byte("v2compressed"), body, true)
+	missingPath := writeSpooledUpload(t, spool, []byte("v2missing"), body, false)
+	os.Remove(missingPath)
+
+	// While the owning process is running, its spool must not be flushed.
+	backend := newRecordingBackend()
+	result, err := flushSpool(backend, root, 4, testSpoolLogger())
+	if err != nil {
+		t.Fatalf("flushSpool returned error: %v", err)
+	}
+	if result.Uploaded != 0 {
+		t.Fatalf("Expected no uploads from a spool owned by a running process, got: %d", result.Uploaded)
+	}
+
+	// Simulate the owning process exiting with uploads still pending.
+	spool.close()
+
+	result, err = flushSpool(backend, root, 4, testSpoolLogger())
+	if err != nil {
+		t.Fatalf("flushSpool returned error: %v", err)
+	}
+	if result.Uploaded != 2 || result.Skipped != 1 || result.Failed != 0 {
+		t.Errorf("Unexpected flush result: %+v", result)
+	}
+
+	if data, ok := backend.get([]byte("v2plain")); !ok || !bytes.Equal(data, body) {
+		t.Errorf("Expected uncompressed entry to be uploaded as-is")
+	}
+	data, ok := backend.get([]byte("v2compressed"))
+	if !ok {
+		t.Fatalf("Expected compressed entry to be uploaded")
+	}
+	decompressed, err := decompressData(data)
+	if err != nil || !bytes.Equal(decompressed, body) {
+		t.Errorf("Expected compressed entry to decompress to the original body, err: %v", err)
+	}
+
+	if entries, _ := os.ReadDir(root); len(entries) != 0 {
+		t.Errorf("Expected flushed spool directory to be removed, found %d entries", len(entries))
+	}
+}
+
+func TestUploadSpool_FailedUploadsStayInSpool(t *testing.T) {
+	root := t.TempDir()
+	spool, err := newUploadSpool(root, testSpoolLogger())
+	if err != nil {
+		t.Fatalf("Failed to create spool: %v", err)
+	}
+	writeSpooledUpload(t, spool, []byte("v2key"), []byte("data"), false)
+	spool.close()
+
+	backend := newRecordingBackend()
+	backend.failing = true
+	result, err := flushSpool(backend, root, 1, testSpoolLogger())
+	if err != nil {
+		t.Fatalf("flushSpool returned error: %v", err)
+	}
+	if result.Failed != 1 {
+		t.Fatalf("Expected 1 failed upload, got: %+v", result)
+	}
+
+	backend.failing = false
+	result, err = flushSpool(backend, root, 1, testSpoolLogger())
+	if err != nil {
+		t.Fatalf("flushSpool returned error: %v", err)
+	}
+	if result.Uploaded != 1 {
+		t.Errorf("Expected failed upload to be retried by the next flush, got: %+v", result)
+	}
+}
+
+func TestSpoolingBackend_RemovesEntryOnSuccess(t *testing.T) {
+	spool, err := newUploadSpool(t.TempDir(), testSpoolLogger())
+	if err != nil {
+		t.Fatalf("Failed to create spool: %v", err)
+	}
+	defer spool.close()
+
+	inner := newRecordingBackend()
+	backend := &spoolingBackend{Backend: inner, spool: spool}
+
+	inner.failing = true
+	writeSpooledUpload(t, spool, []byte("v2key"), []byte("data"), false)
+	if err := backend.Put([]byte("v2key"), []byte("out"), bytes.NewReader([]byte("data")), 4); err == nil {
+		t.Fatalf("Expected PUT to fail")
+	}
+	if got := spool.pending(); got != 1 {
+		t.Fatalf("Expected failed upload to stay in the spool, got %d pending", got)
+	}
+
+	inner.failing = false
+	if err := backend.Put([]byte("v2key"), []byte("out"), bytes.NewReader([]byte("data")), 4); err != nil {
+		t.Fatalf("PUT failed: %v", err)
+	}
+	if got := spool.pending(); got != 0 {
+		t.Errorf("Expected successful upload to be removed from the spool, got %d pending", got)
+	}
+}
+
+// blockingCloseBackend is a backend whose Close blocks until released.
+type blockingCloseBackend struct {
+	backends.Noop
+	release chan struct{}
+}
+
+func (b *blockingCloseBackend) Close() error {
+	<-b.release
+	return nil
+}
+
+func TestCloseTimeout_StopsWaitingForPendingUploads(t *testing.T) {
+	backend := &blockingCloseBackend{release: make(chan struct{})}
+	defer close(backend.release)
+
+	cp, err := NewCacheProg(backend, locking.NewNoOpGroup(), t.TempDir(), false, false, false, false)
+	if err != nil {
+		t.Fatalf("Failed to create CacheProg: %v", err)
+	}
+	cp.closeTimeout = 10 * time.Millisecond
+
+	resp, err := cp.handleRequest(&Request{ID: 1, Command: CmdClose})
+	if err != nil || resp.Err != "" {
+		t.Fatalf("Expected close to succeed, got: %v %q", err, resp.Err)
+	}
+	if !cp.closeTimedOut.Load() {
+		t.Errorf("Expected close to time out")
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// traceSource is where a GET was served from.
+type traceSource string
+
+const (
+	traceSourceLocal  traceSource = "local"
+	traceSourceRemote traceSource = "remote"
+	traceSourceMiss   traceSource = "miss"
+)
+
+// traceEvent is one GET or PUT request, as written to a trace file.
+type traceEvent struct {
+	Time       time.Time   // When the request was received
+	Command    Cmd         // get or put
+	ActionID   string      // Hex encoded
+	Size       int64       `json:",omitempty"` // Body size of PUTs and of GET hits
+	DurationMs float64     // How long the request took to handle
+	Source     traceSource `json:",omitempty"` // Where a GET was served from
+	Namespace  string      `json:",omitempty"` // Read namespace of a remote hit
+	Err        string      `json:",omitempty"`
+}
+
+func newTraceEvent(req *Request, resp Response, start time.Time, duration time.Duration) traceEvent {
+	e := traceEvent{
+		Time:       start,
+		Command:    req.Command,
+		ActionID:   hex.EncodeToString(req.ActionID),
+		DurationMs: float64(duration) / float64(time.Millisecond),
+		Err:        resp.Err,
+	}
+	if req.Command == CmdPut {
+		e.Size = req.BodySize
+	} else {
+		e.Size = resp.Size
+		e.Source = resp.source
+		e.Namespace = resp.namespace
+	}
+	return e
+}
+
+// traceWriter appends trace events to a file, one JSON object per line. Every
+// event is a single write to a file opened for appending, so several processes
+// of the same build can share a trace file.
+type traceWriter struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func newTraceWriter(path string) (*traceWriter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open trace file: %w", err)
+	}
+	return &traceWriter{f: f}, nil
+}
+
+func (t *traceWriter) record(e traceEvent) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, err = t.f.Write(line)
+	return err
+}
+
+func (t *traceWriter) close() error {
+	return t.f.Close()
+}
+
+// readTrace reads the GET and PUT events of a trace, sorted by time. Blank lines
+// are skipped.
+func readTrace(r io.Reader) ([]traceEvent, error) {
+	var (
+		events  []traceEvent
+		scanner = bufio.NewScanner(r)
+		lineNum int
+	)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var e traceEvent
+		if err := json.Unmarshal(line, &e); err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+		if e.Command != CmdGet && e.Command != CmdPut {
+			continue
+		}
+		if _, err := hex.DecodeString(e.ActionID); err != nil || e.ActionID == "" {
+			return nil, fmt.Errorf("line %d: invalid action ID %q", lineNum, e.ActionID)
+		}
+		events = append(events, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sortTrace(events)
+	return events, nil
+}
+
+// sortTrace sorts events by time. Processes sharing a trace file may append
+// their events slightly out of order.
+func sortTrace(events []traceEvent) {
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+}
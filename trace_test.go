@@ -0,0 +1,179 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/gobuildcache/pkg/backends"
+	"github.com/richardartoul/gobuildcache/pkg/locking"
+)
+
+func TestTraceWriter_RecordsGetsAndPuts(t *testing.T) {
+	backend := newRecordingBackend()
+	cp, err := NewCacheProg(backend, locking.NewNoOpGroup(), t.TempDir(), false, false, false, false)
+	if err != nil {
+		t.Fatalf("Failed to create CacheProg: %v", err)
+	}
+	cp.setNamespaces("main/", nil)
+	tracePath := filepath.Join(t.TempDir(), "trace.jsonl")
+	trace, err := newTraceWriter(tracePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp.trace = trace
+
+	body := "hello"
+	requests := []*Request{
+		{ID: 1, Command: CmdPut, ActionID: []byte{1}, OutputID: []byte("output"), BodySize: int64(len(body)), Body: strings.NewReader(body)},
+		{ID: 2, Command: CmdGet, ActionID: []byte{1}},
+		{ID: 3, Command: CmdGet, ActionID: []byte{2}},
+	}
+	for _, req := range requests {
+		if _, err := cp.handleRequest(req); err != nil {
+			t.Fatalf("request %d failed: %v", req.ID, err)
+		}
+	}
+	// Evict the entry locally so that the next GET is served by the backend.
+	if err := cp.localCache.remove([]byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cp.handleRequest(&Request{ID: 4, Command: CmdGet, ActionID: []byte{1}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cp.handleRequest(&Request{ID: 5, Command: CmdClose}); err != nil {
+		t.Fatal(err)
+	}
+	trace.close()
+
+	f, err := os.Open(tracePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	events, err := readTrace(f)
+	if err != nil {
+		t.Fatalf("readTrace failed: %v", err)
+	}
+
+	want := []struct {
+		command   Cmd
+		actionID  string
+		size      int64
+		source    traceSource
+		namespace string
+	}{
+		{CmdPut, "01", 5, "", ""},
+		{CmdGet, "01", 5, traceSourceLocal, ""},
+		{CmdGet, "02", 0, traceSourceMiss, ""},
+		{CmdGet, "01", 5, traceSourceRemote, "main/"},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("got %d events, want %d (close isn't traced): %+v", len(events), len(want), events)
+	}
+	for i, w := range want {
+		e := events[i]
+		if e.Command != w.command || e.ActionID != w.actionID || e.Size != w.size || e.Source != w.source || e.Namespace != w.namespace {
+			t.Errorf("event %d = %+v, want %+v", i, e, w)
+		}
+		if e.Time.IsZero() || e.DurationMs <= 0 {
+			t.Errorf("event %d has no timing: %+v", i, e)
+		}
+	}
+}
+
+func TestReadTrace_SortsAndValidates(t *testing.T) {
+	trace := `{"Time":"2026-01-01T00:00:02Z","Command":"get","ActionID":"02","Source":"miss"}
+
+{"Time":"2026-01-01T00:00:01Z","Command":"put","ActionID":"01","Size":3}
+`
+	events, err := readTrace(strings.NewReader(trace))
+	if err != nil {
+		t.Fatalf("readTrace failed: %v", err)
+	}
+	if len(events) != 2 || events[0].ActionID != "01" || events[1].ActionID != "02" {
+		t.Errorf("events not sorted by time: %+v", events)
+	}
+
+	if _, err := readTrace(strings.NewReader(`{"Command":"get","ActionID":"xyz"}`)); err == nil {
+		t.Error("expected an error for an invalid action ID")
+	}
+	if _, err := readTrace(strings.NewReader("not json\n")); err == nil {
+		t.Error("expected an error for an invalid line")
+	}
+}
+
+func TestReplaySeeds(t *testing.T) {
+	events := []traceEvent{
+		{Command: CmdGet, ActionID: "01", Source: traceSourceRemote, Size: 10},
+		{Command: CmdGet, ActionID: "02", Source: traceSourceLocal, Size: 20},
+		{Command: CmdPut, ActionID: "03", Size: 30},
+		{Command: CmdGet, ActionID: "03", Source: traceSourceLocal, Size: 30},
+		{Command: CmdGet, ActionID: "04", Source: traceSourceMiss},
+		{Command: CmdPut, ActionID: "04", Size: 40},
+		{Command: CmdGet, ActionID: "04", Source: traceSourceRemote, Size: 40},
+	}
+	local, remote := replaySeeds(events)
+	if len(local) != 1 || local["02"] != 20 {
+		t.Errorf("local seeds = %v, want only 02", local)
+	}
+	if len(remote) != 1 || remote["01"] != 10 {
+		t.Errorf("remote seeds = %v, want only 01", remote)
+	}
+}
+
+func TestRunReplay(t *testing.T) {
+	start := time.Now()
+	at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+	events := []traceEvent{
+		{Time: at(0), Command: CmdGet, ActionID: "01", Source: traceSourceRemote, Size: 1024, DurationMs: 20},
+		{Time: at(10), Command: CmdGet, ActionID: "02", Source: traceSourceLocal, Size: 2048, DurationMs: 1},
+		{Time: at(20), Command: CmdGet, ActionID: "03", Source: traceSourceMiss, DurationMs: 15},
+		{Time: at(100), Command: CmdPut, ActionID: "03", Size: 4096, DurationMs: 5},
+		{Time: at(200), Command: CmdGet, ActionID: "03", Source: traceSourceLocal, Size: 4096, DurationMs: 1},
+	}
+
+	for _, seed := range []bool{true, false} {
+		backend := deletingBackend{newRecordingBackend()}
+		report, err := runReplay(events, func() (backends.Backend, error) { return backend, nil }, locking.NewMemLock(), replayOptions{
+			Speed:        2,
+			Concurrency:  4,
+			Seed:         seed,
+			Compressible: 0.5,
+			Compression:  true,
+			WorkDir:      t.TempDir(),
+			Namespace:    "replay/",
+		}, io.Discard)
+		if err != nil {
+			t.Fatalf("runReplay failed: %v", err)
+		}
+
+		if report.Get.Count != 4 || report.Put.Count != 1 || report.Get.Errors != 0 || report.Put.Errors != 0 {
+			t.Errorf("seed=%v: got %+v GETs and %+v PUTs", seed, report.Get, report.Put)
+		}
+		if report.TraceHitRate != 0.75 {
+			t.Errorf("seed=%v: trace hit rate = %v, want 0.75", seed, report.TraceHitRate)
+		}
+		// Without seeding only the GET after the PUT hits.
+		wantHitRate, wantSeeded := 0.25, 0
+		if seed {
+			wantHitRate, wantSeeded = 0.75, 2
+			if report.LocalHits != 2 || report.RemoteHits != 1 {
+				t.Errorf("got %d local and %d remote hits, want 2 and 1", report.LocalHits, report.RemoteHits)
+			}
+		}
+		if report.HitRate != wantHitRate || report.Seeded != wantSeeded {
+			t.Errorf("seed=%v: hit rate = %v with %d seeded, want %v with %d", seed, report.HitRate, report.Seeded, wantHitRate, wantSeeded)
+		}
+		// The trace spans 200ms, replayed at twice the speed.
+		if report.Elapsed < 100*time.Millisecond {
+			t.Errorf("seed=%v: replay took %s, want at least 100ms", seed, report.Elapsed)
+		}
+		if len(backend.puts) != 0 {
+			t.Errorf("seed=%v: %d replayed objects were left in the backend", seed, len(backend.puts))
+		}
+	}
+}